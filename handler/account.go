@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultSessionTTL is the lifetime of sessions if Handler.SessionTTL is zero
+const DefaultSessionTTL = 24 * time.Hour
+
+const (
+	// sessionCookie is the name of the cookie holding the session token
+	sessionCookie = "session"
+
+	// userKey is the key of the signed-in *model.User in gin.Context
+	userKey = "user"
+)
+
+// requireAccounts responds 404 unless accounts of end users are enabled
+func (h *Handler) requireAccounts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.CredentialController == nil || h.SessionController == nil {
+			abortWithError(c, &statusError{status: http.StatusNotFound, detail: "route is not found"})
+		}
+	}
+}
+
+// startSession starts a session of the user and sets the cookie.
+// The session in the current cookie is ended, so that tokens are not reused across logins.
+func (h *Handler) startSession(c *gin.Context, userID int) error {
+	ctx := c.Request.Context()
+
+	if secret, err := c.Cookie(sessionCookie); err == nil {
+		if err := h.SessionController.DeleteSession(ctx, secret); err != nil {
+			return err
+		}
+	}
+
+	ttl := h.SessionTTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	sess, secret, err := h.SessionController.NewSession(ctx, userID, ttl)
+
+	if err != nil {
+		return err
+	}
+
+	h.setSessionCookie(c, secret, sess.ExpiresAt)
+
+	return nil
+}
+
+// setSessionCookie sets the secret to the HttpOnly and SameSite cookie, which is deleted if secret is empty
+func (h *Handler) setSessionCookie(c *gin.Context, secret string, expiresAt time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   h.SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if len(secret) == 0 {
+		cookie.Expires = time.Unix(0, 0)
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(c.Writer, cookie)
+}
+
+// signUp handles POST /auth/signup
+func (h *Handler) signUp(c *gin.Context) {
+	var param struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	u, err := h.CredentialController.SignUp(c.Request.Context(), param.Name, param.Email, param.Password)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	if err := h.startSession(c, u.ID); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	// the user is created anyway, and can request another email
+	if h.mailEnabled() {
+		if err := h.sendEmailVerification(c.Request.Context(), u); err != nil {
+			c.Error(err)
+		}
+	}
+
+	c.JSON(http.StatusCreated, u)
+}
+
+// login handles POST /auth/login
+func (h *Handler) login(c *gin.Context) {
+	var param struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	u, err := h.CredentialController.Login(c.Request.Context(), param.Email, param.Password)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	if h.challengeMFA(c, u.ID) {
+		return
+	}
+
+	if err := h.startSession(c, u.ID); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, u)
+}
+
+// logout handles POST /auth/logout. It succeeds even without a session.
+func (h *Handler) logout(c *gin.Context) {
+	if secret, err := c.Cookie(sessionCookie); err == nil {
+		if err := h.SessionController.DeleteSession(c.Request.Context(), secret); err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+	}
+
+	h.setSessionCookie(c, "", time.Time{})
+	c.Status(http.StatusNoContent)
+}
+
+// authenticateSession rejects requests without a valid session cookie,
+// and puts the user id of the session into the request context
+func (h *Handler) authenticateSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret, err := c.Cookie(sessionCookie)
+
+		if err != nil {
+			abortWithError(c, &statusError{status: http.StatusUnauthorized, detail: "login is required"})
+
+			return
+		}
+
+		sess, err := h.SessionController.AuthenticateSession(c.Request.Context(), secret)
+
+		if err != nil {
+			if err == model.ErrInvalidSession {
+				h.setSessionCookie(c, "", time.Time{})
+			}
+			abortWithError(c, err)
+
+			return
+		}
+
+		setUserID(c, sess.UserID)
+	}
+}
+
+// authenticateUser authenticates requests with an access token if Authorization is given, or with the session cookie.
+// The signed-in user is set to the context.
+func (h *Handler) authenticateUser() gin.HandlerFunc {
+	bySession, byToken := h.authenticateSession(), h.authenticateToken()
+
+	return func(c *gin.Context) {
+		_, bearer := bearerCredential(c)
+		bearer = bearer && h.TokenKeys != nil
+
+		if bearer {
+			byToken(c)
+		} else {
+			bySession(c)
+		}
+
+		if c.IsAborted() {
+			return
+		}
+
+		id, _ := UserIDFromContext(c.Request.Context())
+		u, err := h.UserController.GetUser(c.Request.Context(), id)
+
+		// credentials of deleted users are left until they expire
+		if err == model.ErrNoUser {
+			if bearer {
+				unauthorized(c, token.ErrInvalidToken)
+
+				return
+			}
+
+			h.setSessionCookie(c, "", time.Time{})
+			err = model.ErrInvalidSession
+		}
+
+		if err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		c.Set(userKey, u)
+	}
+}
+
+// me handles GET /me
+func (h *Handler) me(c *gin.Context) {
+	c.Header("Cache-Control", "private, no-store")
+	c.JSON(http.StatusOK, c.MustGet(userKey))
+}
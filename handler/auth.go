@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// apiKeyKey is the key of the authenticated *model.APIKey in gin.Context
+	apiKeyKey = "api_key"
+
+	// scopesKey is the key of the scopes granted to the credential in gin.Context
+	scopesKey = "scopes"
+)
+
+// scopeError is an error of a credential without the scope required
+type scopeError struct {
+	scope string
+}
+
+func (e *scopeError) Error() string {
+	return "scope " + e.scope + " is required"
+}
+
+// bearerCredential returns the credential of Authorization: Bearer or X-API-Key
+func bearerCredential(c *gin.Context) (string, bool) {
+	if auth := c.GetHeader("Authorization"); len(auth) != 0 {
+		// the scheme is case-insensitive as RFC 7235
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			return strings.TrimSpace(auth[7:]), true
+		}
+
+		return "", false
+	}
+
+	if key := c.GetHeader("X-API-Key"); len(key) != 0 {
+		return key, true
+	}
+
+	return "", false
+}
+
+// authenticate rejects requests without a valid API key or personal token.
+// Requests are not authenticated if APIKeyController is nil, but personal tokens presented are still checked,
+// so that their scopes and owners are enforced.
+func (h *Handler) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret, ok := bearerCredential(c)
+
+		if ok && h.PersonalTokenController != nil && strings.HasPrefix(secret, model.PersonalTokenPrefix) {
+			h.authenticatePersonalToken(c, secret)
+
+			return
+		}
+
+		if h.APIKeyController == nil {
+			return
+		}
+
+		if !ok {
+			unauthorized(c, &statusError{status: http.StatusUnauthorized, detail: "api key is required"})
+
+			return
+		}
+
+		key, err := h.APIKeyController.AuthenticateAPIKey(c.Request.Context(), secret)
+
+		if err != nil {
+			unauthorized(c, err)
+
+			return
+		}
+
+		c.Set(apiKeyKey, key)
+		c.Set(scopesKey, key.Scopes)
+	}
+}
+
+// requireScope rejects requests whose credential is not granted scope.
+// Requests pass if they are not authenticated, i.e. APIKeyController is nil and no personal token is presented.
+func (h *Handler) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.scoped(c) {
+			return
+		}
+
+		if err := checkScope(c, scope); err != nil {
+			forbidden(c, err)
+		}
+	}
+}
+
+// scoped tells whether scopes are enforced on the request,
+// which is unless requests are not authenticated and it has no personal token
+func (h *Handler) scoped(c *gin.Context) bool {
+	_, personal := c.Get(personalTokenKey)
+
+	return h.APIKeyController != nil || personal
+}
+
+// checkScope returns an error if the credential of the request is not granted scope
+func checkScope(c *gin.Context, scope string) *scopeError {
+	scopes, _ := c.Get(scopesKey)
+	granted, _ := scopes.([]string)
+
+	if !model.HasScope(granted, scope) {
+		return &scopeError{scope: scope}
+	}
+
+	return nil
+}
+
+// forbidden responds err with the challenge of RFC 6750 naming the missing scope
+func forbidden(c *gin.Context, err *scopeError) {
+	c.Header("WWW-Authenticate", `Bearer realm="users", error="insufficient_scope", scope="`+err.scope+`"`)
+
+	abortWithError(c, err)
+}
+
+// unauthorized responds err with the challenge of RFC 6750
+func unauthorized(c *gin.Context, err error) {
+	if err == model.ErrInvalidAPIKey || err == model.ErrInvalidPersonalToken || err == token.ErrInvalidToken {
+		c.Header("WWW-Authenticate", `Bearer realm="users", error="invalid_token"`)
+	} else {
+		c.Header("WWW-Authenticate", `Bearer realm="users"`)
+	}
+
+	abortWithError(c, err)
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/gin-gonic/gin"
+)
+
+// Modes of batch requests
+const (
+	// batchAtomic rolls back every operation if any of them fails
+	batchAtomic = "atomic"
+
+	// batchPartial keeps operations which succeeded
+	batchPartial = "partial"
+)
+
+// errRollback aborts the transaction of an atomic batch
+var errRollback = errors.New("batch is rolled back")
+
+// batchOperation is an item of POST /users:batch
+type batchOperation struct {
+	// Method is "create", "update" or "delete"
+	Method string `json:"method"`
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+}
+
+// batchResult is the result of an operation in the order of the request
+type batchResult struct {
+	Index   int         `json:"index"`
+	Status  int         `json:"status"`
+	User    *model.User `json:"user,omitempty"`
+	Problem *Problem    `json:"problem,omitempty"`
+}
+
+// batchUsers handles POST /users:batch.
+// Operations are executed in statements per method in the order of create, update and delete.
+func (h *Handler) batchUsers(c *gin.Context) {
+	var param struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	if len(param.Mode) == 0 {
+		param.Mode = batchAtomic
+	}
+
+	if param.Mode != batchAtomic && param.Mode != batchPartial {
+		abortWithError(c, badRequest("mode must be "+batchAtomic+" or "+batchPartial))
+
+		return
+	}
+
+	if len(param.Operations) > model.MaxBatchSize {
+		abortWithError(c, badRequest("at most "+strconv.Itoa(model.MaxBatchSize)+" operations are allowed"))
+
+		return
+	}
+
+	for i, op := range param.Operations {
+		if op.Method != "create" && op.Method != "update" && op.Method != "delete" {
+			abortWithError(c, badRequest("operation "+strconv.Itoa(i)+": unknown method "+strconv.Quote(op.Method)))
+
+			return
+		}
+	}
+
+	if h.scoped(c) {
+		for _, op := range param.Operations {
+			if op.Method != "delete" {
+				continue
+			}
+
+			if err := checkScope(c, model.ScopeDelete); err != nil {
+				forbidden(c, err)
+
+				return
+			}
+
+			break
+		}
+	}
+
+	var (
+		results []batchResult
+		failed  bool
+	)
+	run := func(uc model.UserController) error {
+		var err error
+		results, failed, err = h.runBatch(c, uc, param.Operations)
+
+		if err == nil && failed && param.Mode == batchAtomic {
+			return errRollback
+		}
+
+		return err
+	}
+
+	var err error
+	if param.Mode == batchAtomic {
+		err = h.UserController.WithTx(c.Request.Context(), run)
+	} else {
+		err = run(h.UserController)
+	}
+
+	if err != nil && err != errRollback {
+		abortWithError(c, err)
+
+		return
+	}
+
+	status := http.StatusOK
+	if err == errRollback {
+		status = rollBack(c, results)
+	}
+
+	c.JSON(status, gin.H{"results": results})
+}
+
+// runBatch executes operations and reports whether any of them failed
+func (h *Handler) runBatch(c *gin.Context, uc model.UserController, ops []batchOperation) ([]batchResult, bool, error) {
+	ctx := c.Request.Context()
+	results := make([]batchResult, len(ops))
+
+	var (
+		creates, updates []*model.User
+		deletes          []int
+
+		createIndexes, updateIndexes, deleteIndexes []int
+	)
+	for i, op := range ops {
+		switch op.Method {
+		case "create":
+			creates = append(creates, &model.User{Name: op.Name, Email: op.Email})
+			createIndexes = append(createIndexes, i)
+		case "update":
+			updates = append(updates, &model.User{ID: op.ID, Name: op.Name, Email: op.Email})
+			updateIndexes = append(updateIndexes, i)
+		case "delete":
+			deletes = append(deletes, op.ID)
+			deleteIndexes = append(deleteIndexes, i)
+		}
+	}
+
+	failed := false
+	collect := func(indexes []int, batch []model.BatchResult, status int) {
+		for j, r := range batch {
+			i := indexes[j]
+			results[i] = batchResult{Index: i, Status: status, User: r.User}
+
+			if r.Err != nil {
+				p := newProblem(c, r.Err)
+				results[i] = batchResult{Index: i, Status: p.Status, Problem: p}
+				failed = true
+			}
+		}
+	}
+
+	if len(creates) != 0 {
+		batch, err := uc.NewUsers(ctx, creates)
+
+		if err != nil {
+			return nil, false, err
+		}
+		collect(createIndexes, batch, http.StatusCreated)
+	}
+
+	if len(updates) != 0 {
+		batch, err := uc.UpdateUsers(ctx, updates)
+
+		if err != nil {
+			return nil, false, err
+		}
+		collect(updateIndexes, batch, http.StatusOK)
+	}
+
+	if len(deletes) != 0 {
+		batch, err := uc.DeleteUsers(ctx, deletes)
+
+		if err != nil {
+			return nil, false, err
+		}
+		collect(deleteIndexes, batch, http.StatusNoContent)
+	}
+
+	return results, failed, nil
+}
+
+// rollBack marks operations which succeeded as rolled back,
+// and returns the status of the first failure as the status of the batch
+func rollBack(c *gin.Context, results []batchResult) int {
+	status := 0
+	for i, r := range results {
+		if r.Problem != nil {
+			if status == 0 {
+				status = r.Status
+			}
+
+			continue
+		}
+
+		p := newProblem(c, &statusError{status: http.StatusFailedDependency, detail: "rolled back since other operations failed"})
+		results[i] = batchResult{Index: r.Index, Status: p.Status, Problem: p}
+	}
+
+	return status
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CachePolicy is the caching headers of a route
+type CachePolicy struct {
+	// MaxAge lets caches reuse responses without revalidation for the duration.
+	// Zero requires revalidation with conditional requests every time.
+	MaxAge time.Duration
+
+	// Public allows shared caches to store responses
+	Public bool
+
+	// NoStore forbids caches to store responses at all
+	NoStore bool
+
+	// Vary lists request headers which responses depend on
+	Vary []string
+}
+
+// DefaultCachePolicy is used for routes without policies in Handler.CachePolicies.
+// Responses vary by credentials, since scopes and owners of tokens limit what is returned.
+var DefaultCachePolicy = CachePolicy{
+	Vary: []string{"Accept", "Authorization", "X-API-Key"},
+}
+
+// cacheControl returns the value of Cache-Control
+func (p *CachePolicy) cacheControl() string {
+	if p.NoStore {
+		return "no-store"
+	}
+
+	directives := []string{"private"}
+	if p.Public {
+		directives[0] = "public"
+	}
+
+	if p.MaxAge > 0 {
+		directives = append(directives, "max-age="+strconv.FormatInt(int64(p.MaxAge/time.Second), 10))
+	} else {
+		directives = append(directives, "no-cache")
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// cachePolicy sets caching headers of the route
+func (h *Handler) cachePolicy(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := DefaultCachePolicy
+		if p, ok := h.CachePolicies[route]; ok {
+			policy = p
+		}
+
+		c.Header("Cache-Control", policy.cacheControl())
+
+		if len(policy.Vary) != 0 {
+			c.Header("Vary", strings.Join(policy.Vary, ", "))
+		}
+	}
+}
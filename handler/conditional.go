@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/gin-gonic/gin"
+)
+
+// userETag returns a strong entity tag of u, which changes whenever u is updated
+func userETag(u *model.User) string {
+	return `"` + strconv.Itoa(u.ID) + "-" + strconv.FormatInt(u.UpdatedAt.UnixNano(), 36) + `"`
+}
+
+// usersETag returns a weak entity tag of a page of users.
+// The max updated_at and the number of rows change on most updates,
+// and the hash covers rows replaced with older ones such as on deletions.
+func usersETag(page *model.UserPage) string {
+	h := fnv.New64a()
+	b := make([]byte, 8)
+
+	for _, u := range page.Users {
+		binary.BigEndian.PutUint64(b, uint64(u.ID))
+		h.Write(b)
+		binary.BigEndian.PutUint64(b, uint64(u.UpdatedAt.UnixNano()))
+		h.Write(b)
+	}
+	h.Write([]byte(page.NextCursor))
+
+	var modified int64
+	if t := lastModified(page.Users); !t.IsZero() {
+		modified = t.UnixNano()
+	}
+
+	return `W/"` + strconv.Itoa(len(page.Users)) + "-" + strconv.FormatInt(modified, 36) +
+		"-" + strconv.FormatUint(h.Sum64(), 36) + `"`
+}
+
+// lastModified returns the max updated_at of users
+func lastModified(users []*model.User) time.Time {
+	var t time.Time
+	for _, u := range users {
+		if u.UpdatedAt.After(t) {
+			t = u.UpdatedAt
+		}
+	}
+
+	return t
+}
+
+// matchETag reports whether the If-Match header matches etag by the strong comparison
+func matchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchWeakETag reports whether the If-None-Match header matches etag by the weak comparison
+func matchWeakETag(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setValidators sets ETag and Last-Modified. The zero time omits Last-Modified.
+func setValidators(c *gin.Context, etag string, modified time.Time) {
+	c.Header("ETag", etag)
+
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified responds 304 if the client has the current representation.
+// If-Modified-Since is evaluated only without If-None-Match as RFC 7232, and never with the zero time.
+func notModified(c *gin.Context, etag string, modified time.Time) bool {
+	if header := c.GetHeader("If-None-Match"); len(header) != 0 {
+		if !matchWeakETag(header, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+
+		// Last-Modified is in seconds
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+
+	setValidators(c, etag, modified)
+	c.Status(http.StatusNotModified)
+
+	return true
+}
+
+// respondUser responds u with its validators
+func respondUser(c *gin.Context, status int, u *model.User) {
+	setValidators(c, userETag(u), u.UpdatedAt)
+	c.JSON(status, u)
+}
+
+// checkPreconditionRequired rejects writes without If-Match in the strict mode
+func (h *Handler) checkPreconditionRequired(c *gin.Context) error {
+	if h.RequireIfMatch && len(c.GetHeader("If-Match")) == 0 {
+		return &statusError{status: http.StatusPreconditionRequired, detail: "If-Match is required"}
+	}
+
+	return nil
+}
+
+// checkIfMatch returns the updated_at to compare on writes, which is zero without If-Match.
+// It returns model.ErrPreconditionFailed if If-Match does not match current.
+func checkIfMatch(c *gin.Context, current *model.User) (time.Time, error) {
+	header := c.GetHeader("If-Match")
+
+	if len(header) == 0 {
+		return time.Time{}, nil
+	}
+
+	if !matchETag(header, userETag(current)) {
+		return time.Time{}, model.ErrPreconditionFailed
+	}
+
+	return current.UpdatedAt, nil
+}
+
+// ifMatch calls fn with the updated_at to compare on writes.
+// With If-Match, the current user is checked in the same transaction as fn.
+func (h *Handler) ifMatch(c *gin.Context, id int, fn func(uc model.UserController, updatedAt time.Time) error) error {
+	if err := h.checkPreconditionRequired(c); err != nil {
+		return err
+	}
+
+	if len(c.GetHeader("If-Match")) == 0 {
+		return fn(h.UserController, time.Time{})
+	}
+
+	ctx := c.Request.Context()
+
+	return h.UserController.WithTx(ctx, func(uc model.UserController) error {
+		current, err := uc.GetUser(ctx, id)
+
+		if err != nil {
+			// If-Match never matches missing resources as RFC 7232
+			if err == model.ErrNoUser {
+				return model.ErrPreconditionFailed
+			}
+
+			return err
+		}
+
+		updatedAt, err := checkIfMatch(c, current)
+
+		if err != nil {
+			return err
+		}
+
+		return fn(uc, updatedAt)
+	})
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// customMethodPrefix is the prefix of internal routes of custom methods
+	customMethodPrefix = "/_custom"
+
+	// staticRoutePrefix is the prefix of internal routes of staticRoutes
+	staticRoutePrefix = "/_static"
+)
+
+// staticRoutes are paths the router of gin can not route next to "/users/:id"
+var staticRoutes = map[string]bool{
+	"/users/export": true,
+	"/users/import": true,
+}
+
+// originalURIKey is the context key of the request URI before rewriting
+type originalURIKey struct{}
+
+// customMethodPath converts a custom method such as "/users:batch" to its internal route.
+// The router of gin can not route it next to "/users/:id" since ':' starts a parameter.
+func customMethodPath(path string) string {
+	slash := strings.LastIndexByte(path, '/')
+
+	return customMethodPrefix + path[:slash+1] + strings.Replace(path[slash+1:], ":", "/", 1)
+}
+
+// staticRoutePath converts a path in staticRoutes to its internal route
+func staticRoutePath(path string) string {
+	return staticRoutePrefix + path
+}
+
+// rewriteInternalRoutes routes custom methods and staticRoutes to their internal routes
+func rewriteInternalRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+
+		var internal string
+		switch {
+		case staticRoutes[path]:
+			internal = staticRoutePath(path)
+		case strings.ContainsRune(path[strings.LastIndexByte(path, '/')+1:], ':'):
+			internal = customMethodPath(path)
+		}
+
+		if len(internal) != 0 {
+			r = r.WithContext(context.WithValue(r.Context(), originalURIKey{}, r.URL.RequestURI()))
+
+			u := *r.URL
+			u.Path, u.RawPath = internal, ""
+			r.URL = &u
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// internalRoute hides internal routes from clients
+func internalRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Context().Value(originalURIKey{}) == nil {
+			abortWithError(c, &statusError{status: http.StatusNotFound, detail: "route is not found"})
+		}
+	}
+}
+
+// requestURI returns the URI requested by the client
+func requestURI(c *gin.Context) string {
+	if uri, ok := c.Request.Context().Value(originalURIKey{}).(string); ok {
+		return uri
+	}
+
+	return c.Request.URL.RequestURI()
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/mailer"
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// passwordResetTTL is the lifetime of tokens resetting passwords
+	passwordResetTTL = time.Hour
+
+	// emailVerificationTTL is the lifetime of tokens verifying emails
+	emailVerificationTTL = 24 * time.Hour
+
+	// backgroundMailTimeout is the deadline of emails sent after the response
+	backgroundMailTimeout = time.Minute
+)
+
+// mailEnabled reports whether tokens can be sent by email
+func (h *Handler) mailEnabled() bool {
+	return h.Mailer != nil && h.OneTimeTokenController != nil
+}
+
+// requireMail responds 404 unless tokens can be sent by email
+func (h *Handler) requireMail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.mailEnabled() {
+			abortWithError(c, &statusError{status: http.StatusNotFound, detail: "route is not found"})
+		}
+	}
+}
+
+// link returns the URL of the frontend page receiving the token
+func (h *Handler) link(path, token string) string {
+	return strings.TrimRight(h.LinkBaseURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendEmailVerification sends a token verifying the current email of the user
+func (h *Handler) sendEmailVerification(ctx context.Context, u *model.User) error {
+	token, err := h.OneTimeTokenController.NewOneTimeToken(ctx, u.ID, model.PurposeEmailVerification, emailVerificationTTL)
+
+	if err != nil {
+		return err
+	}
+
+	return h.Mailer.Send(ctx, &mailer.Message{
+		To:      u.Email,
+		Subject: "Verify your email",
+		Body: "Hello " + u.Name + ",\n\n" +
+			"Open the link below within 24 hours to verify your email.\n" +
+			h.link("/verify-email", token) + "\n",
+	})
+}
+
+// forgotPassword handles POST /auth/password/forgot, which sends a token resetting the password.
+// It responds 202 right after the lookup whether the user exists or not, and the token is sent in the background,
+// so that emails of users can not be probed by the timing or failures of sending.
+func (h *Handler) forgotPassword(c *gin.Context) {
+	var param struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	u, err := h.UserController.GetUserByEmail(c.Request.Context(), param.Email)
+
+	if err == model.ErrNoUser {
+		c.Status(http.StatusAccepted)
+
+		return
+	}
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), backgroundMailTimeout)
+		defer cancel()
+
+		if err := h.sendPasswordReset(ctx, u); err != nil {
+			log.Printf("failed to send a password reset to user %d: %v", u.ID, err)
+		}
+	}()
+
+	c.Status(http.StatusAccepted)
+}
+
+// sendPasswordReset sends a token resetting the password of the user
+func (h *Handler) sendPasswordReset(ctx context.Context, u *model.User) error {
+	token, err := h.OneTimeTokenController.NewOneTimeToken(ctx, u.ID, model.PurposePasswordReset, passwordResetTTL)
+
+	if err != nil {
+		return err
+	}
+
+	return h.Mailer.Send(ctx, &mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: "Hello " + u.Name + ",\n\n" +
+			"Open the link below within an hour to set a new password.\n" +
+			h.link("/reset-password", token) + "\n\n" +
+			"If you did not request it, you can ignore this email.\n",
+	})
+}
+
+// resetPassword handles POST /auth/password/reset, which sets the password with a token sent by forgotPassword.
+// Sessions, refresh tokens and personal tokens of the user are revoked with it.
+func (h *Handler) resetPassword(c *gin.Context) {
+	var param struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	// the user is signed out everywhere, and the token is not consumed if it fails
+	if _, err := h.CredentialController.ResetPassword(c.Request.Context(), param.Token, param.Password); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// verifyEmail handles POST /auth/email/verify, which verifies the email with a token sent to it
+func (h *Handler) verifyEmail(c *gin.Context) {
+	var param struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	ctx := c.Request.Context()
+	id, err := h.OneTimeTokenController.ConsumeOneTimeToken(ctx, param.Token, model.PurposeEmailVerification)
+
+	var u *model.User
+	if err == nil {
+		u, err = h.UserController.VerifyEmail(ctx, id)
+	}
+
+	if err == model.ErrNoUser {
+		err = model.ErrInvalidOneTimeToken
+	}
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, u)
+}
+
+// requestEmailVerification handles POST /me/email/verification, which sends a token verifying the email again
+func (h *Handler) requestEmailVerification(c *gin.Context) {
+	u := c.MustGet(userKey).(*model.User)
+
+	if u.EmailVerifiedAt != nil {
+		abortWithError(c, model.ErrEmailVerified)
+
+		return
+	}
+
+	if err := h.sendEmailVerification(c.Request.Context(), u); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
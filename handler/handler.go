@@ -1,65 +1,238 @@
 package handler
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
+	"github.com/cs3238-tsuzu/coding_challenge_03/mailer"
 	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
+	"github.com/cs3238-tsuzu/coding_challenge_03/userio"
 	"github.com/gin-gonic/gin"
 )
 
 // Handler is a struct for handler
 type Handler struct {
 	UserController model.UserController
-	handler        http.Handler
+
+	// QueryTimeout is the deadline of queries in a request. Zero means no deadline.
+	QueryTimeout time.Duration
+
+	// RouteQueryTimeouts overrides QueryTimeout for routes such as "GET /users/:id"
+	RouteQueryTimeouts map[string]time.Duration
+
+	// CachePolicies overrides DefaultCachePolicy for routes such as "GET /users"
+	CachePolicies map[string]CachePolicy
+
+	// RequireIfMatch rejects PUT, PATCH and DELETE of users without If-Match
+	RequireIfMatch bool
+
+	// APIKeyController authenticates requests to users. Requests are not authenticated if it is nil.
+	APIKeyController model.APIKeyController
+
+	// CredentialController and SessionController enable accounts of end users under /auth and /me.
+	// The routes respond 404 if either of them is nil.
+	CredentialController model.CredentialController
+	SessionController    model.SessionController
+
+	// SessionTTL is the lifetime of sessions. Zero means DefaultSessionTTL.
+	SessionTTL time.Duration
+
+	// SecureCookies sends session cookies only over HTTPS
+	SecureCookies bool
+
+	// TokenKeys and RefreshTokenController enable access tokens for clients without cookies.
+	// /auth/token, /auth/revoke and /.well-known/jwks.json respond 404 if either of them or CredentialController is nil.
+	TokenKeys              *token.KeySet
+	RefreshTokenController model.RefreshTokenController
+
+	// AccessTokenTTL and RefreshTokenTTL are the lifetimes of tokens. Zero means DefaultAccessTokenTTL and DefaultRefreshTokenTTL.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// MFAController enables TOTP under /me/mfa and the second step of login for users who confirmed it.
+	// Login takes a single step if it is nil.
+	MFAController model.MFAController
+
+	// TOTPIssuer is the issuer shown in authenticator apps. Empty means DefaultTOTPIssuer.
+	TOTPIssuer string
+
+	// Mailer and OneTimeTokenController enable password reset and email verification.
+	// The routes respond 404 if either of them or the controllers of accounts is nil.
+	Mailer                 mailer.Mailer
+	OneTimeTokenController model.OneTimeTokenController
+
+	// LinkBaseURL is the URL of the frontend linked from emails such as "https://example.com".
+	// Tokens are sent as links to LinkBaseURL + "/reset-password?token=..." and "/verify-email?token=...".
+	LinkBaseURL string
+
+	// PersonalTokenController enables personal tokens managed under /users/:id/tokens by the signed-in user.
+	// The tokens authenticate requests to /users/:id of the owner as API keys do.
+	// The routes respond 404 if it or the controllers of accounts is nil.
+	PersonalTokenController model.PersonalTokenController
+
+	handler http.Handler
 }
 
 // NewHandler initializes a handler for Hello world
 func NewHandler(db model.DB) *Handler {
 	router := gin.Default()
+	router.Use(requestID())
 
 	handler := &Handler{
-		handler: router,
+		handler: rewriteInternalRoutes(router),
 	}
 
+	router.NoRoute(func(c *gin.Context) {
+		abortWithError(c, &statusError{status: http.StatusNotFound, detail: "route is not found"})
+	})
+
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "Hello World!!",
 		})
 	})
 
-	router.GET("/users", func(c *gin.Context) {
-		l, err := handler.UserController.ListUsers()
+	// end users sign in with passwords and are identified by session cookies
+	accounts := router.Group("/", handler.requireAccounts())
+
+	accounts.POST("/auth/signup", handler.queryTimeout("POST /auth/signup"), handler.signUp)
+	accounts.POST("/auth/login", handler.queryTimeout("POST /auth/login"), handler.login)
+	accounts.POST("/auth/logout", handler.queryTimeout("POST /auth/logout"), handler.logout)
+	accounts.GET("/me", handler.queryTimeout("GET /me"), handler.authenticateUser(), handler.me)
+
+	// signed-in users enroll TOTP as the second factor of login
+	mfa := accounts.Group("/", handler.requireMFA())
+
+	mfa.POST("/auth/login/mfa", handler.queryTimeout("POST /auth/login/mfa"), handler.loginMFA)
+	mfa.POST("/me/mfa/totp", handler.queryTimeout("POST /me/mfa/totp"), handler.authenticateUser(), handler.enrollTOTP)
+	mfa.POST("/me/mfa/totp/confirm", handler.queryTimeout("POST /me/mfa/totp/confirm"), handler.authenticateUser(), handler.confirmTOTP)
+	mfa.POST("/me/mfa/disable", handler.queryTimeout("POST /me/mfa/disable"), handler.authenticateUser(), handler.disableMFA)
+
+	// tokens are sent by email to reset forgotten passwords and to verify emails
+	mail := accounts.Group("/", handler.requireMail())
+
+	mail.POST("/auth/password/forgot", handler.queryTimeout("POST /auth/password/forgot"), handler.forgotPassword)
+	mail.POST("/auth/password/reset", handler.queryTimeout("POST /auth/password/reset"), handler.resetPassword)
+	mail.POST("/auth/email/verify", handler.queryTimeout("POST /auth/email/verify"), handler.verifyEmail)
+	mail.POST("/me/email/verification", handler.queryTimeout("POST /me/email/verification"), handler.authenticateUser(), handler.requestEmailVerification)
+
+	// signed-in users issue personal tokens to script against their own users
+	personalTokens := accounts.Group("/", handler.requirePersonalTokens())
+
+	personalTokens.POST("/users/:id/tokens", handler.queryTimeout("POST /users/:id/tokens"), handler.authenticateUser(), requireSelf(), handler.createPersonalToken)
+	personalTokens.GET("/users/:id/tokens", handler.queryTimeout("GET /users/:id/tokens"), handler.authenticateUser(), requireSelf(), handler.listPersonalTokens)
+	personalTokens.GET("/users/:id/tokens/:token_id", handler.queryTimeout("GET /users/:id/tokens/:token_id"), handler.authenticateUser(), requireSelf(), handler.getPersonalToken)
+	personalTokens.PATCH("/users/:id/tokens/:token_id", handler.queryTimeout("PATCH /users/:id/tokens/:token_id"), handler.authenticateUser(), requireSelf(), handler.updatePersonalToken)
+	personalTokens.DELETE("/users/:id/tokens/:token_id", handler.queryTimeout("DELETE /users/:id/tokens/:token_id"), handler.authenticateUser(), requireSelf(), handler.revokePersonalToken)
+
+	// clients without cookies exchange passwords and refresh tokens for access tokens
+	tokens := router.Group("/", handler.requireTokens())
+
+	tokens.POST("/auth/token", handler.queryTimeout("POST /auth/token"), handler.issueTokens)
+	tokens.POST("/auth/revoke", handler.queryTimeout("POST /auth/revoke"), handler.revokeTokens)
+	tokens.GET("/.well-known/jwks.json", handler.queryTimeout("GET /.well-known/jwks.json"), handler.jwks)
+
+	// users require API keys or personal tokens granted the scope declared for each route
+	users := router.Group("/", handler.authenticate())
+
+	users.GET("/users", handler.requireScope(model.ScopeRead), exceptStreams(handler.queryTimeout("GET /users")), handler.cachePolicy("GET /users"), func(c *gin.Context) {
+		opts, err := parseListOptions(c)
 
 		if err != nil {
-			c.String(http.StatusInternalServerError, "internal server error")
+			abortWithError(c, err)
+
+			return
+		}
+
+		// deleted users are listed only for administrators
+		if opts.IncludeDeleted && handler.scoped(c) {
+			if err := checkScope(c, model.ScopeAdmin); err != nil {
+				forbidden(c, err)
+
+				return
+			}
+		}
+
+		// streams are neither paged nor validated by ETag
+		if c.NegotiateFormat(gin.MIMEJSON, ndjsonType) == ndjsonType {
+			c.Header("Content-Type", ndjsonType)
+
+			if err := userio.Export(c.Request.Context(), handler.UserController, c.Writer, userio.NDJSON, opts); err != nil {
+				abortStream(c, err)
+			}
 
 			return
 		}
 
-		c.JSON(http.StatusOK, l)
+		if s := c.Query("stream"); len(s) != 0 {
+			stream, err := strconv.ParseBool(s)
+
+			if err != nil {
+				abortWithError(c, invalidParam("stream", err))
+
+				return
+			}
+
+			if stream {
+				handler.streamUsers(c, opts)
+
+				return
+			}
+		}
+
+		page, err := handler.UserController.ListUsers(c.Request.Context(), opts)
+
+		if err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		if len(page.NextCursor) != 0 {
+			c.Header("X-Next-Cursor", page.NextCursor)
+			c.Header("Link", "<"+nextPageURL(c.Request.URL, page.NextCursor)+">; rel=\"next\"")
+		}
+
+		// collections are validated only by ETag, since deletions hide rows without raising the max updated_at
+		etag := usersETag(page)
+		if notModified(c, etag, time.Time{}) {
+			return
+		}
+
+		setValidators(c, etag, time.Time{})
+		c.JSON(http.StatusOK, page.Users)
 	})
 
-	router.GET("/users/:id", func(c *gin.Context) {
-		id, err := strconv.Atoi(c.Param("id"))
+	users.GET("/users/:id", handler.requireScope(model.ScopeRead), handler.queryTimeout("GET /users/:id"), handler.cachePolicy("GET /users/:id"), func(c *gin.Context) {
+		id, err := parseID(c)
 
 		if err != nil {
-			c.String(http.StatusBadRequest, "invalid id")
+			abortWithError(c, err)
 
 			return
 		}
-		res, err := handler.UserController.GetUser(id)
+		res, err := handler.UserController.GetUser(c.Request.Context(), id)
 
 		if err != nil {
-			c.String(http.StatusInternalServerError, "internal server error")
+			abortWithError(c, err)
 
 			return
 		}
 
-		c.JSON(http.StatusOK, res)
+		if notModified(c, userETag(res), res.UpdatedAt) {
+			return
+		}
+
+		respondUser(c, http.StatusOK, res)
 	})
 
-	router.POST("/users", func(c *gin.Context) {
+	users.POST("/users", handler.requireScope(model.ScopeWrite), handler.queryTimeout("POST /users"), func(c *gin.Context) {
 		type parameterType struct {
 			Name  string `json:"name"`
 			Email string `json:"email"`
@@ -67,73 +240,198 @@ func NewHandler(db model.DB) *Handler {
 
 		var param parameterType
 
-		if err := c.BindJSON(&param); err != nil {
-			c.String(http.StatusBadRequest, "bad request")
+		if err := c.ShouldBindJSON(&param); err != nil {
+			abortWithError(c, badRequest("malformed json: "+err.Error()))
 
 			return
 		}
 
-		u, err := handler.UserController.NewUser(param.Name, param.Email)
+		u, err := handler.UserController.NewUser(c.Request.Context(), param.Name, param.Email)
 
 		if err != nil {
-			c.String(http.StatusInternalServerError, "internal server error")
+			abortWithError(c, err)
 
 			return
 		}
 
-		c.JSON(http.StatusCreated, u)
+		respondUser(c, http.StatusCreated, u)
 	})
 
-	router.PUT("/users/:id", func(c *gin.Context) {
+	users.PUT("/users/:id", handler.requireScope(model.ScopeWrite), handler.queryTimeout("PUT /users/:id"), func(c *gin.Context) {
 		var user model.User
 
-		id, err := strconv.Atoi(c.Param("id"))
+		id, err := parseID(c)
 
 		if err != nil {
-			c.String(http.StatusBadRequest, "invalid id")
+			abortWithError(c, err)
 
 			return
 		}
 
-		if err := c.BindJSON(&user); err != nil {
-			c.String(http.StatusBadRequest, "bad request")
+		if err := c.ShouldBindJSON(&user); err != nil {
+			abortWithError(c, badRequest("malformed json: "+err.Error()))
 
 			return
 		}
 		user.ID = id
 
-		res, err := handler.UserController.UpdateUser(&user)
+		var res *model.User
+		err = handler.ifMatch(c, id, func(uc model.UserController, updatedAt time.Time) error {
+			// updated_at in the body is ignored not to fail unexpectedly
+			user.UpdatedAt = updatedAt
+
+			var err error
+			res, err = uc.UpdateUser(c.Request.Context(), &user)
+
+			return err
+		})
+
+		if err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		respondUser(c, http.StatusOK, res)
+	})
+
+	users.PATCH("/users/:id", handler.requireScope(model.ScopeWrite), handler.queryTimeout("PATCH /users/:id"), func(c *gin.Context) {
+		id, err := parseID(c)
+
+		if err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		// RFC 5789 advertises the acceptable patch formats
+		c.Header("Accept-Patch", mergePatchType+", "+jsonPatchType)
+
+		mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if mediaType != mergePatchType && mediaType != jsonPatchType {
+			abortWithError(c, &statusError{
+				status: http.StatusUnsupportedMediaType,
+				detail: "content type must be " + mergePatchType + " or " + jsonPatchType,
+			})
+
+			return
+		}
+
+		b, err := ioutil.ReadAll(c.Request.Body)
 
 		if err != nil {
-			if err == model.ErrNoUser {
-				c.JSON(http.StatusNotFound, gin.H{
-					"message": "not found",
-				})
+			abortWithError(c, badRequest("failed to read body: "+err.Error()))
+
+			return
+		}
+
+		var apply func(doc interface{}) (interface{}, error)
+
+		if mediaType == mergePatchType {
+			var patch map[string]interface{}
+			if err := json.Unmarshal(b, &patch); err != nil {
+				abortWithError(c, badRequest("merge patch must be a JSON object: "+err.Error()))
 
 				return
 			}
 
-			c.String(http.StatusInternalServerError, "internal server error")
+			apply = func(doc interface{}) (interface{}, error) {
+				return applyMergePatch(doc, patch), nil
+			}
+		} else {
+			ops, err := parseJSONPatch(b)
+
+			if err != nil {
+				abortWithError(c, err)
+
+				return
+			}
+
+			apply = func(doc interface{}) (interface{}, error) {
+				return applyJSONPatch(doc, ops)
+			}
+		}
+
+		if err := handler.checkPreconditionRequired(c); err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		// the patch is applied to the user read in the same transaction
+		ctx := c.Request.Context()
+		var res *model.User
+		err = handler.UserController.WithTx(ctx, func(uc model.UserController) error {
+			u, err := uc.GetUser(ctx, id)
+
+			if err != nil {
+				if err == model.ErrNoUser && len(c.GetHeader("If-Match")) != 0 {
+					return model.ErrPreconditionFailed
+				}
+
+				return err
+			}
+
+			updatedAt, err := checkIfMatch(c, u)
+
+			if err != nil {
+				return err
+			}
+
+			original, err := userDocument(u)
+
+			if err != nil {
+				return err
+			}
+
+			doc, err := userDocument(u)
+
+			if err != nil {
+				return err
+			}
+
+			patched, err := apply(doc)
+
+			if err != nil {
+				return err
+			}
+
+			patch, err := userPatch(original, patched)
+
+			if err != nil {
+				return err
+			}
+			patch.UpdatedAt = updatedAt
+
+			res, err = uc.PatchUser(ctx, id, patch)
+
+			return err
+		})
+
+		if err != nil {
+			abortWithError(c, err)
 
 			return
 		}
 
-		c.JSON(http.StatusOK, res)
+		respondUser(c, http.StatusOK, res)
 	})
 
-	router.DELETE("/users/:id", func(c *gin.Context) {
-		id, err := strconv.Atoi(c.Param("id"))
+	users.DELETE("/users/:id", handler.requireScope(model.ScopeDelete), handler.queryTimeout("DELETE /users/:id"), func(c *gin.Context) {
+		id, err := parseID(c)
 
 		if err != nil {
-			c.String(http.StatusBadRequest, "invalid id")
+			abortWithError(c, err)
 
 			return
 		}
 
-		err = handler.UserController.DeleteUser(id)
+		err = handler.ifMatch(c, id, func(uc model.UserController, _ time.Time) error {
+			return uc.DeleteUser(c.Request.Context(), id)
+		})
 
 		if err != nil {
-			c.String(http.StatusInternalServerError, "internal server error")
+			abortWithError(c, err)
 
 			return
 		}
@@ -141,6 +439,33 @@ func NewHandler(db model.DB) *Handler {
 		c.Status(http.StatusNoContent)
 	})
 
+	users.POST("/users/:id/restore", handler.requireScope(model.ScopeAdmin), handler.queryTimeout("POST /users/:id/restore"), func(c *gin.Context) {
+		id, err := parseID(c)
+
+		if err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		res, err := handler.UserController.RestoreUser(c.Request.Context(), id)
+
+		if err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		respondUser(c, http.StatusOK, res)
+	})
+
+	// batches including deletes additionally require users:delete
+	users.POST(customMethodPath("/users:batch"), internalRoute(), handler.requireScope(model.ScopeWrite), handler.queryTimeout("POST /users:batch"), handler.batchUsers)
+
+	// exports and imports take time in proportion to the number of users, so QueryTimeout is not applied
+	users.GET(staticRoutePath("/users/export"), internalRoute(), handler.requireScope(model.ScopeAdmin), handler.exportUsers)
+	users.POST(staticRoutePath("/users/import"), internalRoute(), handler.requireScope(model.ScopeAdmin), handler.importUsers)
+
 	return handler
 }
 
@@ -148,3 +473,72 @@ func NewHandler(db model.DB) *Handler {
 func (h *Handler) GetHandler() http.Handler {
 	return h.handler
 }
+
+// parseID parses :id in the path
+func parseID(c *gin.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+
+	if err != nil {
+		return 0, invalidParam("id", err)
+	}
+
+	return id, nil
+}
+
+// nextPageURL returns a reference to the next page keeping the other query parameters
+func nextPageURL(u *url.URL, cursor string) string {
+	q := u.Query()
+	q.Set("cursor", cursor)
+
+	next := url.URL{
+		Path:     u.Path,
+		RawQuery: q.Encode(),
+	}
+
+	return next.String()
+}
+
+// parseListOptions parses the query parameters of GET /users
+func parseListOptions(c *gin.Context) (model.ListOptions, error) {
+	var opts model.ListOptions
+
+	if l := c.Query("limit"); len(l) != 0 {
+		limit, err := strconv.Atoi(l)
+
+		if err != nil || limit <= 0 {
+			return opts, invalidParam("limit", err)
+		}
+
+		opts.Limit = limit
+	}
+	opts.Cursor = c.Query("cursor")
+
+	if f := c.Query("filter"); len(f) != 0 {
+		filter, err := model.ParseFilter(f)
+
+		if err != nil {
+			return opts, invalidParam("filter", err)
+		}
+
+		opts.Filter = filter
+	}
+
+	sort, err := model.ParseSort(c.Query("sort"))
+
+	if err != nil {
+		return opts, invalidParam("sort", err)
+	}
+	opts.Sort = sort
+
+	if d := c.Query("include_deleted"); len(d) != 0 {
+		includeDeleted, err := strconv.ParseBool(d)
+
+		if err != nil {
+			return opts, invalidParam("include_deleted", err)
+		}
+
+		opts.IncludeDeleted = includeDeleted
+	}
+
+	return opts, nil
+}
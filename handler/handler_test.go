@@ -2,48 +2,77 @@ package handler_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"image/png"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/cs3238-tsuzu/coding_challenge_03/handler"
+	"github.com/cs3238-tsuzu/coding_challenge_03/mailer"
 	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
 )
 
 type userController struct {
 	model.UserController
 
-	newUser    func(name, email string) (*model.User, error)
-	listUsers  func() ([]*model.User, error)
-	getUser    func(id int) (*model.User, error)
-	updateUser func(u *model.User) (*model.User, error)
-	deleteUser func(id int) error
+	newUser     func(ctx context.Context, name, email string) (*model.User, error)
+	listUsers   func(ctx context.Context, p model.ListOptions) (*model.UserPage, error)
+	eachUser    func(ctx context.Context, p model.ListOptions, fn func(u *model.User) error) error
+	getUser     func(ctx context.Context, id int) (*model.User, error)
+	updateUser  func(ctx context.Context, u *model.User) (*model.User, error)
+	patchUser   func(ctx context.Context, id int, p model.UserPatch) (*model.User, error)
+	deleteUser  func(ctx context.Context, id int) error
+	restoreUser func(ctx context.Context, id int) (*model.User, error)
 }
 
 var _ model.UserController = &userController{}
 
-func (uc *userController) NewUser(name string, email string) (*model.User, error) {
-	return uc.newUser(name, email)
+func (uc *userController) NewUser(ctx context.Context, name string, email string) (*model.User, error) {
+	return uc.newUser(ctx, name, email)
 }
 
-func (uc *userController) ListUsers() ([]*model.User, error) {
-	return uc.listUsers()
+func (uc *userController) ListUsers(ctx context.Context, p model.ListOptions) (*model.UserPage, error) {
+	return uc.listUsers(ctx, p)
 }
 
-func (uc *userController) GetUser(id int) (*model.User, error) {
-	return uc.getUser(id)
+func (uc *userController) EachUser(ctx context.Context, p model.ListOptions, fn func(u *model.User) error) error {
+	return uc.eachUser(ctx, p, fn)
 }
 
-func (uc *userController) UpdateUser(u *model.User) (*model.User, error) {
-	return uc.updateUser(u)
+func (uc *userController) GetUser(ctx context.Context, id int) (*model.User, error) {
+	return uc.getUser(ctx, id)
 }
 
-func (uc *userController) DeleteUser(id int) error {
-	return uc.deleteUser(id)
+func (uc *userController) UpdateUser(ctx context.Context, u *model.User) (*model.User, error) {
+	return uc.updateUser(ctx, u)
+}
+
+func (uc *userController) PatchUser(ctx context.Context, id int, p model.UserPatch) (*model.User, error) {
+	return uc.patchUser(ctx, id, p)
+}
+
+func (uc *userController) WithTx(ctx context.Context, fn func(uc model.UserController) error) error {
+	return fn(uc)
+}
+
+func (uc *userController) DeleteUser(ctx context.Context, id int) error {
+	return uc.deleteUser(ctx, id)
+}
+
+func (uc *userController) RestoreUser(ctx context.Context, id int) (*model.User, error) {
+	return uc.restoreUser(ctx, id)
 }
 
 type nopDB struct {
@@ -53,11 +82,18 @@ type nopDB struct {
 func initAll(t *testing.T) (*httptest.Server, *userController, *http.Client) {
 	t.Helper()
 
+	return initAllWithHandler(t, func(h *handler.Handler) {})
+}
+
+func initAllWithHandler(t *testing.T, configure func(h *handler.Handler)) (*httptest.Server, *userController, *http.Client) {
+	t.Helper()
+
 	handler := handler.NewHandler(&nopDB{})
 
 	uc := &userController{}
 
 	handler.UserController = uc
+	configure(handler)
 
 	server := httptest.NewServer(handler.GetHandler())
 
@@ -141,6 +177,34 @@ func compare(t *testing.T, b *body, m *model.User) {
 	}
 }
 
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance"`
+	RequestID string `json:"request_id"`
+}
+
+func decodeProblem(t *testing.T, resp *http.Response) *problem {
+	t.Helper()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatal("content type should be application/problem+json, but got", ct)
+	}
+
+	var p problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatal("jsson decoding error", err)
+	}
+
+	if len(p.RequestID) == 0 || p.RequestID != resp.Header.Get("X-Request-Id") {
+		t.Error("request id is incorrect", p.RequestID, resp.Header.Get("X-Request-Id"))
+	}
+
+	return &p
+}
+
 func TestHandlerGetUsersSuccess(t *testing.T) {
 	t.Parallel()
 	server, uc, client := initAll(t)
@@ -152,8 +216,8 @@ func TestHandlerGetUsersSuccess(t *testing.T) {
 		{ID: 40, Name: "sabu", Email: "sabu@example.com", CreatedAt: time.Now().Add(40 * time.Second), UpdatedAt: time.Now().Add(41 * time.Second)},
 	}
 
-	uc.listUsers = func() ([]*model.User, error) {
-		return dataset, nil
+	uc.listUsers = func(ctx context.Context, p model.ListOptions) (*model.UserPage, error) {
+		return &model.UserPage{Users: dataset}, nil
 	}
 
 	resp, err := client.Get(server.URL + "/users")
@@ -190,7 +254,7 @@ func TestHandlerGetUsersError(t *testing.T) {
 
 	var expecterError = errors.New("internal server error")
 
-	uc.listUsers = func() ([]*model.User, error) {
+	uc.listUsers = func(ctx context.Context, p model.ListOptions) (*model.UserPage, error) {
 		return nil, expecterError
 	}
 
@@ -204,6 +268,145 @@ func TestHandlerGetUsersError(t *testing.T) {
 	if resp.StatusCode != http.StatusInternalServerError {
 		t.Fatal("expected status is 500, but got", resp.StatusCode)
 	}
+
+	p := decodeProblem(t, resp)
+
+	if p.Type != "/problems/internal-error" || p.Title != "Internal Server Error" || p.Status != http.StatusInternalServerError {
+		t.Error("problem is incorrect", p)
+	}
+
+	if len(p.Detail) != 0 {
+		t.Error("internal errors must not be leaked", p.Detail)
+	}
+}
+
+func TestHandlerGetUsersPagination(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	dataset := []*model.User{
+		{ID: 10, Name: "taro", Email: "taro@example.com", CreatedAt: time.Now().Add(10 * time.Second), UpdatedAt: time.Now().Add(11 * time.Second)},
+	}
+
+	uc.listUsers = func(ctx context.Context, p model.ListOptions) (*model.UserPage, error) {
+		if p.Limit != 1 {
+			t.Error("invalid requested limit", p.Limit)
+		}
+		if p.Cursor != "current" {
+			t.Error("invalid requested cursor", p.Cursor)
+		}
+		if p.Filter == nil {
+			t.Error("filter should be passed")
+		}
+		if len(p.Sort) != 1 || p.Sort[0] != (model.SortField{Field: "created_at", Desc: true}) {
+			t.Error("invalid requested sort", p.Sort)
+		}
+
+		return &model.UserPage{Users: dataset, NextCursor: "next"}, nil
+	}
+
+	query := url.Values{
+		"limit":  {"1"},
+		"cursor": {"current"},
+		"filter": {`email ew "@example.com"`},
+		"sort":   {"-created_at"},
+	}
+	resp, err := client.Get(server.URL + "/users?" + query.Encode())
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("status code should be 200, but got", resp.StatusCode)
+	}
+
+	if c := resp.Header.Get("X-Next-Cursor"); c != "next" {
+		t.Error("next cursor is incorrect", c)
+	}
+
+	query.Set("cursor", "next")
+	if l := resp.Header.Get("Link"); l != "</users?"+query.Encode()+`>; rel="next"` {
+		t.Error("link header is incorrect", l)
+	}
+
+	var b []body
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		t.Fatal("jsson decoding error", err)
+	}
+
+	if len(b) != len(dataset) {
+		t.Fatal("dataset is incorrect", jsonMarshal(t, b), jsonMarshal(t, dataset))
+	}
+}
+
+func TestHandlerGetUsersInvalidPage(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	uc.listUsers = func(ctx context.Context, p model.ListOptions) (*model.UserPage, error) {
+		return nil, model.ErrInvalidCursor
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=abc", "?cursor=broken"} {
+		resp, err := client.Get(server.URL + "/users" + query)
+
+		if err != nil {
+			t.Fatal("http get error", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error("status code should be 400, but got", resp.StatusCode, query)
+		}
+	}
+}
+
+func TestHandlerGetUsersInvalidQuery(t *testing.T) {
+	t.Parallel()
+	server, _, client := initAll(t)
+	defer server.Close()
+
+	type errorBody struct {
+		Param    string `json:"param"`
+		Position int    `json:"position"`
+	}
+
+	testCases := []struct {
+		query    url.Values
+		expected errorBody
+	}{
+		{query: url.Values{"filter": {`name eq "taro" and password eq "x"`}}, expected: errorBody{Param: "filter", Position: 19}},
+		{query: url.Values{"filter": {`id eq "10"`}}, expected: errorBody{Param: "filter", Position: 6}},
+		{query: url.Values{"sort": {"name,-password"}}, expected: errorBody{Param: "sort", Position: 5}},
+	}
+
+	for _, tc := range testCases {
+		resp, err := client.Get(server.URL + "/users?" + tc.query.Encode())
+
+		if err != nil {
+			t.Fatal("http get error", err)
+		}
+
+		var b errorBody
+		err = json.NewDecoder(resp.Body).Decode(&b)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatal("jsson decoding error", err)
+		}
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error("status code should be 400, but got", resp.StatusCode)
+		}
+
+		if b != tc.expected {
+			t.Error("error position is incorrect", b, tc.expected)
+		}
+	}
 }
 
 func TestHandlerGetUser(t *testing.T) {
@@ -215,7 +418,7 @@ func TestHandlerGetUser(t *testing.T) {
 		ID: 10, Name: "taro", Email: "taro@example.com", CreatedAt: time.Now().Add(10 * time.Second), UpdatedAt: time.Now().Add(11 * time.Second),
 	}
 
-	uc.getUser = func(id int) (*model.User, error) {
+	uc.getUser = func(ctx context.Context, id int) (*model.User, error) {
 		if id != dataset.ID {
 			t.Error("invalid requested id", id)
 		}
@@ -252,7 +455,7 @@ func TestHandlerAddUser(t *testing.T) {
 		ID: 10, Name: "taro", Email: "taro@example.com", CreatedAt: time.Now().Add(10 * time.Second), UpdatedAt: time.Now().Add(11 * time.Second),
 	}
 
-	uc.newUser = func(name string, email string) (*model.User, error) {
+	uc.newUser = func(ctx context.Context, name string, email string) (*model.User, error) {
 		if dataset.Name != name {
 			t.Fatal("invalid request name", name, dataset.Name)
 		}
@@ -304,13 +507,17 @@ func TestHandlerUpdateUser(t *testing.T) {
 		UpdatedAt: time.Now().Add(11 * time.Second),
 	}
 
-	uc.updateUser = func(u *model.User) (*model.User, error) {
-		r, e := jsonMarshal(t, u), jsonMarshal(t, dataset)
+	uc.updateUser = func(ctx context.Context, u *model.User) (*model.User, error) {
+		// updated_at in the body must not be used as a precondition
+		expected := *dataset
+		expected.UpdatedAt = time.Time{}
+
+		r, e := jsonMarshal(t, u), jsonMarshal(t, &expected)
 		if r != e {
 			t.Fatal("data doesn't match", r, e)
 		}
 
-		return u, nil
+		return dataset, nil
 	}
 
 	buf := bytes.NewBuffer(nil)
@@ -355,7 +562,7 @@ func TestHandlerUpdateUserNotFound(t *testing.T) {
 		UpdatedAt: time.Now().Add(11 * time.Second),
 	}
 
-	uc.updateUser = func(u *model.User) (*model.User, error) {
+	uc.updateUser = func(ctx context.Context, u *model.User) (*model.User, error) {
 		return nil, model.ErrNoUser
 	}
 
@@ -379,6 +586,12 @@ func TestHandlerUpdateUserNotFound(t *testing.T) {
 	if resp.StatusCode != http.StatusNotFound {
 		t.Fatal("status code should be 404, but got", resp.StatusCode)
 	}
+
+	p := decodeProblem(t, resp)
+
+	if p.Type != "/problems/not-found" || p.Status != http.StatusNotFound || p.Instance != "/users/10" {
+		t.Error("problem is incorrect", p)
+	}
 }
 
 func TestHandlerDeleteUser(t *testing.T) {
@@ -388,7 +601,7 @@ func TestHandlerDeleteUser(t *testing.T) {
 
 	dataset := 10
 
-	uc.deleteUser = func(id int) error {
+	uc.deleteUser = func(ctx context.Context, id int) error {
 		if id != dataset {
 			t.Fatal("id doesn't match", id, dataset)
 		}
@@ -413,3 +626,2234 @@ func TestHandlerDeleteUser(t *testing.T) {
 		t.Fatal("status code should be 204, but got", resp.StatusCode)
 	}
 }
+
+func TestHandlerQueryTimeout(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.QueryTimeout = 10 * time.Second
+		h.RouteQueryTimeouts = map[string]time.Duration{
+			"GET /users/:id": 10 * time.Millisecond,
+		}
+	})
+	defer server.Close()
+
+	uc.getUser = func(ctx context.Context, id int) (*model.User, error) {
+		<-ctx.Done()
+
+		return nil, ctx.Err()
+	}
+
+	uc.listUsers = func(ctx context.Context, p model.ListOptions) (*model.UserPage, error) {
+		deadline, ok := ctx.Deadline()
+
+		if !ok || time.Until(deadline) < 5*time.Second {
+			t.Error("default query timeout is not applied", deadline, ok)
+		}
+
+		return &model.UserPage{}, nil
+	}
+
+	resp, err := client.Get(server.URL + "/users/10")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("status code should be 504, but got", resp.StatusCode)
+	}
+
+	resp, err = client.Get(server.URL + "/users")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("status code should be 200, but got", resp.StatusCode)
+	}
+}
+
+func TestHandlerStreamOutlivesQueryTimeout(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.QueryTimeout = 10 * time.Millisecond
+	})
+	defer server.Close()
+
+	uc.eachUser = func(ctx context.Context, p model.ListOptions, fn func(u *model.User) error) error {
+		for i := 1; i <= 3; i++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			if err := fn(&model.User{ID: i, Name: "name", Email: "hoge" + strconv.Itoa(i) + "@example.com"}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	resp, err := client.Get(server.URL + "/users?stream=true")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	var users []*model.User
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		t.Fatal("the stream should be a complete json array", err)
+	}
+	resp.Body.Close()
+
+	if len(users) != 3 {
+		t.Fatal("every user should be streamed", users)
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/users", nil)
+
+	if err != nil {
+		t.Fatal("new request error", err)
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	resp, err = client.Do(req)
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal("read body error", err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 3 {
+		t.Fatal("every user should be streamed as ndjson", string(b))
+	}
+}
+
+func TestHandlerProblem(t *testing.T) {
+	t.Parallel()
+	server, _, client := initAll(t)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/users/abc?x=1", nil)
+
+	if err != nil {
+		t.Fatal("new requesrt error", err)
+	}
+	req.Header.Set("X-Request-Id", "request-1")
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("status code should be 400, but got", resp.StatusCode)
+	}
+
+	p := decodeProblem(t, resp)
+
+	expected := problem{
+		Type:      "/problems/bad-request",
+		Title:     "Bad Request",
+		Status:    http.StatusBadRequest,
+		Detail:    "invalid id",
+		Instance:  "/users/abc?x=1",
+		RequestID: "request-1",
+	}
+
+	if *p != expected {
+		t.Error("problem is incorrect", p)
+	}
+
+	resp, err = client.Get(server.URL + "/unknown")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("status code should be 404, but got", resp.StatusCode)
+	}
+
+	if p := decodeProblem(t, resp); p.Type != "/problems/not-found" {
+		t.Error("problem is incorrect", p)
+	}
+}
+
+func TestHandlerUserNotFound(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	uc.getUser = func(ctx context.Context, id int) (*model.User, error) {
+		return nil, model.ErrNoUser
+	}
+	uc.updateUser = func(ctx context.Context, u *model.User) (*model.User, error) {
+		return nil, model.ErrNoUser
+	}
+	uc.deleteUser = func(ctx context.Context, id int) error {
+		return model.ErrNoUser
+	}
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		t.Run(method, func(t *testing.T) {
+			var body io.Reader
+			if method == "PUT" {
+				body = strings.NewReader(`{"name":"taro","email":"taro@example.com"}`)
+			}
+
+			req, err := http.NewRequest(method, server.URL+"/users/999", body)
+
+			if err != nil {
+				t.Fatal("new requesrt error", err)
+			}
+
+			resp, err := client.Do(req)
+
+			if err != nil {
+				t.Fatal("http request error", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatal("status code should be 404, but got", resp.StatusCode)
+			}
+
+			if p := decodeProblem(t, resp); p.Type != "/problems/not-found" || p.Instance != "/users/999" {
+				t.Error("problem is incorrect", p)
+			}
+		})
+	}
+}
+
+func TestHandlerAddUserValidationError(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	uc.newUser = func(ctx context.Context, name, email string) (*model.User, error) {
+		_, _, err := model.ValidateUser(name, email)
+
+		return nil, err
+	}
+
+	resp, err := client.Post(server.URL+"/users", "application/json", strings.NewReader(`{"name":"","email":"hoge"}`))
+
+	if err != nil {
+		t.Fatal("http post error", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal("status code should be 422, but got", resp.StatusCode)
+	}
+
+	var b struct {
+		Type   string             `json:"type"`
+		Errors []model.FieldError `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		t.Fatal("jsson decoding error", err)
+	}
+
+	if b.Type != "/problems/validation-error" || len(b.Errors) != 2 || b.Errors[0].Field != "name" || b.Errors[1].Field != "email" {
+		t.Error("problem is incorrect", b)
+	}
+}
+
+func TestHandlerEmailConflict(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	uc.newUser = func(ctx context.Context, name, email string) (*model.User, error) {
+		return nil, &model.ConflictError{Message: "email is already used", ExistingID: 3}
+	}
+
+	resp, err := client.Post(server.URL+"/users", "application/json", strings.NewReader(`{"name":"taro","email":"Taro@example.com"}`))
+
+	if err != nil {
+		t.Fatal("http post error", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatal("status code should be 409, but got", resp.StatusCode)
+	}
+
+	var b struct {
+		Type       string `json:"type"`
+		ExistingID int    `json:"existing_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+
+	if b.Type != "/problems/conflict" || b.ExistingID != 3 {
+		t.Error("problem is incorrect", b)
+	}
+}
+
+func TestHandlerRestoreUser(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	user := &model.User{
+		ID:        1,
+		Name:      "taro",
+		Email:     "taro@example.com",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	uc.restoreUser = func(ctx context.Context, id int) (*model.User, error) {
+		switch id {
+		case 1:
+			return user, nil
+		case 2:
+			return nil, model.ErrNotDeleted
+		}
+
+		return nil, model.ErrNoUser
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/users/1/restore", http.StatusOK},
+		{"/users/2/restore", http.StatusConflict},
+		{"/users/3/restore", http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		resp, err := client.Post(server.URL+tc.path, "", nil)
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("status code of %s should be %d, but got %d", tc.path, tc.status, resp.StatusCode)
+		}
+
+		if tc.status == http.StatusOK {
+			var b body
+			if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+				t.Fatal("json decoding error", err)
+			}
+
+			compare(t, &b, user)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestHandlerGetUsersIncludeDeleted(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	uc.listUsers = func(ctx context.Context, opts model.ListOptions) (*model.UserPage, error) {
+		if !opts.IncludeDeleted {
+			t.Error("deleted users should be included")
+		}
+
+		return &model.UserPage{Users: []*model.User{}}, nil
+	}
+
+	resp, err := client.Get(server.URL + "/users?include_deleted=true")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("status code should be 200, but got", resp.StatusCode)
+	}
+
+	resp, err = client.Get(server.URL + "/users?include_deleted=maybe")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	defer resp.Body.Close()
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusBadRequest || p.Detail != "invalid include_deleted" {
+		t.Error("problem is incorrect", p)
+	}
+}
+
+func TestHandlerPatchUser(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	user := &model.User{
+		ID: 10, Name: "taro", Email: "taro@example.com", CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}
+
+	uc.getUser = func(ctx context.Context, id int) (*model.User, error) {
+		if id != user.ID {
+			return nil, model.ErrNoUser
+		}
+
+		copied := *user
+
+		return &copied, nil
+	}
+
+	var patched *model.UserPatch
+	uc.patchUser = func(ctx context.Context, id int, p model.UserPatch) (*model.User, error) {
+		patched = &p
+
+		u := *user
+		if p.Name != nil {
+			u.Name = *p.Name
+		}
+		if p.Email != nil {
+			u.Email = *p.Email
+		}
+
+		return &u, nil
+	}
+
+	str := func(p *string) string {
+		if p == nil {
+			return "<nil>"
+		}
+
+		return *p
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		patchName   string
+		patchEmail  string
+		problemType string
+		fields      []string
+	}{
+		{
+			name: "MergePatch", contentType: "application/merge-patch+json",
+			body: `{"name":"jiro"}`, status: http.StatusOK, patchName: "jiro", patchEmail: "<nil>",
+		},
+		{
+			name: "MergePatchUnchanged", contentType: "application/merge-patch+json; charset=utf-8",
+			body: `{"name":"taro","id":10}`, status: http.StatusOK, patchName: "<nil>", patchEmail: "<nil>",
+		},
+		{
+			name: "MergePatchRemove", contentType: "application/merge-patch+json",
+			body: `{"name":null,"created_at":"2019-01-01T00:00:00Z","admin":true}`, status: http.StatusUnprocessableEntity,
+			problemType: "/problems/validation-error", fields: []string{"name", "admin", "created_at"},
+		},
+		{
+			name: "JSONPatch", contentType: "application/json-patch+json",
+			body: `[
+				{"op":"test","path":"/email","value":"taro@example.com"},
+				{"op":"copy","from":"/email","path":"/name"},
+				{"op":"replace","path":"/email","value":"jiro@example.com"}
+			]`,
+			status: http.StatusOK, patchName: "taro@example.com", patchEmail: "jiro@example.com",
+		},
+		{
+			name: "JSONPatchTestFailed", contentType: "application/json-patch+json",
+			body:   `[{"op":"test","path":"/name","value":"jiro"},{"op":"replace","path":"/name","value":"saburo"}]`,
+			status: http.StatusConflict, problemType: "/problems/conflict",
+		},
+		{
+			name: "JSONPatchReadOnly", contentType: "application/json-patch+json",
+			body:   `[{"op":"replace","path":"/id","value":11}]`,
+			status: http.StatusUnprocessableEntity, problemType: "/problems/validation-error", fields: []string{"id"},
+		},
+		{
+			name: "JSONPatchMissingPath", contentType: "application/json-patch+json",
+			body:   `[{"op":"remove","path":"/nickname"}]`,
+			status: http.StatusConflict, problemType: "/problems/conflict",
+		},
+		{
+			name: "JSONPatchMalformed", contentType: "application/json-patch+json",
+			body:   `[{"op":"replace","path":"name","value":"jiro"}]`,
+			status: http.StatusBadRequest, problemType: "/problems/bad-request",
+		},
+		{
+			name: "UnsupportedMediaType", contentType: "application/json",
+			body:   `{"name":"jiro"}`,
+			status: http.StatusUnsupportedMediaType, problemType: "/problems/unsupported-media-type",
+		},
+	}
+
+	for _, tc := range tests {
+		patched = nil
+
+		req, err := http.NewRequest("PATCH", server.URL+"/users/10", strings.NewReader(tc.body))
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header.Set("Content-Type", tc.contentType)
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http request error", err)
+		}
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status code should be %d, but got %d", tc.name, tc.status, resp.StatusCode)
+		}
+
+		if resp.Header.Get("Accept-Patch") != "application/merge-patch+json, application/json-patch+json" {
+			t.Errorf("%s: Accept-Patch is incorrect: %s", tc.name, resp.Header.Get("Accept-Patch"))
+		}
+
+		if tc.status == http.StatusOK {
+			if patched == nil || str(patched.Name) != tc.patchName || str(patched.Email) != tc.patchEmail {
+				t.Errorf("%s: patch is incorrect: %v", tc.name, patched)
+			}
+		} else {
+			var b struct {
+				Type   string             `json:"type"`
+				Errors []model.FieldError `json:"errors"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+				t.Fatal("json decoding error", err)
+			}
+
+			if b.Type != tc.problemType || len(b.Errors) != len(tc.fields) {
+				t.Errorf("%s: problem is incorrect: %v", tc.name, b)
+			}
+
+			for i := range tc.fields {
+				if i < len(b.Errors) && b.Errors[i].Field != tc.fields[i] {
+					t.Errorf("%s: invalid field is incorrect: %v", tc.name, b.Errors[i])
+				}
+			}
+
+			if patched != nil {
+				t.Errorf("%s: invalid patch should not be applied", tc.name)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestHandlerIfMatch(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAll(t)
+	defer server.Close()
+
+	user := &model.User{
+		ID: 10, Name: "taro", Email: "taro@example.com", CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}
+
+	uc.getUser = func(ctx context.Context, id int) (*model.User, error) {
+		if id != user.ID {
+			return nil, model.ErrNoUser
+		}
+
+		copied := *user
+
+		return &copied, nil
+	}
+	uc.updateUser = func(ctx context.Context, u *model.User) (*model.User, error) {
+		if !u.UpdatedAt.Equal(user.UpdatedAt) {
+			t.Error("updated_at should be compared", u.UpdatedAt)
+		}
+
+		return u, nil
+	}
+	uc.patchUser = func(ctx context.Context, id int, p model.UserPatch) (*model.User, error) {
+		if !p.UpdatedAt.Equal(user.UpdatedAt) {
+			t.Error("updated_at should be compared", p.UpdatedAt)
+		}
+
+		return user, nil
+	}
+	uc.deleteUser = func(ctx context.Context, id int) error {
+		return nil
+	}
+
+	resp, err := client.Get(server.URL + "/users/10")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 3 {
+		t.Fatal("strong etag should be returned", etag)
+	}
+
+	tests := []struct {
+		method  string
+		path    string
+		ifMatch string
+		status  int
+	}{
+		{"PUT", "/users/10", etag, http.StatusOK},
+		{"PUT", "/users/10", `"10-0"`, http.StatusPreconditionFailed},
+		{"PUT", "/users/10", "W/" + etag, http.StatusPreconditionFailed},
+		{"PUT", "/users/11", "*", http.StatusPreconditionFailed},
+		{"PATCH", "/users/10", `"10-0", ` + etag, http.StatusOK},
+		{"PATCH", "/users/10", `"10-0"`, http.StatusPreconditionFailed},
+		{"DELETE", "/users/10", "*", http.StatusNoContent},
+		{"DELETE", "/users/10", `"10-0"`, http.StatusPreconditionFailed},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(`{"name":"jiro","email":"taro@example.com"}`))
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header.Set("If-Match", tc.ifMatch)
+
+		if tc.method == "PATCH" {
+			req.Header.Set("Content-Type", "application/merge-patch+json")
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http request error", err)
+		}
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s with %s: status code should be %d, but got %d", tc.method, tc.path, tc.ifMatch, tc.status, resp.StatusCode)
+		}
+
+		if tc.status == http.StatusPreconditionFailed {
+			if p := decodeProblem(t, resp); p.Type != "/problems/precondition-failed" {
+				t.Error("problem is incorrect", p)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestHandlerRequireIfMatch(t *testing.T) {
+	t.Parallel()
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.RequireIfMatch = true
+	})
+	defer server.Close()
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		req, err := http.NewRequest(method, server.URL+"/users/10", strings.NewReader(`{"name":"jiro"}`))
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http request error", err)
+		}
+
+		if resp.StatusCode != http.StatusPreconditionRequired {
+			t.Errorf("%s: status code should be 428, but got %d", method, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestHandlerConditionalGet(t *testing.T) {
+	t.Parallel()
+	server, uc, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.CachePolicies = map[string]handler.CachePolicy{
+			"GET /users": {MaxAge: time.Minute, Public: true, Vary: []string{"Accept", "Authorization"}},
+		}
+	})
+	defer server.Close()
+
+	user := &model.User{
+		ID: 10, Name: "taro", Email: "taro@example.com", CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}
+	users := []*model.User{user}
+
+	uc.getUser = func(ctx context.Context, id int) (*model.User, error) {
+		return user, nil
+	}
+	uc.listUsers = func(ctx context.Context, opts model.ListOptions) (*model.UserPage, error) {
+		return &model.UserPage{Users: users}, nil
+	}
+
+	get := func(path string, header http.Header) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header = header
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http request error", err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	for _, path := range []string{"/users/10", "/users"} {
+		resp := get(path, http.Header{})
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("status code should be 200, but got", resp.StatusCode)
+		}
+
+		since := user.UpdatedAt.UTC().Format(http.TimeFormat)
+		expectedModified, sinceStatus := since, http.StatusNotModified
+
+		// collections are validated only by ETag
+		if path == "/users" {
+			expectedModified, sinceStatus = "", http.StatusOK
+		}
+
+		etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if len(etag) == 0 || modified != expectedModified {
+			t.Fatal("validators are incorrect", path, etag, modified)
+		}
+
+		tests := []struct {
+			header http.Header
+			status int
+		}{
+			{http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+			{http.Header{"If-None-Match": {`"other", ` + etag}}, http.StatusNotModified},
+			{http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+			{http.Header{"If-Modified-Since": {since}}, sinceStatus},
+			{http.Header{"If-Modified-Since": {user.UpdatedAt.Add(-time.Second).UTC().Format(http.TimeFormat)}}, http.StatusOK},
+			// If-None-Match takes precedence
+			{http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {since}}, http.StatusOK},
+		}
+
+		for _, tc := range tests {
+			resp := get(path, tc.header)
+
+			if resp.StatusCode != tc.status {
+				t.Errorf("%s with %v: status code should be %d, but got %d", path, tc.header, tc.status, resp.StatusCode)
+			}
+
+			if resp.Header.Get("ETag") != etag {
+				t.Errorf("%s with %v: etag should be kept: %s", path, tc.header, resp.Header.Get("ETag"))
+			}
+		}
+	}
+
+	resp := get("/users/10", http.Header{})
+
+	if cc, vary := resp.Header.Get("Cache-Control"), resp.Header.Get("Vary"); cc != "private, no-cache" || vary != "Accept, Authorization, X-API-Key" {
+		t.Error("default cache policy is incorrect", cc, vary)
+	}
+
+	resp = get("/users", http.Header{})
+	etag := resp.Header.Get("ETag")
+
+	if cc, vary := resp.Header.Get("Cache-Control"), resp.Header.Get("Vary"); cc != "public, max-age=60" || vary != "Accept, Authorization" {
+		t.Error("cache policy of the route is incorrect", cc, vary)
+	}
+
+	// a replaced row changes the collection even if the count and the max updated_at are kept
+	users = []*model.User{{ID: 11, UpdatedAt: user.UpdatedAt}}
+
+	if resp := get("/users", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusOK {
+		t.Error("changed collection should be returned", resp.StatusCode)
+	}
+
+	// deleting a row hides it without raising the max updated_at of the rest
+	users = []*model.User{user, {ID: 11, UpdatedAt: user.UpdatedAt.Add(-time.Hour)}}
+	etag = get("/users", http.Header{}).Header.Get("ETag")
+	users = []*model.User{user}
+
+	for _, header := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-Modified-Since": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}},
+	} {
+		if resp := get("/users", header); resp.StatusCode != http.StatusOK {
+			t.Error("collection without the deleted row should be returned", header, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandlerBatch(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+	})
+	defer server.Close()
+
+	existing, err := uc.NewUser(context.Background(), "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error", err)
+	}
+
+	type result struct {
+		Index   int         `json:"index"`
+		Status  int         `json:"status"`
+		User    *model.User `json:"user"`
+		Problem *problem    `json:"problem"`
+	}
+
+	batch := func(body string) (int, []result) {
+		t.Helper()
+
+		resp, err := client.Post(server.URL+"/users:batch", "application/json", strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+		defer resp.Body.Close()
+
+		var b struct {
+			Results []result `json:"results"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+			t.Fatal("json decoding error", err)
+		}
+
+		return resp.StatusCode, b.Results
+	}
+
+	operations := `[
+		{"method":"create","name":"jiro","email":"jiro@example.com"},
+		{"method":"create","name":"taro2","email":"TARO@example.com"},
+		{"method":"update","id":` + strconv.Itoa(existing.ID) + `,"name":"taro3","email":"taro@example.com"},
+		{"method":"delete","id":999}
+	]`
+
+	status, results := batch(`{"mode":"atomic","operations":` + operations + `}`)
+
+	if status != http.StatusConflict || len(results) != 4 {
+		t.Fatal("atomic batch should fail with the first failure", status, results)
+	}
+
+	expected := []struct {
+		status      int
+		problemType string
+	}{
+		{http.StatusFailedDependency, "/problems/rolled-back"},
+		{http.StatusConflict, "/problems/conflict"},
+		{http.StatusFailedDependency, "/problems/rolled-back"},
+		{http.StatusNotFound, "/problems/not-found"},
+	}
+	for i, e := range expected {
+		if r := results[i]; r.Index != i || r.Status != e.status || r.Problem == nil || r.Problem.Type != e.problemType {
+			t.Errorf("result %d is incorrect: %+v", i, r)
+		}
+	}
+
+	page, err := uc.ListUsers(context.Background(), model.ListOptions{})
+
+	if err != nil {
+		t.Fatal("list users error", err)
+	}
+
+	if len(page.Users) != 1 || page.Users[0].Name != "taro" {
+		t.Fatal("atomic batch should be rolled back", page.Users)
+	}
+
+	status, results = batch(`{"mode":"partial","operations":` + operations + `}`)
+
+	if status != http.StatusOK || len(results) != 4 {
+		t.Fatal("partial batch should succeed", status, results)
+	}
+
+	if r := results[0]; r.Status != http.StatusCreated || r.User == nil || r.User.Name != "jiro" {
+		t.Error("user should be created", r)
+	}
+
+	if r := results[1]; r.Status != http.StatusConflict || r.Problem == nil || r.Problem.Type != "/problems/conflict" {
+		t.Error("conflict should be reported", r)
+	}
+
+	if r := results[2]; r.Status != http.StatusOK || r.User == nil || r.User.Name != "taro3" {
+		t.Error("user should be updated", r)
+	}
+
+	if r := results[3]; r.Status != http.StatusNotFound || r.Problem.Instance != "/users:batch" {
+		t.Error("missing user should be reported", r, r.Problem)
+	}
+
+	for _, path := range []string{"/users:unknown", "/_custom/users/batch"} {
+		resp, err := client.Post(server.URL+path, "application/json", strings.NewReader(`{"operations":[]}`))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+
+		if p := decodeProblem(t, resp); p.Status != http.StatusNotFound || p.Instance != path {
+			t.Error("unknown route should not be found", p)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestHandlerExportImport(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+	})
+	defer server.Close()
+
+	existing, err := uc.NewUser(context.Background(), "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error", err)
+	}
+
+	type report struct {
+		DryRun   bool `json:"dry_run"`
+		Rows     int  `json:"rows"`
+		Imported int  `json:"imported"`
+		Failures []struct {
+			Row     int      `json:"row"`
+			Problem *problem `json:"problem"`
+		} `json:"failures"`
+	}
+
+	csv := "Full Name,Mail\njiro,jiro@example.com\ntaro2,TARO@example.com\n"
+
+	for _, dryRun := range []string{"true", "false"} {
+		resp, err := client.Post(server.URL+"/users/import?mapping=Full+Name:name,Mail:email&dry_run="+dryRun, "text/csv", strings.NewReader(csv))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+
+		var r report
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatal("json decoding error", err)
+		}
+
+		if resp.StatusCode != http.StatusOK || strconv.FormatBool(r.DryRun) != dryRun || r.Rows != 2 || r.Imported != 1 || len(r.Failures) != 1 {
+			t.Fatal("the first row should be imported", resp.StatusCode, r)
+		}
+
+		if f := r.Failures[0]; f.Row != 3 || f.Problem == nil || f.Problem.Status != http.StatusConflict {
+			t.Fatal("the conflicting row should be reported", f)
+		}
+	}
+
+	resp, err := client.Get(server.URL + "/users/export?format=ndjson&sort=id")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal("read error", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("users should be exported", resp.StatusCode, resp.Header)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	if len(lines) != 2 {
+		t.Fatal("a line should be written per user", lines)
+	}
+
+	var u model.User
+	if err := json.Unmarshal([]byte(lines[0]), &u); err != nil || u.ID != existing.ID {
+		t.Fatal("users should be exported in order", lines[0], err)
+	}
+
+	resp, err = client.Get(server.URL + "/users/export")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal("read error", err)
+	}
+
+	if !strings.HasPrefix(string(b), "id,name,email,created_at,updated_at,deleted_at\n") || strings.Count(string(b), "\n") != 3 {
+		t.Fatal("users should be exported in csv by default", string(b))
+	}
+
+	resp, err = client.Get(server.URL + "/users/export?format=xml")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusBadRequest {
+		t.Fatal("unknown formats should be rejected", p)
+	}
+
+	resp, err = client.Post(server.URL+"/users/import", "application/json", strings.NewReader("[]"))
+
+	if err != nil {
+		t.Fatal("http post error", err)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnsupportedMediaType {
+		t.Fatal("unknown media types should be rejected", p)
+	}
+
+	resp, err = client.Get(server.URL + "/_static/users/export")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusNotFound {
+		t.Fatal("internal routes should be hidden", p)
+	}
+}
+
+func TestHandlerStreamUsers(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+	})
+	defer server.Close()
+
+	get := func(query, accept string) (*http.Response, []byte) {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", server.URL+"/users"+query, nil)
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header.Set("Accept", accept)
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http get error", err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+
+		if err != nil {
+			t.Fatal("read error", err)
+		}
+
+		return resp, b
+	}
+
+	resp, b := get("?stream=true", "application/json")
+
+	if resp.StatusCode != http.StatusOK || string(b) != "[]" {
+		t.Fatal("an empty array should be streamed", resp.StatusCode, string(b))
+	}
+
+	// more than the default page size
+	n := model.DefaultPageLimit + 10
+	for i := 0; i < n; i++ {
+		if _, err := uc.NewUser(context.Background(), "user"+strconv.Itoa(i), "user"+strconv.Itoa(i)+"@example.com"); err != nil {
+			t.Fatal("new user error", err)
+		}
+	}
+
+	resp, b = get("?stream=true", "application/json")
+
+	var users []*model.User
+	if err := json.Unmarshal(b, &users); err != nil {
+		t.Fatal("json decoding error", err, string(b))
+	}
+
+	if resp.StatusCode != http.StatusOK || len(users) != n || len(resp.Header.Get("X-Next-Cursor")) != 0 {
+		t.Fatal("every user should be streamed without paging", resp.StatusCode, len(users))
+	}
+
+	for i, u := range users {
+		if u.Name != "user"+strconv.Itoa(i) {
+			t.Fatal("users should be streamed in order", i, u)
+		}
+	}
+
+	resp, b = get("?limit=3", "application/x-ndjson")
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("ndjson should be streamed", resp.StatusCode, resp.Header)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	if len(lines) != 3 {
+		t.Fatal("limit should be applied to streams", lines)
+	}
+
+	resp, _ = get("?stream=maybe", "application/json")
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("invalid stream should be rejected", resp.StatusCode)
+	}
+}
+
+func TestHandlerAPIKey(t *testing.T) {
+	t.Parallel()
+	kc := model.NewMemoryAPIKeyController()
+	server, uc, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.APIKeyController = kc
+	})
+	defer server.Close()
+
+	uc.listUsers = func(ctx context.Context, opts model.ListOptions) (*model.UserPage, error) {
+		return &model.UserPage{Users: []*model.User{}}, nil
+	}
+
+	key, secret, err := kc.NewAPIKey(context.Background(), "test", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new api key error", err)
+	}
+
+	get := func(header, value string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", server.URL+"/users", nil)
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+
+		if len(header) != 0 {
+			req.Header.Set(header, value)
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http get error", err)
+		}
+
+		return resp
+	}
+
+	resp := get("", "")
+
+	if resp.Header.Get("WWW-Authenticate") != `Bearer realm="users"` {
+		t.Error("challenge should be returned", resp.Header)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized || p.Type != "/problems/unauthorized" {
+		t.Fatal("requests without keys should be rejected", p)
+	}
+
+	for _, header := range [][2]string{{"Authorization", "Bearer " + secret}, {"Authorization", "bearer " + secret}, {"X-API-Key", secret}} {
+		resp := get(header[0], header[1])
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("valid keys should be accepted", header[0], resp.StatusCode)
+		}
+	}
+
+	resp = get("Authorization", "Basic "+secret)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+		t.Fatal("other schemes should be rejected", p)
+	}
+
+	if err := kc.RevokeAPIKey(context.Background(), key.ID); err != nil {
+		t.Fatal("revoke error", err)
+	}
+
+	resp = get("X-API-Key", secret)
+
+	if !strings.Contains(resp.Header.Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Error("invalid token should be notified", resp.Header)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+		t.Fatal("revoked keys should be rejected", p)
+	}
+
+	resp, err = client.Get(server.URL)
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("the root should not require keys", resp.StatusCode)
+	}
+}
+
+func TestHandlerScopes(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	kc := model.NewMemoryAPIKeyController()
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.APIKeyController = kc
+	})
+	defer server.Close()
+
+	user, err := uc.NewUser(context.Background(), "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error", err)
+	}
+
+	_, writer, err := kc.NewAPIKey(context.Background(), "writer", []string{model.ScopeRead, model.ScopeWrite}, nil)
+
+	if err != nil {
+		t.Fatal("new api key error", err)
+	}
+
+	_, admin, err := kc.NewAPIKey(context.Background(), "admin", []string{model.ScopeAdmin}, nil)
+
+	if err != nil {
+		t.Fatal("new api key error", err)
+	}
+
+	do := func(secret, method, path, body string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+		req.Header.Set("Content-Type", "application/json")
+		if method == "PATCH" {
+			req.Header.Set("Content-Type", "application/merge-patch+json")
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http request error", err)
+		}
+
+		return resp
+	}
+
+	id := strconv.Itoa(user.ID)
+	allowed := []struct{ method, path, body string }{
+		{method: "GET", path: "/users"},
+		{method: "GET", path: "/users?include_deleted=false"},
+		{method: "GET", path: "/users/" + id},
+		{method: "PATCH", path: "/users/" + id, body: `{"name": "jiro"}`},
+		{method: "POST", path: "/users:batch", body: `{"operations": [{"method": "create", "name": "hanako", "email": "hanako@example.com"}]}`},
+	}
+
+	for _, tc := range allowed {
+		resp := do(writer, tc.method, tc.path, tc.body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			t.Error("granted scopes should be accepted", tc.method, tc.path, resp.StatusCode)
+		}
+	}
+
+	denied := []struct{ method, path, body, scope string }{
+		{method: "DELETE", path: "/users/" + id, scope: model.ScopeDelete},
+		{method: "POST", path: "/users/" + id + "/restore", scope: model.ScopeAdmin},
+		{method: "GET", path: "/users/export", scope: model.ScopeAdmin},
+		{method: "GET", path: "/users?include_deleted=true", scope: model.ScopeAdmin},
+		{method: "GET", path: "/users?include_deleted=true&stream=true", scope: model.ScopeAdmin},
+		{method: "POST", path: "/users:batch", body: `{"operations": [{"method": "delete", "id": ` + id + `}]}`, scope: model.ScopeDelete},
+	}
+
+	for _, tc := range denied {
+		resp := do(writer, tc.method, tc.path, tc.body)
+
+		if challenge := resp.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, `error="insufficient_scope", scope="`+tc.scope+`"`) {
+			t.Error("insufficient scope should be notified", tc.method, tc.path, challenge)
+		}
+
+		if p := decodeProblem(t, resp); p.Status != http.StatusForbidden || p.Type != "/problems/forbidden" || !strings.Contains(p.Detail, tc.scope) {
+			t.Error("missing scopes should be rejected", tc.method, tc.path, p)
+		}
+	}
+
+	if _, err := uc.GetUser(context.Background(), user.ID); err != nil {
+		t.Fatal("denied requests should not delete users", err)
+	}
+
+	resp := do(admin, "DELETE", "/users/"+id, "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("users:admin should grant every scope", resp.StatusCode)
+	}
+	resp = do(admin, "GET", "/users?include_deleted=true", "")
+
+	var users []*model.User
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || len(users) != 2 || users[0].DeletedAt == nil {
+		t.Error("administrators should list deleted users", resp.StatusCode, users)
+	}
+}
+
+func TestHandlerAccounts(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.CredentialController = model.NewMemoryCredentialController(uc)
+		h.SessionController = model.NewMemorySessionController()
+	})
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		t.Fatal("cookie jar error", err)
+	}
+	client.Jar = jar
+
+	post := func(path, body string) *http.Response {
+		t.Helper()
+
+		resp, err := client.Post(server.URL+path, "application/json", strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+
+		return resp
+	}
+
+	me := func() *http.Response {
+		t.Helper()
+
+		resp, err := client.Get(server.URL + "/me")
+
+		if err != nil {
+			t.Fatal("http get error", err)
+		}
+
+		return resp
+	}
+
+	resp := post("/auth/signup", `{"name": "taro", "email": "taro@example.com", "password": "short"}`)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnprocessableEntity {
+		t.Fatal("short passwords should be rejected", p)
+	}
+
+	resp = post("/auth/signup", `{"name": "taro", "email": "taro@example.com", "password": "correct horse"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("sign up should succeed", resp.StatusCode)
+	}
+
+	cookie := resp.Header.Get("Set-Cookie")
+
+	if !strings.Contains(cookie, "HttpOnly") || !strings.Contains(cookie, "SameSite=Lax") {
+		t.Error("session cookie should be HttpOnly and SameSite", cookie)
+	}
+
+	resp = me()
+
+	var user model.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || user.Email != "taro@example.com" {
+		t.Fatal("the signed-in user should be returned", resp.StatusCode, user)
+	}
+
+	resp = post("/auth/logout", "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal("logout should succeed", resp.StatusCode)
+	}
+
+	if p := decodeProblem(t, me()); p.Status != http.StatusUnauthorized {
+		t.Fatal("logged out users should be rejected", p)
+	}
+
+	resp = post("/auth/login", `{"email": "taro@example.com", "password": "wrong horse"}`)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized || p.Detail != "email or password is incorrect" {
+		t.Fatal("wrong passwords should be rejected", p)
+	}
+
+	resp = post("/auth/login", `{"email": "taro@example.com", "password": "correct horse"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("login should succeed", resp.StatusCode)
+	}
+
+	resp = me()
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("logged in users should be returned", resp.StatusCode)
+	}
+
+	if err := uc.DeleteUser(context.Background(), user.ID); err != nil {
+		t.Fatal("delete user error", err)
+	}
+
+	if p := decodeProblem(t, me()); p.Status != http.StatusUnauthorized {
+		t.Fatal("sessions of deleted users should be rejected", p)
+	}
+}
+
+func TestHandlerAccountsDisabled(t *testing.T) {
+	t.Parallel()
+	server, _, client := initAll(t)
+	defer server.Close()
+
+	resp, err := client.Post(server.URL+"/auth/login", "application/json", strings.NewReader(`{}`))
+
+	if err != nil {
+		t.Fatal("http post error", err)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusNotFound {
+		t.Fatal("accounts should not be available without controllers", p)
+	}
+}
+
+func TestHandlerMFA(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	cc := model.NewMemoryCredentialController(uc)
+	mc := model.NewMemoryMFAController()
+	keys, err := token.NewKeySet(model.NewMemorySigningKeyController(), token.RS256)
+
+	if err != nil {
+		t.Fatal("new key set error", err)
+	}
+
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.CredentialController = cc
+		h.SessionController = model.NewMemorySessionController()
+		h.TokenKeys = keys
+		h.RefreshTokenController = model.NewMemoryRefreshTokenController()
+		h.MFAController = mc
+	})
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		t.Fatal("cookie jar error", err)
+	}
+	client.Jar = jar
+
+	post := func(path, body string, ret interface{}) *http.Response {
+		t.Helper()
+
+		resp, err := client.Post(server.URL+path, "application/json", strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+
+		if resp.StatusCode != http.StatusOK || ret == nil {
+			return resp
+		}
+		defer resp.Body.Close()
+
+		if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+			t.Fatal("json decoding error", err)
+		}
+
+		return resp
+	}
+
+	resp := post("/auth/signup", `{"name": "taro", "email": "taro@example.com", "password": "correct horse"}`, nil)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("sign up should succeed", resp.StatusCode)
+	}
+
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+		QRCodePNG  []byte `json:"qr_code_png"`
+	}
+	resp = post("/me/mfa/totp", "", &enrollment)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("enrollment should succeed", resp.StatusCode)
+	}
+
+	if !strings.HasPrefix(enrollment.OTPAuthURI, "otpauth://totp/users:taro@example.com?") || !strings.Contains(enrollment.OTPAuthURI, "secret="+enrollment.Secret) {
+		t.Error("otpauth uri is incorrect", enrollment.OTPAuthURI)
+	}
+
+	if img, err := png.Decode(bytes.NewReader(enrollment.QRCodePNG)); err != nil || img.Bounds().Dx() != 256 {
+		t.Error("qr code should be a png image", err)
+	}
+
+	code := func(d time.Duration) string {
+		t.Helper()
+
+		code, err := model.TOTPCode(enrollment.Secret, time.Now().Add(d))
+
+		if err != nil {
+			t.Fatal("totp code error", err)
+		}
+
+		return code
+	}
+
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	resp = post("/me/mfa/totp/confirm", `{"code": "`+code(0)+`"}`, &confirmation)
+
+	if resp.StatusCode != http.StatusOK || len(confirmation.RecoveryCodes) != 10 {
+		t.Fatal("confirmation should return recovery codes", resp.StatusCode, confirmation)
+	}
+
+	resp = post("/auth/logout", "", nil)
+	resp.Body.Close()
+
+	type challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+	var ch challenge
+	post("/auth/login", `{"email": "taro@example.com", "password": "correct horse"}`, &ch)
+
+	if !ch.MFARequired || len(ch.MFAToken) == 0 {
+		t.Fatal("login should require the second step", ch)
+	}
+
+	resp, err = client.Get(server.URL + "/me")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+		t.Fatal("sessions should not start before the second step", p)
+	}
+
+	resp = post("/auth/login/mfa", `{"mfa_token": "`+ch.MFAToken+`", "code": "`+code(0)+`"}`, nil)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized || p.Detail != model.ErrInvalidMFACode.Error() {
+		t.Fatal("the code used for confirmation should not be replayed", p)
+	}
+
+	var user model.User
+	resp = post("/auth/login/mfa", `{"mfa_token": "`+ch.MFAToken+`", "code": "`+confirmation.RecoveryCodes[0]+`"}`, &user)
+
+	if resp.StatusCode != http.StatusOK || user.Email != "taro@example.com" {
+		t.Fatal("recovery codes should complete login", resp.StatusCode, user)
+	}
+
+	resp, err = client.Get(server.URL + "/me")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("sessions should start after the second step", resp.StatusCode)
+	}
+
+	ch = challenge{}
+	post("/auth/token", `{"grant_type": "password", "email": "taro@example.com", "password": "correct horse"}`, &ch)
+
+	if !ch.MFARequired {
+		t.Fatal("password grant should require the second step", ch)
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	resp = post("/auth/token", `{"grant_type": "mfa", "mfa_token": "`+ch.MFAToken+`", "code": "`+code(30*time.Second)+`"}`, &tokens)
+
+	if resp.StatusCode != http.StatusOK || len(tokens.AccessToken) == 0 {
+		t.Fatal("mfa grant should issue tokens", resp.StatusCode)
+	}
+
+	resp = post("/me/mfa/disable", `{"code": "`+confirmation.RecoveryCodes[0]+`"}`, nil)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+		t.Fatal("used recovery codes should be rejected", p)
+	}
+
+	resp = post("/me/mfa/disable", `{"code": "`+confirmation.RecoveryCodes[1]+`"}`, nil)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal("disabling mfa should succeed", resp.StatusCode)
+	}
+
+	user = model.User{}
+	post("/auth/login", `{"email": "taro@example.com", "password": "correct horse"}`, &user)
+
+	if user.Email != "taro@example.com" {
+		t.Fatal("login should take a single step after mfa is disabled", user)
+	}
+
+	secret, err := mc.EnrollTOTP(context.Background(), user.ID)
+
+	if err != nil {
+		t.Fatal("enroll error", err)
+	}
+
+	first, err := model.TOTPCode(secret, time.Now())
+
+	if err != nil {
+		t.Fatal("totp code error", err)
+	}
+
+	codes, err := mc.ConfirmTOTP(context.Background(), user.ID, first)
+
+	if err != nil {
+		t.Fatal("confirm error", err)
+	}
+
+	// wrong codes count across challenges, so logging in again does not allow more guesses
+	for i := 0; i < 5; i++ {
+		ch = challenge{}
+		post("/auth/login", `{"email": "taro@example.com", "password": "correct horse"}`, &ch)
+
+		resp = post("/auth/login/mfa", `{"mfa_token": "`+ch.MFAToken+`", "code": "aaaa-aaaa-aaaa-aaaa"}`, nil)
+
+		if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+			t.Fatal("wrong codes should be rejected", p)
+		}
+	}
+
+	ch = challenge{}
+	post("/auth/login", `{"email": "taro@example.com", "password": "correct horse"}`, &ch)
+
+	resp = post("/auth/login/mfa", `{"mfa_token": "`+ch.MFAToken+`", "code": "`+codes[0]+`"}`, nil)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusTooManyRequests || p.Type != "/problems/too-many-requests" {
+		t.Fatal("users should be locked out after wrong codes in a row", p)
+	}
+}
+
+// waitSent waits until m has sent n messages in the background
+func waitSent(t *testing.T, m *mailer.LogMailer, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); len(m.Sent()) < n; {
+		if time.Now().After(deadline) {
+			t.Fatal("message should be sent", m.Sent())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingMailer fails to send every message
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg *mailer.Message) error {
+	return errors.New("smtp server is down")
+}
+
+func TestHandlerForgotPasswordMailerError(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	cc := model.NewMemoryCredentialController(uc)
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.CredentialController = cc
+		h.SessionController = model.NewMemorySessionController()
+		h.Mailer = failingMailer{}
+		h.OneTimeTokenController = model.NewMemoryOneTimeTokenController(uc)
+	})
+	defer server.Close()
+
+	if _, err := cc.SignUp(context.Background(), "taro", "taro@example.com", "correct horse"); err != nil {
+		t.Fatal("sign up error", err)
+	}
+
+	for _, email := range []string{"taro@example.com", "jiro@example.com"} {
+		resp, err := client.Post(server.URL+"/auth/password/forgot", "application/json", strings.NewReader(`{"email": "`+email+`"}`))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			t.Error("failures of sending should not be responded", email, resp.StatusCode)
+		}
+	}
+}
+
+// sentToken returns the token linked from the last message sent by m
+func sentToken(t *testing.T, m *mailer.LogMailer, to string) string {
+	t.Helper()
+
+	sent := m.Sent()
+
+	if len(sent) == 0 || sent[len(sent)-1].To != to {
+		t.Fatal("message should be sent", sent)
+	}
+
+	match := regexp.MustCompile(`\?token=(\S+)`).FindStringSubmatch(sent[len(sent)-1].Body)
+
+	if match == nil {
+		t.Fatal("message should have a link with the token", sent[len(sent)-1].Body)
+	}
+
+	token, err := url.QueryUnescape(match[1])
+
+	if err != nil {
+		t.Fatal("unescape error", err)
+	}
+
+	return token
+}
+
+func TestHandlerEmails(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	sc := model.NewMemorySessionController()
+	otc := model.NewMemoryOneTimeTokenController(uc)
+	m := mailer.NewLogMailer(nil, "noreply@example.com")
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.CredentialController = model.NewMemoryCredentialController(uc, model.WithMemoryResetControllers(otc, sc, nil, nil))
+		h.SessionController = sc
+		h.Mailer = m
+		h.OneTimeTokenController = otc
+		h.LinkBaseURL = "https://example.com/"
+	})
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		t.Fatal("cookie jar error", err)
+	}
+	client.Jar = jar
+
+	post := func(path, body string) *http.Response {
+		t.Helper()
+
+		resp, err := client.Post(server.URL+path, "application/json", strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+
+		return resp
+	}
+
+	resp := post("/auth/signup", `{"name": "taro", "email": "taro@example.com", "password": "correct horse"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("sign up should succeed", resp.StatusCode)
+	}
+
+	first := sentToken(t, m, "taro@example.com")
+
+	if body := m.Sent()[0].Body; !strings.Contains(body, "https://example.com/verify-email?token=") {
+		t.Error("link should point to the frontend", body)
+	}
+
+	resp = post("/me/email/verification", "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatal("verification should be sent again", resp.StatusCode)
+	}
+
+	second := sentToken(t, m, "taro@example.com")
+
+	if p := decodeProblem(t, post("/auth/email/verify", `{"token": "`+first+`"}`)); p.Status != http.StatusBadRequest {
+		t.Fatal("tokens sent before should be invalidated", p)
+	}
+
+	resp = post("/auth/email/verify", `{"token": "`+second+`"}`)
+
+	var user model.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || user.EmailVerifiedAt == nil {
+		t.Fatal("email should be verified", resp.StatusCode, user)
+	}
+
+	if p := decodeProblem(t, post("/me/email/verification", "")); p.Status != http.StatusConflict {
+		t.Fatal("verified emails should not be verified again", p)
+	}
+
+	sent := len(m.Sent())
+	resp = post("/auth/password/forgot", `{"email": "jiro@example.com"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted || len(m.Sent()) != sent {
+		t.Fatal("unknown emails should be accepted without sending messages", resp.StatusCode)
+	}
+
+	resp = post("/auth/password/forgot", `{"email": "Taro@example.com"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatal("password reset should be requested", resp.StatusCode)
+	}
+
+	waitSent(t, m, sent+1)
+	reset := sentToken(t, m, "taro@example.com")
+
+	if p := decodeProblem(t, post("/auth/email/verify", `{"token": "`+reset+`"}`)); p.Status != http.StatusBadRequest {
+		t.Fatal("tokens should be rejected for other purposes", p)
+	}
+
+	if p := decodeProblem(t, post("/auth/password/reset", `{"token": "`+reset+`", "password": "short"}`)); p.Status != http.StatusUnprocessableEntity {
+		t.Fatal("short passwords should be rejected", p)
+	}
+
+	resp = post("/auth/password/reset", `{"token": "`+reset+`", "password": "battery staple"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal("password should be reset", resp.StatusCode)
+	}
+
+	resp, err = client.Get(server.URL + "/me")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("sessions should be revoked by resetting the password", resp.StatusCode)
+	}
+
+	if p := decodeProblem(t, post("/auth/password/reset", `{"token": "`+reset+`", "password": "battery staple"}`)); p.Status != http.StatusBadRequest {
+		t.Fatal("tokens should be used only once", p)
+	}
+
+	if p := decodeProblem(t, post("/auth/login", `{"email": "taro@example.com", "password": "correct horse"}`)); p.Status != http.StatusUnauthorized {
+		t.Fatal("the old password should be rejected", p)
+	}
+
+	resp = post("/auth/login", `{"email": "taro@example.com", "password": "battery staple"}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("the new password should be accepted", resp.StatusCode)
+	}
+}
+
+func TestHandlerTokens(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	cc := model.NewMemoryCredentialController(uc)
+	keys, err := token.NewKeySet(model.NewMemorySigningKeyController(), token.RS256)
+
+	if err != nil {
+		t.Fatal("new key set error", err)
+	}
+
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.CredentialController = cc
+		h.SessionController = model.NewMemorySessionController()
+		h.TokenKeys = keys
+		h.RefreshTokenController = model.NewMemoryRefreshTokenController()
+	})
+	defer server.Close()
+
+	if _, err := cc.SignUp(context.Background(), "taro", "taro@example.com", "correct horse"); err != nil {
+		t.Fatal("sign up error", err)
+	}
+
+	type tokens struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	issue := func(body string) (*http.Response, *tokens) {
+		t.Helper()
+
+		resp, err := client.Post(server.URL+"/auth/token", "application/json", strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("http post error", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return resp, nil
+		}
+		defer resp.Body.Close()
+
+		var ret tokens
+		if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+			t.Fatal("json decoding error", err)
+		}
+
+		return resp, &ret
+	}
+
+	me := func(access string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", server.URL+"/me", nil)
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+access)
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http get error", err)
+		}
+
+		return resp
+	}
+
+	resp, first := issue(`{"grant_type": "password", "email": "taro@example.com", "password": "correct horse"}`)
+
+	if first == nil {
+		t.Fatal("password grant should succeed", resp.StatusCode)
+	}
+
+	if first.TokenType != "Bearer" || first.ExpiresIn != int(handler.DefaultAccessTokenTTL/time.Second) || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Error("token response is incorrect", first, resp.Header)
+	}
+
+	resp = me(first.AccessToken)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("access tokens should authenticate users", resp.StatusCode)
+	}
+
+	resp = me(first.AccessToken + "x")
+
+	if !strings.Contains(resp.Header.Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Error("invalid token should be notified", resp.Header)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+		t.Fatal("invalid access tokens should be rejected", p)
+	}
+
+	resp, second := issue(`{"grant_type": "refresh_token", "refresh_token": "` + first.RefreshToken + `"}`)
+
+	if second == nil || second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh tokens should be rotated", resp.StatusCode, second)
+	}
+
+	resp, _ = issue(`{"grant_type": "refresh_token", "refresh_token": "` + first.RefreshToken + `"}`)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized || p.Detail != model.ErrRefreshTokenReused.Error() {
+		t.Fatal("reused refresh tokens should be rejected", p)
+	}
+
+	resp, _ = issue(`{"grant_type": "refresh_token", "refresh_token": "` + second.RefreshToken + `"}`)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+		t.Fatal("the family should be revoked on reuse", p)
+	}
+
+	resp, _ = issue(`{"grant_type": "client_credentials"}`)
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusBadRequest {
+		t.Fatal("unknown grant types should be rejected", p)
+	}
+
+	resp, err = client.Get(server.URL + "/.well-known/jwks.json")
+
+	if err != nil {
+		t.Fatal("http get error", err)
+	}
+
+	var jwks token.JWKSet
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+	resp.Body.Close()
+
+	if len(jwks.Keys) != 1 || jwks.Keys[0].KeyType != "RSA" || len(jwks.Keys[0].KeyID) == 0 {
+		t.Error("the signing key should be published", jwks)
+	}
+}
+
+func TestHandlerPersonalTokens(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.APIKeyController = model.NewMemoryAPIKeyController()
+		h.CredentialController = model.NewMemoryCredentialController(uc)
+		h.SessionController = model.NewMemorySessionController()
+		h.PersonalTokenController = model.NewMemoryPersonalTokenController(uc)
+	})
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		t.Fatal("cookie jar error", err)
+	}
+	session := &http.Client{Jar: jar}
+
+	// do sends a request signed in with the session, or with the personal token if bearer is not empty
+	do := func(method, path, bearer, body string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		c := session
+		if len(bearer) != 0 {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+			c = client
+		}
+
+		resp, err := c.Do(req)
+
+		if err != nil {
+			t.Fatal("http request error", err)
+		}
+
+		return resp
+	}
+
+	resp := do("POST", "/auth/signup", "", `{"name": "taro", "email": "taro@example.com", "password": "correct horse"}`)
+
+	var user model.User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+	resp.Body.Close()
+
+	other, err := uc.NewUser(context.Background(), "jiro", "jiro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error", err)
+	}
+
+	tokens := "/users/" + strconv.Itoa(user.ID) + "/tokens"
+
+	if p := decodeProblem(t, do("POST", "/users/"+strconv.Itoa(other.ID)+"/tokens", "", `{"name": "cli", "scopes": ["users:read"]}`)); p.Status != http.StatusForbidden {
+		t.Fatal("tokens of other users should not be managed", p)
+	}
+
+	if p := decodeProblem(t, do("POST", tokens, "", `{"name": "cli", "scopes": ["users:admin"]}`)); p.Status != http.StatusUnprocessableEntity {
+		t.Fatal("admin scope should not be granted", p)
+	}
+
+	resp = do("POST", tokens, "", `{"name": "cli", "scopes": ["users:read"]}`)
+
+	var created struct {
+		model.PersonalToken
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(created.Secret, created.Prefix) || created.UserID != user.ID {
+		t.Fatal("token should be created with the secret", resp.StatusCode, created)
+	}
+
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Error("the secret should not be cached", cc)
+	}
+
+	resp = do("GET", "/users/"+strconv.Itoa(user.ID), created.Secret, "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("the owner should be read with the token", resp.StatusCode)
+	}
+
+	for _, path := range []string{"/users/" + strconv.Itoa(other.ID), "/users"} {
+		if p := decodeProblem(t, do("GET", path, created.Secret, "")); p.Status != http.StatusForbidden {
+			t.Fatal("tokens should only access the owner", path, p)
+		}
+	}
+
+	if p := decodeProblem(t, do("DELETE", "/users/"+strconv.Itoa(user.ID), created.Secret, "")); p.Status != http.StatusForbidden || p.Type != "/problems/forbidden" {
+		t.Fatal("scopes of the token should be enforced", p)
+	}
+
+	if p := decodeProblem(t, do("GET", tokens, created.Secret, "")); p.Status != http.StatusUnauthorized {
+		t.Fatal("tokens should not manage tokens", p)
+	}
+
+	resp = do("PATCH", tokens+"/"+strconv.Itoa(created.ID), "", `{"scopes": ["users:read", "users:delete"]}`)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("scopes should be updated", resp.StatusCode)
+	}
+
+	resp = do("GET", tokens, "", "")
+
+	var listed []*model.PersonalToken
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatal("json decoding error", err)
+	}
+	resp.Body.Close()
+
+	if len(listed) != 1 || listed[0].LastUsedAt == nil || len(listed[0].LastUsedIP) == 0 ||
+		!model.HasScope(listed[0].Scopes, model.ScopeDelete) {
+		t.Fatal("the use and the scopes should be recorded", listed)
+	}
+
+	resp = do("DELETE", tokens+"/"+strconv.Itoa(created.ID), "", "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal("token should be revoked", resp.StatusCode)
+	}
+
+	resp = do("GET", "/users/"+strconv.Itoa(user.ID), created.Secret, "")
+
+	if !strings.Contains(resp.Header.Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Error("invalid token should be notified", resp.Header)
+	}
+
+	if p := decodeProblem(t, resp); p.Status != http.StatusUnauthorized {
+		t.Fatal("revoked tokens should be rejected", p)
+	}
+
+	if p := decodeProblem(t, do("GET", tokens+"/"+strconv.Itoa(created.ID+100), "", "")); p.Status != http.StatusNotFound {
+		t.Fatal("unknown tokens should not be found", p)
+	}
+}
+
+func TestHandlerPersonalTokensWithoutAPIKeys(t *testing.T) {
+	t.Parallel()
+	uc := model.NewMemoryUserController()
+	pc := model.NewMemoryPersonalTokenController(uc)
+	server, _, client := initAllWithHandler(t, func(h *handler.Handler) {
+		h.UserController = uc
+		h.PersonalTokenController = pc
+	})
+	defer server.Close()
+
+	ctx := context.Background()
+	user, err := uc.NewUser(ctx, "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error", err)
+	}
+
+	other, err := uc.NewUser(ctx, "jiro", "jiro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error", err)
+	}
+
+	_, secret, err := pc.NewPersonalToken(ctx, user.ID, "cli", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new personal token error", err)
+	}
+
+	do := func(method, path, bearer string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, nil)
+
+		if err != nil {
+			t.Fatal("new request error", err)
+		}
+
+		if len(bearer) != 0 {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal("http request error", err)
+		}
+
+		return resp
+	}
+
+	resp := do("GET", "/users/"+strconv.Itoa(other.ID), "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("requests without credentials should not be authenticated", resp.StatusCode)
+	}
+
+	resp = do("GET", "/users/"+strconv.Itoa(user.ID), secret)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("the owner should be read with the token", resp.StatusCode)
+	}
+
+	if p := decodeProblem(t, do("GET", "/users/"+strconv.Itoa(other.ID), secret)); p.Status != http.StatusForbidden {
+		t.Fatal("tokens should only access the owner", p)
+	}
+
+	if p := decodeProblem(t, do("DELETE", "/users/"+strconv.Itoa(user.ID), secret)); p.Status != http.StatusForbidden {
+		t.Fatal("scopes of the token should be enforced", p)
+	}
+
+	if p := decodeProblem(t, do("GET", "/users/"+strconv.Itoa(user.ID), model.PersonalTokenPrefix+"unknown")); p.Status != http.StatusUnauthorized {
+		t.Fatal("unknown tokens should be rejected", p)
+	}
+}
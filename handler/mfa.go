@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultTOTPIssuer is the issuer shown in authenticator apps if Handler.TOTPIssuer is empty
+const DefaultTOTPIssuer = "users"
+
+const (
+	// mfaChallengeTTL is the time to enter a code after the password is accepted
+	mfaChallengeTTL = 5 * time.Minute
+
+	// qrCodeSize is the width and the height of QR codes in pixels
+	qrCodeSize = 256
+)
+
+// requireMFA responds 404 unless MFA is enabled
+func (h *Handler) requireMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.MFAController == nil {
+			abortWithError(c, &statusError{status: http.StatusNotFound, detail: "route is not found"})
+		}
+	}
+}
+
+// challengeMFA responds a challenge of the second step instead of completing login if the user has enabled MFA.
+// It reports whether the response has been written.
+func (h *Handler) challengeMFA(c *gin.Context, userID int) bool {
+	if h.MFAController == nil {
+		return false
+	}
+
+	ctx := c.Request.Context()
+	enabled, err := h.MFAController.MFAEnabled(ctx, userID)
+
+	if err == nil && !enabled {
+		return false
+	}
+
+	var challenge string
+	if err == nil {
+		challenge, err = h.MFAController.NewMFAChallenge(ctx, userID, mfaChallengeTTL)
+	}
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return true
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"mfa_required": true,
+		"mfa_token":    challenge,
+		"expires_in":   int(mfaChallengeTTL / time.Second),
+	})
+
+	return true
+}
+
+// loginMFA handles POST /auth/login/mfa, which completes login with a code of TOTP or a recovery code
+func (h *Handler) loginMFA(c *gin.Context) {
+	var param struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	ctx := c.Request.Context()
+	id, err := h.MFAController.CompleteMFAChallenge(ctx, param.MFAToken, param.Code)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	u, err := h.UserController.GetUser(ctx, id)
+
+	// the user may be deleted after the password is accepted
+	if err == model.ErrNoUser {
+		err = model.ErrInvalidMFAChallenge
+	}
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	if err := h.startSession(c, u.ID); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, u)
+}
+
+// enrollTOTP handles POST /me/mfa/totp, which returns a new secret as an otpauth:// URI and a QR code.
+// MFA is not enabled until the secret is confirmed.
+func (h *Handler) enrollTOTP(c *gin.Context) {
+	u := c.MustGet(userKey).(*model.User)
+
+	secret, err := h.MFAController.EnrollTOTP(c.Request.Context(), u.ID)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	issuer := h.TOTPIssuer
+	if len(issuer) == 0 {
+		issuer = DefaultTOTPIssuer
+	}
+
+	uri := model.TOTPURI(issuer, u.Email, secret)
+	image, err := qrCodePNG(uri)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": uri,
+		// []byte is encoded in base64
+		"qr_code_png": image,
+	})
+}
+
+// qrCodePNG encodes content into a QR code in PNG
+func qrCodePNG(content string) ([]byte, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+
+	if err != nil {
+		return nil, err
+	}
+
+	code, err = barcode.Scale(code, qrCodeSize, qrCodeSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bindMFACode reads the code of TOTP or a recovery code from the body
+func bindMFACode(c *gin.Context) (string, bool) {
+	var param struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return "", false
+	}
+
+	return param.Code, true
+}
+
+// confirmTOTP handles POST /me/mfa/totp/confirm, which enables MFA with the first code and returns recovery codes
+func (h *Handler) confirmTOTP(c *gin.Context) {
+	code, ok := bindMFACode(c)
+
+	if !ok {
+		return
+	}
+
+	u := c.MustGet(userKey).(*model.User)
+	codes, err := h.MFAController.ConfirmTOTP(c.Request.Context(), u.ID, code)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// disableMFA handles POST /me/mfa/disable, which requires a code so that a stolen session can not remove the factor
+func (h *Handler) disableMFA(c *gin.Context) {
+	code, ok := bindMFACode(c)
+
+	if !ok {
+		return
+	}
+
+	u := c.MustGet(userKey).(*model.User)
+	ctx := c.Request.Context()
+
+	if err := h.MFAController.VerifyMFA(ctx, u.ID, code); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	if err := h.MFAController.DisableMFA(ctx, u.ID); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
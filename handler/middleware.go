@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+const requestIDKey = "request_id"
+
+// requestID takes over X-Request-Id from clients or generates one
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-Id")
+
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+
+			id = hex.EncodeToString(b)
+		}
+
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-Id", id)
+	}
+}
+
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// queryTimeout sets the deadline of queries to the request context
+func (h *Handler) queryTimeout(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := h.QueryTimeout
+		if t, ok := h.RouteQueryTimeouts[route]; ok {
+			timeout = t
+		}
+
+		if timeout <= 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
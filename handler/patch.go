@@ -0,0 +1,466 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// Media types of patch documents accepted by PATCH
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// readOnlyFields are fields of model.User which can not be patched
+var readOnlyFields = map[string]bool{
+	"id":         true,
+	"created_at": true,
+	"updated_at": true,
+	"deleted_at": true,
+
+	"email_verified_at": true,
+}
+
+// patchConflict means the patch can not be applied to the current document
+func patchConflict(detail string) error {
+	return &statusError{status: http.StatusConflict, detail: detail}
+}
+
+// applyMergePatch applies a JSON Merge Patch defined in RFC 7396 to doc
+func applyMergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+
+	if !ok {
+		return patch
+	}
+
+	d, ok := doc.(map[string]interface{})
+
+	if !ok {
+		d = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+
+			continue
+		}
+
+		d[k] = applyMergePatch(d[k], v)
+	}
+
+	return d
+}
+
+// patchOperation is an operation of JSON Patch defined in RFC 6902
+type patchOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from"`
+
+	// Value is empty if the member is missing, and "null" for null
+	Value json.RawMessage `json:"value"`
+}
+
+// parseJSONPatch decodes a JSON Patch document and checks the required members
+func parseJSONPatch(b []byte) ([]patchOperation, error) {
+	var ops []patchOperation
+
+	if err := json.Unmarshal(b, &ops); err != nil {
+		return nil, badRequest("malformed json patch: " + err.Error())
+	}
+
+	for i, op := range ops {
+		prefix := "operation " + strconv.Itoa(i) + ": "
+
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, badRequest(prefix + "value is required")
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, badRequest(prefix + "from is " + err.Error())
+			}
+		case "remove":
+		default:
+			return nil, badRequest(prefix + "unknown op " + strconv.Quote(op.Op))
+		}
+
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, badRequest(prefix + "path is " + err.Error())
+		}
+	}
+
+	return ops, nil
+}
+
+// applyJSONPatch applies operations in order. Nothing is applied if any operation fails.
+func applyJSONPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		doc, err = applyOperation(doc, op)
+
+		if err != nil {
+			return nil, patchConflict("operation " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+
+	var value interface{}
+	if len(op.Value) != 0 {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+
+		return doc, err
+	case "replace":
+		doc, _, err := removeValue(doc, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addValue(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+
+		if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+			return nil, &pointerError{"a location can not be moved into its child"}
+		}
+
+		doc, moved, err := removeValue(doc, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addValue(doc, path, moved)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		copied, err := getValue(doc, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// values must not be shared between locations
+		b, err := json.Marshal(copied)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var cloned interface{}
+		if err := json.Unmarshal(b, &cloned); err != nil {
+			return nil, err
+		}
+
+		return addValue(doc, path, cloned)
+	default: // test
+		actual, err := getValue(doc, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// numbers are decoded as float64 on both sides
+		if !reflect.DeepEqual(actual, value) {
+			return nil, &pointerError{"test failed at " + strconv.Quote(op.Path)}
+		}
+
+		return doc, nil
+	}
+}
+
+// pointerError is an error while evaluating JSON Pointers
+type pointerError struct {
+	message string
+}
+
+func (e *pointerError) Error() string {
+	return e.message
+}
+
+// parsePointer splits a JSON Pointer defined in RFC 6901 into reference tokens
+func parsePointer(s string) ([]string, error) {
+	if len(s) == 0 {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(s, "/") {
+		return nil, &pointerError{"not a json pointer: " + strconv.Quote(s)}
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses a reference token for an array of size n.
+// "-" is allowed only if end is true, and means n.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+
+	i, err := strconv.Atoi(token)
+
+	max := n - 1
+	if end {
+		max = n
+	}
+
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, &pointerError{"invalid array index " + strconv.Quote(token)}
+	}
+
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+
+			if !ok {
+				return nil, &pointerError{"member " + strconv.Quote(token) + " is not found"}
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, &pointerError{"a scalar value can not be referenced by " + strconv.Quote(token)}
+		}
+	}
+
+	return doc, nil
+}
+
+// addValue returns doc with value added at path.
+// Arrays may be reallocated, so the result must be used instead of doc.
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, rest := path[0], path[1:]
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			d[token] = value
+
+			return d, nil
+		}
+
+		child, ok := d[token]
+
+		if !ok {
+			return nil, &pointerError{"member " + strconv.Quote(token) + " is not found"}
+		}
+
+		v, err := addValue(child, rest, value)
+
+		if err != nil {
+			return nil, err
+		}
+		d[token] = v
+
+		return d, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(d), len(rest) == 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rest) == 0 {
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = value
+
+			return d, nil
+		}
+
+		v, err := addValue(d[i], rest, value)
+
+		if err != nil {
+			return nil, err
+		}
+		d[i] = v
+
+		return d, nil
+	}
+
+	return nil, &pointerError{"a scalar value can not be referenced by " + strconv.Quote(token)}
+}
+
+// removeValue returns doc without the value at path and the removed value
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, &pointerError{"the whole document can not be removed"}
+	}
+	token, rest := path[0], path[1:]
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+
+		if !ok {
+			return nil, nil, &pointerError{"member " + strconv.Quote(token) + " is not found"}
+		}
+
+		if len(rest) == 0 {
+			delete(d, token)
+
+			return d, child, nil
+		}
+
+		v, removed, err := removeValue(child, rest)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		d[token] = v
+
+		return d, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(d), false)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(rest) == 0 {
+			removed := d[i]
+
+			return append(d[:i], d[i+1:]...), removed, nil
+		}
+
+		v, removed, err := removeValue(d[i], rest)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		d[i] = v
+
+		return d, removed, nil
+	}
+
+	return nil, nil, &pointerError{"a scalar value can not be referenced by " + strconv.Quote(token)}
+}
+
+// userDocument converts u into the generic JSON representation patches are applied to
+func userDocument(u *model.User) (map[string]interface{}, error) {
+	b, err := json.Marshal(u)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// userPatch compares the patched document with the original one and
+// returns the changes, or *model.ValidationError if the changes are not allowed
+func userPatch(original map[string]interface{}, patched interface{}) (model.UserPatch, error) {
+	var p model.UserPatch
+
+	doc, ok := patched.(map[string]interface{})
+
+	if !ok {
+		return p, &model.ValidationError{Message: "patched user must be a JSON object"}
+	}
+
+	var fields []model.FieldError
+
+	for _, name := range []string{"name", "email"} {
+		v, ok := doc[name]
+
+		if !ok {
+			fields = append(fields, model.FieldError{Field: name, Reason: "required"})
+
+			continue
+		}
+
+		s, ok := v.(string)
+
+		if !ok {
+			fields = append(fields, model.FieldError{Field: name, Reason: "must be a string"})
+
+			continue
+		}
+
+		if s == original[name] {
+			continue
+		}
+
+		if name == "name" {
+			p.Name = &s
+		} else {
+			p.Email = &s
+		}
+	}
+
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	for k := range original {
+		if _, ok := doc[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch {
+		case k == "name" || k == "email":
+		case readOnlyFields[k]:
+			if !reflect.DeepEqual(original[k], doc[k]) {
+				fields = append(fields, model.FieldError{Field: k, Reason: "read-only"})
+			}
+		default:
+			fields = append(fields, model.FieldError{Field: k, Reason: "unknown"})
+		}
+	}
+
+	if len(fields) != 0 {
+		return p, &model.ValidationError{Message: "patch is invalid", Fields: fields}
+	}
+
+	return p, nil
+}
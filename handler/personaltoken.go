@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/gin-gonic/gin"
+)
+
+// personalTokenKey is the key of the authenticated *model.PersonalToken in gin.Context
+const personalTokenKey = "personal_token"
+
+// requirePersonalTokens responds 404 unless personal tokens are enabled
+func (h *Handler) requirePersonalTokens() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.PersonalTokenController == nil {
+			abortWithError(c, &statusError{status: http.StatusNotFound, detail: "route is not found"})
+		}
+	}
+}
+
+// requireSelf rejects requests to :id other than the signed-in user
+func requireSelf() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := parseID(c)
+
+		if err != nil {
+			abortWithError(c, err)
+
+			return
+		}
+
+		if u := c.MustGet(userKey).(*model.User); u.ID != id {
+			abortWithError(c, &statusError{status: http.StatusForbidden, detail: "personal tokens of other users can not be managed"})
+		}
+	}
+}
+
+// parseTokenID parses :token_id in the path
+func parseTokenID(c *gin.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("token_id"))
+
+	if err != nil {
+		return 0, invalidParam("token_id", err)
+	}
+
+	return id, nil
+}
+
+// authenticatePersonalToken authenticates the secret of a personal token as its owner.
+// Personal tokens act as the owner, so only routes of the owner such as /users/:id are allowed.
+func (h *Handler) authenticatePersonalToken(c *gin.Context, secret string) {
+	ctx := c.Request.Context()
+	pt, err := h.PersonalTokenController.AuthenticatePersonalToken(ctx, secret, c.ClientIP())
+
+	if err != nil {
+		unauthorized(c, err)
+
+		return
+	}
+
+	u, err := h.UserController.GetUser(ctx, pt.UserID)
+
+	// tokens of deleted users are left until the users are restored
+	if err == model.ErrNoUser {
+		unauthorized(c, model.ErrInvalidPersonalToken)
+
+		return
+	}
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	if id, err := strconv.Atoi(c.Param("id")); err != nil || id != u.ID {
+		abortWithError(c, &statusError{status: http.StatusForbidden, detail: "personal tokens can only access the user who owns them"})
+
+		return
+	}
+
+	c.Set(personalTokenKey, pt)
+	c.Set(scopesKey, pt.Scopes)
+	c.Set(userKey, u)
+	setUserID(c, u.ID)
+}
+
+// respondPersonalToken responds the token with the secret, which is shown only on creation
+func respondPersonalToken(c *gin.Context, pt *model.PersonalToken, secret string) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, struct {
+		*model.PersonalToken
+		Secret string `json:"secret"`
+	}{pt, secret})
+}
+
+// createPersonalToken handles POST /users/:id/tokens
+func (h *Handler) createPersonalToken(c *gin.Context) {
+	var param struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	u := c.MustGet(userKey).(*model.User)
+	pt, secret, err := h.PersonalTokenController.NewPersonalToken(c.Request.Context(), u.ID, param.Name, param.Scopes, param.ExpiresAt)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	respondPersonalToken(c, pt, secret)
+}
+
+// listPersonalTokens handles GET /users/:id/tokens
+func (h *Handler) listPersonalTokens(c *gin.Context) {
+	u := c.MustGet(userKey).(*model.User)
+	tokens, err := h.PersonalTokenController.ListPersonalTokens(c.Request.Context(), u.ID)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// getPersonalToken handles GET /users/:id/tokens/:token_id
+func (h *Handler) getPersonalToken(c *gin.Context) {
+	id, err := parseTokenID(c)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	u := c.MustGet(userKey).(*model.User)
+	pt, err := h.PersonalTokenController.GetPersonalToken(c.Request.Context(), u.ID, id)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, pt)
+}
+
+// updatePersonalToken handles PATCH /users/:id/tokens/:token_id, which renames the token or changes the scopes
+func (h *Handler) updatePersonalToken(c *gin.Context) {
+	id, err := parseTokenID(c)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	var param struct {
+		Name   *string  `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	u := c.MustGet(userKey).(*model.User)
+	pt, err := h.PersonalTokenController.UpdatePersonalToken(c.Request.Context(), u.ID, id, model.PersonalTokenPatch{
+		Name:   param.Name,
+		Scopes: param.Scopes,
+	})
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, pt)
+}
+
+// revokePersonalToken handles DELETE /users/:id/tokens/:token_id.
+// Revoked tokens are still listed with revoked_at.
+func (h *Handler) revokePersonalToken(c *gin.Context) {
+	id, err := parseTokenID(c)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	u := c.MustGet(userKey).(*model.User)
+	if err := h.PersonalTokenController.RevokePersonalToken(c.Request.Context(), u.ID, id); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
+	"github.com/gin-gonic/gin"
+)
+
+// Types of problems relative to the API root
+const (
+	problemBadRequest   = "/problems/bad-request"
+	problemUnauthorized = "/problems/unauthorized"
+	problemForbidden    = "/problems/forbidden"
+	problemNotFound     = "/problems/not-found"
+	problemConflict     = "/problems/conflict"
+	problemMediaType    = "/problems/unsupported-media-type"
+	problemPrecondition = "/problems/precondition-failed"
+	problemRolledBack   = "/problems/rolled-back"
+	problemValidation   = "/problems/validation-error"
+	problemTooMany      = "/problems/too-many-requests"
+	problemTimeout      = "/problems/timeout"
+	problemInternal     = "/problems/internal-error"
+)
+
+// Problem is a problem details object defined in RFC 7807
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Extensions are additional members of the problem
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON flattens extension members into the problem object
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+
+	b, err := json.Marshal((*problem)(p))
+
+	if err != nil || len(p.Extensions) == 0 {
+		return b, err
+	}
+
+	members := map[string]interface{}{}
+	if err := json.Unmarshal(b, &members); err != nil {
+		return nil, err
+	}
+
+	for k, v := range p.Extensions {
+		if _, ok := members[k]; !ok {
+			members[k] = v
+		}
+	}
+
+	return json.Marshal(members)
+}
+
+// statusError is an error detected in the handler with its status code
+type statusError struct {
+	status int
+	detail string
+
+	// param is the name of the invalid parameter if any
+	param string
+	cause error
+}
+
+func (e *statusError) Error() string {
+	return e.detail
+}
+
+func badRequest(detail string) error {
+	return &statusError{status: http.StatusBadRequest, detail: detail}
+}
+
+func invalidParam(param string, cause error) error {
+	detail := "invalid " + param
+	if qerr, ok := cause.(*model.QueryError); ok {
+		detail += ": " + qerr.Message
+	}
+
+	return &statusError{status: http.StatusBadRequest, detail: detail, param: param, cause: cause}
+}
+
+// newProblem maps an error to a problem. All errors responded to clients are mapped here.
+func newProblem(c *gin.Context, err error) *Problem {
+	p := &Problem{
+		Instance:  requestURI(c),
+		RequestID: c.GetString(requestIDKey),
+	}
+
+	switch e := err.(type) {
+	case *statusError:
+		p.Status = e.status
+		switch e.status {
+		case http.StatusUnauthorized:
+			p.Type = problemUnauthorized
+		case http.StatusForbidden:
+			p.Type = problemForbidden
+		case http.StatusNotFound:
+			p.Type = problemNotFound
+		case http.StatusConflict:
+			p.Type = problemConflict
+		case http.StatusUnsupportedMediaType:
+			p.Type = problemMediaType
+		case http.StatusPreconditionRequired:
+			p.Type = problemPrecondition
+		case http.StatusFailedDependency:
+			p.Type = problemRolledBack
+		default:
+			p.Type = problemBadRequest
+		}
+		p.Detail = e.detail
+
+		if len(e.param) != 0 {
+			p.Extensions = map[string]interface{}{"param": e.param}
+
+			if qerr, ok := e.cause.(*model.QueryError); ok {
+				p.Extensions["position"] = qerr.Pos
+			}
+		}
+	case *scopeError:
+		p.Status = http.StatusForbidden
+		p.Type = problemForbidden
+		p.Detail = e.Error()
+		p.Extensions = map[string]interface{}{"scope": e.scope}
+	case *model.NotFoundError:
+		p.Status = http.StatusNotFound
+		p.Type = problemNotFound
+		p.Detail = e.Message
+	case *model.ConflictError:
+		p.Status = http.StatusConflict
+		p.Type = problemConflict
+		p.Detail = e.Message
+
+		if e.ExistingID != 0 {
+			p.Extensions = map[string]interface{}{"existing_id": e.ExistingID}
+		}
+	case *model.ValidationError:
+		p.Status = http.StatusUnprocessableEntity
+		p.Type = problemValidation
+		p.Detail = e.Message
+		p.Extensions = map[string]interface{}{"errors": e.Fields}
+	default:
+		switch {
+		case err == model.ErrPreconditionFailed:
+			p.Status = http.StatusPreconditionFailed
+			p.Type = problemPrecondition
+			p.Detail = err.Error()
+		case err == model.ErrInvalidAPIKey, err == model.ErrInvalidPersonalToken, err == model.ErrInvalidCredentials, err == model.ErrInvalidSession,
+			err == model.ErrInvalidRefreshToken, err == model.ErrRefreshTokenReused, err == token.ErrInvalidToken,
+			err == model.ErrInvalidMFACode, err == model.ErrInvalidMFAChallenge:
+			p.Status = http.StatusUnauthorized
+			p.Type = problemUnauthorized
+			p.Detail = err.Error()
+		case err == model.ErrMFALocked:
+			p.Status = http.StatusTooManyRequests
+			p.Type = problemTooMany
+			p.Detail = err.Error()
+		case err == model.ErrInvalidOneTimeToken:
+			p.Status = http.StatusBadRequest
+			p.Type = problemBadRequest
+			p.Detail = err.Error()
+			p.Extensions = map[string]interface{}{"param": "token"}
+		case err == model.ErrInvalidCursor:
+			p.Status = http.StatusBadRequest
+			p.Type = problemBadRequest
+			p.Detail = err.Error()
+			p.Extensions = map[string]interface{}{"param": "cursor"}
+		case c.Request.Context().Err() == context.DeadlineExceeded:
+			p.Status = http.StatusGatewayTimeout
+			p.Type = problemTimeout
+			p.Detail = "query timed out"
+		default:
+			// details of unexpected errors must not be leaked
+			p.Status = http.StatusInternalServerError
+			p.Type = problemInternal
+		}
+	}
+
+	p.Title = http.StatusText(p.Status)
+
+	return p
+}
+
+// abortWithError responds err as application/problem+json
+func abortWithError(c *gin.Context, err error) {
+	p := newProblem(c, err)
+
+	if p.Status >= http.StatusInternalServerError {
+		c.Error(err)
+	}
+
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(p.Status, p)
+}
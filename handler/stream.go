@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/userio"
+	"github.com/gin-gonic/gin"
+)
+
+// ndjsonType is the media type of GET /users streaming users as NDJSON
+const ndjsonType = "application/x-ndjson"
+
+// streamRequested tells whether GET /users streams users as NDJSON or a JSON array.
+// A malformed stream parameter is reported by the handler instead.
+func streamRequested(c *gin.Context) bool {
+	if c.NegotiateFormat(gin.MIMEJSON, ndjsonType) == ndjsonType {
+		return true
+	}
+
+	stream, _ := strconv.ParseBool(c.Query("stream"))
+
+	return stream
+}
+
+// exceptStreams skips mw on streams, which take time in proportion to the number of users as exports.
+// A deadline would cut them short after the status has been sent.
+func exceptStreams(mw gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if streamRequested(c) {
+			return
+		}
+
+		mw(c)
+	}
+}
+
+// streamUsers writes users listed by opts as a JSON array without buffering them.
+// The array is left unterminated if the listing fails on the way.
+func (h *Handler) streamUsers(c *gin.Context, opts model.ListOptions) {
+	w := c.Writer
+	n := 0
+
+	err := h.UserController.EachUser(c.Request.Context(), opts, func(u *model.User) error {
+		b, err := json.Marshal(u)
+
+		if err != nil {
+			return err
+		}
+
+		sep := ","
+		if n == 0 {
+			c.Header("Content-Type", gin.MIMEJSON+"; charset=utf-8")
+			sep = "["
+		}
+
+		if _, err := w.WriteString(sep); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+
+		if n++; n%userio.FlushInterval == 0 {
+			w.Flush()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		abortStream(c, err)
+
+		return
+	}
+
+	if n == 0 {
+		c.JSON(http.StatusOK, []*model.User{})
+
+		return
+	}
+
+	w.WriteString("]")
+}
+
+// abortStream responds err if nothing has been written yet.
+// Otherwise the response is only cut short since the status has been sent.
+func abortStream(c *gin.Context, err error) {
+	if c.Writer.Written() {
+		c.Error(err)
+		c.Abort()
+
+		return
+	}
+
+	c.Writer.Header().Del("Content-Disposition")
+	abortWithError(c, err)
+}
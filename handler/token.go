@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DefaultAccessTokenTTL is the lifetime of access tokens if Handler.AccessTokenTTL is zero
+	DefaultAccessTokenTTL = 15 * time.Minute
+
+	// DefaultRefreshTokenTTL is the lifetime of refresh tokens if Handler.RefreshTokenTTL is zero
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Grant types of POST /auth/token
+const (
+	grantPassword     = "password"
+	grantRefreshToken = "refresh_token"
+	grantMFA          = "mfa"
+)
+
+// userIDContextKey is the key of the id of the authenticated user in request contexts
+type userIDContextKey struct{}
+
+// UserIDFromContext returns the id of the user authenticated with an access token or a session
+func UserIDFromContext(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(userIDContextKey{}).(int)
+
+	return id, ok
+}
+
+// setUserID puts the id of the authenticated user into the request context
+func setUserID(c *gin.Context, id int) {
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), userIDContextKey{}, id))
+}
+
+// requireTokens responds 404 unless access tokens are enabled
+func (h *Handler) requireTokens() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.TokenKeys == nil || h.RefreshTokenController == nil || h.CredentialController == nil {
+			abortWithError(c, &statusError{status: http.StatusNotFound, detail: "route is not found"})
+		}
+	}
+}
+
+func (h *Handler) accessTokenTTL() time.Duration {
+	if h.AccessTokenTTL > 0 {
+		return h.AccessTokenTTL
+	}
+
+	return DefaultAccessTokenTTL
+}
+
+func (h *Handler) refreshTokenTTL() time.Duration {
+	if h.RefreshTokenTTL > 0 {
+		return h.RefreshTokenTTL
+	}
+
+	return DefaultRefreshTokenTTL
+}
+
+// authenticateToken rejects requests without a valid access token in Authorization: Bearer,
+// and puts the subject user id into the request context
+func (h *Handler) authenticateToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw, ok := bearerCredential(c)
+
+		if !ok {
+			unauthorized(c, &statusError{status: http.StatusUnauthorized, detail: "access token is required"})
+
+			return
+		}
+
+		claims, err := h.TokenKeys.Verify(c.Request.Context(), raw)
+
+		if err != nil {
+			unauthorized(c, err)
+
+			return
+		}
+
+		id, err := strconv.Atoi(claims.Subject)
+
+		if err != nil {
+			unauthorized(c, token.ErrInvalidToken)
+
+			return
+		}
+
+		setUserID(c, id)
+	}
+}
+
+// issueTokens handles POST /auth/token, which exchanges a password or a refresh token for tokens.
+// Refresh tokens are rotated on each use.
+func (h *Handler) issueTokens(c *gin.Context) {
+	var param struct {
+		GrantType    string `json:"grant_type"`
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		RefreshToken string `json:"refresh_token"`
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	var (
+		rt      *model.RefreshToken
+		refresh string
+		err     error
+	)
+	switch param.GrantType {
+	case grantPassword:
+		var u *model.User
+		u, err = h.CredentialController.Login(ctx, param.Email, param.Password)
+
+		if err == nil && h.challengeMFA(c, u.ID) {
+			return
+		}
+
+		if err == nil {
+			rt, refresh, err = h.RefreshTokenController.NewRefreshToken(ctx, u.ID, h.refreshTokenTTL())
+		}
+	case grantRefreshToken:
+		rt, refresh, err = h.RefreshTokenController.RotateRefreshToken(ctx, param.RefreshToken, h.refreshTokenTTL())
+
+		if err == nil {
+			err = h.checkTokenOwner(ctx, rt, refresh)
+		}
+	case grantMFA:
+		if h.MFAController == nil {
+			err = unsupportedGrant()
+
+			break
+		}
+
+		var id int
+		id, err = h.MFAController.CompleteMFAChallenge(ctx, param.MFAToken, param.Code)
+
+		if err == nil {
+			rt, refresh, err = h.RefreshTokenController.NewRefreshToken(ctx, id, h.refreshTokenTTL())
+		}
+
+		if err == nil {
+			err = h.checkTokenOwner(ctx, rt, refresh)
+		}
+	default:
+		err = unsupportedGrant()
+	}
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	now := time.Now()
+	jti := make([]byte, 16)
+	rand.Read(jti)
+
+	access, err := h.TokenKeys.Sign(ctx, &token.Claims{
+		Subject:   strconv.Itoa(rt.UserID),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(h.accessTokenTTL()).Unix(),
+		ID:        hex.EncodeToString(jti),
+	})
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	// tokens must not be cached as RFC 6749
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(h.accessTokenTTL() / time.Second),
+		"refresh_token": refresh,
+	})
+}
+
+func unsupportedGrant() error {
+	return &statusError{
+		status: http.StatusBadRequest,
+		detail: "grant_type must be " + grantPassword + ", " + grantRefreshToken + " or " + grantMFA,
+		param:  "grant_type",
+	}
+}
+
+// checkTokenOwner revokes the family of the refresh token if the user has been deleted
+func (h *Handler) checkTokenOwner(ctx context.Context, rt *model.RefreshToken, refresh string) error {
+	_, err := h.UserController.GetUser(ctx, rt.UserID)
+
+	if err != model.ErrNoUser {
+		return err
+	}
+
+	if err := h.RefreshTokenController.RevokeRefreshToken(ctx, refresh); err != nil {
+		return err
+	}
+
+	return model.ErrInvalidRefreshToken
+}
+
+// revokeTokens handles POST /auth/revoke, which revokes the family of the refresh token
+func (h *Handler) revokeTokens(c *gin.Context) {
+	var param struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.ShouldBindJSON(&param); err != nil {
+		abortWithError(c, badRequest("malformed json: "+err.Error()))
+
+		return
+	}
+
+	if err := h.RefreshTokenController.RevokeRefreshToken(c.Request.Context(), param.RefreshToken); err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// jwks handles GET /.well-known/jwks.json
+func (h *Handler) jwks(c *gin.Context) {
+	set, err := h.TokenKeys.JWKS(c.Request.Context())
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	// verifiers may cache keys shorter than the interval of rotation
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
+}
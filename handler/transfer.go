@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/userio"
+	"github.com/gin-gonic/gin"
+)
+
+// importFailure is a row which was not imported
+type importFailure struct {
+	Row     int      `json:"row"`
+	Problem *Problem `json:"problem"`
+}
+
+// exportUsers handles GET /users/export.
+// Users are streamed, so errors after the first flush only cut the response short.
+func (h *Handler) exportUsers(c *gin.Context) {
+	format := userio.CSV
+	if f := c.Query("format"); len(f) != 0 {
+		var err error
+		format, err = userio.ParseFormat(f)
+
+		if err != nil {
+			abortWithError(c, invalidParam("format", err))
+
+			return
+		}
+	}
+
+	opts, err := parseListOptions(c)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	c.Header("Content-Type", format.ContentType())
+	c.Header("Content-Disposition", `attachment; filename="users.`+string(format)+`"`)
+
+	if err := userio.Export(c.Request.Context(), h.UserController, c.Writer, format, opts); err != nil {
+		abortStream(c, err)
+	}
+}
+
+// importUsers handles POST /users/import.
+// The format is specified by the format parameter or Content-Type.
+func (h *Handler) importUsers(c *gin.Context) {
+	var (
+		format userio.Format
+		err    error
+	)
+	if f := c.Query("format"); len(f) != 0 {
+		format, err = userio.ParseFormat(f)
+
+		if err != nil {
+			abortWithError(c, invalidParam("format", err))
+
+			return
+		}
+	} else {
+		var ok bool
+		format, ok = userio.FormatOf(c.ContentType())
+
+		if !ok {
+			abortWithError(c, &statusError{status: http.StatusUnsupportedMediaType, detail: "Content-Type must be text/csv or application/x-ndjson"})
+
+			return
+		}
+	}
+
+	opts := userio.ImportOptions{}
+
+	opts.Mapping, err = userio.ParseMapping(c.Query("mapping"))
+
+	if err != nil {
+		abortWithError(c, &statusError{status: http.StatusBadRequest, detail: "invalid mapping: " + err.Error(), param: "mapping"})
+
+		return
+	}
+
+	if d := c.Query("dry_run"); len(d) != 0 {
+		opts.DryRun, err = strconv.ParseBool(d)
+
+		if err != nil {
+			abortWithError(c, invalidParam("dry_run", err))
+
+			return
+		}
+	}
+
+	report, err := userio.Import(c.Request.Context(), h.UserController, c.Request.Body, format, opts)
+
+	if err != nil {
+		abortWithError(c, err)
+
+		return
+	}
+
+	failures := make([]importFailure, len(report.Failures))
+	for i, f := range report.Failures {
+		failures[i] = importFailure{Row: f.Row, Problem: newProblem(c, f.Err)}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":  opts.DryRun,
+		"rows":     report.Rows,
+		"imported": report.Imported,
+		"failures": failures,
+	})
+}
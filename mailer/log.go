@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// LogMailer writes messages to a writer instead of sending them, and keeps them so that tests can inspect them.
+// It is safe for concurrent use.
+type LogMailer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+	sent []Message
+}
+
+// NewLogMailer creates a mailer writing messages from the sender to w. w may be nil to only keep them.
+func NewLogMailer(w io.Writer, from string) *LogMailer {
+	return &LogMailer{w: w, from: from}
+}
+
+// Send writes msg in a readable form. Messages rejected by SMTPMailer are rejected as well.
+func (m *LogMailer) Send(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	if _, _, _, err := msg.encode(m.from, now); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, *msg)
+
+	if m.w == nil {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(m.w, "--- %s\nFrom: %s\nTo: %s\nSubject: %s\n\n%s\n", now.Format(time.RFC3339), m.from, msg.To, msg.Subject, msg.Body)
+
+	return err
+}
+
+// Sent returns the messages sent so far in order
+func (m *LogMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.sent...)
+}
@@ -0,0 +1,64 @@
+// Package mailer sends emails to users over SMTP, or writes them to a log for local development
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMessage means an address or the subject can not be put in headers
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Message is a plain text email
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// encode returns the addresses of the sender and the recipient, and the message in RFC 5322
+func (msg *Message) encode(from string, date time.Time) (string, string, []byte, error) {
+	sender, err := mail.ParseAddress(from)
+
+	if err != nil {
+		return "", "", nil, ErrInvalidMessage
+	}
+
+	recipient, err := mail.ParseAddress(msg.To)
+
+	if err != nil {
+		return "", "", nil, ErrInvalidMessage
+	}
+
+	// line breaks would inject headers
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return "", "", nil, ErrInvalidMessage
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("From: " + sender.String() + "\r\n")
+	buf.WriteString("To: " + recipient.String() + "\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	buf.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(strings.Replace(msg.Body, "\n", "\r\n", -1)))
+	w.Close()
+
+	return sender.Address, recipient.Address, buf.Bytes(), nil
+}
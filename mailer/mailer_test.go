@@ -0,0 +1,157 @@
+package mailer_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/mailer"
+)
+
+// serveSMTP accepts a connection and returns the envelope and the data of the message received
+func serveSMTP(l net.Listener) <-chan []string {
+	ch := make(chan []string, 1)
+
+	go func() {
+		defer close(ch)
+
+		conn, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) {
+			conn.Write([]byte(s + "\r\n"))
+		}
+
+		var received []string
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT":
+				received = append(received, line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+
+				var data []string
+				for {
+					l, err := r.ReadString('\n')
+
+					if err != nil {
+						return
+					}
+
+					if l == ".\r\n" {
+						break
+					}
+					data = append(data, l)
+				}
+				received = append(received, strings.Join(data, ""))
+				reply("250 OK")
+			case "QUIT":
+				reply("221 bye")
+				ch <- received
+
+				return
+			default:
+				reply("502 unknown")
+			}
+		}
+	}()
+
+	return ch
+}
+
+func TestSMTPMailer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("listen error", err)
+	}
+	defer l.Close()
+
+	ch := serveSMTP(l)
+	m := mailer.NewSMTPMailer(l.Addr().String(), "Users <noreply@example.com>", "", "")
+
+	err = m.Send(context.Background(), &mailer.Message{To: "taro@example.com", Subject: "パスワードの再設定", Body: "Open the link\nhttps://example.com/?token=a=b"})
+
+	if err != nil {
+		t.Fatal("send error", err)
+	}
+
+	received := <-ch
+
+	if len(received) != 3 || received[0] != "MAIL FROM:<noreply@example.com>" || received[1] != "RCPT TO:<taro@example.com>" {
+		t.Fatal("envelope is incorrect", received)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(received[2]))
+
+	if err != nil {
+		t.Fatal("message is malformed", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+
+	if err != nil || subject != "パスワードの再設定" || msg.Header.Get("To") != "<taro@example.com>" {
+		t.Error("headers are incorrect", msg.Header)
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+
+	if err != nil {
+		t.Fatal("body is malformed", err)
+	}
+
+	if strings.TrimRight(string(body), "\r\n") != "Open the link\r\nhttps://example.com/?token=a=b" {
+		t.Errorf("body is incorrect: %q", body)
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	var buf bytes.Buffer
+	m := mailer.NewLogMailer(&buf, "noreply@example.com")
+	ctx := context.Background()
+
+	if err := m.Send(ctx, &mailer.Message{To: "taro@example.com", Subject: "Hello", Body: "body"}); err != nil {
+		t.Fatal("send error", err)
+	}
+
+	if err := m.Send(ctx, &mailer.Message{To: "taro@example.com", Subject: "Hello\r\nBcc: jiro@example.com"}); err != mailer.ErrInvalidMessage {
+		t.Error("line breaks in subjects should be rejected", err)
+	}
+
+	if err := m.Send(ctx, &mailer.Message{To: "not an address"}); err != mailer.ErrInvalidMessage {
+		t.Error("malformed addresses should be rejected", err)
+	}
+
+	sent := m.Sent()
+
+	if len(sent) != 1 || sent[0].To != "taro@example.com" || sent[0].Body != "body" {
+		t.Error("sent messages should be kept", sent)
+	}
+
+	if !strings.Contains(buf.String(), "To: taro@example.com\nSubject: Hello\n\nbody\n") {
+		t.Error("messages should be written", buf.String())
+	}
+}
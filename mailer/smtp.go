@@ -0,0 +1,100 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends messages to an SMTP server
+type SMTPMailer struct {
+	// Addr is the host and the port of the server
+	Addr string
+
+	// From is the sender of messages such as "Users <noreply@example.com>"
+	From string
+
+	// Auth authenticates the client. Messages are sent without authentication if it is nil.
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer authenticating with PLAIN if username is not empty
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+
+	if len(username) != 0 {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m
+}
+
+// Send delivers msg in a connection. STARTTLS is used if the server supports it,
+// and the deadline of ctx applies to the whole conversation.
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	from, to, data, err := msg.encode(m.From, time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(m.Addr)
+	c, err := smtp.NewClient(conn, host)
+
+	if err != nil {
+		conn.Close()
+
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if m.Auth != nil {
+		if err := c.Auth(m.Auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
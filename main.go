@@ -1,25 +1,62 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/cs3238-tsuzu/coding_challenge_03/handler"
+	"github.com/cs3238-tsuzu/coding_challenge_03/mailer"
+	"github.com/cs3238-tsuzu/coding_challenge_03/migrations"
 	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
+	"github.com/cs3238-tsuzu/coding_challenge_03/userio"
 	_ "github.com/lib/pq"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
-	migrate = flag.Bool("migrate", false, "execute migration")
-	dsn     = flag.String("db", "", "data source name")
-	help    = flag.Bool("help", false, "Show usage")
+	migrate                = flag.String("migrate", "", "execute migration: up [N], down N, status or redo (servers start only after up)")
+	dsn                    = flag.String("db", "", "data source name")
+	store                  = flag.String("store", "postgres", "user store: postgres or memory (users are lost on exit)")
+	timeout                = flag.Duration("query-timeout", 10*time.Second, "deadline of queries in a request (0 means no deadline)")
+	retention              = flag.Duration("purge-retention", 30*24*time.Hour, "period to keep deleted users before purging them (0 disables purging)")
+	purgeInterval          = flag.Duration("purge-interval", time.Hour, "interval of purging deleted users")
+	requireIfMatch         = flag.Bool("require-if-match", false, "reject updates and deletions of users without If-Match")
+	apiKey                 = flag.String("api-key", "", "manage api keys: create NAME, list or revoke ID")
+	apiKeyExpiresIn        = flag.Duration("api-key-expires-in", 0, "validity of created api keys (0 means no expiry)")
+	apiKeyScopes           = flag.String("api-key-scopes", model.ScopeRead, "comma-separated scopes of created api keys")
+	sessionTTL             = flag.Duration("session-ttl", handler.DefaultSessionTTL, "lifetime of sessions of signed-in users")
+	secureCookies          = flag.Bool("secure-cookies", false, "send session cookies only over HTTPS")
+	totpIssuer             = flag.String("totp-issuer", handler.DefaultTOTPIssuer, "issuer shown in authenticator apps for TOTP")
+	smtpAddr               = flag.String("smtp-addr", "", "host:port of the SMTP server sending password resets and email verifications")
+	smtpUsername           = flag.String("smtp-username", "", "username of the SMTP server (the password is read from SMTP_PASSWORD)")
+	mailFrom               = flag.String("mail-from", "noreply@localhost", "sender of emails")
+	mailLog                = flag.String("mail-log", "", "write emails to the file (- for stdout) instead of sending them")
+	linkBaseURL            = flag.String("link-base-url", "http://localhost:8080", "URL of the frontend linked from emails")
+	jwtAlgorithm           = flag.String("jwt-algorithm", token.RS256, "algorithm of keys signing access tokens: RS256 or EdDSA (Go 1.13 or later)")
+	accessTokenTTL         = flag.Duration("access-token-ttl", handler.DefaultAccessTokenTTL, "lifetime of access tokens")
+	refreshTokenTTL        = flag.Duration("refresh-token-ttl", handler.DefaultRefreshTokenTTL, "lifetime of refresh tokens")
+	rotateSigningKey       = flag.Bool("rotate-signing-key", false, "generate a key signing access tokens and purge expired ones instead of starting the server")
+	exportPath             = flag.String("export", "", "write users to the file (- for stdout) instead of starting the server")
+	importPath             = flag.String("import", "", "create users from the file (- for stdin) instead of starting the server")
+	format                 = flag.String("format", "csv", "format of export and import: csv or ndjson")
+	importMapping          = flag.String("import-mapping", "", "columns of fields on import such as \"Full Name:name,Mail:email\"")
+	importDryRun           = flag.Bool("import-dry-run", false, "report the result of import without creating users")
+	caseSensitiveLocalPart = flag.Bool("email-case-sensitive-local-part", false, "distinguish cases of local parts when emails are checked for uniqueness")
+	emailNFC               = flag.Bool("email-nfc", false, "normalize emails to Unicode NFC when they are checked for uniqueness")
+	help                   = flag.Bool("help", false, "Show usage")
 )
 
 func main() {
@@ -38,28 +75,159 @@ func main() {
 		dsn = dsnEnv
 	}
 
-	db, err := sql.Open("postgres", dsn)
+	var (
+		db          model.DB
+		uc          model.UserController
+		apiKeys     model.APIKeyController
+		credentials model.CredentialController
+		sessions    model.SessionController
+		signingKeys model.SigningKeyController
+		refresh     model.RefreshTokenController
+		mfa         model.MFAController
+		tokens      model.OneTimeTokenController
+		personal    model.PersonalTokenController
+	)
+
+	policy := model.EmailPolicy{
+		CaseSensitiveLocalPart: *caseSensitiveLocalPart,
+	}
+
+	if *emailNFC {
+		policy.Normalize = norm.NFC.String
+	}
+
+	switch *store {
+	case "postgres":
+		sqlDB, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(*migrate) != 0 {
+			if err := runMigration(sqlDB, policy, *migrate, flag.Arg(0)); err != nil {
+				log.Fatal("migration error: ", err)
+			}
+
+			if *migrate != "up" {
+				return
+			}
+		}
+
+		kc := model.NewAPIKeyController(sqlDB)
+
+		if len(*apiKey) != 0 {
+			if err := runAPIKey(kc, *apiKey, flag.Arg(0)); err != nil {
+				log.Fatal("api key error: ", err)
+			}
+
+			return
+		}
+
+		db = sqlDB
+		uc = model.NewUserController(sqlDB, model.WithEmailPolicy(policy))
+		apiKeys = kc
+		credentials = model.NewCredentialController(sqlDB, model.WithEmailPolicy(policy))
+		sessions = model.NewSessionController(sqlDB)
+		signingKeys = model.NewSigningKeyController(sqlDB)
+		refresh = model.NewRefreshTokenController(sqlDB)
+		mfa = model.NewMFAController(sqlDB)
+		tokens = model.NewOneTimeTokenController(sqlDB)
+		personal = model.NewPersonalTokenController(sqlDB)
+
+		if len(*exportPath) != 0 || len(*importPath) != 0 {
+			if err := runTransfer(uc); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+	case "memory":
+		if len(*migrate) != 0 {
+			log.Fatal("migration is not available for memory store")
+		}
+
+		if len(*exportPath) != 0 || len(*importPath) != 0 {
+			log.Fatal("export and import are not available for memory store")
+		}
+
+		if *rotateSigningKey {
+			log.Fatal("signing keys of memory store are generated on start")
+		}
+
+		// requests are not authenticated for frontend development
+		if len(*apiKey) != 0 {
+			log.Fatal("api keys are not available for memory store")
+		}
+
+		uc = model.NewMemoryUserController(model.WithEmailPolicy(policy))
+		sessions = model.NewMemorySessionController()
+		signingKeys = model.NewMemorySigningKeyController()
+		refresh = model.NewMemoryRefreshTokenController()
+		mfa = model.NewMemoryMFAController()
+		tokens = model.NewMemoryOneTimeTokenController(uc)
+		personal = model.NewMemoryPersonalTokenController(uc)
+		credentials = model.NewMemoryCredentialController(uc, model.WithMemoryResetControllers(tokens, sessions, refresh, personal))
+	default:
+		log.Fatal("unknown store: ", *store)
+	}
+
+	keys, err := token.NewKeySet(signingKeys, *jwtAlgorithm)
+
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	handler := handler.NewHandler(db)
+	if *rotateSigningKey {
+		if err := runRotateSigningKey(keys, signingKeys); err != nil {
+			log.Fatal("signing key error: ", err)
+		}
+
+		return
+	}
 
-	uc := model.NewUserController(db)
+	m, err := newMailer()
 
-	if *migrate {
-		if err := uc.Migrate(); err != nil {
-			log.Fatal("users table migration error: ", err)
-		}
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	handler := handler.NewHandler(db)
+
 	handler.UserController = uc
+	handler.QueryTimeout = *timeout
+	handler.RequireIfMatch = *requireIfMatch
+	handler.APIKeyController = apiKeys
+	handler.CredentialController = credentials
+	handler.SessionController = sessions
+	handler.SessionTTL = *sessionTTL
+	handler.SecureCookies = *secureCookies
+	handler.TokenKeys = keys
+	handler.RefreshTokenController = refresh
+	handler.AccessTokenTTL = *accessTokenTTL
+	handler.RefreshTokenTTL = *refreshTokenTTL
+	handler.MFAController = mfa
+	handler.TOTPIssuer = *totpIssuer
+	handler.Mailer = m
+	handler.OneTimeTokenController = tokens
+	handler.LinkBaseURL = *linkBaseURL
+	handler.PersonalTokenController = personal
 
 	server := http.Server{
 		Addr:    ":80",
 		Handler: handler.GetHandler(),
 	}
 
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+
+	if *retention > 0 {
+		if *purgeInterval <= 0 {
+			log.Fatal("purge interval must be positive")
+		}
+
+		go purge(purgeCtx, uc, *retention, *purgeInterval)
+	}
+
 	go func() {
 		if err := server.ListenAndServe(); err != nil {
 			log.Fatal("listen and server error: ", err)
@@ -68,11 +236,308 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	<-sig
+	stopPurge()
 
 	ctx, canceler := context.WithTimeout(context.Background(), 5*time.Second)
 	defer canceler()
 
 	if err := server.Shutdown(ctx); err != nil {
 		log.Print(err)
+
+		// closing connections cancels contexts of in-flight requests
+		server.Close()
+	}
+}
+
+// newMailer returns a mailer chosen by flags, or nil to disable emails
+func newMailer() (mailer.Mailer, error) {
+	switch {
+	case len(*mailLog) != 0 && len(*smtpAddr) != 0:
+		return nil, errors.New("--mail-log and --smtp-addr can not be used together")
+	case *mailLog == "-":
+		return mailer.NewLogMailer(os.Stdout, *mailFrom), nil
+	case len(*mailLog) != 0:
+		f, err := os.OpenFile(*mailLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return mailer.NewLogMailer(f, *mailFrom), nil
+	case len(*smtpAddr) != 0:
+		return mailer.NewSMTPMailer(*smtpAddr, *mailFrom, *smtpUsername, os.Getenv("SMTP_PASSWORD")), nil
+	}
+
+	return nil, nil
+}
+
+// purge hard-deletes users deleted before the retention period every interval until ctx is canceled
+func purge(ctx context.Context, uc model.UserController, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := uc.PurgeUsers(ctx, time.Now().Add(-retention))
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Print("purge error: ", err)
+		case n != 0:
+			log.Printf("purged %d users", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runAPIKey creates, lists or revokes api keys
+func runAPIKey(kc model.APIKeyController, command, arg string) error {
+	ctx := context.Background()
+
+	switch command {
+	case "create":
+		if len(arg) == 0 {
+			return fmt.Errorf("the name of the key is required")
+		}
+
+		var expiresAt *time.Time
+		if *apiKeyExpiresIn > 0 {
+			t := time.Now().Add(*apiKeyExpiresIn)
+			expiresAt = &t
+		}
+
+		key, secret, err := kc.NewAPIKey(ctx, arg, strings.Split(*apiKeyScopes, ","), expiresAt)
+
+		if err != nil {
+			return err
+		}
+		log.Printf("created api key %d (%s): the key below is shown only once", key.ID, key.Name)
+
+		fmt.Println(secret)
+
+		return nil
+	case "list":
+		keys, err := kc.ListAPIKeys(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		format := func(t *time.Time) string {
+			if t == nil {
+				return "never"
+			}
+
+			return t.Format(time.RFC3339)
+		}
+
+		now := time.Now()
+		for _, k := range keys {
+			state := "active"
+			switch {
+			case k.RevokedAt != nil:
+				state = "revoked at " + format(k.RevokedAt)
+			case k.ExpiresAt != nil && !k.ExpiresAt.After(now):
+				state = "expired"
+			}
+
+			fmt.Printf("%d\t%s\t%s...\t%s\tcreated at %s\tlast used %s\texpires %s\t%s\n",
+				k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","), format(&k.CreatedAt), format(k.LastUsedAt), format(k.ExpiresAt), state)
+		}
+
+		return nil
+	case "revoke":
+		id, err := strconv.Atoi(arg)
+
+		if err != nil {
+			return fmt.Errorf("invalid id of the key: %s", arg)
+		}
+
+		if err := kc.RevokeAPIKey(ctx, id); err != nil {
+			return err
+		}
+		log.Printf("revoked api key %d", id)
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown api key command: %s", command)
+}
+
+// runRotateSigningKey generates a key signing access tokens,
+// and purges keys retired before the lifetime of access tokens since tokens signed with them have expired
+func runRotateSigningKey(keys *token.KeySet, kc model.SigningKeyController) error {
+	ctx := context.Background()
+
+	k, err := keys.Rotate(ctx)
+
+	if err != nil {
+		return err
+	}
+	log.Printf("generated signing key %s (%s)", k.ID, k.Algorithm)
+
+	n, err := kc.PurgeSigningKeys(ctx, time.Now().Add(-*accessTokenTTL))
+
+	if err != nil {
+		return err
+	}
+
+	if n != 0 {
+		log.Printf("purged %d retired signing keys", n)
+	}
+
+	return nil
+}
+
+// runTransfer exports or imports users as specified by the flags
+func runTransfer(uc model.UserController) error {
+	if len(*exportPath) != 0 && len(*importPath) != 0 {
+		return fmt.Errorf("export and import can not be run at once")
+	}
+
+	f, err := userio.ParseFormat(*format)
+
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if len(*exportPath) != 0 {
+		out := os.Stdout
+		if *exportPath != "-" {
+			out, err = os.Create(*exportPath)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		w := bufio.NewWriter(out)
+
+		if err := userio.Export(ctx, uc, w, f, model.ListOptions{}); err != nil {
+			out.Close()
+
+			return err
+		}
+
+		if err := w.Flush(); err != nil {
+			out.Close()
+
+			return err
+		}
+
+		return out.Close()
+	}
+
+	mapping, err := userio.ParseMapping(*importMapping)
+
+	if err != nil {
+		return err
 	}
+
+	in := os.Stdin
+	if *importPath != "-" {
+		in, err = os.Open(*importPath)
+
+		if err != nil {
+			return err
+		}
+	}
+	defer in.Close()
+
+	report, err := userio.Import(ctx, uc, in, f, userio.ImportOptions{Mapping: mapping, DryRun: *importDryRun})
+
+	if err != nil {
+		return err
+	}
+
+	for _, failure := range report.Failures {
+		log.Printf("row %d: %v", failure.Row, failure.Err)
+	}
+
+	verb := "imported"
+	if *importDryRun {
+		verb = "would be imported"
+	}
+	log.Printf("%d of %d rows %s", report.Imported, report.Rows, verb)
+
+	if len(report.Failures) != 0 {
+		return fmt.Errorf("%d rows failed", len(report.Failures))
+	}
+
+	return nil
+}
+
+func runMigration(db *sql.DB, policy model.EmailPolicy, command, arg string) error {
+	ctx := context.Background()
+	m := migrations.NewMigrator(db)
+	m.Config.EmailKey = policy.Key
+
+	n := 0
+	if len(arg) != 0 {
+		var err error
+		n, err = strconv.Atoi(arg)
+
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number of migrations: %s", arg)
+		}
+	}
+
+	switch command {
+	case "up":
+		applied, err := m.Up(ctx, n)
+
+		for _, mig := range applied {
+			log.Printf("applied %d_%s", mig.Version, mig.Name)
+		}
+
+		return err
+	case "down":
+		if n == 0 {
+			return fmt.Errorf("the number of migrations to revert is required")
+		}
+
+		reverted, err := m.Down(ctx, n)
+
+		for _, mig := range reverted {
+			log.Printf("reverted %d_%s", mig.Version, mig.Name)
+		}
+
+		return err
+	case "redo":
+		mig, err := m.Redo(ctx)
+
+		if err != nil {
+			return err
+		}
+		log.Printf("redone %d_%s", mig.Version, mig.Name)
+
+		return nil
+	case "status":
+		statuses, err := m.Status(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied at " + s.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%d_%s\t%s\n", s.Version, s.Name, state)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown migration command: %s", command)
 }
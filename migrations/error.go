@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error is an error occurred in a migration step
+type Error struct {
+	Migration Migration
+	Up        bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	direction := "down"
+	if e.Up {
+		direction = "up"
+	}
+
+	return fmt.Sprintf("migration %d_%s (%s) failed: %v", e.Migration.Version, e.Migration.Name, direction, e.Err)
+}
+
+// DuplicateEmail is a normalized email shared by several users
+type DuplicateEmail struct {
+	Key string
+	IDs []int
+}
+
+// DuplicateEmailsError means users must be merged or fixed before emails are made unique
+type DuplicateEmailsError struct {
+	Duplicates []DuplicateEmail
+}
+
+func (e *DuplicateEmailsError) Error() string {
+	dups := make([]string, 0, len(e.Duplicates))
+	for _, d := range e.Duplicates {
+		ids := make([]string, 0, len(d.IDs))
+		for _, id := range d.IDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+
+		dups = append(dups, fmt.Sprintf("%s (ids %s)", d.Key, strings.Join(ids, ", ")))
+	}
+
+	return fmt.Sprintf("%d emails are duplicated: %s", len(e.Duplicates), strings.Join(dups, "; "))
+}
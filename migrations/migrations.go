@@ -0,0 +1,341 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// Migration is a reversible schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+
+	// UpFunc runs after Up in the same transaction for changes which can not be written in SQL
+	UpFunc func(ctx context.Context, tx *sql.Tx, cfg *Config) error
+}
+
+// Migrations are all schema changes in order of Version
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users",
+		// IF NOT EXISTS adopts tables created before schema_migrations existed
+		Up: `
+		CREATE TABLE IF NOT EXISTS users (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(256),
+			email VARCHAR(256) NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE OR REPLACE FUNCTION set_update_time() RETURNS TRIGGER AS $$
+			BEGIN
+				new.updated_at := now();
+				return new;
+			END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS update_tri ON users;
+		CREATE TRIGGER update_tri BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE set_update_time();
+		`,
+		Down: `
+		DROP TABLE users;
+		DROP FUNCTION set_update_time();
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "users_name_not_null",
+		Up: `
+		UPDATE users SET name = '' WHERE name IS NULL;
+		ALTER TABLE users ALTER COLUMN name SET NOT NULL;
+		`,
+		Down: `
+		ALTER TABLE users ALTER COLUMN name DROP NOT NULL;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "users_email_key",
+		Up: `
+		ALTER TABLE users ADD COLUMN email_key TEXT;
+		`,
+		UpFunc: fillEmailKeys,
+		Down: `
+		ALTER TABLE users DROP COLUMN email_key;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "users_soft_delete",
+		// soft-deleted users release their emails
+		Up: `
+		ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+		DROP INDEX users_email_key_idx;
+		CREATE UNIQUE INDEX users_email_key_idx ON users(email_key) WHERE deleted_at IS NULL;
+		CREATE INDEX users_deleted_at_idx ON users(deleted_at) WHERE deleted_at IS NOT NULL;
+		`,
+		// soft-deleted users are purged since they can not be hidden any more
+		Down: `
+		DELETE FROM users WHERE deleted_at IS NOT NULL;
+		DROP INDEX users_email_key_idx;
+		CREATE UNIQUE INDEX users_email_key_idx ON users(email_key);
+		ALTER TABLE users DROP COLUMN deleted_at;
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "create_api_keys",
+		// only argon2id hashes of keys are stored, and keys are looked up by the prefix
+		Up: `
+		CREATE TABLE api_keys (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(256) NOT NULL,
+			prefix VARCHAR(16) NOT NULL,
+			key_hash TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP WITH TIME ZONE,
+			expires_at TIMESTAMP WITH TIME ZONE,
+			revoked_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX api_keys_prefix_idx ON api_keys (prefix);
+		`,
+		Down: `
+		DROP TABLE api_keys;
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "api_keys_scopes",
+		// existing keys keep the full access they had
+		Up: `
+		ALTER TABLE api_keys ADD COLUMN scopes TEXT[] NOT NULL DEFAULT '{users:admin}';
+		ALTER TABLE api_keys ALTER COLUMN scopes DROP DEFAULT;
+		`,
+		Down: `
+		ALTER TABLE api_keys DROP COLUMN scopes;
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "create_password_credentials_and_sessions",
+		// credentials and sessions are removed with users when they are purged
+		Up: `
+		CREATE TABLE password_credentials (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			password_hash TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE sessions (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash BYTEA NOT NULL UNIQUE,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+		CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+		`,
+		Down: `
+		DROP TABLE sessions;
+		DROP TABLE password_credentials;
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "create_signing_keys_and_refresh_tokens",
+		// used refresh tokens are kept until they expire to detect reuse
+		Up: `
+		CREATE TABLE signing_keys (
+			id VARCHAR(64) PRIMARY KEY,
+			algorithm VARCHAR(16) NOT NULL,
+			private_key BYTEA NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			retired_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE TABLE refresh_tokens (
+			id SERIAL PRIMARY KEY,
+			family VARCHAR(64) NOT NULL,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash BYTEA NOT NULL UNIQUE,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE,
+			revoked_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family);
+		CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+		`,
+		Down: `
+		DROP TABLE refresh_tokens;
+		DROP TABLE signing_keys;
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "create_mfa_tables",
+		// secrets of TOTP are kept as is since codes are computed from them,
+		// and wrong codes are counted per user across challenges to lock out guessing
+		Up: `
+		CREATE TABLE totp_credentials (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			secret BYTEA NOT NULL,
+			last_used_step BIGINT NOT NULL DEFAULT 0,
+			failed_attempts INTEGER NOT NULL DEFAULT 0,
+			locked_until TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			confirmed_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE TABLE recovery_codes (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash BYTEA NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE,
+			UNIQUE (user_id, code_hash)
+		);
+		CREATE TABLE mfa_challenges (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash BYTEA NOT NULL UNIQUE,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+		CREATE INDEX mfa_challenges_user_id_idx ON mfa_challenges (user_id);
+		`,
+		Down: `
+		DROP TABLE mfa_challenges;
+		DROP TABLE recovery_codes;
+		DROP TABLE totp_credentials;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "create_one_time_tokens",
+		// tokens keep the email they are sent to, so that they are invalidated when it changes
+		Up: `
+		ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE;
+		CREATE OR REPLACE FUNCTION reset_email_verification() RETURNS TRIGGER AS $$
+			BEGIN
+				IF new.email_key IS DISTINCT FROM old.email_key THEN
+					new.email_verified_at := NULL;
+				END IF;
+				return new;
+			END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER email_verification_tri BEFORE UPDATE OF email_key ON users FOR EACH ROW EXECUTE PROCEDURE reset_email_verification();
+		CREATE TABLE one_time_tokens (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			purpose VARCHAR(32) NOT NULL,
+			email VARCHAR(256) NOT NULL,
+			token_hash BYTEA NOT NULL UNIQUE,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX one_time_tokens_user_id_idx ON one_time_tokens (user_id, purpose);
+		`,
+		Down: `
+		DROP TABLE one_time_tokens;
+		DROP TRIGGER email_verification_tri ON users;
+		DROP FUNCTION reset_email_verification();
+		ALTER TABLE users DROP COLUMN email_verified_at;
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "create_personal_tokens",
+		Up: `
+		CREATE TABLE personal_tokens (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name VARCHAR(256) NOT NULL,
+			prefix VARCHAR(16) NOT NULL,
+			scopes TEXT[] NOT NULL,
+			token_hash TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP WITH TIME ZONE,
+			last_used_ip VARCHAR(64),
+			expires_at TIMESTAMP WITH TIME ZONE,
+			revoked_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX personal_tokens_user_id_idx ON personal_tokens (user_id);
+		CREATE INDEX personal_tokens_prefix_idx ON personal_tokens (prefix);
+		`,
+		Down: `
+		DROP TABLE personal_tokens;
+		`,
+	},
+}
+
+// fillEmailKeys normalizes existing emails and makes them unique.
+// Duplicates are reported instead of being resolved arbitrarily.
+func fillEmailKeys(ctx context.Context, tx *sql.Tx, cfg *Config) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, email FROM users ORDER BY id")
+
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		ids  []int64
+		keys []string
+	)
+	byKey := map[string][]int{}
+	for rows.Next() {
+		var (
+			id    int
+			email string
+		)
+		if err := rows.Scan(&id, &email); err != nil {
+			return err
+		}
+
+		key := cfg.EmailKey(email)
+		byKey[key] = append(byKey[key], id)
+
+		ids = append(ids, int64(id))
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var duplicates []DuplicateEmail
+	for key, ids := range byKey {
+		if len(ids) > 1 {
+			duplicates = append(duplicates, DuplicateEmail{Key: key, IDs: ids})
+		}
+	}
+
+	if len(duplicates) != 0 {
+		sort.Slice(duplicates, func(i, j int) bool {
+			return duplicates[i].IDs[0] < duplicates[j].IDs[0]
+		})
+
+		return &DuplicateEmailsError{Duplicates: duplicates}
+	}
+
+	query := `
+	UPDATE users SET email_key = v.key
+	FROM unnest($1::INTEGER[], $2::TEXT[]) AS v(id, key)
+	WHERE users.id = v.id
+	`
+
+	if _, err := tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(keys)); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	ALTER TABLE users ALTER COLUMN email_key SET NOT NULL;
+	CREATE UNIQUE INDEX users_email_key_idx ON users(email_key);
+	`)
+
+	return err
+}
@@ -0,0 +1,269 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// lockKey is the key of the advisory lock taken while migrating
+const lockKey = 0x636333
+
+// ErrNoMigration means there is no migration to revert
+var ErrNoMigration = errors.New("no migration is applied")
+
+// Status is a migration and whether it is applied
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Config is the application settings migrations depend on
+type Config struct {
+	// EmailKey normalizes emails in the same way as model.EmailPolicy.Key
+	EmailKey func(email string) string
+}
+
+// Migrator applies migrations holding a Postgres advisory lock
+// so that replicas starting together do not race each other
+type Migrator struct {
+	// Config is passed to Migration.UpFunc
+	Config Config
+
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for Migrations with the default email policy
+func NewMigrator(db *sql.DB) *Migrator {
+	return &Migrator{
+		Config: Config{
+			EmailKey: model.EmailPolicy{}.Key,
+		},
+		db:         db,
+		migrations: Migrations,
+	}
+}
+
+// Up applies at most n pending migrations. n <= 0 applies all of them.
+func (m *Migrator) Up(ctx context.Context, n int) ([]Migration, error) {
+	var applied []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if n > 0 && len(applied) >= n {
+				break
+			}
+
+			if _, ok := versions[mig.Version]; ok {
+				continue
+			}
+
+			if err := m.apply(ctx, conn, mig, true); err != nil {
+				return err
+			}
+
+			applied = append(applied, mig)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the last n applied migrations
+func (m *Migrator) Down(ctx context.Context, n int) ([]Migration, error) {
+	var reverted []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < n; i-- {
+			mig := m.migrations[i]
+
+			if _, ok := versions[mig.Version]; !ok {
+				continue
+			}
+
+			if err := m.apply(ctx, conn, mig, false); err != nil {
+				return err
+			}
+
+			reverted = append(reverted, mig)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Redo reverts and reapplies the last applied migration
+func (m *Migrator) Redo(ctx context.Context) (*Migration, error) {
+	var redone *Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if _, ok := versions[m.migrations[i].Version]; ok {
+				redone = &m.migrations[i]
+
+				break
+			}
+		}
+
+		if redone == nil {
+			return ErrNoMigration
+		}
+
+		if err := m.apply(ctx, conn, *redone, false); err != nil {
+			return err
+		}
+
+		return m.apply(ctx, conn, *redone, true)
+	})
+
+	return redone, err
+}
+
+// Status returns all migrations with their states
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			at, ok := versions[mig.Version]
+
+			statuses = append(statuses, Status{
+				Migration: mig,
+				Applied:   ok,
+				AppliedAt: at,
+			})
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// locked calls fn on a connection holding the advisory lock.
+// The lock belongs to a session, so every statement must use the same connection.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return err
+	}
+	defer func() {
+		// the lock is released when the connection is closed even if unlocking fails
+		if _, uerr := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+
+	query := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(256) NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[int]time.Time{}
+	for rows.Next() {
+		var (
+			version int
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+
+		versions[version] = at
+	}
+
+	return versions, rows.Err()
+}
+
+// apply runs a migration and its bookkeeping in a transaction
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+			return &Error{Migration: mig, Up: up, Err: err}
+		}
+
+		if mig.UpFunc != nil {
+			if err := mig.UpFunc(ctx, tx, &m.Config); err != nil {
+				return &Error{Migration: mig, Up: up, Err: err}
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations(version, name) VALUES ($1, $2)", mig.Version, mig.Name); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+			return &Error{Migration: mig, Up: up, Err: err}
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.Version); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
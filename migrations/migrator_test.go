@@ -0,0 +1,203 @@
+package migrations_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/migrations"
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/lib/pq"
+)
+
+// schema isolates this package from other packages testing on the same database
+const schema = "migrations_test"
+
+func initDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_DSN")
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		parsed, err := pq.ParseURL(dsn)
+
+		if err != nil {
+			t.Fatal("dsn parse error", err)
+		}
+		dsn = parsed
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE; CREATE SCHEMA " + schema); err != nil {
+		t.Fatal("create schema error", err)
+	}
+
+	db, err = sql.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func checkApplied(t *testing.T, m *migrations.Migrator, expected int) {
+	t.Helper()
+
+	statuses, err := m.Status(context.Background())
+
+	if err != nil {
+		t.Fatal("status error", err)
+	}
+
+	if len(statuses) != len(migrations.Migrations) {
+		t.Fatal("the number of statuses is incorrect", len(statuses))
+	}
+
+	for i, s := range statuses {
+		if s.Version != migrations.Migrations[i].Version {
+			t.Error("status is not ordered", s.Version)
+		}
+
+		if s.Applied != (i < expected) {
+			t.Errorf("applied state of %d should be %v", s.Version, i < expected)
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	db := initDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	m := migrations.NewMigrator(db)
+	all := len(migrations.Migrations)
+
+	checkApplied(t, m, 0)
+
+	if applied, err := m.Up(ctx, 1); err != nil || len(applied) != 1 {
+		t.Fatal("up 1 error", applied, err)
+	}
+	checkApplied(t, m, 1)
+
+	if applied, err := m.Up(ctx, 0); err != nil || len(applied) != all-1 {
+		t.Fatal("up error", applied, err)
+	}
+	checkApplied(t, m, all)
+
+	// check idempotency
+	if applied, err := m.Up(ctx, 0); err != nil || len(applied) != 0 {
+		t.Fatal("up for checking idempotency error", applied, err)
+	}
+
+	if _, err := db.Exec("INSERT INTO users(name, email, email_key) VALUES ('taro', 'Taro@example.com', 'taro@example.com')"); err != nil {
+		t.Fatal("insert error", err)
+	}
+
+	redone, err := m.Redo(ctx)
+
+	if err != nil || redone.Version != migrations.Migrations[all-1].Version {
+		t.Fatal("redo error", redone, err)
+	}
+	checkApplied(t, m, all)
+
+	if reverted, err := m.Down(ctx, all); err != nil || len(reverted) != all {
+		t.Fatal("down error", reverted, err)
+	}
+	checkApplied(t, m, 0)
+
+	if _, err := m.Redo(ctx); err != migrations.ErrNoMigration {
+		t.Fatal("redo without migrations should fail", err)
+	}
+
+	if _, err := m.Up(ctx, 0); err != nil {
+		t.Fatal("up after down error", err)
+	}
+	checkApplied(t, m, all)
+}
+
+func TestMigratorConcurrent(t *testing.T) {
+	db := initDB(t)
+	defer db.Close()
+
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := migrations.NewMigrator(db).Up(context.Background(), 0)
+
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Error("concurrent up error", err)
+		}
+	}
+
+	checkApplied(t, migrations.NewMigrator(db), len(migrations.Migrations))
+}
+
+func TestMigratorDuplicateEmails(t *testing.T) {
+	db := initDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	m := migrations.NewMigrator(db)
+
+	if _, err := m.Up(ctx, 2); err != nil {
+		t.Fatal("up error", err)
+	}
+
+	query := `
+	INSERT INTO users(name, email) VALUES
+		('taro', 'taro@example.com'),
+		('jiro', 'jiro@example.com'),
+		('taro2', 'Taro@Example.com'),
+		('jiro2', 'JIRO@example.com'),
+		('jiro3', 'jiro@EXAMPLE.COM')
+	`
+	if _, err := db.Exec(query); err != nil {
+		t.Fatal("insert error", err)
+	}
+
+	_, err := m.Up(ctx, 0)
+
+	merr, ok := err.(*migrations.Error)
+	if !ok {
+		t.Fatal("migration should fail", err)
+	}
+
+	derr, ok := merr.Err.(*migrations.DuplicateEmailsError)
+	if !ok {
+		t.Fatal("duplicates should be reported", merr.Err)
+	}
+
+	expected := []migrations.DuplicateEmail{
+		{Key: "taro@example.com", IDs: []int{1, 3}},
+		{Key: "jiro@example.com", IDs: []int{2, 4, 5}},
+	}
+	if !reflect.DeepEqual(derr.Duplicates, expected) {
+		t.Fatal("duplicates are incorrect", derr.Duplicates)
+	}
+	checkApplied(t, m, 2)
+
+	// local parts in different cases are allowed by the policy
+	m.Config.EmailKey = model.EmailPolicy{CaseSensitiveLocalPart: true}.Key
+
+	if _, err := db.Exec("DELETE FROM users WHERE id = 5"); err != nil {
+		t.Fatal("delete error", err)
+	}
+
+	if _, err := m.Up(ctx, 0); err != nil {
+		t.Fatal("up after resolving duplicates error", err)
+	}
+	checkApplied(t, m, len(migrations.Migrations))
+}
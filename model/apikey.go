@@ -0,0 +1,212 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// apiKeyPrefix starts every API key
+	apiKeyPrefix = "uak_"
+
+	// apiKeyDisplayLength is the length of APIKey.Prefix shown to identify keys
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+)
+
+// APIKey is a credential for the API. Only the argon2id hash of the secret is stored.
+type APIKey struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+
+	// Prefix is the beginning of the secret to tell keys apart
+	Prefix string `json:"prefix"`
+
+	// Scopes are the permissions of the key such as ScopeRead
+	Scopes []string `json:"scopes"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+
+	// ExpiresAt is nil if the key never expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// APIKeyController defines an interface for api_keys table
+type APIKeyController interface {
+	// NewAPIKey creates a key with scopes and returns it with the secret, which can not be retrieved later
+	NewAPIKey(ctx context.Context, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error)
+
+	// ListAPIKeys returns every key including revoked ones in order of id
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+
+	// RevokeAPIKey disables the key permanently
+	RevokeAPIKey(ctx context.Context, id int) error
+
+	// AuthenticateAPIKey returns the key of the secret and records the use.
+	// It fails with ErrInvalidAPIKey if the key is unknown, revoked or expired.
+	AuthenticateAPIKey(ctx context.Context, secret string) (*APIKey, error)
+}
+
+// NewAPIKeyController creates a controller for api_keys table
+func NewAPIKeyController(db DB) APIKeyController {
+	return &apiKeyController{db: db}
+}
+
+type apiKeyController struct {
+	db DB
+}
+
+const apiKeyColumns = "id, name, prefix, scopes, created_at, last_used_at, expires_at, revoked_at"
+
+// apiKeyPrefixOf returns APIKey.Prefix of the secret, which is indexed to look the key up
+func apiKeyPrefixOf(secret string) (string, bool) {
+	if len(secret) < apiKeyDisplayLength || !strings.HasPrefix(secret, apiKeyPrefix) {
+		return "", false
+	}
+
+	return secret[:apiKeyDisplayLength], true
+}
+
+func scanAPIKey(s scanner, k *APIKey) error {
+	return s.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.CreatedAt, &k.LastUsedAt, &k.ExpiresAt, &k.RevokedAt)
+}
+
+// validateAPIKey validates the name, the scopes and the expiry of a new key
+func validateAPIKey(name string, scopes []string, expiresAt *time.Time) (string, []string, error) {
+	var fields []FieldError
+
+	name, ferr := validateName(name)
+	if ferr != nil {
+		fields = append(fields, *ferr)
+	}
+
+	scopes, ferr = validateScopes(scopes)
+	if ferr != nil {
+		fields = append(fields, *ferr)
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		fields = append(fields, FieldError{Field: "expires_at", Reason: "must be in the future"})
+	}
+
+	if len(fields) != 0 {
+		return "", nil, &ValidationError{Message: "api key is invalid", Fields: fields}
+	}
+
+	return name, scopes, nil
+}
+
+func (kc *apiKeyController) NewAPIKey(ctx context.Context, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	name, scopes, err := validateAPIKey(name, scopes, expiresAt)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := newSecret(apiKeyPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := hashArgon2(secret, defaultArgon2Params)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	k := &APIKey{}
+	err = scanAPIKey(
+		kc.db.QueryRowContext(
+			ctx,
+			"INSERT INTO api_keys(name, prefix, scopes, key_hash, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING "+apiKeyColumns,
+			name, secret[:apiKeyDisplayLength], pq.Array(scopes), hash, expiresAt,
+		),
+		k,
+	)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return k, secret, nil
+}
+
+func (kc *apiKeyController) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	rows, err := kc.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k := &APIKey{}
+		if err := scanAPIKey(rows, k); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (kc *apiKeyController) RevokeAPIKey(ctx context.Context, id int) error {
+	var revoked bool
+	err := kc.db.
+		QueryRowContext(ctx, "UPDATE api_keys SET revoked_at=COALESCE(revoked_at, now()) WHERE id=$1 RETURNING true", id).
+		Scan(&revoked)
+
+	if err == sql.ErrNoRows {
+		return ErrNoAPIKey
+	}
+
+	return err
+}
+
+func (kc *apiKeyController) AuthenticateAPIKey(ctx context.Context, secret string) (*APIKey, error) {
+	prefix, ok := apiKeyPrefixOf(secret)
+
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	id, err := lookupByPrefix(ctx, kc.db, "api_keys", "key_hash", prefix, secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if id == 0 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	k := &APIKey{}
+	err = scanAPIKey(
+		kc.db.QueryRowContext(
+			ctx,
+			`UPDATE api_keys SET last_used_at=now()
+			WHERE id=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+			RETURNING `+apiKeyColumns,
+			id,
+		),
+		k,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
@@ -0,0 +1,171 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemoryAPIKeyController creates a controller keeping API keys in memory.
+// It is safe for concurrent use and behaves like the controller for api_keys table.
+func NewMemoryAPIKeyController() APIKeyController {
+	return &memoryAPIKeyController{
+		keys:     map[int]*memoryAPIKey{},
+		byPrefix: map[string][]*memoryAPIKey{},
+	}
+}
+
+type memoryAPIKey struct {
+	APIKey
+	hash string
+}
+
+// memoryAPIKeyController looks keys up by the prefix as the index of api_keys
+type memoryAPIKeyController struct {
+	mu       sync.Mutex
+	keys     map[int]*memoryAPIKey
+	byPrefix map[string][]*memoryAPIKey
+	lastID   int
+}
+
+func (kc *memoryAPIKeyController) NewAPIKey(ctx context.Context, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	name, scopes, err := validateAPIKey(name, scopes, expiresAt)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := newSecret(apiKeyPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := hashArgon2(secret, defaultArgon2Params)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if expiresAt != nil {
+		// Postgres rounds times to microseconds
+		t := expiresAt.Round(time.Microsecond)
+		expiresAt = &t
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	kc.lastID++
+	k := &memoryAPIKey{
+		APIKey: APIKey{
+			ID:        kc.lastID,
+			Name:      name,
+			Prefix:    secret[:apiKeyDisplayLength],
+			Scopes:    scopes,
+			CreatedAt: now(),
+			ExpiresAt: expiresAt,
+		},
+		hash: hash,
+	}
+	kc.keys[k.ID] = k
+	kc.byPrefix[k.Prefix] = append(kc.byPrefix[k.Prefix], k)
+
+	ret := k.APIKey
+
+	return &ret, secret, nil
+}
+
+func (kc *memoryAPIKeyController) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	kc.mu.Lock()
+	keys := make([]*APIKey, 0, len(kc.keys))
+	for _, k := range kc.keys {
+		copied := k.APIKey
+		keys = append(keys, &copied)
+	}
+	kc.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (kc *memoryAPIKeyController) RevokeAPIKey(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	k, ok := kc.keys[id]
+
+	if !ok {
+		return ErrNoAPIKey
+	}
+
+	if k.RevokedAt == nil {
+		t := now()
+		k.RevokedAt = &t
+	}
+
+	return nil
+}
+
+func (kc *memoryAPIKeyController) AuthenticateAPIKey(ctx context.Context, secret string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	prefix, ok := apiKeyPrefixOf(secret)
+
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	kc.mu.Lock()
+	candidates := append([]*memoryAPIKey(nil), kc.byPrefix[prefix]...)
+	kc.mu.Unlock()
+
+	hashes := make([]string, len(candidates))
+	for i, k := range candidates {
+		hashes[i] = k.hash
+	}
+
+	// hashes are verified without the lock since argon2id takes time
+	i, err := matchArgon2(hashes, secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if i < 0 {
+		return nil, ErrInvalidAPIKey
+	}
+	matched := candidates[i]
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	t := now()
+
+	if matched.RevokedAt != nil || (matched.ExpiresAt != nil && !matched.ExpiresAt.After(t)) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	matched.LastUsedAt = &t
+	ret := matched.APIKey
+
+	return &ret, nil
+}
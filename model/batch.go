@@ -0,0 +1,360 @@
+package model
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// MaxBatchSize is the maximum number of users in a batch operation
+const MaxBatchSize = 1000
+
+// BatchResult is the result of a user in a batch operation.
+// Err is set if the user failed. Otherwise User is set except for deletions.
+type BatchResult struct {
+	User *User
+	Err  error
+}
+
+func checkBatchSize(n int) error {
+	if n > MaxBatchSize {
+		return &ValidationError{Message: "batch must have at most " + strconv.Itoa(MaxBatchSize) + " users"}
+	}
+
+	return nil
+}
+
+// valuesRow returns a row of VALUES for the last len(casts) arguments.
+// Every placeholder is cast since types of parameters in VALUES are not inferred from the target.
+func valuesRow(args []interface{}, casts ...string) string {
+	placeholders := make([]string, len(casts))
+	for i, c := range casts {
+		placeholders[i] = "$" + strconv.Itoa(len(args)-len(casts)+i+1) + "::" + c
+	}
+
+	return "(" + strings.Join(placeholders, ", ") + ")"
+}
+
+// emailOwners returns ids of users having the keys
+func (uc *userController) emailOwners(ctx context.Context, keys []string) (map[string]int, error) {
+	rows, err := uc.db.QueryContext(ctx, "SELECT email_key, id FROM users WHERE email_key = ANY($1) AND deleted_at IS NULL", pq.Array(keys))
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := map[string]int{}
+	for rows.Next() {
+		var (
+			key string
+			id  int
+		)
+		if err := rows.Scan(&key, &id); err != nil {
+			return nil, err
+		}
+
+		owners[key] = id
+	}
+
+	return owners, rows.Err()
+}
+
+// NewUsers inserts users with a multi-row INSERT.
+// When emails are duplicated in the batch, the first user wins.
+func (uc *userController) NewUsers(ctx context.Context, users []*User) ([]BatchResult, error) {
+	if err := checkBatchSize(len(users)); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(users))
+	keys := make([]string, len(users))
+
+	var (
+		rows    []string
+		args    []interface{}
+		pending = map[string][]int{}
+	)
+	for i, u := range users {
+		name, email, err := ValidateUser(u.Name, u.Email)
+
+		if err != nil {
+			results[i].Err = err
+
+			continue
+		}
+
+		keys[i] = uc.emailPolicy.Key(email)
+		pending[keys[i]] = append(pending[keys[i]], i)
+		results[i].User = &User{Name: name, Email: email}
+
+		args = append(args, name, email, keys[i])
+		rows = append(rows, valuesRow(args, "VARCHAR", "VARCHAR", "TEXT"))
+	}
+
+	if len(rows) == 0 {
+		return results, nil
+	}
+
+	query := "INSERT INTO users(name, email, email_key) VALUES " + strings.Join(rows, ", ") +
+		" ON CONFLICT (email_key) WHERE deleted_at IS NULL DO NOTHING RETURNING id, email_key, created_at, updated_at"
+
+	inserted, err := uc.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer inserted.Close()
+
+	for inserted.Next() {
+		var (
+			key string
+			u   User
+		)
+		if err := inserted.Scan(&u.ID, &key, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+
+		i := pending[key][0]
+		pending[key] = pending[key][1:]
+
+		results[i].User.ID, results[i].User.CreatedAt, results[i].User.UpdatedAt = u.ID, u.CreatedAt, u.UpdatedAt
+	}
+
+	if err := inserted.Err(); err != nil {
+		return nil, err
+	}
+
+	var conflicted []string
+	for key, indexes := range pending {
+		if len(indexes) != 0 {
+			conflicted = append(conflicted, key)
+		}
+	}
+
+	if len(conflicted) == 0 {
+		return results, nil
+	}
+
+	owners, err := uc.emailOwners(ctx, conflicted)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range conflicted {
+		for _, i := range pending[key] {
+			results[i] = BatchResult{Err: newEmailConflictError(owners[key])}
+		}
+	}
+
+	return results, nil
+}
+
+// UpdateUsers updates users with UPDATE ... FROM VALUES
+func (uc *userController) UpdateUsers(ctx context.Context, users []*User) ([]BatchResult, error) {
+	if err := checkBatchSize(len(users)); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(users))
+	keys := make([]string, len(users))
+	seen := map[int]bool{}
+	takenBy := map[string]int{}
+
+	var pending []int
+	for i, u := range users {
+		if seen[u.ID] {
+			results[i].Err = ErrDuplicatedInBatch
+
+			continue
+		}
+		seen[u.ID] = true
+
+		name, email, err := ValidateUser(u.Name, u.Email)
+
+		if err != nil {
+			results[i].Err = err
+
+			continue
+		}
+
+		keys[i] = uc.emailPolicy.Key(email)
+
+		// the unique index would reject the whole statement
+		if id, ok := takenBy[keys[i]]; ok {
+			results[i].Err = newEmailConflictError(id)
+
+			continue
+		}
+		takenBy[keys[i]] = u.ID
+
+		results[i].User = &User{ID: u.ID, Name: name, Email: email}
+		pending = append(pending, i)
+	}
+
+	if len(pending) == 0 {
+		return results, nil
+	}
+
+	pendingKeys := make([]string, len(pending))
+	for j, i := range pending {
+		pendingKeys[j] = keys[i]
+	}
+
+	owners, err := uc.emailOwners(ctx, pendingKeys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		rows    []string
+		args    []interface{}
+		targets = map[int]int{}
+	)
+	for _, i := range pending {
+		if owner, ok := owners[keys[i]]; ok && owner != users[i].ID {
+			results[i] = BatchResult{Err: newEmailConflictError(owner)}
+
+			continue
+		}
+
+		u := results[i].User
+		targets[u.ID] = i
+
+		args = append(args, u.ID, u.Name, u.Email, keys[i], unmodifiedSince(users[i].UpdatedAt))
+		rows = append(rows, valuesRow(args, "INTEGER", "VARCHAR", "VARCHAR", "TEXT", "TIMESTAMP WITH TIME ZONE"))
+	}
+
+	if len(rows) == 0 {
+		return results, nil
+	}
+
+	query := `UPDATE users SET name=v.name, email=v.email, email_key=v.email_key
+	FROM (VALUES ` + strings.Join(rows, ", ") + `) AS v(id, name, email, email_key, updated_at)
+	WHERE users.id=v.id AND users.deleted_at IS NULL AND (v.updated_at IS NULL OR users.updated_at=v.updated_at)
+	RETURNING users.id, users.created_at, users.updated_at, users.email_verified_at`
+
+	updated, err := uc.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		if isUniqueViolation(err) {
+			// another user has taken an email after the check
+			return nil, newEmailConflictError(0)
+		}
+
+		return nil, err
+	}
+	defer updated.Close()
+
+	for updated.Next() {
+		var u User
+		if err := updated.Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt, &u.EmailVerifiedAt); err != nil {
+			return nil, err
+		}
+
+		i := targets[u.ID]
+		delete(targets, u.ID)
+
+		results[i].User.CreatedAt, results[i].User.UpdatedAt, results[i].User.EmailVerifiedAt = u.CreatedAt, u.UpdatedAt, u.EmailVerifiedAt
+	}
+
+	if err := updated.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(targets) == 0 {
+		return results, nil
+	}
+
+	// the rest are missing or modified
+	ids := make([]int64, 0, len(targets))
+	for id := range targets {
+		ids = append(ids, int64(id))
+	}
+
+	existing, err := uc.existingIDs(ctx, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for id, i := range targets {
+		results[i] = BatchResult{Err: ErrNoUser}
+
+		if existing[id] {
+			results[i].Err = ErrPreconditionFailed
+		}
+	}
+
+	return results, nil
+}
+
+// existingIDs returns ids of users which are not deleted
+func (uc *userController) existingIDs(ctx context.Context, ids []int64) (map[int]bool, error) {
+	rows, err := uc.db.QueryContext(ctx, "SELECT id FROM users WHERE id = ANY($1) AND deleted_at IS NULL", pq.Array(ids))
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		existing[id] = true
+	}
+
+	return existing, rows.Err()
+}
+
+// DeleteUsers soft-deletes users with WHERE id = ANY($1)
+func (uc *userController) DeleteUsers(ctx context.Context, ids []int) ([]BatchResult, error) {
+	if err := checkBatchSize(len(ids)); err != nil {
+		return nil, err
+	}
+
+	params := make([]int64, len(ids))
+	for i, id := range ids {
+		params[i] = int64(id)
+	}
+
+	rows, err := uc.db.QueryContext(ctx, "UPDATE users SET deleted_at=now() WHERE id = ANY($1) AND deleted_at IS NULL RETURNING id", pq.Array(params))
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		deleted[id] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(ids))
+	for i, id := range ids {
+		// only the first of duplicated ids is deleted as DeleteUser called in order
+		if !deleted[id] {
+			results[i].Err = ErrNoUser
+		}
+		delete(deleted, id)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,218 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// CredentialController defines an interface for password_credentials table
+type CredentialController interface {
+	// SignUp creates a user with the password atomically
+	SignUp(ctx context.Context, name, email, password string) (*User, error)
+
+	// SetPassword sets the password of the user, replacing the current one if any
+	SetPassword(ctx context.Context, userID int, password string) error
+
+	// ResetPassword consumes the password reset token and sets the password of its user, revoking sessions,
+	// refresh tokens and personal tokens of the user at the same time, and returns the id of the user.
+	// The token is kept if it fails. It fails with ErrInvalidOneTimeToken like ConsumeOneTimeToken.
+	ResetPassword(ctx context.Context, token, password string) (int, error)
+
+	// Login returns the user of the email if the password matches.
+	// It fails with ErrInvalidCredentials if the user is unknown, deleted, has no password or the password differs.
+	Login(ctx context.Context, email, password string) (*User, error)
+}
+
+// NewCredentialController creates a controller for password_credentials table.
+// opts must be the same as the ones of the UserController to look users up by email.
+func NewCredentialController(db DB, opts ...Option) CredentialController {
+	return &credentialController{
+		db:          db,
+		emailPolicy: newOptions(opts).emailPolicy,
+		opts:        opts,
+	}
+}
+
+type credentialController struct {
+	db          DB
+	emailPolicy EmailPolicy
+	opts        []Option
+}
+
+// validateSignUp validates the user and the password of a new account together
+func validateSignUp(name, email, password string) (string, string, error) {
+	var fields []FieldError
+
+	name, email, err := ValidateUser(name, email)
+	if verr, ok := err.(*ValidationError); ok {
+		fields = append(fields, verr.Fields...)
+	}
+
+	if ferr := validatePassword(password); ferr != nil {
+		fields = append(fields, *ferr)
+	}
+
+	if len(fields) != 0 {
+		return "", "", &ValidationError{Message: "user is invalid", Fields: fields}
+	}
+
+	return name, email, nil
+}
+
+func (cc *credentialController) SignUp(ctx context.Context, name, email, password string) (*User, error) {
+	name, email, err := validateSignUp(name, email, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// hashing is slow, so it is done before the transaction
+	hash, err := hashPassword(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var u *User
+	err = withTx(ctx, cc.db, func(db DB) error {
+		var err error
+		u, err = NewUserController(db, cc.opts...).NewUser(ctx, name, email)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = db.ExecContext(
+			ctx,
+			"INSERT INTO password_credentials(user_id, password_hash) VALUES ($1, $2)",
+			u.ID, hash,
+		)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (cc *credentialController) SetPassword(ctx context.Context, userID int, password string) error {
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+
+	if err != nil {
+		return err
+	}
+
+	return setPassword(ctx, cc.db, userID, hash)
+}
+
+// setPassword stores the hash as the password of the user
+func setPassword(ctx context.Context, db DB, userID int, hash string) error {
+	var id int
+	err := db.
+		QueryRowContext(
+			ctx,
+			`INSERT INTO password_credentials(user_id, password_hash)
+			SELECT id, $2 FROM users WHERE id=$1 AND deleted_at IS NULL
+			ON CONFLICT (user_id) DO UPDATE SET password_hash=EXCLUDED.password_hash, updated_at=now()
+			RETURNING user_id`,
+			userID, hash,
+		).
+		Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return ErrNoUser
+	}
+
+	return err
+}
+
+// revokeCredentials signs the user out everywhere by revoking sessions, refresh tokens and personal tokens
+func revokeCredentials(ctx context.Context, db DB, userID int) error {
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE user_id=$1",
+		"UPDATE refresh_tokens SET revoked_at=COALESCE(revoked_at, now()) WHERE user_id=$1",
+		"UPDATE personal_tokens SET revoked_at=COALESCE(revoked_at, now()) WHERE user_id=$1",
+	} {
+		if _, err := db.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cc *credentialController) ResetPassword(ctx context.Context, token, password string) (int, error) {
+	if err := ValidatePassword(password); err != nil {
+		return 0, err
+	}
+
+	hash, err := hashPassword(password)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var userID int
+	err = withTx(ctx, cc.db, func(db DB) error {
+		id, err := consumeOneTimeToken(ctx, db, token, PurposePasswordReset)
+
+		if err != nil {
+			return err
+		}
+
+		if err := setPassword(ctx, db, id, hash); err != nil {
+			return err
+		}
+		userID = id
+
+		return revokeCredentials(ctx, db, id)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+func (cc *credentialController) Login(ctx context.Context, email, password string) (*User, error) {
+	u := &User{}
+	var hash sql.NullString
+	err := scanUser(
+		cc.db.QueryRowContext(
+			ctx,
+			"SELECT "+userColumns+", (SELECT password_hash FROM password_credentials WHERE user_id=users.id) FROM users WHERE email_key=$1 AND deleted_at IS NULL",
+			cc.emailPolicy.Key(sanitize(email)),
+		),
+		u, &hash,
+	)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows || !hash.Valid {
+		rejectPassword(password)
+
+		return nil, ErrInvalidCredentials
+	}
+
+	ok, err := verifyPassword(hash.String, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return u, nil
+}
@@ -0,0 +1,197 @@
+package model
+
+import (
+	"context"
+	"sync"
+)
+
+// NewMemoryCredentialController creates a controller keeping passwords of users in uc,
+// which must be created by NewMemoryUserController.
+// It is safe for concurrent use and behaves like the controller for password_credentials table.
+// Passwords can be reset only with WithMemoryResetControllers.
+func NewMemoryCredentialController(uc UserController, opts ...Option) CredentialController {
+	return &memoryCredentialController{
+		users:  uc.(*memoryUserController),
+		reset:  newOptions(opts).reset,
+		hashes: map[int]string{},
+	}
+}
+
+// memoryResetControllers are the memory controllers resetting a password consumes a token of and revokes credentials in
+type memoryResetControllers struct {
+	tokens   *memoryOneTimeTokenController
+	sessions *memorySessionController
+	refresh  *memoryRefreshTokenController
+	personal *memoryPersonalTokenController
+}
+
+// WithMemoryResetControllers sets the controllers created by NewMemory* functions which a memory credential controller
+// consumes password reset tokens of and revokes credentials in, as the controllers for tables share a database instead.
+// Controllers may be nil if they are not used. Other controllers ignore it.
+func WithMemoryResetControllers(tokens OneTimeTokenController, sessions SessionController, refresh RefreshTokenController, personal PersonalTokenController) Option {
+	return func(o *options) {
+		o.reset.tokens, _ = tokens.(*memoryOneTimeTokenController)
+		o.reset.sessions, _ = sessions.(*memorySessionController)
+		o.reset.refresh, _ = refresh.(*memoryRefreshTokenController)
+		o.reset.personal, _ = personal.(*memoryPersonalTokenController)
+	}
+}
+
+type memoryCredentialController struct {
+	users *memoryUserController
+	reset memoryResetControllers
+
+	mu     sync.Mutex
+	hashes map[int]string
+}
+
+func (cc *memoryCredentialController) SignUp(ctx context.Context, name, email, password string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	name, email, err := validateSignUp(name, email, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashPassword(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// storing the hash can not fail, so the user does not need a transaction
+	u, err := cc.users.NewUser(ctx, name, email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cc.mu.Lock()
+	cc.hashes[u.ID] = hash
+	cc.mu.Unlock()
+
+	return u, nil
+}
+
+func (cc *memoryCredentialController) SetPassword(ctx context.Context, userID int, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := cc.users.GetUser(ctx, userID); err != nil {
+		return err
+	}
+
+	cc.mu.Lock()
+	cc.hashes[userID] = hash
+	cc.mu.Unlock()
+
+	return nil
+}
+
+func (cc *memoryCredentialController) ResetPassword(ctx context.Context, token, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := ValidatePassword(password); err != nil {
+		return 0, err
+	}
+
+	hash, err := hashPassword(password)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if cc.reset.tokens == nil {
+		return 0, ErrInvalidOneTimeToken
+	}
+
+	// nothing fails after the token is consumed, so the token is kept on failures as in the transaction
+	userID, err := cc.reset.tokens.ConsumeOneTimeToken(ctx, token, PurposePasswordReset)
+
+	if err != nil {
+		return 0, err
+	}
+
+	cc.mu.Lock()
+	cc.hashes[userID] = hash
+	cc.mu.Unlock()
+
+	if cc.reset.sessions != nil {
+		cc.reset.sessions.revokeUser(userID)
+	}
+
+	if cc.reset.refresh != nil {
+		cc.reset.refresh.revokeUser(userID)
+	}
+
+	if cc.reset.personal != nil {
+		cc.reset.personal.revokeUser(userID)
+	}
+
+	return userID, nil
+}
+
+func (cc *memoryCredentialController) Login(ctx context.Context, email, password string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var found *User
+	store := cc.users.store
+	key := store.emailPolicy.Key(sanitize(email))
+
+	cc.users.rlock()
+	for _, u := range store.users {
+		if u.DeletedAt == nil && store.emailPolicy.Key(u.Email) == key {
+			copied := *u
+			found = &copied
+
+			break
+		}
+	}
+	cc.users.runlock()
+
+	var (
+		hash string
+		ok   bool
+	)
+	if found != nil {
+		cc.mu.Lock()
+		hash, ok = cc.hashes[found.ID]
+		cc.mu.Unlock()
+	}
+
+	if !ok {
+		rejectPassword(password)
+
+		return nil, ErrInvalidCredentials
+	}
+
+	ok, err := verifyPassword(hash, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return found, nil
+}
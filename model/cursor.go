@@ -0,0 +1,77 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// cursor is a position in an ordered listing used for keyset pagination
+type cursor struct {
+	// Sort is the ordering the cursor was issued for
+	Sort string `json:"s"`
+
+	// Values are the values of the order keys of the last row
+	Values []json.RawMessage `json:"k"`
+}
+
+func newCursor(keys []orderKey, u *User) string {
+	c := &cursor{
+		Sort:   orderSignature(keys),
+		Values: make([]json.RawMessage, 0, len(keys)),
+	}
+
+	for _, k := range keys {
+		b, _ := json.Marshal(k.field.value(u))
+
+		c.Values = append(c.Values, b)
+	}
+
+	b, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the values of the order keys
+func decodeCursor(s string, keys []orderKey) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if c.Sort != orderSignature(keys) || len(c.Values) != len(keys) {
+		return nil, ErrInvalidCursor
+	}
+
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		var err error
+
+		switch k.field.kind {
+		case intField:
+			var v int
+			err = json.Unmarshal(c.Values[i], &v)
+			values[i] = v
+		case stringField:
+			var v string
+			err = json.Unmarshal(c.Values[i], &v)
+			values[i] = v
+		case timeField:
+			var v time.Time
+			err = json.Unmarshal(c.Values[i], &v)
+			values[i] = v
+		}
+
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,61 @@
+package model
+
+import "strings"
+
+// EmailPolicy decides which emails are regarded as the same address.
+// The zero value compares whole addresses case-insensitively.
+type EmailPolicy struct {
+	// CaseSensitiveLocalPart keeps the case of local parts.
+	// Domains are always compared in lower case.
+	CaseSensitiveLocalPart bool
+
+	// Normalize is applied to addresses before comparison if it is not nil
+	// (e.g. norm.NFC.String of golang.org/x/text/unicode/norm)
+	Normalize func(email string) string
+}
+
+// Key returns the normalized email which must be unique among users
+func (p EmailPolicy) Key(email string) string {
+	if p.Normalize != nil {
+		email = p.Normalize(email)
+	}
+
+	at := strings.LastIndexByte(email, '@')
+
+	if at < 0 {
+		return strings.ToLower(email)
+	}
+
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+
+	if !p.CaseSensitiveLocalPart {
+		local = strings.ToLower(local)
+	}
+
+	return local + "@" + domain
+}
+
+// Option configures controllers
+type Option func(o *options)
+
+type options struct {
+	emailPolicy EmailPolicy
+	reset       memoryResetControllers
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithEmailPolicy sets the policy to detect duplicated emails
+func WithEmailPolicy(p EmailPolicy) Option {
+	return func(o *options) {
+		o.emailPolicy = p
+	}
+}
@@ -0,0 +1,42 @@
+package model_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestEmailPolicyKey(t *testing.T) {
+	upper := model.EmailPolicy{
+		Normalize: strings.ToUpper,
+	}
+	nfc := model.EmailPolicy{
+		Normalize: norm.NFC.String,
+	}
+
+	tests := []struct {
+		policy   model.EmailPolicy
+		email    string
+		expected string
+	}{
+		{model.EmailPolicy{}, "Hoge@Example.COM", "hoge@example.com"},
+		{model.EmailPolicy{}, `"A@B"@Example.com`, `"a@b"@example.com`},
+		{model.EmailPolicy{CaseSensitiveLocalPart: true}, "Hoge@Example.COM", "Hoge@example.com"},
+		{model.EmailPolicy{CaseSensitiveLocalPart: true}, `"A@B"@Example.com`, `"A@B"@example.com`},
+		{upper, "Hoge@Example.COM", "hoge@example.com"},
+		{model.EmailPolicy{CaseSensitiveLocalPart: true, Normalize: upper.Normalize}, "Hoge@Example.COM", "HOGE@example.com"},
+		// E followed by the combining acute accent is composed into \u00c9 before lowering
+		{nfc, "JOSE\u0301@Example.com", "jos\u00e9@example.com"},
+		{nfc, "Jos\u00e9@Example.com", "jos\u00e9@example.com"},
+		{model.EmailPolicy{}, "JOSE\u0301@Example.com", "jose\u0301@example.com"},
+		{model.EmailPolicy{CaseSensitiveLocalPart: true, Normalize: norm.NFC.String}, "JOSE\u0301@Example.COM", "JOS\u00c9@example.com"},
+	}
+
+	for _, tc := range tests {
+		if key := tc.policy.Key(tc.email); key != tc.expected {
+			t.Errorf("key of %s is incorrect (expected: %s, actual: %s)", tc.email, tc.expected, key)
+		}
+	}
+}
@@ -4,5 +4,111 @@ import "errors"
 
 var (
 	// ErrNoUser means there is no target user in db
-	ErrNoUser = errors.New("specified user is not found")
+	ErrNoUser error = &NotFoundError{Message: "specified user is not found"}
+
+	// ErrInvalidCursor means the page cursor is malformed
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// ErrPreconditionFailed means the user has been updated since the expected time
+	ErrPreconditionFailed = errors.New("user has been modified")
+
+	// ErrDuplicatedInBatch means the user appears more than once in a batch
+	ErrDuplicatedInBatch error = &ConflictError{Message: "user is duplicated in the batch"}
+
+	// ErrNotDeleted means the user to restore is not deleted
+	ErrNotDeleted error = &ConflictError{Message: "specified user is not deleted"}
+
+	// ErrNoAPIKey means there is no target api key in db
+	ErrNoAPIKey error = &NotFoundError{Message: "specified api key is not found"}
+
+	// ErrInvalidAPIKey means the api key is unknown, revoked or expired
+	ErrInvalidAPIKey = errors.New("api key is invalid")
+
+	// ErrInvalidCredentials means the email or the password is incorrect
+	ErrInvalidCredentials = errors.New("email or password is incorrect")
+
+	// ErrInvalidSession means the session is unknown or expired
+	ErrInvalidSession = errors.New("session is invalid")
+
+	// ErrInvalidRefreshToken means the refresh token is unknown, revoked or expired
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid")
+
+	// ErrRefreshTokenReused means the refresh token has been used already, and its family is revoked
+	ErrRefreshTokenReused = errors.New("refresh token has been reused")
+
+	// ErrMFAEnabled means the user has confirmed TOTP already
+	ErrMFAEnabled error = &ConflictError{Message: "mfa is already enabled"}
+
+	// ErrTOTPNotEnrolled means the user has not started enrollment of TOTP
+	ErrTOTPNotEnrolled error = &ConflictError{Message: "totp is not enrolled"}
+
+	// ErrInvalidMFACode means the code is wrong, replayed or MFA is not enabled
+	ErrInvalidMFACode = errors.New("mfa code is invalid")
+
+	// ErrMFALocked means the user has entered wrong codes too many times in a row,
+	// and codes are rejected until the lockout ends
+	ErrMFALocked = errors.New("too many wrong mfa codes; try again later")
+
+	// ErrInvalidMFAChallenge means the challenge of the second step is unknown, expired or attempted too many times
+	ErrInvalidMFAChallenge = errors.New("mfa challenge is invalid")
+
+	// ErrInvalidOneTimeToken means the token is unknown, used, expired, for another purpose,
+	// or the email of the user has changed since it was issued
+	ErrInvalidOneTimeToken = errors.New("one-time token is invalid")
+
+	// ErrEmailVerified means the current email of the user has been verified already
+	ErrEmailVerified error = &ConflictError{Message: "email is already verified"}
+
+	// ErrNoPersonalToken means there is no target personal token of the user in db
+	ErrNoPersonalToken error = &NotFoundError{Message: "specified personal token is not found"}
+
+	// ErrInvalidPersonalToken means the personal token is unknown, revoked or expired
+	ErrInvalidPersonalToken = errors.New("personal token is invalid")
 )
+
+// NotFoundError means the target resource does not exist
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+// ConflictError means the request conflicts with the current state of resources
+type ConflictError struct {
+	Message string
+
+	// ExistingID is the id of the conflicting user if it is known
+	ExistingID int
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+func newEmailConflictError(existingID int) error {
+	return &ConflictError{Message: "email is already used", ExistingID: existingID}
+}
+
+// ValidationError means the input is semantically invalid
+type ValidationError struct {
+	Message string
+
+	// Fields are every invalid field and the reason
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msg := e.Message
+	for i, f := range e.Fields {
+		sep := "; "
+		if i == 0 {
+			sep = ": "
+		}
+
+		msg += sep + f.Field + " " + f.Reason
+	}
+
+	return msg
+}
@@ -0,0 +1,15 @@
+package model
+
+// TOTPCodeAt exposes totpCode to tests against the test vectors
+var TOTPCodeAt = totpCode
+
+// HashArgon2 exposes hashArgon2 with the default parameters
+func HashArgon2(secret string) (string, error) {
+	return hashArgon2(secret, defaultArgon2Params)
+}
+
+// VerifyArgon2 exposes verifyArgon2
+var VerifyArgon2 = verifyArgon2
+
+// MFALockout exposes mfaLockout
+var MFALockout = mfaLockout
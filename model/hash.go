@@ -0,0 +1,152 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Params is the cost of argon2id hashes.
+// Hashes keep their parameters, so they can be raised later.
+type argon2Params struct {
+	time    uint32
+	memory  uint32 // KiB
+	threads uint8
+}
+
+// defaultArgon2Params is the minimum configuration of argon2id recommended by OWASP
+var defaultArgon2Params = argon2Params{time: 2, memory: 19 * 1024, threads: 1}
+
+const (
+	argon2SaltBytes = 16
+	argon2KeyBytes  = 32
+)
+
+// errMalformedHash means the stored hash can not be parsed
+var errMalformedHash = errors.New("malformed hash")
+
+// hashArgon2 returns the salted argon2id hash of secret in the PHC string format
+// "$argon2id$v=19$m=19456,t=2,p=1$salt$key"
+func hashArgon2(secret string, p argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltBytes)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(secret), salt, p.time, p.memory, p.threads, argon2KeyBytes)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyArgon2 reports whether secret matches hash in constant time
+func verifyArgon2(hash, secret string) (bool, error) {
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 6 || len(parts[0]) != 0 || parts[1] != "argon2id" {
+		return false, errMalformedHash
+	}
+
+	var (
+		version int
+		p       argon2Params
+	)
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errMalformedHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil || p.time == 0 || p.threads == 0 {
+		return false, errMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return false, errMalformedHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil || len(key) == 0 {
+		return false, errMalformedHash
+	}
+
+	derived := argon2.IDKey([]byte(secret), salt, p.time, p.memory, p.threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// matchArgon2 returns the index of the first of hashes which secret matches, or -1 if none does
+func matchArgon2(hashes []string, secret string) (int, error) {
+	for i, hash := range hashes {
+		matched, err := verifyArgon2(hash, secret)
+
+		if err != nil {
+			return -1, err
+		}
+
+		if matched {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// lookupByPrefix returns the id of the active row of table whose hashColumn secret matches among the ones
+// with prefix, or 0 if none does.
+// The row may be revoked while the hashes are verified, so callers must check it again when they use it.
+func lookupByPrefix(ctx context.Context, db DB, table, hashColumn, prefix, secret string) (int, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		"SELECT id, "+hashColumn+" FROM "+table+" WHERE prefix=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())",
+		prefix,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		ids    []int
+		hashes []string
+	)
+	for rows.Next() {
+		var (
+			id   int
+			hash string
+		)
+		if err := rows.Scan(&id, &hash); err != nil {
+			return 0, err
+		}
+
+		ids = append(ids, id)
+		hashes = append(hashes, hash)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	// the connection is released before argon2id takes time
+	rows.Close()
+
+	i, err := matchArgon2(hashes, secret)
+
+	if err != nil || i < 0 {
+		return 0, err
+	}
+
+	return ids[i], nil
+}
@@ -0,0 +1,47 @@
+package model_test
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestArgon2(t *testing.T) {
+	hash, err := model.HashArgon2("secret")
+
+	if err != nil {
+		t.Fatal("hash error ", err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Error("hash should describe the parameters", hash)
+	}
+
+	if other, _ := model.HashArgon2("secret"); other == hash {
+		t.Error("hashes should be salted", hash)
+	}
+
+	if ok, err := model.VerifyArgon2(hash, "secret"); !ok || err != nil {
+		t.Error("the secret should match", ok, err)
+	}
+
+	if ok, err := model.VerifyArgon2(hash, "Secret"); ok || err != nil {
+		t.Error("other secrets should not match", ok, err)
+	}
+
+	// hashes made with other parameters are verified with their own parameters
+	key := argon2.IDKey([]byte("secret"), []byte("saltsalt"), 1, 8, 1, 16)
+	cheap := "$argon2id$v=19$m=8,t=1,p=1$" + base64.RawStdEncoding.EncodeToString([]byte("saltsalt")) + "$" + base64.RawStdEncoding.EncodeToString(key)
+	if ok, err := model.VerifyArgon2(cheap, "secret"); !ok || err != nil {
+		t.Error("hashes with other parameters should match", ok, err)
+	}
+
+	for _, malformed := range []string{"", "secret", "$argon2i$v=19$m=8,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=16$m=8,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=8,t=0,p=1$c2FsdA$a2V5"} {
+		if _, err := model.VerifyArgon2(malformed, "secret"); err == nil {
+			t.Error("malformed hashes should be rejected", malformed)
+		}
+	}
+}
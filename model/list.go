@@ -0,0 +1,189 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ListOptions specifies the users returned by ListUsers
+type ListOptions struct {
+	PageRequest
+
+	// Filter restricts users if it is not nil
+	Filter *Filter
+
+	// Sort is the ordering of users. Users are ordered by created_at by default.
+	// id is always used as the last key to make the ordering total.
+	Sort []SortField
+
+	// IncludeDeleted lists soft-deleted users as well
+	IncludeDeleted bool
+}
+
+// orderKey is a resolved SortField
+type orderKey struct {
+	name  string
+	field *userField
+	desc  bool
+}
+
+// orderKeys resolves opts.Sort. It fails with *QueryError on unknown or duplicated fields,
+// which ParseSort rejects but ListOptions built by hand may contain.
+func (opts *ListOptions) orderKeys() ([]orderKey, error) {
+	sort := opts.Sort
+	if len(sort) == 0 {
+		sort = []SortField{{Field: "created_at"}}
+	}
+
+	keys := make([]orderKey, 0, len(sort)+1)
+	seen := map[string]bool{}
+	for _, s := range sort {
+		field, ok := userFields[s.Field]
+
+		if !ok {
+			return nil, &QueryError{Message: "unknown sort field " + strconv.Quote(s.Field)}
+		}
+
+		if seen[s.Field] {
+			return nil, &QueryError{Message: "duplicated sort field " + strconv.Quote(s.Field)}
+		}
+		seen[s.Field] = true
+
+		keys = append(keys, orderKey{name: s.Field, field: field, desc: s.Desc})
+	}
+
+	if !seen["id"] {
+		keys = append(keys, orderKey{name: "id", field: userFields["id"]})
+	}
+
+	return keys, nil
+}
+
+func orderSignature(keys []orderKey) string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.name
+		if k.desc {
+			names[i] = "-" + names[i]
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// compareUsers compares users by the order keys
+func compareUsers(keys []orderKey, a, b *User) int {
+	for _, k := range keys {
+		c := compareValues(k.field.value(a), k.field.value(b))
+
+		if k.desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// afterCursor reports whether u comes after the cursor values
+func afterCursor(keys []orderKey, values []interface{}, u *User) bool {
+	for i, k := range keys {
+		c := compareValues(k.field.value(u), values[i])
+
+		if k.desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c > 0
+		}
+	}
+
+	return false
+}
+
+// listQuery builds a parameterized query fetching limit rows, or every row if limit is not positive
+func listQuery(opts *ListOptions, keys []orderKey, limit int) (string, []interface{}, error) {
+	var (
+		b     strings.Builder
+		args  []interface{}
+		conds []string
+	)
+
+	if !opts.IncludeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+
+	if opts.Filter != nil {
+		var cb strings.Builder
+		opts.Filter.root.sql(&cb, &args)
+
+		conds = append(conds, cb.String())
+	}
+
+	if len(opts.Cursor) != 0 {
+		values, err := decodeCursor(opts.Cursor, keys)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		conds = append(conds, keysetCondition(keys, values, &args))
+	}
+
+	b.WriteString("SELECT " + userColumns + " FROM users")
+
+	if len(conds) != 0 {
+		b.WriteString(" WHERE " + strings.Join(conds, " AND "))
+	}
+
+	b.WriteString(" ORDER BY ")
+	for i, k := range keys {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+
+		b.WriteString(k.field.column)
+		if k.desc {
+			b.WriteString(" DESC")
+		}
+	}
+
+	if limit > 0 {
+		args = append(args, limit)
+		b.WriteString(" LIMIT $" + strconv.Itoa(len(args)))
+	}
+
+	return b.String(), args, nil
+}
+
+// keysetCondition expands the row comparison for mixed directions as
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+func keysetCondition(keys []orderKey, values []interface{}, args *[]interface{}) string {
+	placeholders := make([]string, len(keys))
+	for i := range keys {
+		*args = append(*args, values[i])
+		placeholders[i] = "$" + strconv.Itoa(len(*args))
+	}
+
+	ors := make([]string, 0, len(keys))
+	for i, k := range keys {
+		ands := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			ands = append(ands, keys[j].field.column+" = "+placeholders[j])
+		}
+
+		op := " > "
+		if k.desc {
+			op = " < "
+		}
+		ands = append(ands, k.field.column+op+placeholders[i])
+
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+
+	return "(" + strings.Join(ors, " OR ") + ")"
+}
@@ -0,0 +1,568 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemoryUserController creates a controller keeping users in memory.
+// It is safe for concurrent use and behaves like the controller for users table.
+func NewMemoryUserController(opts ...Option) UserController {
+	o := newOptions(opts)
+
+	return &memoryUserController{
+		mu: &sync.RWMutex{},
+		store: &memoryStore{
+			users:       map[int]*User{},
+			emailPolicy: o.emailPolicy,
+		},
+	}
+}
+
+// memoryStore is shared by a controller and its transactions
+type memoryStore struct {
+	users       map[int]*User
+	lastID      int
+	emailPolicy EmailPolicy
+}
+
+// conflict returns *ConflictError if another user than id has the same email
+func (s *memoryStore) conflict(id int, email string) error {
+	key := s.emailPolicy.Key(email)
+
+	for _, u := range s.users {
+		if u.ID != id && u.DeletedAt == nil && s.emailPolicy.Key(u.Email) == key {
+			return newEmailConflictError(u.ID)
+		}
+	}
+
+	return nil
+}
+
+// insert adds a validated user
+func (s *memoryStore) insert(name, email string) (*User, error) {
+	if err := s.conflict(0, email); err != nil {
+		return nil, err
+	}
+
+	s.lastID++
+	t := now()
+
+	u := &User{
+		ID:        s.lastID,
+		Name:      name,
+		Email:     email,
+		CreatedAt: t,
+		UpdatedAt: t,
+	}
+	s.users[u.ID] = u
+
+	ret := *u
+
+	return &ret, nil
+}
+
+// update replaces name and email of u with validated ones
+func (s *memoryStore) update(u *User, name, email string) (*User, error) {
+	stored, ok := s.users[u.ID]
+
+	if !ok || stored.DeletedAt != nil {
+		return nil, ErrNoUser
+	}
+
+	if !u.UpdatedAt.IsZero() && !stored.UpdatedAt.Equal(u.UpdatedAt) {
+		return nil, ErrPreconditionFailed
+	}
+
+	if err := s.conflict(u.ID, email); err != nil {
+		return nil, err
+	}
+
+	s.changeEmail(stored, email)
+	stored.Name = name
+	stored.UpdatedAt = now()
+
+	ret := *stored
+
+	return &ret, nil
+}
+
+// changeEmail sets email to u, which needs verification again unless it is the same under the email policy
+func (s *memoryStore) changeEmail(u *User, email string) {
+	if s.emailPolicy.Key(u.Email) != s.emailPolicy.Key(email) {
+		u.EmailVerifiedAt = nil
+	}
+
+	u.Email = email
+}
+
+func (s *memoryStore) softDelete(id int) error {
+	u, ok := s.users[id]
+
+	if !ok || u.DeletedAt != nil {
+		return ErrNoUser
+	}
+
+	t := now()
+	u.DeletedAt = &t
+	u.UpdatedAt = t
+
+	return nil
+}
+
+type memoryUserController struct {
+	// mu is nil in transactions, which hold the lock of the parent
+	mu    *sync.RWMutex
+	store *memoryStore
+}
+
+var _ UserController = &memoryUserController{}
+
+func (uc *memoryUserController) lock() {
+	if uc.mu != nil {
+		uc.mu.Lock()
+	}
+}
+
+func (uc *memoryUserController) unlock() {
+	if uc.mu != nil {
+		uc.mu.Unlock()
+	}
+}
+
+func (uc *memoryUserController) rlock() {
+	if uc.mu != nil {
+		uc.mu.RLock()
+	}
+}
+
+func (uc *memoryUserController) runlock() {
+	if uc.mu != nil {
+		uc.mu.RUnlock()
+	}
+}
+
+// now returns the current time in the precision of Postgres
+func now() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+func (uc *memoryUserController) NewUser(ctx context.Context, name, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	name, email, err := ValidateUser(name, email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	return uc.store.insert(name, email)
+}
+
+// listed returns copies of users listed by opts in order
+func (uc *memoryUserController) listed(ctx context.Context, opts ListOptions, keys []orderKey) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	if len(opts.Cursor) != 0 {
+		var err error
+		values, err = decodeCursor(opts.Cursor, keys)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uc.rlock()
+	users := make([]*User, 0, len(uc.store.users))
+	for _, u := range uc.store.users {
+		if u.DeletedAt != nil && !opts.IncludeDeleted {
+			continue
+		}
+
+		if opts.Filter != nil && !opts.Filter.root.match(u) {
+			continue
+		}
+
+		if values != nil && !afterCursor(keys, values, u) {
+			continue
+		}
+
+		copied := *u
+		users = append(users, &copied)
+	}
+	uc.runlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return compareUsers(keys, users[i], users[j]) < 0
+	})
+
+	return users, nil
+}
+
+func (uc *memoryUserController) ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	limit := opts.limit()
+	keys, err := opts.orderKeys()
+
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := uc.listed(ctx, opts, keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page := &UserPage{
+		Users: users,
+	}
+
+	if len(users) > limit {
+		page.Users = users[:limit]
+		page.NextCursor = newCursor(keys, page.Users[limit-1])
+	}
+
+	return page, nil
+}
+
+// EachUser calls fn on a snapshot of users, which are in memory anyway.
+// The lock is not held while fn is called.
+func (uc *memoryUserController) EachUser(ctx context.Context, opts ListOptions, fn func(u *User) error) error {
+	keys, err := opts.orderKeys()
+
+	if err != nil {
+		return err
+	}
+
+	users, err := uc.listed(ctx, opts, keys)
+
+	if err != nil {
+		return err
+	}
+
+	if opts.Limit > 0 && len(users) > opts.Limit {
+		users = users[:opts.Limit]
+	}
+
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (uc *memoryUserController) GetUser(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uc.rlock()
+	defer uc.runlock()
+
+	u, ok := uc.store.users[id]
+
+	if !ok || u.DeletedAt != nil {
+		return nil, ErrNoUser
+	}
+
+	ret := *u
+
+	return &ret, nil
+}
+
+func (uc *memoryUserController) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uc.rlock()
+	defer uc.runlock()
+
+	key := uc.store.emailPolicy.Key(sanitize(email))
+	for _, u := range uc.store.users {
+		if u.DeletedAt == nil && uc.store.emailPolicy.Key(u.Email) == key {
+			ret := *u
+
+			return &ret, nil
+		}
+	}
+
+	return nil, ErrNoUser
+}
+
+func (uc *memoryUserController) VerifyEmail(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	u, ok := uc.store.users[id]
+
+	if !ok || u.DeletedAt != nil {
+		return nil, ErrNoUser
+	}
+
+	if u.EmailVerifiedAt == nil {
+		t := now()
+		u.EmailVerifiedAt = &t
+		u.UpdatedAt = t
+	}
+
+	ret := *u
+
+	return &ret, nil
+}
+
+func (uc *memoryUserController) UpdateUser(ctx context.Context, u *User) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	name, email, err := ValidateUser(u.Name, u.Email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	return uc.store.update(u, name, email)
+}
+
+func (uc *memoryUserController) PatchUser(ctx context.Context, id int, p UserPatch) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p, err := ValidatePatch(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	stored, ok := uc.store.users[id]
+
+	if !ok || stored.DeletedAt != nil {
+		return nil, ErrNoUser
+	}
+
+	if !p.UpdatedAt.IsZero() && !stored.UpdatedAt.Equal(p.UpdatedAt) {
+		return nil, ErrPreconditionFailed
+	}
+
+	if p.Email != nil {
+		if err := uc.store.conflict(id, *p.Email); err != nil {
+			return nil, err
+		}
+
+		uc.store.changeEmail(stored, *p.Email)
+	}
+
+	if p.Name != nil {
+		stored.Name = *p.Name
+	}
+
+	if p.Name != nil || p.Email != nil {
+		stored.UpdatedAt = now()
+	}
+
+	ret := *stored
+
+	return &ret, nil
+}
+
+func (uc *memoryUserController) DeleteUser(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	return uc.store.softDelete(id)
+}
+
+func (uc *memoryUserController) RestoreUser(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	u, ok := uc.store.users[id]
+
+	if !ok {
+		return nil, ErrNoUser
+	}
+
+	if u.DeletedAt == nil {
+		return nil, ErrNotDeleted
+	}
+
+	if err := uc.store.conflict(id, u.Email); err != nil {
+		return nil, err
+	}
+
+	u.DeletedAt = nil
+	u.UpdatedAt = now()
+
+	ret := *u
+
+	return &ret, nil
+}
+
+func (uc *memoryUserController) PurgeUsers(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	n := 0
+	for id, u := range uc.store.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(before) {
+			delete(uc.store.users, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (uc *memoryUserController) NewUsers(ctx context.Context, users []*User) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := checkBatchSize(len(users)); err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	results := make([]BatchResult, len(users))
+	for i, u := range users {
+		name, email, err := ValidateUser(u.Name, u.Email)
+
+		if err == nil {
+			results[i].User, err = uc.store.insert(name, email)
+		}
+		results[i].Err = err
+	}
+
+	return results, nil
+}
+
+func (uc *memoryUserController) UpdateUsers(ctx context.Context, users []*User) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := checkBatchSize(len(users)); err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	results := make([]BatchResult, len(users))
+	seen := map[int]bool{}
+	for i, u := range users {
+		if seen[u.ID] {
+			results[i].Err = ErrDuplicatedInBatch
+
+			continue
+		}
+		seen[u.ID] = true
+
+		name, email, err := ValidateUser(u.Name, u.Email)
+
+		if err == nil {
+			results[i].User, err = uc.store.update(u, name, email)
+		}
+		results[i].Err = err
+	}
+
+	return results, nil
+}
+
+func (uc *memoryUserController) DeleteUsers(ctx context.Context, ids []int) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := checkBatchSize(len(ids)); err != nil {
+		return nil, err
+	}
+
+	uc.lock()
+	defer uc.unlock()
+
+	results := make([]BatchResult, len(ids))
+	for i, id := range ids {
+		results[i].Err = uc.store.softDelete(id)
+	}
+
+	return results, nil
+}
+
+// WithTx runs fn exclusively and restores users if fn fails.
+// IDs are not reused after rollback like sequences of Postgres.
+func (uc *memoryUserController) WithTx(ctx context.Context, fn func(uc UserController) error) error {
+	if uc.mu == nil {
+		return fn(uc)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	snapshot := make(map[int]*User, len(uc.store.users))
+	for id, u := range uc.store.users {
+		copied := *u
+		snapshot[id] = &copied
+	}
+
+	committed := false
+	defer func() {
+		// also restores users when fn panics
+		if !committed {
+			uc.store.users = snapshot
+		}
+	}()
+
+	if err := fn(&memoryUserController{store: uc.store}); err != nil {
+		return err
+	}
+	committed = true
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package model_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/model/modeltest"
+)
+
+func TestMemoryUserControllerSuite(t *testing.T) {
+	modeltest.RunUserControllerSuite(t, func(t *testing.T) model.UserController {
+		return model.NewMemoryUserController()
+	})
+}
+
+func TestMemoryAPIKeyControllerSuite(t *testing.T) {
+	modeltest.RunAPIKeyControllerSuite(t, func(t *testing.T) model.APIKeyController {
+		return model.NewMemoryAPIKeyController()
+	})
+}
+
+func TestMemoryUserControllerEmailPolicy(t *testing.T) {
+	ctx := context.Background()
+	uc := model.NewMemoryUserController(model.WithEmailPolicy(model.EmailPolicy{CaseSensitiveLocalPart: true}))
+
+	if _, err := uc.NewUser(ctx, "name", "hoge@example.com"); err != nil {
+		t.Fatal("new user error ", err)
+	}
+
+	if _, err := uc.NewUser(ctx, "name2", "Hoge@example.com"); err != nil {
+		t.Fatal("local parts in different cases should be allowed", err)
+	}
+
+	if _, err := uc.NewUser(ctx, "name3", "hoge@EXAMPLE.com"); err == nil {
+		t.Fatal("domains should be case-insensitive")
+	}
+}
+
+func TestMemoryCredentialControllerSuite(t *testing.T) {
+	modeltest.RunCredentialControllerSuite(t, func(t *testing.T) (model.UserController, model.CredentialController) {
+		uc := model.NewMemoryUserController()
+
+		return uc, model.NewMemoryCredentialController(uc)
+	})
+}
+
+func TestMemorySessionControllerSuite(t *testing.T) {
+	modeltest.RunSessionControllerSuite(t, func(t *testing.T) (model.SessionController, int) {
+		return model.NewMemorySessionController(), 1
+	})
+}
+
+func TestMemorySigningKeyControllerSuite(t *testing.T) {
+	modeltest.RunSigningKeyControllerSuite(t, func(t *testing.T) model.SigningKeyController {
+		return model.NewMemorySigningKeyController()
+	})
+}
+
+func TestMemoryRefreshTokenControllerSuite(t *testing.T) {
+	modeltest.RunRefreshTokenControllerSuite(t, func(t *testing.T) (model.RefreshTokenController, int) {
+		return model.NewMemoryRefreshTokenController(), 1
+	})
+}
+
+func TestMemoryMFAControllerSuite(t *testing.T) {
+	modeltest.RunMFAControllerSuite(t, func(t *testing.T) (model.MFAController, int) {
+		return model.NewMemoryMFAController(), 1
+	})
+}
+
+func TestMemoryOneTimeTokenControllerSuite(t *testing.T) {
+	modeltest.RunOneTimeTokenControllerSuite(t, func(t *testing.T) (model.UserController, model.OneTimeTokenController) {
+		uc := model.NewMemoryUserController()
+
+		return uc, model.NewMemoryOneTimeTokenController(uc)
+	})
+}
+
+func TestMemoryPersonalTokenControllerSuite(t *testing.T) {
+	modeltest.RunPersonalTokenControllerSuite(t, func(t *testing.T) (model.UserController, model.PersonalTokenController) {
+		uc := model.NewMemoryUserController()
+
+		return uc, model.NewMemoryPersonalTokenController(uc)
+	})
+}
+
+func TestMemoryPasswordResetSuite(t *testing.T) {
+	modeltest.RunPasswordResetSuite(t, func(t *testing.T) *modeltest.PasswordResetControllers {
+		uc := model.NewMemoryUserController()
+		c := &modeltest.PasswordResetControllers{
+			Users:          uc,
+			OneTimeTokens:  model.NewMemoryOneTimeTokenController(uc),
+			Sessions:       model.NewMemorySessionController(),
+			RefreshTokens:  model.NewMemoryRefreshTokenController(),
+			PersonalTokens: model.NewMemoryPersonalTokenController(uc),
+		}
+		c.Credentials = model.NewMemoryCredentialController(uc, model.WithMemoryResetControllers(c.OneTimeTokens, c.Sessions, c.RefreshTokens, c.PersonalTokens))
+
+		return c
+	})
+}
@@ -0,0 +1,386 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	// mfaChallengePrefix starts every token of MFA challenges
+	mfaChallengePrefix = "umc_"
+
+	// maxMFAAttempts is the number of wrong codes after which a challenge is rejected,
+	// and the number of wrong codes of a user in a row after which the user is locked out
+	maxMFAAttempts = 5
+
+	// minMFALockout is the first lockout, which doubles on each lockout in a row up to maxMFALockout
+	minMFALockout = time.Minute
+	maxMFALockout = 24 * time.Hour
+)
+
+// mfaLockout returns how long codes of a user are rejected after failures wrong codes in a row.
+// Users are locked out every maxMFAAttempts failures, so that codes can not be guessed by starting new challenges.
+func mfaLockout(failures int) time.Duration {
+	if failures == 0 || failures%maxMFAAttempts != 0 {
+		return 0
+	}
+
+	d := minMFALockout
+	for i := maxMFAAttempts; i < failures && d < maxMFALockout; i += maxMFAAttempts {
+		d *= 2
+	}
+
+	if d > maxMFALockout {
+		d = maxMFALockout
+	}
+
+	return d
+}
+
+// MFAController defines an interface for totp_credentials, recovery_codes and mfa_challenges tables
+type MFAController interface {
+	// EnrollTOTP generates a new secret of the user and returns it in base32.
+	// The secret replaces one not confirmed yet, and it fails with ErrMFAEnabled if TOTP is confirmed.
+	EnrollTOTP(ctx context.Context, userID int) (string, error)
+
+	// ConfirmTOTP enables MFA of the user if code is valid for the enrolled secret,
+	// and returns recovery codes, which can not be retrieved later.
+	// It fails with ErrTOTPNotEnrolled, ErrMFAEnabled or ErrInvalidMFACode.
+	ConfirmTOTP(ctx context.Context, userID int, code string) ([]string, error)
+
+	// MFAEnabled reports whether the user has confirmed TOTP
+	MFAEnabled(ctx context.Context, userID int) (bool, error)
+
+	// VerifyMFA consumes a code of TOTP or a recovery code of the user.
+	// It fails with ErrInvalidMFACode if the code is wrong, the time step has been used or MFA is disabled,
+	// and with ErrMFALocked while the user is locked out after wrong codes in a row.
+	VerifyMFA(ctx context.Context, userID int, code string) error
+
+	// DisableMFA removes TOTP and recovery codes of the user
+	DisableMFA(ctx context.Context, userID int) error
+
+	// NewMFAChallenge starts the second step of login of the user lasting for ttl, and returns the token
+	NewMFAChallenge(ctx context.Context, userID int, ttl time.Duration) (string, error)
+
+	// CompleteMFAChallenge verifies code as VerifyMFA for the user of the challenge and returns the user id.
+	// Wrong codes count towards the lockout of the user as well as the attempts of the challenge.
+	// The challenge is consumed on success. It fails with ErrInvalidMFAChallenge
+	// if the challenge is unknown, expired or has been attempted with wrong codes too many times.
+	CompleteMFAChallenge(ctx context.Context, token, code string) (int, error)
+}
+
+// NewMFAController creates a controller for totp_credentials, recovery_codes and mfa_challenges tables
+func NewMFAController(db DB) MFAController {
+	return &mfaController{db: db}
+}
+
+type mfaController struct {
+	db DB
+}
+
+func (mc *mfaController) EnrollTOTP(ctx context.Context, userID int) (string, error) {
+	key, err := newTOTPSecret()
+
+	if err != nil {
+		return "", err
+	}
+
+	var enrolled bool
+	err = mc.db.
+		QueryRowContext(
+			ctx,
+			`INSERT INTO totp_credentials(user_id, secret) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, last_used_step=0, created_at=now()
+			WHERE totp_credentials.confirmed_at IS NULL
+			RETURNING true`,
+			userID, key,
+		).
+		Scan(&enrolled)
+
+	if err == sql.ErrNoRows {
+		return "", ErrMFAEnabled
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(key), nil
+}
+
+func (mc *mfaController) ConfirmTOTP(ctx context.Context, userID int, code string) ([]string, error) {
+	var codes []string
+	err := withTx(ctx, mc.db, func(db DB) error {
+		var (
+			key       []byte
+			last      int64
+			confirmed bool
+		)
+		err := db.
+			QueryRowContext(ctx, "SELECT secret, last_used_step, confirmed_at IS NOT NULL FROM totp_credentials WHERE user_id=$1 FOR UPDATE", userID).
+			Scan(&key, &last, &confirmed)
+
+		if err == sql.ErrNoRows {
+			return ErrTOTPNotEnrolled
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if confirmed {
+			return ErrMFAEnabled
+		}
+
+		step := matchTOTP(key, normalizeMFACode(code), time.Now(), last)
+
+		if step == 0 {
+			return ErrInvalidMFACode
+		}
+
+		if _, err := db.ExecContext(ctx, "UPDATE totp_credentials SET confirmed_at=now(), last_used_step=$2 WHERE user_id=$1", userID, step); err != nil {
+			return err
+		}
+
+		codes, err = replaceRecoveryCodes(ctx, db, userID)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// replaceRecoveryCodes issues new recovery codes of the user invalidating old ones
+func replaceRecoveryCodes(ctx context.Context, db DB, userID int) ([]string, error) {
+	codes, err := newRecoveryCodes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id=$1", userID); err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		if _, err := db.ExecContext(ctx, "INSERT INTO recovery_codes(user_id, code_hash) VALUES ($1, $2)", userID, hashSecret(normalizeMFACode(code))); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+func (mc *mfaController) MFAEnabled(ctx context.Context, userID int) (bool, error) {
+	var enabled bool
+	err := mc.db.
+		QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM totp_credentials WHERE user_id=$1 AND confirmed_at IS NOT NULL)", userID).
+		Scan(&enabled)
+
+	return enabled, err
+}
+
+func (mc *mfaController) VerifyMFA(ctx context.Context, userID int, code string) error {
+	failed := false
+	err := withTx(ctx, mc.db, func(db DB) error {
+		err := verifyMFA(ctx, db, userID, code)
+
+		// the failure is committed although the verification fails
+		if err == ErrInvalidMFACode {
+			failed = true
+
+			return nil
+		}
+
+		return err
+	})
+
+	if err == nil && failed {
+		return ErrInvalidMFACode
+	}
+
+	return err
+}
+
+// verifyMFA consumes the code of the user in db.
+// Wrong codes are counted, so db must be committed on ErrInvalidMFACode.
+func verifyMFA(ctx context.Context, db DB, userID int, code string) error {
+	var (
+		key      []byte
+		last     int64
+		failures int
+		locked   bool
+	)
+	err := db.
+		QueryRowContext(
+			ctx,
+			`SELECT secret, last_used_step, failed_attempts, COALESCE(locked_until > now(), false)
+			FROM totp_credentials WHERE user_id=$1 AND confirmed_at IS NOT NULL FOR UPDATE`,
+			userID,
+		).
+		Scan(&key, &last, &failures, &locked)
+
+	if err == sql.ErrNoRows {
+		return ErrInvalidMFACode
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		return ErrMFALocked
+	}
+
+	ok, err := consumeMFACode(ctx, db, userID, key, last, normalizeMFACode(code))
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		failures++
+		_, err := db.ExecContext(
+			ctx,
+			`UPDATE totp_credentials SET failed_attempts=$2,
+			locked_until=CASE WHEN $3 > 0 THEN now() + $3 * interval '1 microsecond' ELSE locked_until END
+			WHERE user_id=$1`,
+			userID, failures, int64(mfaLockout(failures)/time.Microsecond),
+		)
+
+		if err != nil {
+			return err
+		}
+
+		return ErrInvalidMFACode
+	}
+
+	if failures == 0 {
+		return nil
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE totp_credentials SET failed_attempts=0, locked_until=NULL WHERE user_id=$1", userID)
+
+	return err
+}
+
+// consumeMFACode reports whether code is a recovery code of the user or a TOTP code of key after the step last,
+// and marks it used. The row of totp_credentials must be locked.
+func consumeMFACode(ctx context.Context, db DB, userID int, key []byte, last int64, code string) (bool, error) {
+	if !isTOTPCode(code) {
+		var used bool
+		err := db.
+			QueryRowContext(ctx, "UPDATE recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL RETURNING true", userID, hashSecret(code)).
+			Scan(&used)
+
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	step := matchTOTP(key, code, time.Now(), last)
+
+	if step == 0 {
+		return false, nil
+	}
+
+	_, err := db.ExecContext(ctx, "UPDATE totp_credentials SET last_used_step=$2 WHERE user_id=$1", userID, step)
+
+	return err == nil, err
+}
+
+func (mc *mfaController) DisableMFA(ctx context.Context, userID int) error {
+	return withTx(ctx, mc.db, func(db DB) error {
+		if _, err := db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id=$1", userID); err != nil {
+			return err
+		}
+
+		_, err := db.ExecContext(ctx, "DELETE FROM totp_credentials WHERE user_id=$1", userID)
+
+		return err
+	})
+}
+
+func (mc *mfaController) NewMFAChallenge(ctx context.Context, userID int, ttl time.Duration) (string, error) {
+	token, err := newSecret(mfaChallengePrefix)
+
+	if err != nil {
+		return "", err
+	}
+
+	// expired challenges of the user are removed here since nothing else reads them
+	if _, err := mc.db.ExecContext(ctx, "DELETE FROM mfa_challenges WHERE user_id=$1 AND expires_at <= now()", userID); err != nil {
+		return "", err
+	}
+
+	_, err = mc.db.ExecContext(
+		ctx,
+		"INSERT INTO mfa_challenges(user_id, token_hash, expires_at) VALUES ($1, $2, now() + $3 * interval '1 microsecond')",
+		userID, hashSecret(token), int64(ttl/time.Microsecond),
+	)
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (mc *mfaController) CompleteMFAChallenge(ctx context.Context, token, code string) (int, error) {
+	var (
+		userID int
+		failed bool
+	)
+	err := withTx(ctx, mc.db, func(db DB) error {
+		var id int
+		err := db.
+			QueryRowContext(
+				ctx,
+				"SELECT id, user_id FROM mfa_challenges WHERE token_hash=$1 AND expires_at > now() AND attempts < $2 FOR UPDATE",
+				hashSecret(token), maxMFAAttempts,
+			).
+			Scan(&id, &userID)
+
+		if err == sql.ErrNoRows {
+			return ErrInvalidMFAChallenge
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = verifyMFA(ctx, db, userID, code)
+
+		if err == ErrInvalidMFACode {
+			// the attempt is committed although the verification fails
+			failed = true
+			_, err := db.ExecContext(ctx, "UPDATE mfa_challenges SET attempts=attempts+1 WHERE id=$1", id)
+
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		_, err = db.ExecContext(ctx, "DELETE FROM mfa_challenges WHERE id=$1", id)
+
+		return err
+	})
+
+	switch {
+	case err != nil:
+		return 0, err
+	case failed:
+		return 0, ErrInvalidMFACode
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,252 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewMemoryMFAController creates a controller keeping second factors in memory.
+// It is safe for concurrent use and behaves like the controller for totp_credentials,
+// recovery_codes and mfa_challenges tables.
+func NewMemoryMFAController() MFAController {
+	return &memoryMFAController{
+		totp:          map[int]*memoryTOTP{},
+		recoveryCodes: map[int]map[string]bool{},
+		challenges:    map[string]*memoryMFAChallenge{},
+	}
+}
+
+type memoryTOTP struct {
+	key       []byte
+	lastStep  int64
+	confirmed bool
+
+	// failures is the number of wrong codes in a row
+	failures    int
+	lockedUntil time.Time
+}
+
+type memoryMFAChallenge struct {
+	userID    int
+	expiresAt time.Time
+	attempts  int
+}
+
+// memoryMFAController keeps recovery codes of each user by the hash, which is true once used
+type memoryMFAController struct {
+	mu            sync.Mutex
+	totp          map[int]*memoryTOTP
+	recoveryCodes map[int]map[string]bool
+	challenges    map[string]*memoryMFAChallenge
+}
+
+func (mc *memoryMFAController) EnrollTOTP(ctx context.Context, userID int) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	key, err := newTOTPSecret()
+
+	if err != nil {
+		return "", err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if t, ok := mc.totp[userID]; ok && t.confirmed {
+		return "", ErrMFAEnabled
+	}
+
+	mc.totp[userID] = &memoryTOTP{key: key}
+
+	return totpEncoding.EncodeToString(key), nil
+}
+
+func (mc *memoryMFAController) ConfirmTOTP(ctx context.Context, userID int, code string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	t, ok := mc.totp[userID]
+
+	if !ok {
+		return nil, ErrTOTPNotEnrolled
+	}
+
+	if t.confirmed {
+		return nil, ErrMFAEnabled
+	}
+
+	step := matchTOTP(t.key, normalizeMFACode(code), time.Now(), t.lastStep)
+
+	if step == 0 {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, err := newRecoveryCodes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.confirmed = true
+	t.lastStep = step
+
+	hashes := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		hashes[string(hashSecret(normalizeMFACode(code)))] = false
+	}
+	mc.recoveryCodes[userID] = hashes
+
+	return codes, nil
+}
+
+func (mc *memoryMFAController) MFAEnabled(ctx context.Context, userID int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	t, ok := mc.totp[userID]
+
+	return ok && t.confirmed, nil
+}
+
+func (mc *memoryMFAController) VerifyMFA(ctx context.Context, userID int, code string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	return mc.verify(userID, code)
+}
+
+// verify consumes the code of the user and counts wrong codes. mc.mu must be held.
+func (mc *memoryMFAController) verify(userID int, code string) error {
+	t, ok := mc.totp[userID]
+
+	if !ok || !t.confirmed {
+		return ErrInvalidMFACode
+	}
+
+	if t.lockedUntil.After(now()) {
+		return ErrMFALocked
+	}
+
+	if !mc.consume(t, userID, normalizeMFACode(code)) {
+		t.failures++
+
+		if d := mfaLockout(t.failures); d > 0 {
+			t.lockedUntil = now().Add(d)
+		}
+
+		return ErrInvalidMFACode
+	}
+
+	t.failures = 0
+	t.lockedUntil = time.Time{}
+
+	return nil
+}
+
+// consume reports whether code is a recovery code of the user or a TOTP code of t, and marks it used
+func (mc *memoryMFAController) consume(t *memoryTOTP, userID int, code string) bool {
+	if !isTOTPCode(code) {
+		hash := string(hashSecret(code))
+
+		if used, ok := mc.recoveryCodes[userID][hash]; !ok || used {
+			return false
+		}
+
+		mc.recoveryCodes[userID][hash] = true
+
+		return true
+	}
+
+	step := matchTOTP(t.key, code, time.Now(), t.lastStep)
+
+	if step == 0 {
+		return false
+	}
+
+	t.lastStep = step
+
+	return true
+}
+
+func (mc *memoryMFAController) DisableMFA(ctx context.Context, userID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mc.mu.Lock()
+	delete(mc.totp, userID)
+	delete(mc.recoveryCodes, userID)
+	mc.mu.Unlock()
+
+	return nil
+}
+
+func (mc *memoryMFAController) NewMFAChallenge(ctx context.Context, userID int, ttl time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	token, err := newSecret(mfaChallengePrefix)
+
+	if err != nil {
+		return "", err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	t := now()
+	for hash, ch := range mc.challenges {
+		if ch.userID == userID && !ch.expiresAt.After(t) {
+			delete(mc.challenges, hash)
+		}
+	}
+
+	mc.challenges[string(hashSecret(token))] = &memoryMFAChallenge{
+		userID:    userID,
+		expiresAt: t.Add(ttl),
+	}
+
+	return token, nil
+}
+
+func (mc *memoryMFAController) CompleteMFAChallenge(ctx context.Context, token, code string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	hash := string(hashSecret(token))
+	ch, ok := mc.challenges[hash]
+
+	if !ok || !ch.expiresAt.After(now()) || ch.attempts >= maxMFAAttempts {
+		return 0, ErrInvalidMFAChallenge
+	}
+
+	if err := mc.verify(ch.userID, code); err != nil {
+		ch.attempts++
+
+		return 0, err
+	}
+
+	delete(mc.challenges, hash)
+
+	return ch.userID, nil
+}
@@ -0,0 +1,30 @@
+package model_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+func TestMFALockout(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, time.Minute},
+		{6, 0},
+		{10, 2 * time.Minute},
+		{15, 4 * time.Minute},
+		{60, 24 * time.Hour},
+		{5 << 20, 24 * time.Hour},
+	}
+
+	for _, tc := range tests {
+		if d := model.MFALockout(tc.failures); d != tc.expected {
+			t.Errorf("lockout after %d failures is incorrect (expected: %v, actual: %v)", tc.failures, tc.expected, d)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package modeltest
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// APIKeyFactory returns an empty APIKeyController for each test
+type APIKeyFactory func(t *testing.T) model.APIKeyController
+
+// RunAPIKeyControllerSuite checks that an APIKeyController implementation satisfies the contract
+func RunAPIKeyControllerSuite(t *testing.T, factory APIKeyFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, kc model.APIKeyController)
+	}{
+		{name: "NewAPIKey", fn: testNewAPIKey},
+		{name: "RevokeAPIKey", fn: testRevokeAPIKey},
+		{name: "APIKeyExpiry", fn: testAPIKeyExpiry},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, factory(t))
+		})
+	}
+}
+
+func testNewAPIKey(t *testing.T, kc model.APIKeyController) {
+	ctx := context.Background()
+
+	key, secret, err := kc.NewAPIKey(ctx, "ci", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new api key error ", err)
+	}
+
+	if key.Name != "ci" || !strings.HasPrefix(secret, key.Prefix) || key.LastUsedAt != nil || key.ExpiresAt != nil ||
+		!reflect.DeepEqual(key.Scopes, []string{model.ScopeRead}) {
+		t.Fatal("key is incorrect", key, secret)
+	}
+
+	other, otherSecret, err := kc.NewAPIKey(ctx, "deploy", []string{model.ScopeAdmin}, nil)
+
+	if err != nil {
+		t.Fatal("new api key error ", err)
+	}
+
+	if other.ID == key.ID || otherSecret == secret {
+		t.Fatal("keys should be distinct", key, other)
+	}
+
+	authenticated, err := kc.AuthenticateAPIKey(ctx, secret)
+
+	if err != nil {
+		t.Fatal("authenticate error ", err)
+	}
+
+	if authenticated.ID != key.ID || authenticated.LastUsedAt == nil || !reflect.DeepEqual(authenticated.Scopes, key.Scopes) {
+		t.Fatal("the use should be recorded", authenticated)
+	}
+
+	if _, err := kc.AuthenticateAPIKey(ctx, secret+"x"); err != model.ErrInvalidAPIKey {
+		t.Error("unknown secrets should be rejected", err)
+	}
+
+	keys, err := kc.ListAPIKeys(ctx)
+
+	if err != nil {
+		t.Fatal("list api keys error ", err)
+	}
+
+	if len(keys) != 2 || keys[0].ID != key.ID || keys[0].LastUsedAt == nil || keys[1].ID != other.ID {
+		t.Fatal("keys should be listed in order", keys)
+	}
+
+	if _, _, err := kc.NewAPIKey(ctx, "  ", []string{model.ScopeRead}, nil); err == nil {
+		t.Error("empty names should be rejected")
+	} else if _, ok := err.(*model.ValidationError); !ok {
+		t.Error("error should be *model.ValidationError", err)
+	}
+
+	scoped, _, err := kc.NewAPIKey(ctx, "scoped", []string{model.ScopeDelete, model.ScopeRead, model.ScopeDelete}, nil)
+
+	if err != nil {
+		t.Fatal("new api key error ", err)
+	}
+
+	if !reflect.DeepEqual(scoped.Scopes, []string{model.ScopeRead, model.ScopeDelete}) {
+		t.Error("scopes should be deduplicated in the canonical order", scoped.Scopes)
+	}
+
+	for _, scopes := range [][]string{nil, {"users:unknown"}} {
+		if _, _, err := kc.NewAPIKey(ctx, "invalid", scopes, nil); err == nil {
+			t.Error("invalid scopes should be rejected", scopes)
+		} else if _, ok := err.(*model.ValidationError); !ok {
+			t.Error("error should be *model.ValidationError", err)
+		}
+	}
+}
+
+func testRevokeAPIKey(t *testing.T, kc model.APIKeyController) {
+	ctx := context.Background()
+
+	key, secret, err := kc.NewAPIKey(ctx, "ci", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new api key error ", err)
+	}
+
+	if err := kc.RevokeAPIKey(ctx, key.ID); err != nil {
+		t.Fatal("revoke error ", err)
+	}
+
+	// revoking twice keeps the first time
+	if err := kc.RevokeAPIKey(ctx, key.ID); err != nil {
+		t.Fatal("revoke error ", err)
+	}
+
+	if _, err := kc.AuthenticateAPIKey(ctx, secret); err != model.ErrInvalidAPIKey {
+		t.Error("revoked keys should be rejected", err)
+	}
+
+	keys, err := kc.ListAPIKeys(ctx)
+
+	if err != nil {
+		t.Fatal("list api keys error ", err)
+	}
+
+	if len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Fatal("revoked keys should be listed", keys)
+	}
+
+	if err := kc.RevokeAPIKey(ctx, key.ID+1); err != model.ErrNoAPIKey {
+		t.Error("missing keys should be reported", err)
+	}
+}
+
+func testAPIKeyExpiry(t *testing.T, kc model.APIKeyController) {
+	ctx := context.Background()
+
+	past := time.Now().Add(-time.Minute)
+	if _, _, err := kc.NewAPIKey(ctx, "expired", []string{model.ScopeRead}, &past); err == nil {
+		t.Error("keys expiring in the past should be rejected")
+	}
+
+	expiresAt := time.Now().Add(200 * time.Millisecond)
+	key, secret, err := kc.NewAPIKey(ctx, "short", []string{model.ScopeRead}, &expiresAt)
+
+	if err != nil {
+		t.Fatal("new api key error ", err)
+	}
+
+	if key.ExpiresAt == nil || !key.ExpiresAt.Equal(expiresAt.Round(time.Microsecond)) {
+		t.Error("expiry is incorrect", key.ExpiresAt)
+	}
+
+	if _, err := kc.AuthenticateAPIKey(ctx, secret); err != nil {
+		t.Fatal("authenticate error ", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := kc.AuthenticateAPIKey(ctx, secret); err != model.ErrInvalidAPIKey {
+		t.Error("expired keys should be rejected", err)
+	}
+}
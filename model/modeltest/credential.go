@@ -0,0 +1,156 @@
+package modeltest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// CredentialFactory returns an empty UserController and a CredentialController sharing its users for each test
+type CredentialFactory func(t *testing.T) (model.UserController, model.CredentialController)
+
+// RunCredentialControllerSuite checks that a CredentialController implementation satisfies the contract
+func RunCredentialControllerSuite(t *testing.T, factory CredentialFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, uc model.UserController, cc model.CredentialController)
+	}{
+		{name: "SignUp", fn: testSignUp},
+		{name: "SetPassword", fn: testSetPassword},
+		{name: "LoginDeletedUser", fn: testLoginDeletedUser},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			uc, cc := factory(t)
+			tc.fn(t, uc, cc)
+		})
+	}
+}
+
+func testSignUp(t *testing.T, uc model.UserController, cc model.CredentialController) {
+	ctx := context.Background()
+
+	u, err := cc.SignUp(ctx, "taro", "taro@example.com", "correct horse")
+
+	if err != nil {
+		t.Fatal("sign up error ", err)
+	}
+
+	if stored, err := uc.GetUser(ctx, u.ID); err != nil || stored.Email != "taro@example.com" {
+		t.Fatal("the user should be created", stored, err)
+	}
+
+	logged, err := cc.Login(ctx, " TARO@example.com ", "correct horse")
+
+	if err != nil {
+		t.Fatal("login error ", err)
+	}
+
+	if logged.ID != u.ID {
+		t.Error("the user of the email should be returned", logged)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", "wrong horse"); err != model.ErrInvalidCredentials {
+		t.Error("wrong passwords should be rejected", err)
+	}
+
+	if _, err := cc.Login(ctx, "jiro@example.com", "correct horse"); err != model.ErrInvalidCredentials {
+		t.Error("unknown emails should be rejected", err)
+	}
+
+	if _, err := cc.SignUp(ctx, "taro2", "taro@example.com", "correct horse"); err == nil {
+		t.Error("used emails should be rejected")
+	} else if _, ok := err.(*model.ConflictError); !ok {
+		t.Error("error should be *model.ConflictError", err)
+	}
+
+	_, err = cc.SignUp(ctx, "", "hanako@example.com", "short")
+	verr, ok := err.(*model.ValidationError)
+
+	if !ok || len(verr.Fields) != 2 || verr.Fields[0].Field != "name" || verr.Fields[1].Field != "password" {
+		t.Fatal("invalid users and passwords should be reported together", err)
+	}
+
+	page, err := uc.ListUsers(ctx, model.ListOptions{})
+
+	if err != nil {
+		t.Fatal("list users error ", err)
+	}
+
+	if len(page.Users) != 1 {
+		t.Error("failed sign ups should not create users", page.Users)
+	}
+}
+
+func testSetPassword(t *testing.T, uc model.UserController, cc model.CredentialController) {
+	ctx := context.Background()
+
+	u, err := uc.NewUser(ctx, "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error ", err)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", ""); err != model.ErrInvalidCredentials {
+		t.Error("users without passwords should not log in", err)
+	}
+
+	if err := cc.SetPassword(ctx, u.ID, "first password"); err != nil {
+		t.Fatal("set password error ", err)
+	}
+
+	if err := cc.SetPassword(ctx, u.ID, "second password"); err != nil {
+		t.Fatal("set password error ", err)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", "first password"); err != model.ErrInvalidCredentials {
+		t.Error("replaced passwords should be rejected", err)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", "second password"); err != nil {
+		t.Error("the current password should be accepted", err)
+	}
+
+	if err := cc.SetPassword(ctx, u.ID+1, "password"); err != model.ErrNoUser {
+		t.Error("unknown users should be rejected", err)
+	}
+
+	if err := cc.SetPassword(ctx, u.ID, "short"); err == nil {
+		t.Error("short passwords should be rejected")
+	} else if _, ok := err.(*model.ValidationError); !ok {
+		t.Error("error should be *model.ValidationError", err)
+	}
+}
+
+func testLoginDeletedUser(t *testing.T, uc model.UserController, cc model.CredentialController) {
+	ctx := context.Background()
+
+	u, err := cc.SignUp(ctx, "taro", "taro@example.com", "correct horse")
+
+	if err != nil {
+		t.Fatal("sign up error ", err)
+	}
+
+	if err := uc.DeleteUser(ctx, u.ID); err != nil {
+		t.Fatal("delete user error ", err)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", "correct horse"); err != model.ErrInvalidCredentials {
+		t.Error("deleted users should not log in", err)
+	}
+
+	if err := cc.SetPassword(ctx, u.ID, "new password"); err != model.ErrNoUser {
+		t.Error("passwords of deleted users should not be set", err)
+	}
+
+	if _, err := uc.RestoreUser(ctx, u.ID); err != nil {
+		t.Fatal("restore user error ", err)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", "correct horse"); err != nil {
+		t.Error("restored users should log in again", err)
+	}
+}
@@ -0,0 +1,340 @@
+package modeltest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// MFAFactory returns an MFAController without second factors and an id of an existing user for each test
+type MFAFactory func(t *testing.T) (model.MFAController, int)
+
+// RunMFAControllerSuite checks that an MFAController implementation satisfies the contract
+func RunMFAControllerSuite(t *testing.T, factory MFAFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, mc model.MFAController, userID int)
+	}{
+		{name: "ConfirmTOTP", fn: testConfirmTOTP},
+		{name: "TOTPReplay", fn: testTOTPReplay},
+		{name: "RecoveryCodes", fn: testRecoveryCodes},
+		{name: "MFAChallenge", fn: testMFAChallenge},
+		{name: "MFALockout", fn: testMFALockout},
+		{name: "DisableMFA", fn: testDisableMFA},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mc, userID := factory(t)
+			tc.fn(t, mc, userID)
+		})
+	}
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := model.TOTPCode(secret, at)
+
+	if err != nil {
+		t.Fatal("totp code error ", err)
+	}
+
+	return code
+}
+
+// wrongTOTPCode returns a code accepted at no step around now
+func wrongTOTPCode(t *testing.T, secret string) string {
+	t.Helper()
+
+	valid := map[string]bool{}
+	for _, d := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		valid[totpCode(t, secret, time.Now().Add(d))] = true
+	}
+
+	for _, code := range []string{"000000", "111111", "222222", "333333"} {
+		if !valid[code] {
+			return code
+		}
+	}
+
+	panic("unreachable")
+}
+
+// enableMFA enrolls and confirms TOTP of the user, and returns the secret and recovery codes
+func enableMFA(t *testing.T, mc model.MFAController, userID int) (string, []string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	secret, err := mc.EnrollTOTP(ctx, userID)
+
+	if err != nil {
+		t.Fatal("enroll error ", err)
+	}
+
+	codes, err := mc.ConfirmTOTP(ctx, userID, totpCode(t, secret, time.Now()))
+
+	if err != nil {
+		t.Fatal("confirm error ", err)
+	}
+
+	return secret, codes
+}
+
+func testConfirmTOTP(t *testing.T, mc model.MFAController, userID int) {
+	ctx := context.Background()
+
+	if _, err := mc.ConfirmTOTP(ctx, userID, "123456"); err != model.ErrTOTPNotEnrolled {
+		t.Error("confirmation without enrollment should fail", err)
+	}
+
+	old, err := mc.EnrollTOTP(ctx, userID)
+
+	if err != nil {
+		t.Fatal("enroll error ", err)
+	}
+
+	secret, err := mc.EnrollTOTP(ctx, userID)
+
+	if err != nil {
+		t.Fatal("enroll error ", err)
+	}
+
+	if len(secret) != 32 || secret == old {
+		t.Fatal("secret should be regenerated", old, secret)
+	}
+
+	if enabled, err := mc.MFAEnabled(ctx, userID); err != nil || enabled {
+		t.Error("mfa should be disabled until confirmation", enabled, err)
+	}
+
+	if _, err := mc.ConfirmTOTP(ctx, userID, wrongTOTPCode(t, secret)); err != model.ErrInvalidMFACode {
+		t.Error("wrong codes should be rejected", err)
+	}
+
+	codes, err := mc.ConfirmTOTP(ctx, userID, totpCode(t, secret, time.Now()))
+
+	if err != nil {
+		t.Fatal("confirm error ", err)
+	}
+
+	if len(codes) != 10 {
+		t.Fatal("recovery codes should be issued", codes)
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if seen[code] {
+			t.Error("recovery codes should be distinct", codes)
+		}
+		seen[code] = true
+	}
+
+	if enabled, err := mc.MFAEnabled(ctx, userID); err != nil || !enabled {
+		t.Error("mfa should be enabled", enabled, err)
+	}
+
+	if _, err := mc.EnrollTOTP(ctx, userID); err != model.ErrMFAEnabled {
+		t.Error("enrollment should fail while mfa is enabled", err)
+	}
+
+	if _, err := mc.ConfirmTOTP(ctx, userID, totpCode(t, secret, time.Now())); err != model.ErrMFAEnabled {
+		t.Error("confirmation should fail while mfa is enabled", err)
+	}
+}
+
+func testTOTPReplay(t *testing.T, mc model.MFAController, userID int) {
+	ctx := context.Background()
+
+	secret, _ := enableMFA(t, mc, userID)
+
+	if err := mc.VerifyMFA(ctx, userID, totpCode(t, secret, time.Now())); err != model.ErrInvalidMFACode {
+		t.Error("the code used for confirmation should be rejected", err)
+	}
+
+	next := totpCode(t, secret, time.Now().Add(30*time.Second))
+
+	if err := mc.VerifyMFA(ctx, userID, next); err != nil {
+		t.Fatal("codes of the next step should be accepted for clock drift", err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID, next); err != model.ErrInvalidMFACode {
+		t.Error("replayed codes should be rejected", err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID, totpCode(t, secret, time.Now().Add(-30*time.Second))); err != model.ErrInvalidMFACode {
+		t.Error("codes of steps before the used one should be rejected", err)
+	}
+}
+
+func testRecoveryCodes(t *testing.T, mc model.MFAController, userID int) {
+	ctx := context.Background()
+
+	_, codes := enableMFA(t, mc, userID)
+
+	if err := mc.VerifyMFA(ctx, userID, " "+strings.ToUpper(codes[0])+" "); err != nil {
+		t.Fatal("recovery codes should be accepted regardless of case and spaces", err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID, codes[0]); err != model.ErrInvalidMFACode {
+		t.Error("recovery codes should be used only once", err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID, strings.Replace(codes[1], "-", "", -1)); err != nil {
+		t.Error("recovery codes without separators should be accepted", err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID, "aaaa-aaaa-aaaa-aaaa"); err != model.ErrInvalidMFACode {
+		t.Error("unknown recovery codes should be rejected", err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID+1, codes[2]); err != model.ErrInvalidMFACode {
+		t.Error("recovery codes of other users should be rejected", err)
+	}
+}
+
+func testMFAChallenge(t *testing.T, mc model.MFAController, userID int) {
+	ctx := context.Background()
+
+	secret, codes := enableMFA(t, mc, userID)
+
+	token, err := mc.NewMFAChallenge(ctx, userID, time.Minute)
+
+	if err != nil {
+		t.Fatal("new challenge error ", err)
+	}
+
+	if _, err := mc.CompleteMFAChallenge(ctx, token, wrongTOTPCode(t, secret)); err != model.ErrInvalidMFACode {
+		t.Error("wrong codes should be rejected", err)
+	}
+
+	id, err := mc.CompleteMFAChallenge(ctx, token, codes[0])
+
+	if err != nil {
+		t.Fatal("complete error ", err)
+	}
+
+	if id != userID {
+		t.Error("user of the challenge should be returned", id)
+	}
+
+	if _, err := mc.CompleteMFAChallenge(ctx, token, codes[1]); err != model.ErrInvalidMFAChallenge {
+		t.Error("challenges should be used only once", err)
+	}
+
+	token, err = mc.NewMFAChallenge(ctx, userID, time.Minute)
+
+	if err != nil {
+		t.Fatal("new challenge error ", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := mc.CompleteMFAChallenge(ctx, token, "aaaa-aaaa-aaaa-aaaa"); err != model.ErrInvalidMFACode {
+			t.Fatal("wrong codes should be rejected", err)
+		}
+	}
+
+	if _, err := mc.CompleteMFAChallenge(ctx, token, codes[1]); err != model.ErrInvalidMFAChallenge {
+		t.Error("challenges attempted too many times should be rejected", err)
+	}
+
+	token, err = mc.NewMFAChallenge(ctx, userID, 50*time.Millisecond)
+
+	if err != nil {
+		t.Fatal("new challenge error ", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := mc.CompleteMFAChallenge(ctx, token, codes[1]); err != model.ErrInvalidMFAChallenge {
+		t.Error("expired challenges should be rejected", err)
+	}
+}
+
+func testMFALockout(t *testing.T, mc model.MFAController, userID int) {
+	ctx := context.Background()
+
+	secret, codes := enableMFA(t, mc, userID)
+	wrong := wrongTOTPCode(t, secret)
+
+	// every wrong code is made in a new challenge as an attacker who knows the password
+	fail := func(n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			token, err := mc.NewMFAChallenge(ctx, userID, time.Minute)
+
+			if err != nil {
+				t.Fatal("new challenge error ", err)
+			}
+
+			if _, err := mc.CompleteMFAChallenge(ctx, token, wrong); err != model.ErrInvalidMFACode {
+				t.Fatal("wrong codes should be rejected", err)
+			}
+		}
+	}
+
+	fail(4)
+
+	if err := mc.VerifyMFA(ctx, userID, codes[0]); err != nil {
+		t.Fatal("valid codes should be accepted before the lockout", err)
+	}
+
+	// the success resets the count of wrong codes
+	fail(4)
+
+	if err := mc.VerifyMFA(ctx, userID, wrong); err != model.ErrInvalidMFACode {
+		t.Fatal("wrong codes should be rejected", err)
+	}
+
+	token, err := mc.NewMFAChallenge(ctx, userID, time.Minute)
+
+	if err != nil {
+		t.Fatal("new challenge error ", err)
+	}
+
+	if _, err := mc.CompleteMFAChallenge(ctx, token, codes[1]); err != model.ErrMFALocked {
+		t.Error("users should be locked out after wrong codes across challenges", err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID, codes[1]); err != model.ErrMFALocked {
+		t.Error("valid codes should be rejected during the lockout", err)
+	}
+
+	if err := mc.DisableMFA(ctx, userID); err != nil {
+		t.Fatal("disable error ", err)
+	}
+
+	_, codes = enableMFA(t, mc, userID)
+
+	if err := mc.VerifyMFA(ctx, userID, codes[0]); err != nil {
+		t.Error("the lockout should be removed with the factor", err)
+	}
+}
+
+func testDisableMFA(t *testing.T, mc model.MFAController, userID int) {
+	ctx := context.Background()
+
+	_, codes := enableMFA(t, mc, userID)
+
+	if err := mc.DisableMFA(ctx, userID); err != nil {
+		t.Fatal("disable error ", err)
+	}
+
+	if enabled, err := mc.MFAEnabled(ctx, userID); err != nil || enabled {
+		t.Error("mfa should be disabled", enabled, err)
+	}
+
+	if err := mc.VerifyMFA(ctx, userID, codes[0]); err != model.ErrInvalidMFACode {
+		t.Error("recovery codes should be removed", err)
+	}
+
+	if _, err := mc.EnrollTOTP(ctx, userID); err != nil {
+		t.Error("users should be able to enroll again", err)
+	}
+}
@@ -0,0 +1,168 @@
+package modeltest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// OneTimeTokenFactory returns an empty UserController and a OneTimeTokenController sharing its users for each test
+type OneTimeTokenFactory func(t *testing.T) (model.UserController, model.OneTimeTokenController)
+
+// RunOneTimeTokenControllerSuite checks that a OneTimeTokenController implementation satisfies the contract
+func RunOneTimeTokenControllerSuite(t *testing.T, factory OneTimeTokenFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, uc model.UserController, tc model.OneTimeTokenController)
+	}{
+		{name: "ConsumeOneTimeToken", fn: testConsumeOneTimeToken},
+		{name: "OneTimeTokenReissue", fn: testOneTimeTokenReissue},
+		{name: "OneTimeTokenExpiry", fn: testOneTimeTokenExpiry},
+		{name: "OneTimeTokenEmailChange", fn: testOneTimeTokenEmailChange},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			uc, otc := factory(t)
+			tc.fn(t, uc, otc)
+		})
+	}
+}
+
+func newTokenOwner(t *testing.T, uc model.UserController) *model.User {
+	t.Helper()
+
+	u, err := uc.NewUser(context.Background(), "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error ", err)
+	}
+
+	return u
+}
+
+func testConsumeOneTimeToken(t *testing.T, uc model.UserController, tc model.OneTimeTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	if _, err := tc.NewOneTimeToken(ctx, u.ID+100, model.PurposePasswordReset, time.Hour); err != model.ErrNoUser {
+		t.Error("tokens of unknown users should fail with ErrNoUser", err)
+	}
+
+	token, err := tc.NewOneTimeToken(ctx, u.ID, model.PurposePasswordReset, time.Hour)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, token, model.PurposeEmailVerification); err != model.ErrInvalidOneTimeToken {
+		t.Error("tokens should be rejected for other purposes", err)
+	}
+
+	id, err := tc.ConsumeOneTimeToken(ctx, token, model.PurposePasswordReset)
+
+	if err != nil {
+		t.Fatal("consume error ", err)
+	}
+
+	if id != u.ID {
+		t.Error("owner of the token should be returned", id)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, token, model.PurposePasswordReset); err != model.ErrInvalidOneTimeToken {
+		t.Error("tokens should be used only once", err)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, "unknown", model.PurposePasswordReset); err != model.ErrInvalidOneTimeToken {
+		t.Error("unknown tokens should be rejected", err)
+	}
+}
+
+func testOneTimeTokenReissue(t *testing.T, uc model.UserController, tc model.OneTimeTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	old, err := tc.NewOneTimeToken(ctx, u.ID, model.PurposePasswordReset, time.Hour)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	verification, err := tc.NewOneTimeToken(ctx, u.ID, model.PurposeEmailVerification, time.Hour)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	token, err := tc.NewOneTimeToken(ctx, u.ID, model.PurposePasswordReset, time.Hour)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, old, model.PurposePasswordReset); err != model.ErrInvalidOneTimeToken {
+		t.Error("tokens issued before should be invalidated", err)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, token, model.PurposePasswordReset); err != nil {
+		t.Error("the latest token should be accepted", err)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, verification, model.PurposeEmailVerification); err != nil {
+		t.Error("tokens for other purposes should be kept", err)
+	}
+}
+
+func testOneTimeTokenExpiry(t *testing.T, uc model.UserController, tc model.OneTimeTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	token, err := tc.NewOneTimeToken(ctx, u.ID, model.PurposeEmailVerification, 50*time.Millisecond)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, token, model.PurposeEmailVerification); err != model.ErrInvalidOneTimeToken {
+		t.Error("expired tokens should be rejected", err)
+	}
+}
+
+func testOneTimeTokenEmailChange(t *testing.T, uc model.UserController, tc model.OneTimeTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	token, err := tc.NewOneTimeToken(ctx, u.ID, model.PurposeEmailVerification, time.Hour)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	email := "jiro@example.com"
+	if _, err := uc.PatchUser(ctx, u.ID, model.UserPatch{Email: &email}); err != nil {
+		t.Fatal("patch user error ", err)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, token, model.PurposeEmailVerification); err != model.ErrInvalidOneTimeToken {
+		t.Error("tokens sent to the old email should be rejected", err)
+	}
+
+	token, err = tc.NewOneTimeToken(ctx, u.ID, model.PurposePasswordReset, time.Hour)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	if err := uc.DeleteUser(ctx, u.ID); err != nil {
+		t.Fatal("delete user error ", err)
+	}
+
+	if _, err := tc.ConsumeOneTimeToken(ctx, token, model.PurposePasswordReset); err != model.ErrInvalidOneTimeToken {
+		t.Error("tokens of deleted users should be rejected", err)
+	}
+}
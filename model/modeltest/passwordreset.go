@@ -0,0 +1,114 @@
+package modeltest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// PasswordResetControllers are the controllers which resetting a password consumes a token of and revokes credentials in.
+// They must share the users of Users.
+type PasswordResetControllers struct {
+	Users          model.UserController
+	Credentials    model.CredentialController
+	OneTimeTokens  model.OneTimeTokenController
+	Sessions       model.SessionController
+	RefreshTokens  model.RefreshTokenController
+	PersonalTokens model.PersonalTokenController
+}
+
+// PasswordResetFactory returns controllers without any data for each test
+type PasswordResetFactory func(t *testing.T) *PasswordResetControllers
+
+// RunPasswordResetSuite checks that CredentialController.ResetPassword consumes the token
+// and revokes credentials of the user atomically
+func RunPasswordResetSuite(t *testing.T, factory PasswordResetFactory) {
+	t.Run("ResetPassword", func(t *testing.T) {
+		testResetPassword(t, factory(t))
+	})
+}
+
+func testResetPassword(t *testing.T, c *PasswordResetControllers) {
+	cc := c.Credentials
+	ctx := context.Background()
+
+	u, err := cc.SignUp(ctx, "taro", "taro@example.com", "correct horse")
+
+	if err != nil {
+		t.Fatal("sign up error ", err)
+	}
+
+	_, session, err := c.Sessions.NewSession(ctx, u.ID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new session error ", err)
+	}
+
+	_, refresh, err := c.RefreshTokens.NewRefreshToken(ctx, u.ID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new refresh token error ", err)
+	}
+
+	_, personal, err := c.PersonalTokens.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new personal token error ", err)
+	}
+
+	token, err := c.OneTimeTokens.NewOneTimeToken(ctx, u.ID, model.PurposePasswordReset, time.Hour)
+
+	if err != nil {
+		t.Fatal("new token error ", err)
+	}
+
+	if _, err := cc.ResetPassword(ctx, token, "short"); err == nil {
+		t.Fatal("short passwords should be rejected")
+	} else if _, ok := err.(*model.ValidationError); !ok {
+		t.Fatal("error should be *model.ValidationError", err)
+	}
+
+	if _, err := cc.ResetPassword(ctx, "uot_unknown", "battery staple"); err != model.ErrInvalidOneTimeToken {
+		t.Error("unknown tokens should be rejected", err)
+	}
+
+	if _, err := c.Sessions.AuthenticateSession(ctx, session); err != nil {
+		t.Fatal("sessions should be kept by failures", err)
+	}
+
+	id, err := cc.ResetPassword(ctx, token, "battery staple")
+
+	if err != nil {
+		t.Fatal("tokens should be kept by failures", err)
+	}
+
+	if id != u.ID {
+		t.Error("the user of the token should be returned", id)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", "correct horse"); err != model.ErrInvalidCredentials {
+		t.Error("the old password should be rejected", err)
+	}
+
+	if _, err := cc.Login(ctx, "taro@example.com", "battery staple"); err != nil {
+		t.Error("the new password should be accepted", err)
+	}
+
+	if _, err := c.Sessions.AuthenticateSession(ctx, session); err != model.ErrInvalidSession {
+		t.Error("sessions should be revoked", err)
+	}
+
+	if _, _, err := c.RefreshTokens.RotateRefreshToken(ctx, refresh, time.Hour); err != model.ErrInvalidRefreshToken {
+		t.Error("refresh tokens should be revoked", err)
+	}
+
+	if _, err := c.PersonalTokens.AuthenticatePersonalToken(ctx, personal, "127.0.0.1"); err != model.ErrInvalidPersonalToken {
+		t.Error("personal tokens should be revoked", err)
+	}
+
+	if _, err := cc.ResetPassword(ctx, token, "another password"); err != model.ErrInvalidOneTimeToken {
+		t.Error("tokens should be used only once", err)
+	}
+}
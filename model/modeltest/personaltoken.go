@@ -0,0 +1,270 @@
+package modeltest
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// PersonalTokenFactory returns an empty UserController and a PersonalTokenController sharing its users for each test
+type PersonalTokenFactory func(t *testing.T) (model.UserController, model.PersonalTokenController)
+
+// RunPersonalTokenControllerSuite checks that a PersonalTokenController implementation satisfies the contract
+func RunPersonalTokenControllerSuite(t *testing.T, factory PersonalTokenFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, uc model.UserController, tc model.PersonalTokenController)
+	}{
+		{name: "NewPersonalToken", fn: testNewPersonalToken},
+		{name: "UpdatePersonalToken", fn: testUpdatePersonalToken},
+		{name: "RevokePersonalToken", fn: testRevokePersonalToken},
+		{name: "PersonalTokenExpiry", fn: testPersonalTokenExpiry},
+		{name: "PersonalTokenOwner", fn: testPersonalTokenOwner},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			uc, ptc := factory(t)
+			tc.fn(t, uc, ptc)
+		})
+	}
+}
+
+func testNewPersonalToken(t *testing.T, uc model.UserController, tc model.PersonalTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	if _, _, err := tc.NewPersonalToken(ctx, u.ID+100, "cli", []string{model.ScopeRead}, nil); err != model.ErrNoUser {
+		t.Error("tokens of unknown users should fail with ErrNoUser", err)
+	}
+
+	if _, _, err := tc.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeAdmin}, nil); err == nil {
+		t.Error("admin scope should not be granted")
+	} else if _, ok := err.(*model.ValidationError); !ok {
+		t.Error("error should be *model.ValidationError", err)
+	}
+
+	token, secret, err := tc.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new personal token error ", err)
+	}
+
+	if token.UserID != u.ID || token.Name != "cli" || !strings.HasPrefix(secret, model.PersonalTokenPrefix) ||
+		!strings.HasPrefix(secret, token.Prefix) || token.LastUsedAt != nil || len(token.LastUsedIP) != 0 ||
+		!reflect.DeepEqual(token.Scopes, []string{model.ScopeRead}) {
+		t.Fatal("token is incorrect", token, secret)
+	}
+
+	other, otherSecret, err := tc.NewPersonalToken(ctx, u.ID, "deploy", []string{model.ScopeRead, model.ScopeWrite}, nil)
+
+	if err != nil {
+		t.Fatal("new personal token error ", err)
+	}
+
+	if other.ID == token.ID || otherSecret == secret {
+		t.Fatal("tokens should be distinct", token, other)
+	}
+
+	authenticated, err := tc.AuthenticatePersonalToken(ctx, secret, "192.0.2.1")
+
+	if err != nil {
+		t.Fatal("authenticate error ", err)
+	}
+
+	if authenticated.ID != token.ID || authenticated.UserID != u.ID || authenticated.LastUsedAt == nil ||
+		authenticated.LastUsedIP != "192.0.2.1" || !reflect.DeepEqual(authenticated.Scopes, token.Scopes) {
+		t.Fatal("the use should be recorded", authenticated)
+	}
+
+	if _, err := tc.AuthenticatePersonalToken(ctx, secret+"x", "192.0.2.1"); err != model.ErrInvalidPersonalToken {
+		t.Error("unknown secrets should be rejected", err)
+	}
+
+	tokens, err := tc.ListPersonalTokens(ctx, u.ID)
+
+	if err != nil {
+		t.Fatal("list personal tokens error ", err)
+	}
+
+	if len(tokens) != 2 || tokens[0].ID != token.ID || tokens[0].LastUsedIP != "192.0.2.1" || tokens[1].ID != other.ID {
+		t.Fatal("tokens should be listed in order", tokens)
+	}
+
+	got, err := tc.GetPersonalToken(ctx, u.ID, other.ID)
+
+	if err != nil {
+		t.Fatal("get personal token error ", err)
+	}
+
+	if got.Name != "deploy" || !reflect.DeepEqual(got.Scopes, other.Scopes) {
+		t.Error("token is incorrect", got)
+	}
+
+	if _, err := tc.GetPersonalToken(ctx, u.ID, other.ID+100); err != model.ErrNoPersonalToken {
+		t.Error("unknown tokens should fail with ErrNoPersonalToken", err)
+	}
+}
+
+func testUpdatePersonalToken(t *testing.T, uc model.UserController, tc model.PersonalTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	token, secret, err := tc.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new personal token error ", err)
+	}
+
+	name := "script"
+	updated, err := tc.UpdatePersonalToken(ctx, u.ID, token.ID, model.PersonalTokenPatch{Name: &name})
+
+	if err != nil {
+		t.Fatal("update personal token error ", err)
+	}
+
+	if updated.Name != name || !reflect.DeepEqual(updated.Scopes, token.Scopes) {
+		t.Error("only the name should be updated", updated)
+	}
+
+	updated, err = tc.UpdatePersonalToken(ctx, u.ID, token.ID, model.PersonalTokenPatch{Scopes: []string{model.ScopeWrite}})
+
+	if err != nil {
+		t.Fatal("update personal token error ", err)
+	}
+
+	if updated.Name != name || !reflect.DeepEqual(updated.Scopes, []string{model.ScopeWrite}) {
+		t.Error("only the scopes should be updated", updated)
+	}
+
+	if _, err := tc.UpdatePersonalToken(ctx, u.ID, token.ID, model.PersonalTokenPatch{Scopes: []string{model.ScopeAdmin}}); err == nil {
+		t.Error("admin scope should not be granted")
+	} else if _, ok := err.(*model.ValidationError); !ok {
+		t.Error("error should be *model.ValidationError", err)
+	}
+
+	if _, err := tc.UpdatePersonalToken(ctx, u.ID, token.ID+100, model.PersonalTokenPatch{Name: &name}); err != model.ErrNoPersonalToken {
+		t.Error("unknown tokens should fail with ErrNoPersonalToken", err)
+	}
+
+	authenticated, err := tc.AuthenticatePersonalToken(ctx, secret, "192.0.2.1")
+
+	if err != nil {
+		t.Fatal("the secret should be kept", err)
+	}
+
+	if !reflect.DeepEqual(authenticated.Scopes, []string{model.ScopeWrite}) {
+		t.Error("new scopes should be effective", authenticated)
+	}
+}
+
+func testRevokePersonalToken(t *testing.T, uc model.UserController, tc model.PersonalTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	token, secret, err := tc.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new personal token error ", err)
+	}
+
+	if err := tc.RevokePersonalToken(ctx, u.ID, token.ID); err != nil {
+		t.Fatal("revoke personal token error ", err)
+	}
+
+	if err := tc.RevokePersonalToken(ctx, u.ID, token.ID); err != nil {
+		t.Error("revoking twice should succeed", err)
+	}
+
+	if err := tc.RevokePersonalToken(ctx, u.ID, token.ID+100); err != model.ErrNoPersonalToken {
+		t.Error("unknown tokens should fail with ErrNoPersonalToken", err)
+	}
+
+	if _, err := tc.AuthenticatePersonalToken(ctx, secret, "192.0.2.1"); err != model.ErrInvalidPersonalToken {
+		t.Error("revoked tokens should be rejected", err)
+	}
+
+	got, err := tc.GetPersonalToken(ctx, u.ID, token.ID)
+
+	if err != nil {
+		t.Fatal("get personal token error ", err)
+	}
+
+	if got.RevokedAt == nil {
+		t.Error("revoked tokens should be kept with the time", got)
+	}
+}
+
+func testPersonalTokenExpiry(t *testing.T, uc model.UserController, tc model.PersonalTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	past := time.Now().Add(-time.Minute)
+	if _, _, err := tc.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeRead}, &past); err == nil {
+		t.Error("expiry in the past should be rejected")
+	} else if _, ok := err.(*model.ValidationError); !ok {
+		t.Error("error should be *model.ValidationError", err)
+	}
+
+	expiresAt := time.Now().Add(50 * time.Millisecond)
+	token, secret, err := tc.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeRead}, &expiresAt)
+
+	if err != nil {
+		t.Fatal("new personal token error ", err)
+	}
+
+	if token.ExpiresAt == nil || !token.ExpiresAt.Equal(expiresAt.Round(time.Microsecond)) {
+		t.Error("expiry should be stored", token.ExpiresAt)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := tc.AuthenticatePersonalToken(ctx, secret, "192.0.2.1"); err != model.ErrInvalidPersonalToken {
+		t.Error("expired tokens should be rejected", err)
+	}
+}
+
+func testPersonalTokenOwner(t *testing.T, uc model.UserController, tc model.PersonalTokenController) {
+	ctx := context.Background()
+	u := newTokenOwner(t, uc)
+
+	other, err := uc.NewUser(ctx, "jiro", "jiro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error ", err)
+	}
+
+	token, _, err := tc.NewPersonalToken(ctx, u.ID, "cli", []string{model.ScopeRead}, nil)
+
+	if err != nil {
+		t.Fatal("new personal token error ", err)
+	}
+
+	if _, err := tc.GetPersonalToken(ctx, other.ID, token.ID); err != model.ErrNoPersonalToken {
+		t.Error("tokens of other users should not be found", err)
+	}
+
+	name := "stolen"
+	if _, err := tc.UpdatePersonalToken(ctx, other.ID, token.ID, model.PersonalTokenPatch{Name: &name}); err != model.ErrNoPersonalToken {
+		t.Error("tokens of other users should not be updated", err)
+	}
+
+	if err := tc.RevokePersonalToken(ctx, other.ID, token.ID); err != model.ErrNoPersonalToken {
+		t.Error("tokens of other users should not be revoked", err)
+	}
+
+	tokens, err := tc.ListPersonalTokens(ctx, other.ID)
+
+	if err != nil {
+		t.Fatal("list personal tokens error ", err)
+	}
+
+	if len(tokens) != 0 {
+		t.Error("tokens of other users should not be listed", tokens)
+	}
+}
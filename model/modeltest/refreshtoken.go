@@ -0,0 +1,154 @@
+package modeltest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// RefreshTokenFactory returns a RefreshTokenController without tokens and an id of an existing user for each test
+type RefreshTokenFactory func(t *testing.T) (model.RefreshTokenController, int)
+
+// RunRefreshTokenControllerSuite checks that a RefreshTokenController implementation satisfies the contract
+func RunRefreshTokenControllerSuite(t *testing.T, factory RefreshTokenFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, rc model.RefreshTokenController, userID int)
+	}{
+		{name: "RotateRefreshToken", fn: testRotateRefreshToken},
+		{name: "RefreshTokenReuse", fn: testRefreshTokenReuse},
+		{name: "RevokeRefreshToken", fn: testRevokeRefreshToken},
+		{name: "RefreshTokenExpiry", fn: testRefreshTokenExpiry},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rc, userID := factory(t)
+			tc.fn(t, rc, userID)
+		})
+	}
+}
+
+func testRotateRefreshToken(t *testing.T, rc model.RefreshTokenController, userID int) {
+	ctx := context.Background()
+
+	first, token, err := rc.NewRefreshToken(ctx, userID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new refresh token error ", err)
+	}
+
+	if first.UserID != userID || len(first.Family) == 0 || len(token) == 0 {
+		t.Fatal("token is incorrect", first, token)
+	}
+
+	other, _, err := rc.NewRefreshToken(ctx, userID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new refresh token error ", err)
+	}
+
+	if other.Family == first.Family {
+		t.Error("new tokens should start new families", first, other)
+	}
+
+	next, nextToken, err := rc.RotateRefreshToken(ctx, token, time.Hour)
+
+	if err != nil {
+		t.Fatal("rotate error ", err)
+	}
+
+	if next.Family != first.Family || next.UserID != userID || next.ID == first.ID || nextToken == token {
+		t.Fatal("the next token of the family should be issued", first, next)
+	}
+
+	if _, _, err := rc.RotateRefreshToken(ctx, nextToken, time.Hour); err != nil {
+		t.Error("the next token should be rotated", err)
+	}
+
+	if _, _, err := rc.RotateRefreshToken(ctx, token+"x", time.Hour); err != model.ErrInvalidRefreshToken {
+		t.Error("unknown tokens should be rejected", err)
+	}
+}
+
+func testRefreshTokenReuse(t *testing.T, rc model.RefreshTokenController, userID int) {
+	ctx := context.Background()
+
+	_, token, err := rc.NewRefreshToken(ctx, userID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new refresh token error ", err)
+	}
+
+	_, otherToken, err := rc.NewRefreshToken(ctx, userID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new refresh token error ", err)
+	}
+
+	_, nextToken, err := rc.RotateRefreshToken(ctx, token, time.Hour)
+
+	if err != nil {
+		t.Fatal("rotate error ", err)
+	}
+
+	if _, _, err := rc.RotateRefreshToken(ctx, token, time.Hour); err != model.ErrRefreshTokenReused {
+		t.Fatal("used tokens should be detected", err)
+	}
+
+	if _, _, err := rc.RotateRefreshToken(ctx, nextToken, time.Hour); err != model.ErrInvalidRefreshToken {
+		t.Error("the family should be revoked on reuse", err)
+	}
+
+	if _, _, err := rc.RotateRefreshToken(ctx, otherToken, time.Hour); err != nil {
+		t.Error("other families should be kept", err)
+	}
+}
+
+func testRevokeRefreshToken(t *testing.T, rc model.RefreshTokenController, userID int) {
+	ctx := context.Background()
+
+	_, token, err := rc.NewRefreshToken(ctx, userID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new refresh token error ", err)
+	}
+
+	_, nextToken, err := rc.RotateRefreshToken(ctx, token, time.Hour)
+
+	if err != nil {
+		t.Fatal("rotate error ", err)
+	}
+
+	// revoking with an old token of the family revokes the current one
+	if err := rc.RevokeRefreshToken(ctx, token); err != nil {
+		t.Fatal("revoke error ", err)
+	}
+
+	if _, _, err := rc.RotateRefreshToken(ctx, nextToken, time.Hour); err != model.ErrInvalidRefreshToken {
+		t.Error("revoked families should be rejected", err)
+	}
+
+	if err := rc.RevokeRefreshToken(ctx, "unknown"); err != nil {
+		t.Error("unknown tokens should be ignored", err)
+	}
+}
+
+func testRefreshTokenExpiry(t *testing.T, rc model.RefreshTokenController, userID int) {
+	ctx := context.Background()
+
+	_, token, err := rc.NewRefreshToken(ctx, userID, 50*time.Millisecond)
+
+	if err != nil {
+		t.Fatal("new refresh token error ", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, _, err := rc.RotateRefreshToken(ctx, token, time.Hour); err != model.ErrInvalidRefreshToken {
+		t.Error("expired tokens should be rejected", err)
+	}
+}
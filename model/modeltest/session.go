@@ -0,0 +1,106 @@
+package modeltest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// SessionFactory returns a SessionController without sessions and an id of an existing user for each test
+type SessionFactory func(t *testing.T) (model.SessionController, int)
+
+// RunSessionControllerSuite checks that a SessionController implementation satisfies the contract
+func RunSessionControllerSuite(t *testing.T, factory SessionFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, sc model.SessionController, userID int)
+	}{
+		{name: "NewSession", fn: testNewSession},
+		{name: "SessionExpiry", fn: testSessionExpiry},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			sc, userID := factory(t)
+			tc.fn(t, sc, userID)
+		})
+	}
+}
+
+func testNewSession(t *testing.T, sc model.SessionController, userID int) {
+	ctx := context.Background()
+
+	before := time.Now()
+	sess, token, err := sc.NewSession(ctx, userID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new session error ", err)
+	}
+
+	if sess.UserID != userID || len(token) == 0 {
+		t.Fatal("session is incorrect", sess, token)
+	}
+
+	if sess.ExpiresAt.Before(before.Add(time.Hour-time.Second)) || sess.ExpiresAt.After(time.Now().Add(time.Hour+time.Second)) {
+		t.Error("session should expire after ttl", sess.ExpiresAt)
+	}
+
+	_, other, err := sc.NewSession(ctx, userID, time.Hour)
+
+	if err != nil {
+		t.Fatal("new session error ", err)
+	}
+
+	if other == token {
+		t.Fatal("tokens should be distinct")
+	}
+
+	authenticated, err := sc.AuthenticateSession(ctx, token)
+
+	if err != nil {
+		t.Fatal("authenticate error ", err)
+	}
+
+	if authenticated.ID != sess.ID || authenticated.UserID != userID || !authenticated.ExpiresAt.Equal(sess.ExpiresAt) {
+		t.Error("session of the token should be returned", authenticated)
+	}
+
+	if err := sc.DeleteSession(ctx, token); err != nil {
+		t.Fatal("delete session error ", err)
+	}
+
+	if _, err := sc.AuthenticateSession(ctx, token); err != model.ErrInvalidSession {
+		t.Error("deleted sessions should be rejected", err)
+	}
+
+	if _, err := sc.AuthenticateSession(ctx, other); err != nil {
+		t.Error("other sessions should be kept", err)
+	}
+
+	if err := sc.DeleteSession(ctx, token); err != nil {
+		t.Error("unknown tokens should be ignored", err)
+	}
+}
+
+func testSessionExpiry(t *testing.T, sc model.SessionController, userID int) {
+	ctx := context.Background()
+
+	_, token, err := sc.NewSession(ctx, userID, 50*time.Millisecond)
+
+	if err != nil {
+		t.Fatal("new session error ", err)
+	}
+
+	if _, err := sc.AuthenticateSession(ctx, token); err != nil {
+		t.Fatal("authenticate error ", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := sc.AuthenticateSession(ctx, token); err != model.ErrInvalidSession {
+		t.Error("expired sessions should be rejected", err)
+	}
+}
@@ -0,0 +1,77 @@
+package modeltest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// SigningKeyFactory returns an empty SigningKeyController for each test
+type SigningKeyFactory func(t *testing.T) model.SigningKeyController
+
+// RunSigningKeyControllerSuite checks that a SigningKeyController implementation satisfies the contract
+func RunSigningKeyControllerSuite(t *testing.T, factory SigningKeyFactory) {
+	t.Run("AddSigningKey", func(t *testing.T) {
+		testAddSigningKey(t, factory(t))
+	})
+}
+
+func testAddSigningKey(t *testing.T, kc model.SigningKeyController) {
+	ctx := context.Background()
+
+	first := &model.SigningKey{ID: "first", Algorithm: "RS256", PrivateKey: []byte{1, 2, 3}}
+
+	if err := kc.AddSigningKey(ctx, first); err != nil {
+		t.Fatal("add signing key error ", err)
+	}
+
+	if first.CreatedAt.IsZero() {
+		t.Error("created_at should be set", first)
+	}
+
+	// created_at of keys added in the same transaction time could be equal
+	time.Sleep(10 * time.Millisecond)
+
+	if err := kc.AddSigningKey(ctx, &model.SigningKey{ID: "second", Algorithm: "RS256", PrivateKey: []byte{4, 5, 6}}); err != nil {
+		t.Fatal("add signing key error ", err)
+	}
+
+	keys, err := kc.ListSigningKeys(ctx)
+
+	if err != nil {
+		t.Fatal("list signing keys error ", err)
+	}
+
+	if len(keys) != 2 || keys[0].ID != "second" || keys[0].RetiredAt != nil || keys[1].ID != "first" || keys[1].RetiredAt == nil {
+		t.Fatal("the previous key should be retired", keys)
+	}
+
+	if !bytes.Equal(keys[1].PrivateKey, first.PrivateKey) || keys[1].Algorithm != "RS256" {
+		t.Error("keys should be stored as they are", keys[1])
+	}
+
+	n, err := kc.PurgeSigningKeys(ctx, keys[1].RetiredAt.Add(-time.Second))
+
+	if err != nil || n != 0 {
+		t.Error("keys retired later should be kept", n, err)
+	}
+
+	n, err = kc.PurgeSigningKeys(ctx, time.Now().Add(time.Second))
+
+	if err != nil || n != 1 {
+		t.Fatal("retired keys should be purged", n, err)
+	}
+
+	keys, err = kc.ListSigningKeys(ctx)
+
+	if err != nil {
+		t.Fatal("list signing keys error ", err)
+	}
+
+	if len(keys) != 1 || keys[0].ID != "second" {
+		t.Error("the active key should be kept", keys)
+	}
+}
@@ -0,0 +1,1386 @@
+// Package modeltest provides a conformance test suite for model.UserController implementations.
+package modeltest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// Factory returns an empty UserController for each test
+type Factory func(t *testing.T) model.UserController
+
+// RunUserControllerSuite checks that a UserController implementation satisfies the contract
+func RunUserControllerSuite(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, uc model.UserController)
+	}{
+		{name: "NewUser", fn: testNewUser},
+		{name: "GetUser", fn: testGetUser},
+		{name: "UpdateUser", fn: testUpdateUser},
+		{name: "GetUserNotFound", fn: testGetUserNotFound},
+		{name: "GetUserByEmail", fn: testGetUserByEmail},
+		{name: "VerifyEmail", fn: testVerifyEmail},
+		{name: "UpdateUserNotFound", fn: testUpdateUserNotFound},
+		{name: "PatchUser", fn: testPatchUser},
+		{name: "Precondition", fn: testPrecondition},
+		{name: "DeleteUser", fn: testDeleteUser},
+		{name: "RestoreUser", fn: testRestoreUser},
+		{name: "NewUsers", fn: testNewUsers},
+		{name: "UpdateUsers", fn: testUpdateUsers},
+		{name: "DeleteUsers", fn: testDeleteUsers},
+		{name: "PurgeUsers", fn: testPurgeUsers},
+		{name: "Validation", fn: testValidation},
+		{name: "EmailConflict", fn: testEmailConflict},
+		{name: "ListUsers", fn: testListUsers},
+		{name: "ListUsersPagination", fn: testListUsersPagination},
+		{name: "ListUsersFilterAndSort", fn: testListUsersFilterAndSort},
+		{name: "ListUsersInvalidCursor", fn: testListUsersInvalidCursor},
+		{name: "ListUsersInvalidSort", fn: testListUsersInvalidSort},
+		{name: "EachUser", fn: testEachUser},
+		{name: "Concurrency", fn: testConcurrency},
+		{name: "CanceledContext", fn: testCanceledContext},
+		{name: "WithTxCommit", fn: testWithTxCommit},
+		{name: "WithTxRollback", fn: testWithTxRollback},
+		{name: "WithTxConcurrent", fn: testWithTxConcurrent},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, factory(t))
+		})
+	}
+}
+
+func compareUser(t *testing.T, real *model.User, expected *model.User) {
+	t.Helper()
+
+	if expected.ID != -1 && real.ID != expected.ID {
+		t.Errorf("id does not match (expected: %v, actual: %v)", expected.ID, real.ID)
+	}
+
+	if real.Name != expected.Name {
+		t.Errorf("name does not match (expected: %v, actual: %v)", expected.Name, real.Name)
+	}
+
+	if real.Email != expected.Email {
+		t.Errorf("email does not match (expected: %v, actual: %v)", expected.Email, real.Email)
+	}
+}
+
+func checkTime(t *testing.T, before, after, target time.Time) {
+	t.Helper()
+
+	if target.Before(before.Add(-1*time.Second)) || target.After(after.Add(1*time.Second)) {
+		t.Fatalf("time is invalid(should be in (%v, %v), but got %v)", before, after, target)
+	}
+}
+
+func newUser(t *testing.T, uc model.UserController, name, email string) *model.User {
+	t.Helper()
+	ctx := context.Background()
+
+	u, err := uc.NewUser(ctx, name, email)
+
+	if err != nil {
+		t.Fatal("new user error ", err)
+	}
+
+	return u
+}
+
+func listAll(t *testing.T, uc model.UserController, opts model.ListOptions) []*model.User {
+	t.Helper()
+	ctx := context.Background()
+
+	var users []*model.User
+	for {
+		page, err := uc.ListUsers(ctx, opts)
+
+		if err != nil {
+			t.Fatal("list user error ", err)
+		}
+
+		if opts.Limit > 0 && len(page.Users) > opts.Limit {
+			t.Fatal("page exceeds the limit", len(page.Users), opts.Limit)
+		}
+
+		users = append(users, page.Users...)
+
+		if len(page.NextCursor) == 0 {
+			return users
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func testNewUser(t *testing.T, uc model.UserController) {
+	before := time.Now()
+
+	param := &model.User{
+		ID:    -1,
+		Name:  "name",
+		Email: "hoge@example.com",
+	}
+
+	ret := newUser(t, uc, param.Name, param.Email)
+	after := time.Now()
+
+	compareUser(t, ret, param)
+
+	if ret.ID <= 0 {
+		t.Error("id should be positive", ret.ID)
+	}
+
+	checkTime(t, before, after, ret.CreatedAt)
+	checkTime(t, before, after, ret.UpdatedAt)
+
+	if !ret.CreatedAt.Equal(ret.UpdatedAt) {
+		t.Error("updated_at should equal to created_at", ret.CreatedAt, ret.UpdatedAt)
+	}
+
+	next := newUser(t, uc, "name2", "hoge2@example.com")
+
+	if next.ID <= ret.ID {
+		t.Error("ids should be incremented", ret.ID, next.ID)
+	}
+}
+
+func testGetUser(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+
+	ret, err := uc.GetUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("get user error ", err)
+	}
+
+	compareUser(t, ret, user)
+
+	if !ret.CreatedAt.Equal(user.CreatedAt) || !ret.UpdatedAt.Equal(user.UpdatedAt) {
+		t.Error("timestamps do not match", ret, user)
+	}
+
+	// returned users must not be shared with the store
+	ret.Name = "modified"
+
+	ret, err = uc.GetUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("get user error ", err)
+	}
+
+	compareUser(t, ret, user)
+}
+
+func testUpdateUser(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	created := *user
+
+	time.Sleep(10 * time.Millisecond)
+
+	beforeUpdated := time.Now()
+
+	user.Name = "name2"
+	user.Email = "hoge2@example.com"
+	// created_at in parameters must be ignored, and zero updated_at means no precondition
+	user.CreatedAt = time.Time{}
+	user.UpdatedAt = time.Time{}
+
+	ret, err := uc.UpdateUser(ctx, user)
+
+	if err != nil {
+		t.Fatal("update error ", err)
+	}
+	afterUpdated := time.Now()
+
+	compareUser(t, ret, user)
+
+	if !ret.CreatedAt.Equal(created.CreatedAt) {
+		t.Error("created_at should not be changed", ret.CreatedAt, created.CreatedAt)
+	}
+
+	if !ret.UpdatedAt.After(created.UpdatedAt) {
+		t.Error("updated_at should be advanced", ret.UpdatedAt, created.UpdatedAt)
+	}
+	checkTime(t, beforeUpdated, afterUpdated, ret.UpdatedAt)
+
+	got, err := uc.GetUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("get user error ", err)
+	}
+
+	compareUser(t, got, user)
+
+	if !got.CreatedAt.Equal(ret.CreatedAt) || !got.UpdatedAt.Equal(ret.UpdatedAt) {
+		t.Error("timestamps do not match", got, ret)
+	}
+}
+
+func testGetUserNotFound(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	if _, err := uc.GetUser(ctx, 1); err != model.ErrNoUser {
+		t.Error("get user from empty store should return ErrNoUser, but got", err)
+	}
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+
+	if _, err := uc.GetUser(ctx, user.ID+1000); err != model.ErrNoUser {
+		t.Error("get missing user should return ErrNoUser, but got", err)
+	}
+}
+
+func testGetUserByEmail(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	u, err := uc.NewUser(ctx, "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error ", err)
+	}
+
+	found, err := uc.GetUserByEmail(ctx, " Taro@Example.com ")
+
+	if err != nil {
+		t.Fatal("get user by email error ", err)
+	}
+
+	compareUser(t, found, u)
+
+	if _, err := uc.GetUserByEmail(ctx, "jiro@example.com"); err != model.ErrNoUser {
+		t.Error("unknown emails should fail with ErrNoUser", err)
+	}
+
+	if err := uc.DeleteUser(ctx, u.ID); err != nil {
+		t.Fatal("delete user error ", err)
+	}
+
+	if _, err := uc.GetUserByEmail(ctx, "taro@example.com"); err != model.ErrNoUser {
+		t.Error("deleted users should not be found", err)
+	}
+}
+
+func testVerifyEmail(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	u, err := uc.NewUser(ctx, "taro", "taro@example.com")
+
+	if err != nil {
+		t.Fatal("new user error ", err)
+	}
+
+	if u.EmailVerifiedAt != nil {
+		t.Error("new users should not be verified", u.EmailVerifiedAt)
+	}
+
+	verified, err := uc.VerifyEmail(ctx, u.ID)
+
+	if err != nil {
+		t.Fatal("verify email error ", err)
+	}
+
+	if verified.EmailVerifiedAt == nil {
+		t.Fatal("email should be verified")
+	}
+
+	again, err := uc.VerifyEmail(ctx, u.ID)
+
+	if err != nil || again.EmailVerifiedAt == nil || !again.EmailVerifiedAt.Equal(*verified.EmailVerifiedAt) {
+		t.Error("the first verification should be kept", again, err)
+	}
+
+	name := "jiro"
+	patched, err := uc.PatchUser(ctx, u.ID, model.UserPatch{Name: &name})
+
+	if err != nil || patched.EmailVerifiedAt == nil {
+		t.Error("changing names should keep the verification", patched, err)
+	}
+
+	updated, err := uc.UpdateUser(ctx, &model.User{ID: u.ID, Name: "jiro", Email: "jiro@example.com"})
+
+	if err != nil {
+		t.Fatal("update user error ", err)
+	}
+
+	if updated.EmailVerifiedAt != nil {
+		t.Error("changing emails should clear the verification", updated.EmailVerifiedAt)
+	}
+
+	if got, err := uc.GetUser(ctx, u.ID); err != nil || got.EmailVerifiedAt != nil {
+		t.Error("the cleared verification should be stored", got, err)
+	}
+
+	if _, err := uc.VerifyEmail(ctx, u.ID+100); err != model.ErrNoUser {
+		t.Error("unknown users should fail with ErrNoUser", err)
+	}
+}
+
+func testUpdateUserNotFound(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+
+	_, err := uc.UpdateUser(ctx, &model.User{ID: user.ID + 1000, Name: "name2", Email: "hoge2@example.com"})
+
+	if err != model.ErrNoUser {
+		t.Fatal("update of missing user should return ErrNoUser, but got", err)
+	}
+
+	ret, err := uc.GetUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("get user error ", err)
+	}
+
+	compareUser(t, ret, user)
+}
+
+func testPatchUser(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	other := newUser(t, uc, "name2", "hoge2@example.com")
+
+	name := " name3 "
+	before := time.Now()
+	patched, err := uc.PatchUser(ctx, user.ID, model.UserPatch{Name: &name})
+	after := time.Now()
+
+	if err != nil {
+		t.Fatal("patch user error ", err)
+	}
+	compareUser(t, patched, &model.User{ID: user.ID, Name: "name3", Email: user.Email})
+	checkTime(t, before, after, patched.UpdatedAt)
+
+	if !patched.CreatedAt.Equal(user.CreatedAt) {
+		t.Error("created_at should not be changed", patched.CreatedAt)
+	}
+
+	email := "hoge3@example.com"
+	patched, err = uc.PatchUser(ctx, user.ID, model.UserPatch{Email: &email})
+
+	if err != nil {
+		t.Fatal("patch user error ", err)
+	}
+	compareUser(t, patched, &model.User{ID: user.ID, Name: "name3", Email: email})
+
+	// an empty patch changes nothing
+	if u, err := uc.PatchUser(ctx, user.ID, model.UserPatch{}); err != nil {
+		t.Error("empty patch error", err)
+	} else if !u.UpdatedAt.Equal(patched.UpdatedAt) {
+		t.Error("empty patch should not touch updated_at", u.UpdatedAt, patched.UpdatedAt)
+	}
+
+	empty, invalid := "", "hoge"
+	_, err = uc.PatchUser(ctx, user.ID, model.UserPatch{Name: &empty, Email: &invalid})
+	checkValidationError(t, err, "name", "email")
+
+	email = "HOGE2@example.com"
+	_, err = uc.PatchUser(ctx, user.ID, model.UserPatch{Email: &email})
+	checkConflictError(t, err, other.ID)
+
+	if _, err := uc.PatchUser(ctx, user.ID+1000, model.UserPatch{Name: &name}); err != model.ErrNoUser {
+		t.Error("patching missing user should return ErrNoUser", err)
+	}
+
+	if err := uc.DeleteUser(ctx, other.ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+
+	if _, err := uc.PatchUser(ctx, other.ID, model.UserPatch{Name: &name}); err != model.ErrNoUser {
+		t.Error("deleted user should not be patched", err)
+	}
+}
+
+func testPrecondition(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	stale := *user
+
+	// updated_at is advanced at least by the precision of timestamps
+	time.Sleep(time.Millisecond)
+
+	user.Name = "name2"
+	updated, err := uc.UpdateUser(ctx, user)
+
+	if err != nil {
+		t.Fatal("update with the current updated_at error ", err)
+	}
+
+	stale.Name = "name3"
+	if _, err := uc.UpdateUser(ctx, &stale); err != model.ErrPreconditionFailed {
+		t.Error("update with stale updated_at should return ErrPreconditionFailed", err)
+	}
+
+	name := "name4"
+	if _, err := uc.PatchUser(ctx, user.ID, model.UserPatch{Name: &name, UpdatedAt: stale.UpdatedAt}); err != model.ErrPreconditionFailed {
+		t.Error("patch with stale updated_at should return ErrPreconditionFailed", err)
+	}
+
+	if _, err := uc.PatchUser(ctx, user.ID, model.UserPatch{UpdatedAt: stale.UpdatedAt}); err != model.ErrPreconditionFailed {
+		t.Error("empty patch with stale updated_at should return ErrPreconditionFailed", err)
+	}
+
+	patched, err := uc.PatchUser(ctx, user.ID, model.UserPatch{Name: &name, UpdatedAt: updated.UpdatedAt})
+
+	if err != nil {
+		t.Fatal("patch with the current updated_at error ", err)
+	}
+	compareUser(t, patched, &model.User{ID: user.ID, Name: name, Email: user.Email})
+
+	stale.ID += 1000
+	if _, err := uc.UpdateUser(ctx, &stale); err != model.ErrNoUser {
+		t.Error("missing user should be reported prior to the precondition", err)
+	}
+}
+
+func checkResults(t *testing.T, results []model.BatchResult, n int) {
+	t.Helper()
+
+	if len(results) != n {
+		t.Fatal("the number of results is incorrect", len(results))
+	}
+}
+
+func testNewUsers(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	existing := newUser(t, uc, "name", "hoge@example.com")
+
+	before := time.Now()
+	results, err := uc.NewUsers(ctx, []*model.User{
+		{Name: "name2", Email: "hoge2@example.com"},
+		{Name: "", Email: "hoge3@example.com"},
+		{Name: "name4", Email: "HOGE@example.com"},
+		{Name: " name5 ", Email: "hoge5@example.com"},
+		{Name: "name6", Email: "Hoge5@example.com"},
+	})
+	after := time.Now()
+
+	if err != nil {
+		t.Fatal("new users error ", err)
+	}
+	checkResults(t, results, 5)
+
+	for _, i := range []int{0, 3} {
+		if results[i].Err != nil || results[i].User == nil {
+			t.Fatal("user should be created", i, results[i].Err)
+		}
+		checkTime(t, before, after, results[i].User.CreatedAt)
+	}
+	compareUser(t, results[0].User, &model.User{ID: -1, Name: "name2", Email: "hoge2@example.com"})
+	compareUser(t, results[3].User, &model.User{ID: -1, Name: "name5", Email: "hoge5@example.com"})
+
+	checkValidationError(t, results[1].Err, "name")
+	checkConflictError(t, results[2].Err, existing.ID)
+
+	// the first one wins in the batch
+	checkConflictError(t, results[4].Err, results[3].User.ID)
+
+	for _, i := range []int{0, 3} {
+		u, err := uc.GetUser(ctx, results[i].User.ID)
+
+		if err != nil {
+			t.Fatal("get user error ", err)
+		}
+		compareUser(t, u, results[i].User)
+	}
+
+	if users := listAll(t, uc, model.ListOptions{}); len(users) != 3 {
+		t.Error("the number of users is incorrect", len(users))
+	}
+
+	if _, err := uc.NewUsers(ctx, make([]*model.User, model.MaxBatchSize+1)); err == nil {
+		t.Error("too large batch should be rejected")
+	}
+}
+
+func testUpdateUsers(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	other := newUser(t, uc, "name2", "hoge2@example.com")
+	stale := newUser(t, uc, "name3", "hoge3@example.com")
+	deleted := newUser(t, uc, "name4", "hoge4@example.com")
+
+	if err := uc.DeleteUser(ctx, deleted.ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+
+	staleAt := stale.UpdatedAt.Add(-time.Second)
+
+	results, err := uc.UpdateUsers(ctx, []*model.User{
+		{ID: user.ID, Name: "renamed", Email: "HOGE@example.com"},
+		{ID: other.ID, Name: "renamed2", Email: "hoge@example.com"},
+		{ID: stale.ID, Name: "renamed3", Email: "hoge3@example.com", UpdatedAt: staleAt},
+		{ID: deleted.ID, Name: "renamed4", Email: "hoge4@example.com"},
+		{ID: user.ID, Name: "renamed5", Email: "hoge5@example.com"},
+		{ID: other.ID + 1000, Name: "renamed6", Email: "hoge6@example.com"},
+		{ID: other.ID, Name: "", Email: "hoge2@example.com"},
+	})
+
+	if err != nil {
+		t.Fatal("update users error ", err)
+	}
+	checkResults(t, results, 7)
+
+	if results[0].Err != nil {
+		t.Fatal("user should be updated", results[0].Err)
+	}
+	compareUser(t, results[0].User, &model.User{ID: user.ID, Name: "renamed", Email: "HOGE@example.com"})
+
+	checkConflictError(t, results[1].Err, user.ID)
+
+	if results[2].Err != model.ErrPreconditionFailed {
+		t.Error("stale user should fail with ErrPreconditionFailed", results[2].Err)
+	}
+
+	if results[3].Err != model.ErrNoUser || results[5].Err != model.ErrNoUser {
+		t.Error("missing users should fail with ErrNoUser", results[3].Err, results[5].Err)
+	}
+
+	if results[4].Err != model.ErrDuplicatedInBatch {
+		t.Error("user appearing twice should fail with ErrDuplicatedInBatch", results[4].Err)
+	}
+
+	if results[6].Err != model.ErrDuplicatedInBatch {
+		t.Error("user appearing twice should fail with ErrDuplicatedInBatch", results[6].Err)
+	}
+
+	u, err := uc.GetUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("get user error ", err)
+	}
+	compareUser(t, u, results[0].User)
+
+	if u, err := uc.GetUser(ctx, other.ID); err != nil {
+		t.Fatal("get user error ", err)
+	} else {
+		compareUser(t, u, other)
+	}
+}
+
+func testDeleteUsers(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	other := newUser(t, uc, "name2", "hoge2@example.com")
+	kept := newUser(t, uc, "name3", "hoge3@example.com")
+
+	results, err := uc.DeleteUsers(ctx, []int{user.ID, other.ID, user.ID, kept.ID + 1000})
+
+	if err != nil {
+		t.Fatal("delete users error ", err)
+	}
+	checkResults(t, results, 4)
+
+	if results[0].Err != nil || results[1].Err != nil {
+		t.Error("users should be deleted", results[0].Err, results[1].Err)
+	}
+
+	if results[2].Err != model.ErrNoUser || results[3].Err != model.ErrNoUser {
+		t.Error("deleted or missing users should fail with ErrNoUser", results[2].Err, results[3].Err)
+	}
+
+	users := listAll(t, uc, model.ListOptions{})
+
+	if len(users) != 1 {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+	compareUser(t, users[0], kept)
+}
+
+func testDeleteUser(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	other := newUser(t, uc, "name2", "hoge2@example.com")
+
+	if err := uc.DeleteUser(ctx, user.ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+
+	if _, err := uc.GetUser(ctx, user.ID); err != model.ErrNoUser {
+		t.Error("deleted user should not be found", err)
+	}
+
+	if err := uc.DeleteUser(ctx, user.ID); err != model.ErrNoUser {
+		t.Error("deleting missing user should return ErrNoUser", err)
+	}
+
+	users := listAll(t, uc, model.ListOptions{})
+
+	if len(users) != 1 {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+
+	compareUser(t, users[0], other)
+
+	if _, err := uc.UpdateUser(ctx, user); err != model.ErrNoUser {
+		t.Error("deleted user should not be updated", err)
+	}
+
+	// ids must not be reused
+	if u := newUser(t, uc, "name3", "hoge3@example.com"); u.ID <= other.ID {
+		t.Error("id is reused", u.ID)
+	}
+
+	deleted := listAll(t, uc, model.ListOptions{IncludeDeleted: true})
+
+	if len(deleted) != 3 || deleted[0].ID != user.ID || deleted[0].DeletedAt == nil || deleted[1].DeletedAt != nil {
+		t.Fatal("deleted users should be listed", deleted)
+	}
+}
+
+func testRestoreUser(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+
+	if _, err := uc.RestoreUser(ctx, user.ID); err != model.ErrNotDeleted {
+		t.Error("restoring a user not deleted should return ErrNotDeleted", err)
+	}
+
+	if _, err := uc.RestoreUser(ctx, user.ID+1000); err != model.ErrNoUser {
+		t.Error("restoring missing user should return ErrNoUser", err)
+	}
+
+	if err := uc.DeleteUser(ctx, user.ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+
+	restored, err := uc.RestoreUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("restore error ", err)
+	}
+	compareUser(t, restored, user)
+
+	if restored.DeletedAt != nil {
+		t.Error("restored user should not have deleted_at", restored.DeletedAt)
+	}
+
+	if u, err := uc.GetUser(ctx, user.ID); err != nil {
+		t.Error("restored user should be found", err)
+	} else {
+		compareUser(t, u, user)
+	}
+
+	// the email may be taken while the user is deleted
+	if err := uc.DeleteUser(ctx, user.ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+	other := newUser(t, uc, "name2", "HOGE@example.com")
+
+	_, err = uc.RestoreUser(ctx, user.ID)
+	checkConflictError(t, err, other.ID)
+}
+
+func testPurgeUsers(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	other := newUser(t, uc, "name2", "hoge2@example.com")
+
+	if err := uc.DeleteUser(ctx, user.ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+
+	if n, err := uc.PurgeUsers(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatal("users deleted recently should not be purged", n, err)
+	}
+
+	if n, err := uc.PurgeUsers(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Fatal("purge error", n, err)
+	}
+
+	users := listAll(t, uc, model.ListOptions{IncludeDeleted: true})
+
+	if len(users) != 1 {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+	compareUser(t, users[0], other)
+
+	if _, err := uc.RestoreUser(ctx, user.ID); err != model.ErrNoUser {
+		t.Error("purged user should not be restored", err)
+	}
+}
+
+func testListUsers(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	page, err := uc.ListUsers(ctx, model.ListOptions{})
+
+	if err != nil {
+		t.Fatal("list user error ", err)
+	}
+
+	if len(page.Users) != 0 || len(page.NextCursor) != 0 {
+		t.Fatal("empty store should return an empty page", page)
+	}
+
+	before := time.Now()
+
+	params := []*model.User{
+		{ID: -1, Name: "name", Email: "hoge@example.com"},
+		{ID: -1, Name: "name2", Email: "hoge2@example.com"},
+	}
+
+	for _, p := range params {
+		newUser(t, uc, p.Name, p.Email)
+	}
+
+	after := time.Now()
+
+	page, err = uc.ListUsers(ctx, model.ListOptions{})
+
+	if err != nil {
+		t.Fatal("list user error ", err)
+	}
+
+	if len(page.Users) != len(params) {
+		t.Fatal("the number of users is incorrect", len(page.Users))
+	}
+
+	if len(page.NextCursor) != 0 {
+		t.Error("next cursor should be empty", page.NextCursor)
+	}
+
+	for i, u := range page.Users {
+		compareUser(t, u, params[i])
+
+		checkTime(t, before, after, u.CreatedAt)
+		checkTime(t, before, after, u.UpdatedAt)
+	}
+}
+
+func testListUsersPagination(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	var params []*model.User
+	for i := 0; i < 5; i++ {
+		params = append(params, newUser(t, uc, "name"+strconv.Itoa(i), "hoge"+strconv.Itoa(i)+"@example.com"))
+	}
+
+	opts := model.ListOptions{}
+	opts.Limit = 2
+
+	first, err := uc.ListUsers(ctx, opts)
+
+	if err != nil {
+		t.Fatal("list user error ", err)
+	}
+
+	if len(first.Users) != 2 || len(first.NextCursor) == 0 {
+		t.Fatal("first page is incorrect", len(first.Users), first.NextCursor)
+	}
+
+	compareUser(t, first.Users[0], params[0])
+	compareUser(t, first.Users[1], params[1])
+
+	// rows before the cursor must not shift the next page
+	if err := uc.DeleteUser(ctx, params[0].ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+
+	// rows inserted after the cursor appear in later pages
+	params = append(params, newUser(t, uc, "name5", "hoge5@example.com"))
+
+	opts.Cursor = first.NextCursor
+	second, err := uc.ListUsers(ctx, opts)
+
+	if err != nil {
+		t.Fatal("list user error ", err)
+	}
+
+	if len(second.Users) != 2 || len(second.NextCursor) == 0 {
+		t.Fatal("second page is incorrect", len(second.Users), second.NextCursor)
+	}
+
+	compareUser(t, second.Users[0], params[2])
+	compareUser(t, second.Users[1], params[3])
+
+	opts.Cursor = second.NextCursor
+	last, err := uc.ListUsers(ctx, opts)
+
+	if err != nil {
+		t.Fatal("list user error ", err)
+	}
+
+	if len(last.Users) != 2 || len(last.NextCursor) != 0 {
+		t.Fatal("last page is incorrect", len(last.Users), last.NextCursor)
+	}
+
+	compareUser(t, last.Users[0], params[4])
+	compareUser(t, last.Users[1], params[5])
+}
+
+func testListUsersFilterAndSort(t *testing.T, uc model.UserController) {
+	params := []*model.User{
+		newUser(t, uc, "b", "b@partner.co.jp"),
+		newUser(t, uc, "a", "a@example.com"),
+		newUser(t, uc, "c", "c@partner.co.jp"),
+		newUser(t, uc, "a", "a_%@partner.co.jp"),
+	}
+
+	filter, err := model.ParseFilter(`email ew "@partner.co.jp" and not name eq "c"`)
+
+	if err != nil {
+		t.Fatal("parse filter error ", err)
+	}
+
+	sort, err := model.ParseSort("-name")
+
+	if err != nil {
+		t.Fatal("parse sort error ", err)
+	}
+
+	opts := model.ListOptions{Filter: filter, Sort: sort}
+	opts.Limit = 1
+
+	users := listAll(t, uc, opts)
+
+	if len(users) != 2 {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+
+	compareUser(t, users[0], params[0])
+	compareUser(t, users[1], params[3])
+
+	// special characters of LIKE must be escaped
+	filter, err = model.ParseFilter(`email sw "a_%"`)
+
+	if err != nil {
+		t.Fatal("parse filter error ", err)
+	}
+
+	users = listAll(t, uc, model.ListOptions{Filter: filter})
+
+	if len(users) != 1 {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+
+	compareUser(t, users[0], params[3])
+
+	// id is the tie breaker of equal keys
+	opts = model.ListOptions{Sort: []model.SortField{{Field: "name"}}}
+	opts.Limit = 1
+
+	users = listAll(t, uc, opts)
+
+	if len(users) != len(params) {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+
+	for i, expected := range []*model.User{params[1], params[3], params[0], params[2]} {
+		compareUser(t, users[i], expected)
+	}
+}
+
+func testListUsersInvalidCursor(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		newUser(t, uc, "name"+strconv.Itoa(i), "hoge"+strconv.Itoa(i)+"@example.com")
+	}
+
+	opts := model.ListOptions{}
+	opts.Cursor = "broken"
+
+	if _, err := uc.ListUsers(ctx, opts); err != model.ErrInvalidCursor {
+		t.Error("broken cursor should be rejected", err)
+	}
+
+	opts = model.ListOptions{Sort: []model.SortField{{Field: "name", Desc: true}}}
+	opts.Limit = 1
+
+	page, err := uc.ListUsers(ctx, opts)
+
+	if err != nil {
+		t.Fatal("list user error ", err)
+	}
+
+	opts.Sort = nil
+	opts.Cursor = page.NextCursor
+
+	if _, err := uc.ListUsers(ctx, opts); err != model.ErrInvalidCursor {
+		t.Error("cursor for another ordering should be rejected", err)
+	}
+}
+
+func testListUsersInvalidSort(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	newUser(t, uc, "name", "hoge@example.com")
+
+	for _, sort := range [][]model.SortField{
+		{{Field: "password"}},
+		{{Field: "name"}, {Field: "name", Desc: true}},
+	} {
+		opts := model.ListOptions{Sort: sort}
+
+		if _, err := uc.ListUsers(ctx, opts); err == nil {
+			t.Error("ListUsers should reject the sort", sort)
+		} else if _, ok := err.(*model.QueryError); !ok {
+			t.Error("error should be *model.QueryError", err)
+		}
+
+		err := uc.EachUser(ctx, opts, func(u *model.User) error {
+			return nil
+		})
+
+		if _, ok := err.(*model.QueryError); !ok {
+			t.Error("EachUser should reject the sort with *model.QueryError", sort, err)
+		}
+	}
+}
+
+func testEachUser(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	// more than a page of ListUsers
+	var params []*model.User
+	for i := 0; i < model.DefaultPageLimit+1; i++ {
+		params = append(params, newUser(t, uc, "name"+strconv.Itoa(i), "hoge"+strconv.Itoa(i)+"@example.com"))
+	}
+
+	if err := uc.DeleteUser(ctx, params[0].ID); err != nil {
+		t.Fatal("delete error ", err)
+	}
+
+	var users []*model.User
+	err := uc.EachUser(ctx, model.ListOptions{}, func(u *model.User) error {
+		users = append(users, u)
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal("each user error ", err)
+	}
+
+	if len(users) != len(params)-1 {
+		t.Fatal("every user should be iterated without paging", len(users))
+	}
+
+	for i, u := range users {
+		compareUser(t, u, params[i+1])
+	}
+
+	// the cursor of ListUsers is shared
+	opts := model.ListOptions{}
+	opts.Limit = 1
+
+	page, err := uc.ListUsers(ctx, opts)
+
+	if err != nil {
+		t.Fatal("list user error ", err)
+	}
+
+	opts.Cursor = page.NextCursor
+	opts.Limit = 2
+
+	users = nil
+	err = uc.EachUser(ctx, opts, func(u *model.User) error {
+		users = append(users, u)
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal("each user error ", err)
+	}
+
+	if len(users) != 2 {
+		t.Fatal("users should be limited", len(users))
+	}
+
+	compareUser(t, users[0], params[2])
+	compareUser(t, users[1], params[3])
+
+	// errors of fn stop the iteration
+	stop := errors.New("stop")
+	n := 0
+	err = uc.EachUser(ctx, model.ListOptions{}, func(u *model.User) error {
+		n++
+
+		return stop
+	})
+
+	if err != stop || n != 1 {
+		t.Fatal("iteration should stop at the error", err, n)
+	}
+
+	opts = model.ListOptions{}
+	opts.Cursor = "broken"
+
+	if err := uc.EachUser(ctx, opts, func(u *model.User) error { return nil }); err != model.ErrInvalidCursor {
+		t.Error("broken cursor should be rejected", err)
+	}
+}
+
+func testConcurrency(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	const n = 16
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		users []*model.User
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			u, err := uc.NewUser(ctx, "name"+strconv.Itoa(i), "hoge"+strconv.Itoa(i)+"@example.com")
+
+			if err != nil {
+				t.Error("new user error ", err)
+
+				return
+			}
+
+			mu.Lock()
+			users = append(users, u)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if len(users) != n {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+
+	ids := map[int]bool{}
+	for _, u := range users {
+		if ids[u.ID] {
+			t.Error("id is duplicated", u.ID)
+		}
+		ids[u.ID] = true
+	}
+
+	for _, u := range users {
+		wg.Add(2)
+		go func(u model.User) {
+			defer wg.Done()
+
+			u.Name += "-updated"
+			if _, err := uc.UpdateUser(ctx, &u); err != nil {
+				t.Error("update error ", err)
+			}
+		}(*u)
+		go func(id int) {
+			defer wg.Done()
+
+			if _, err := uc.GetUser(ctx, id); err != nil {
+				t.Error("get user error ", err)
+			}
+		}(u.ID)
+	}
+	wg.Wait()
+
+	listed := listAll(t, uc, model.ListOptions{})
+
+	if len(listed) != n {
+		t.Fatal("the number of users is incorrect", len(listed))
+	}
+
+	for _, u := range listed {
+		if !ids[u.ID] {
+			t.Error("unknown user is listed", u.ID)
+		}
+	}
+}
+
+func testCanceledContext(t *testing.T, uc model.UserController) {
+	user := newUser(t, uc, "name", "hoge@example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := uc.NewUser(ctx, "name2", "hoge2@example.com"); err != context.Canceled {
+		t.Error("NewUser should be canceled", err)
+	}
+
+	if _, err := uc.ListUsers(ctx, model.ListOptions{}); err != context.Canceled {
+		t.Error("ListUsers should be canceled", err)
+	}
+
+	if _, err := uc.GetUser(ctx, user.ID); err != context.Canceled {
+		t.Error("GetUser should be canceled", err)
+	}
+
+	if _, err := uc.UpdateUser(ctx, user); err != context.Canceled {
+		t.Error("UpdateUser should be canceled", err)
+	}
+
+	if err := uc.DeleteUser(ctx, user.ID); err != context.Canceled {
+		t.Error("DeleteUser should be canceled", err)
+	}
+
+	users := listAll(t, uc, model.ListOptions{})
+
+	if len(users) != 1 {
+		t.Fatal("canceled operations should not change users", len(users))
+	}
+
+	compareUser(t, users[0], user)
+}
+
+func testWithTxCommit(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+
+	var created *model.User
+	err := uc.WithTx(ctx, func(tx model.UserController) error {
+		var err error
+		created, err = tx.NewUser(ctx, "name2", "hoge2@example.com")
+
+		if err != nil {
+			return err
+		}
+
+		user.Name = "renamed"
+		if _, err := tx.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+
+		// nested transactions join the outer one
+		return tx.WithTx(ctx, func(tx model.UserController) error {
+			_, err := tx.GetUser(ctx, created.ID)
+
+			return err
+		})
+	})
+
+	if err != nil {
+		t.Fatal("transaction error ", err)
+	}
+
+	users := listAll(t, uc, model.ListOptions{})
+
+	if len(users) != 2 {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+
+	compareUser(t, users[0], user)
+	compareUser(t, users[1], created)
+}
+
+func testWithTxRollback(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	expectedErr := errors.New("rollback")
+
+	err := uc.WithTx(ctx, func(tx model.UserController) error {
+		if _, err := tx.NewUser(ctx, "name2", "hoge2@example.com"); err != nil {
+			return err
+		}
+
+		updated := *user
+		updated.Name = "renamed"
+		if _, err := tx.UpdateUser(ctx, &updated); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteUser(ctx, user.ID); err != nil {
+			return err
+		}
+
+		return expectedErr
+	})
+
+	if err != expectedErr {
+		t.Fatal("error of fn should be returned", err)
+	}
+
+	users := listAll(t, uc, model.ListOptions{})
+
+	if len(users) != 1 {
+		t.Fatal("the number of users is incorrect", len(users))
+	}
+
+	compareUser(t, users[0], user)
+}
+
+func testWithTxConcurrent(t *testing.T, uc model.UserController) {
+	const n = 4
+
+	ctx := context.Background()
+	user := newUser(t, uc, "n", "hoge@example.com")
+
+	// read-modify-write must not lose updates
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := uc.WithTx(ctx, func(tx model.UserController) error {
+				u, err := tx.GetUser(ctx, user.ID)
+
+				if err != nil {
+					return err
+				}
+
+				u.Name += "x"
+				_, err = tx.UpdateUser(ctx, u)
+
+				return err
+			})
+
+			if err != nil {
+				t.Error("transaction error ", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	ret, err := uc.GetUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("get user error ", err)
+	}
+
+	if len(ret.Name) != n+1 {
+		t.Error("updates are lost", ret.Name)
+	}
+}
+
+func checkValidationError(t *testing.T, err error, fields ...string) {
+	t.Helper()
+
+	verr, ok := err.(*model.ValidationError)
+
+	if !ok {
+		t.Fatal("ValidationError should be returned, but got", err)
+	}
+
+	if len(verr.Fields) != len(fields) {
+		t.Fatal("invalid fields are incorrect", verr.Fields)
+	}
+
+	for i := range fields {
+		if verr.Fields[i].Field != fields[i] || len(verr.Fields[i].Reason) == 0 {
+			t.Error("invalid field is incorrect", verr.Fields[i], fields[i])
+		}
+	}
+}
+
+func testValidation(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	_, err := uc.NewUser(ctx, " ", "hoge")
+	checkValidationError(t, err, "name", "email")
+
+	// lengths are counted in characters, not bytes
+	_, err = uc.NewUser(ctx, strings.Repeat("あ", 257), "hoge@example.com")
+	checkValidationError(t, err, "name")
+
+	long := newUser(t, uc, strings.Repeat("あ", 256), "hoge@example.com")
+
+	if long.Name != strings.Repeat("あ", 256) {
+		t.Error("name is incorrect", long.Name)
+	}
+
+	user := newUser(t, uc, " ta\x00ro\u007f ", "\thoge2@example.com\r\n")
+	compareUser(t, user, &model.User{ID: -1, Name: "taro", Email: "hoge2@example.com"})
+
+	invalid := *user
+	invalid.Name = ""
+	invalid.Email = "hoge@@example.com"
+
+	_, err = uc.UpdateUser(ctx, &invalid)
+	checkValidationError(t, err, "name", "email")
+
+	ret, err := uc.GetUser(ctx, user.ID)
+
+	if err != nil {
+		t.Fatal("get user error ", err)
+	}
+
+	compareUser(t, ret, user)
+
+	if users := listAll(t, uc, model.ListOptions{}); len(users) != 2 {
+		t.Error("invalid users should not be stored", len(users))
+	}
+}
+
+func checkConflictError(t *testing.T, err error, existingID int) {
+	t.Helper()
+
+	cerr, ok := err.(*model.ConflictError)
+
+	if !ok {
+		t.Fatal("ConflictError should be returned, but got", err)
+	}
+
+	if cerr.ExistingID != existingID {
+		t.Errorf("existing id is incorrect (expected: %v, actual: %v)", existingID, cerr.ExistingID)
+	}
+}
+
+func testEmailConflict(t *testing.T, uc model.UserController) {
+	ctx := context.Background()
+
+	user := newUser(t, uc, "name", "hoge@example.com")
+	other := newUser(t, uc, "name2", "hoge2@example.com")
+
+	_, err := uc.NewUser(ctx, "name3", "HOGE@Example.COM")
+	checkConflictError(t, err, user.ID)
+
+	conflicted := *other
+	conflicted.Email = "Hoge@example.com"
+
+	_, err = uc.UpdateUser(ctx, &conflicted)
+	checkConflictError(t, err, user.ID)
+
+	// the own email can be changed in case
+	user.Email = "Hoge@EXAMPLE.com"
+	updated, err := uc.UpdateUser(ctx, user)
+
+	if err != nil {
+		t.Fatal("update user error ", err)
+	}
+	compareUser(t, updated, user)
+
+	// emails become available after deletion
+	if err := uc.DeleteUser(ctx, other.ID); err != nil {
+		t.Fatal("delete user error ", err)
+	}
+	newUser(t, uc, "name3", "HOGE2@example.com")
+
+	// the conflict aborts only the statement, not the transaction
+	err = uc.WithTx(ctx, func(tx model.UserController) error {
+		_, err := tx.NewUser(ctx, "name4", "hoge@example.com")
+		checkConflictError(t, err, user.ID)
+
+		_, err = tx.NewUser(ctx, "name4", "hoge4@example.com")
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal("transaction error ", err)
+	}
+}
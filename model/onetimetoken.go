@@ -0,0 +1,109 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// oneTimeTokenPrefix starts every one-time token
+const oneTimeTokenPrefix = "uot_"
+
+// TokenPurpose tells what a one-time token is sent for. Tokens are accepted only for the same purpose.
+type TokenPurpose string
+
+const (
+	// PurposePasswordReset is the purpose of tokens setting a new password of a user who forgot it
+	PurposePasswordReset TokenPurpose = "password_reset"
+
+	// PurposeEmailVerification is the purpose of tokens proving the ownership of an email
+	PurposeEmailVerification TokenPurpose = "email_verification"
+)
+
+// OneTimeTokenController defines an interface for one_time_tokens table.
+// Tokens are bound to the email of the user when they are issued, since they are sent to it.
+type OneTimeTokenController interface {
+	// NewOneTimeToken issues a token of the purpose for the user lasting for ttl, and returns it.
+	// Tokens issued before for the same purpose are invalidated. It fails with ErrNoUser if the user does not exist.
+	NewOneTimeToken(ctx context.Context, userID int, purpose TokenPurpose, ttl time.Duration) (string, error)
+
+	// ConsumeOneTimeToken invalidates the token of the purpose and returns the id of the user.
+	// It fails with ErrInvalidOneTimeToken if the token is unknown, used, expired, for another purpose,
+	// or the email of the user has changed since it was issued.
+	ConsumeOneTimeToken(ctx context.Context, token string, purpose TokenPurpose) (int, error)
+}
+
+// NewOneTimeTokenController creates a controller for one_time_tokens table
+func NewOneTimeTokenController(db DB) OneTimeTokenController {
+	return &oneTimeTokenController{db: db}
+}
+
+type oneTimeTokenController struct {
+	db DB
+}
+
+func (tc *oneTimeTokenController) NewOneTimeToken(ctx context.Context, userID int, purpose TokenPurpose, ttl time.Duration) (string, error) {
+	token, err := newSecret(oneTimeTokenPrefix)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = withTx(ctx, tc.db, func(db DB) error {
+		if _, err := db.ExecContext(ctx, "DELETE FROM one_time_tokens WHERE user_id=$1 AND purpose=$2", userID, string(purpose)); err != nil {
+			return err
+		}
+
+		var issued bool
+		err := db.
+			QueryRowContext(
+				ctx,
+				`INSERT INTO one_time_tokens(user_id, purpose, email, token_hash, expires_at)
+				SELECT id, $2, email, $3, now() + $4 * interval '1 microsecond' FROM users WHERE id=$1 AND deleted_at IS NULL
+				RETURNING true`,
+				userID, string(purpose), hashSecret(token), int64(ttl/time.Microsecond),
+			).
+			Scan(&issued)
+
+		if err == sql.ErrNoRows {
+			return ErrNoUser
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (tc *oneTimeTokenController) ConsumeOneTimeToken(ctx context.Context, token string, purpose TokenPurpose) (int, error) {
+	return consumeOneTimeToken(ctx, tc.db, token, purpose)
+}
+
+// consumeOneTimeToken invalidates the token of the purpose and returns the id of the user
+func consumeOneTimeToken(ctx context.Context, db DB, token string, purpose TokenPurpose) (int, error) {
+	var userID int
+	err := db.
+		QueryRowContext(
+			ctx,
+			`UPDATE one_time_tokens t SET used_at=now() FROM users u
+			WHERE t.token_hash=$1 AND t.purpose=$2 AND t.used_at IS NULL AND t.expires_at > now()
+			AND u.id=t.user_id AND u.deleted_at IS NULL AND u.email=t.email
+			RETURNING t.user_id`,
+			hashSecret(token), string(purpose),
+		).
+		Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidOneTimeToken
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
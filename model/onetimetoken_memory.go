@@ -0,0 +1,93 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewMemoryOneTimeTokenController creates a controller keeping one-time tokens in memory.
+// It is safe for concurrent use and behaves like the controller for one_time_tokens table.
+// Emails of users are read from uc.
+func NewMemoryOneTimeTokenController(uc UserController) OneTimeTokenController {
+	return &memoryOneTimeTokenController{
+		uc:     uc,
+		byHash: map[string]*memoryOneTimeToken{},
+	}
+}
+
+type memoryOneTimeToken struct {
+	userID    int
+	purpose   TokenPurpose
+	email     string
+	expiresAt time.Time
+	used      bool
+}
+
+// memoryOneTimeTokenController looks tokens up by the hash as the unique index of one_time_tokens
+type memoryOneTimeTokenController struct {
+	uc     UserController
+	mu     sync.Mutex
+	byHash map[string]*memoryOneTimeToken
+}
+
+func (tc *memoryOneTimeTokenController) NewOneTimeToken(ctx context.Context, userID int, purpose TokenPurpose, ttl time.Duration) (string, error) {
+	u, err := tc.uc.GetUser(ctx, userID)
+
+	if err != nil {
+		return "", err
+	}
+
+	token, err := newSecret(oneTimeTokenPrefix)
+
+	if err != nil {
+		return "", err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for hash, t := range tc.byHash {
+		if t.userID == userID && t.purpose == purpose {
+			delete(tc.byHash, hash)
+		}
+	}
+
+	tc.byHash[string(hashSecret(token))] = &memoryOneTimeToken{
+		userID:    userID,
+		purpose:   purpose,
+		email:     u.Email,
+		expiresAt: now().Add(ttl),
+	}
+
+	return token, nil
+}
+
+func (tc *memoryOneTimeTokenController) ConsumeOneTimeToken(ctx context.Context, token string, purpose TokenPurpose) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t, ok := tc.byHash[string(hashSecret(token))]
+
+	if !ok || t.used || t.purpose != purpose || !t.expiresAt.After(now()) {
+		return 0, ErrInvalidOneTimeToken
+	}
+
+	u, err := tc.uc.GetUser(ctx, t.userID)
+
+	if err == ErrNoUser || (err == nil && u.Email != t.email) {
+		return 0, ErrInvalidOneTimeToken
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	t.used = true
+
+	return t.userID, nil
+}
@@ -0,0 +1,40 @@
+package model
+
+const (
+	// DefaultPageLimit is used when PageRequest.Limit is not specified
+	DefaultPageLimit = 100
+
+	// MaxPageLimit is the upper bound of PageRequest.Limit
+	MaxPageLimit = 1000
+)
+
+// PageRequest specifies a page of ListUsers
+type PageRequest struct {
+	// Limit is the maximum number of users in a page
+	Limit int
+
+	// Cursor is an opaque position returned as UserPage.NextCursor.
+	// An empty cursor means the first page.
+	Cursor string
+}
+
+func (p PageRequest) limit() int {
+	if p.Limit <= 0 {
+		return DefaultPageLimit
+	}
+
+	if p.Limit > MaxPageLimit {
+		return MaxPageLimit
+	}
+
+	return p.Limit
+}
+
+// UserPage is a page of users returned by ListUsers
+type UserPage struct {
+	Users []*User
+
+	// NextCursor is the cursor for the next page.
+	// It is empty on the last page.
+	NextCursor string
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// MinPasswordLength is the minimum number of characters in passwords
+	MinPasswordLength = 8
+
+	// MaxPasswordLength is the maximum number of characters in passwords.
+	// It bounds the cost of hashing.
+	MaxPasswordLength = 256
+)
+
+// ValidatePassword returns *ValidationError if the password is too short or too long
+func ValidatePassword(password string) error {
+	if ferr := validatePassword(password); ferr != nil {
+		return &ValidationError{Message: "password is invalid", Fields: []FieldError{*ferr}}
+	}
+
+	return nil
+}
+
+func validatePassword(password string) *FieldError {
+	switch n := utf8.RuneCountInString(password); {
+	case n == 0:
+		return &FieldError{Field: "password", Reason: "required"}
+	case n < MinPasswordLength:
+		return &FieldError{Field: "password", Reason: "must be at least 8 characters"}
+	case n > MaxPasswordLength:
+		return &FieldError{Field: "password", Reason: "must be at most 256 characters"}
+	}
+
+	return nil
+}
+
+// hashPassword returns the salted argon2id hash of password, which describes its parameters
+func hashPassword(password string) (string, error) {
+	return hashArgon2(password, defaultArgon2Params)
+}
+
+// verifyPassword reports whether password matches hash in constant time
+func verifyPassword(hash, password string) (bool, error) {
+	return verifyArgon2(hash, password)
+}
+
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+// rejectPassword takes as long as verifyPassword,
+// so that responses do not tell whether the account exists
+func rejectPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = hashPassword("")
+	})
+
+	verifyPassword(dummyPasswordHash, password)
+}
@@ -0,0 +1,337 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// PersonalTokenPrefix starts every personal token, which tells it from API keys
+	PersonalTokenPrefix = "upt_"
+
+	// personalTokenDisplayLength is the length of PersonalToken.Prefix shown to identify tokens
+	personalTokenDisplayLength = len(PersonalTokenPrefix) + 8
+)
+
+// PersonalToken is a credential acting as the user who owns it. Only the argon2id hash of the secret is stored.
+type PersonalToken struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+
+	// Prefix is the beginning of the secret to tell tokens apart
+	Prefix string `json:"prefix"`
+
+	// Scopes are the permissions of the token. ScopeAdmin can not be granted.
+	Scopes []string `json:"scopes"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+
+	// ExpiresAt is nil if the token never expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// PersonalTokenPatch is a partial update of a personal token. Nil fields are kept as they are.
+type PersonalTokenPatch struct {
+	Name   *string
+	Scopes []string
+}
+
+// PersonalTokenController defines an interface for personal_tokens table.
+// Tokens are looked up within the user, so that ids of tokens of other users are not found.
+type PersonalTokenController interface {
+	// NewPersonalToken creates a token of the user and returns it with the secret, which can not be retrieved later.
+	// It fails with ErrNoUser if the user does not exist.
+	NewPersonalToken(ctx context.Context, userID int, name string, scopes []string, expiresAt *time.Time) (*PersonalToken, string, error)
+
+	// ListPersonalTokens returns every token of the user including revoked ones in order of id
+	ListPersonalTokens(ctx context.Context, userID int) ([]*PersonalToken, error)
+
+	GetPersonalToken(ctx context.Context, userID, id int) (*PersonalToken, error)
+
+	// UpdatePersonalToken changes the name or the scopes of the token. The secret is kept.
+	UpdatePersonalToken(ctx context.Context, userID, id int, p PersonalTokenPatch) (*PersonalToken, error)
+
+	// RevokePersonalToken disables the token permanently
+	RevokePersonalToken(ctx context.Context, userID, id int) error
+
+	// AuthenticatePersonalToken returns the token of the secret and records the use from ip.
+	// It fails with ErrInvalidPersonalToken if the token is unknown, revoked or expired.
+	AuthenticatePersonalToken(ctx context.Context, secret, ip string) (*PersonalToken, error)
+}
+
+// NewPersonalTokenController creates a controller for personal_tokens table
+func NewPersonalTokenController(db DB) PersonalTokenController {
+	return &personalTokenController{db: db}
+}
+
+type personalTokenController struct {
+	db DB
+}
+
+// personalTokenPrefixOf returns the prefix of the secret looking the token up
+func personalTokenPrefixOf(secret string) (string, bool) {
+	if len(secret) < personalTokenDisplayLength || !strings.HasPrefix(secret, PersonalTokenPrefix) {
+		return "", false
+	}
+
+	return secret[:personalTokenDisplayLength], true
+}
+
+const personalTokenColumns = "id, user_id, name, prefix, scopes, created_at, last_used_at, COALESCE(last_used_ip, ''), expires_at, revoked_at"
+
+func scanPersonalToken(s scanner, pt *PersonalToken) error {
+	return s.Scan(&pt.ID, &pt.UserID, &pt.Name, &pt.Prefix, pq.Array(&pt.Scopes), &pt.CreatedAt, &pt.LastUsedAt, &pt.LastUsedIP, &pt.ExpiresAt, &pt.RevokedAt)
+}
+
+// validatePersonalTokenScopes validates scopes as API keys except ScopeAdmin, which users do not have
+func validatePersonalTokenScopes(scopes []string) ([]string, *FieldError) {
+	scopes, ferr := validateScopes(scopes)
+
+	if ferr == nil && HasScope(scopes, ScopeAdmin) {
+		return nil, &FieldError{Field: "scopes", Reason: ScopeAdmin + " can not be granted to personal tokens"}
+	}
+
+	return scopes, ferr
+}
+
+// validatePersonalToken validates the name, the scopes and the expiry of a new token
+func validatePersonalToken(name string, scopes []string, expiresAt *time.Time) (string, []string, error) {
+	var fields []FieldError
+
+	name, ferr := validateName(name)
+	if ferr != nil {
+		fields = append(fields, *ferr)
+	}
+
+	scopes, ferr = validatePersonalTokenScopes(scopes)
+	if ferr != nil {
+		fields = append(fields, *ferr)
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		fields = append(fields, FieldError{Field: "expires_at", Reason: "must be in the future"})
+	}
+
+	if len(fields) != 0 {
+		return "", nil, &ValidationError{Message: "personal token is invalid", Fields: fields}
+	}
+
+	return name, scopes, nil
+}
+
+// validatePersonalTokenPatch validates the supplied fields of p as validatePersonalToken does
+func validatePersonalTokenPatch(p PersonalTokenPatch) (PersonalTokenPatch, error) {
+	var fields []FieldError
+
+	if p.Name != nil {
+		name, ferr := validateName(*p.Name)
+
+		if ferr != nil {
+			fields = append(fields, *ferr)
+		}
+		p.Name = &name
+	}
+
+	if p.Scopes != nil {
+		scopes, ferr := validatePersonalTokenScopes(p.Scopes)
+
+		if ferr != nil {
+			fields = append(fields, *ferr)
+		}
+		p.Scopes = scopes
+	}
+
+	if len(fields) != 0 {
+		return PersonalTokenPatch{}, &ValidationError{Message: "personal token is invalid", Fields: fields}
+	}
+
+	return p, nil
+}
+
+func (tc *personalTokenController) NewPersonalToken(ctx context.Context, userID int, name string, scopes []string, expiresAt *time.Time) (*PersonalToken, string, error) {
+	name, scopes, err := validatePersonalToken(name, scopes, expiresAt)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := newSecret(PersonalTokenPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := hashArgon2(secret, defaultArgon2Params)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	pt := &PersonalToken{}
+	err = scanPersonalToken(
+		tc.db.QueryRowContext(
+			ctx,
+			`INSERT INTO personal_tokens(user_id, name, prefix, scopes, token_hash, expires_at)
+			SELECT id, $2, $3, $4, $5, $6 FROM users WHERE id=$1 AND deleted_at IS NULL
+			RETURNING `+personalTokenColumns,
+			userID, name, secret[:personalTokenDisplayLength], pq.Array(scopes), hash, expiresAt,
+		),
+		pt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, "", ErrNoUser
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pt, secret, nil
+}
+
+func (tc *personalTokenController) ListPersonalTokens(ctx context.Context, userID int) ([]*PersonalToken, error) {
+	rows, err := tc.db.QueryContext(ctx, "SELECT "+personalTokenColumns+" FROM personal_tokens WHERE user_id=$1 ORDER BY id", userID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*PersonalToken{}
+	for rows.Next() {
+		pt := &PersonalToken{}
+		if err := scanPersonalToken(rows, pt); err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, pt)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (tc *personalTokenController) GetPersonalToken(ctx context.Context, userID, id int) (*PersonalToken, error) {
+	pt := &PersonalToken{}
+	err := scanPersonalToken(
+		tc.db.QueryRowContext(ctx, "SELECT "+personalTokenColumns+" FROM personal_tokens WHERE id=$1 AND user_id=$2", id, userID),
+		pt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPersonalToken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pt, nil
+}
+
+func (tc *personalTokenController) UpdatePersonalToken(ctx context.Context, userID, id int, p PersonalTokenPatch) (*PersonalToken, error) {
+	p, err := validatePersonalTokenPatch(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sets []string
+		args []interface{}
+	)
+
+	if p.Name != nil {
+		args = append(args, *p.Name)
+		sets = append(sets, "name=$"+strconv.Itoa(len(args)))
+	}
+
+	if p.Scopes != nil {
+		args = append(args, pq.Array(p.Scopes))
+		sets = append(sets, "scopes=$"+strconv.Itoa(len(args)))
+	}
+
+	if len(sets) == 0 {
+		return tc.GetPersonalToken(ctx, userID, id)
+	}
+
+	args = append(args, id, userID)
+	query := "UPDATE personal_tokens SET " + strings.Join(sets, ", ") +
+		" WHERE id=$" + strconv.Itoa(len(args)-1) + " AND user_id=$" + strconv.Itoa(len(args)) +
+		" RETURNING " + personalTokenColumns
+
+	pt := &PersonalToken{}
+	err = scanPersonalToken(tc.db.QueryRowContext(ctx, query, args...), pt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPersonalToken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pt, nil
+}
+
+func (tc *personalTokenController) RevokePersonalToken(ctx context.Context, userID, id int) error {
+	var revoked bool
+	err := tc.db.
+		QueryRowContext(ctx, "UPDATE personal_tokens SET revoked_at=COALESCE(revoked_at, now()) WHERE id=$1 AND user_id=$2 RETURNING true", id, userID).
+		Scan(&revoked)
+
+	if err == sql.ErrNoRows {
+		return ErrNoPersonalToken
+	}
+
+	return err
+}
+
+func (tc *personalTokenController) AuthenticatePersonalToken(ctx context.Context, secret, ip string) (*PersonalToken, error) {
+	prefix, ok := personalTokenPrefixOf(secret)
+
+	if !ok {
+		return nil, ErrInvalidPersonalToken
+	}
+
+	id, err := lookupByPrefix(ctx, tc.db, "personal_tokens", "token_hash", prefix, secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if id == 0 {
+		return nil, ErrInvalidPersonalToken
+	}
+
+	pt := &PersonalToken{}
+	err = scanPersonalToken(
+		tc.db.QueryRowContext(
+			ctx,
+			`UPDATE personal_tokens SET last_used_at=now(), last_used_ip=$2
+			WHERE id=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+			RETURNING `+personalTokenColumns,
+			id, ip,
+		),
+		pt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidPersonalToken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pt, nil
+}
@@ -0,0 +1,254 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemoryPersonalTokenController creates a controller keeping personal tokens in memory.
+// It is safe for concurrent use and behaves like the controller for personal_tokens table.
+// Owners of new tokens are looked up in uc.
+func NewMemoryPersonalTokenController(uc UserController) PersonalTokenController {
+	return &memoryPersonalTokenController{
+		uc:       uc,
+		tokens:   map[int]*memoryPersonalToken{},
+		byPrefix: map[string][]*memoryPersonalToken{},
+	}
+}
+
+type memoryPersonalToken struct {
+	PersonalToken
+	hash string
+}
+
+// memoryPersonalTokenController looks tokens up by the prefix as the index of personal_tokens
+type memoryPersonalTokenController struct {
+	uc       UserController
+	mu       sync.Mutex
+	tokens   map[int]*memoryPersonalToken
+	byPrefix map[string][]*memoryPersonalToken
+	lastID   int
+}
+
+// copyPersonalToken returns a copy not sharing scopes with the stored token
+func copyPersonalToken(pt *memoryPersonalToken) *PersonalToken {
+	ret := pt.PersonalToken
+	ret.Scopes = append([]string(nil), pt.Scopes...)
+
+	return &ret
+}
+
+func (tc *memoryPersonalTokenController) NewPersonalToken(ctx context.Context, userID int, name string, scopes []string, expiresAt *time.Time) (*PersonalToken, string, error) {
+	name, scopes, err := validatePersonalToken(name, scopes, expiresAt)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := tc.uc.GetUser(ctx, userID); err != nil {
+		return nil, "", err
+	}
+
+	secret, err := newSecret(PersonalTokenPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := hashArgon2(secret, defaultArgon2Params)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if expiresAt != nil {
+		// Postgres rounds times to microseconds
+		t := expiresAt.Round(time.Microsecond)
+		expiresAt = &t
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.lastID++
+	pt := &memoryPersonalToken{
+		PersonalToken: PersonalToken{
+			ID:        tc.lastID,
+			UserID:    userID,
+			Name:      name,
+			Prefix:    secret[:personalTokenDisplayLength],
+			Scopes:    scopes,
+			CreatedAt: now(),
+			ExpiresAt: expiresAt,
+		},
+		hash: hash,
+	}
+	tc.tokens[pt.ID] = pt
+	tc.byPrefix[pt.Prefix] = append(tc.byPrefix[pt.Prefix], pt)
+
+	return copyPersonalToken(pt), secret, nil
+}
+
+func (tc *memoryPersonalTokenController) ListPersonalTokens(ctx context.Context, userID int) ([]*PersonalToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	tokens := []*PersonalToken{}
+	for _, pt := range tc.tokens {
+		if pt.UserID == userID {
+			tokens = append(tokens, copyPersonalToken(pt))
+		}
+	}
+	tc.mu.Unlock()
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID < tokens[j].ID
+	})
+
+	return tokens, nil
+}
+
+// get returns the token of the user. tc.mu must be held.
+func (tc *memoryPersonalTokenController) get(userID, id int) (*memoryPersonalToken, error) {
+	pt, ok := tc.tokens[id]
+
+	if !ok || pt.UserID != userID {
+		return nil, ErrNoPersonalToken
+	}
+
+	return pt, nil
+}
+
+func (tc *memoryPersonalTokenController) GetPersonalToken(ctx context.Context, userID, id int) (*PersonalToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	pt, err := tc.get(userID, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return copyPersonalToken(pt), nil
+}
+
+func (tc *memoryPersonalTokenController) UpdatePersonalToken(ctx context.Context, userID, id int, p PersonalTokenPatch) (*PersonalToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p, err := validatePersonalTokenPatch(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	pt, err := tc.get(userID, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Name != nil {
+		pt.Name = *p.Name
+	}
+
+	if p.Scopes != nil {
+		pt.Scopes = p.Scopes
+	}
+
+	return copyPersonalToken(pt), nil
+}
+
+func (tc *memoryPersonalTokenController) RevokePersonalToken(ctx context.Context, userID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	pt, err := tc.get(userID, id)
+
+	if err != nil {
+		return err
+	}
+
+	if pt.RevokedAt == nil {
+		t := now()
+		pt.RevokedAt = &t
+	}
+
+	return nil
+}
+
+func (tc *memoryPersonalTokenController) AuthenticatePersonalToken(ctx context.Context, secret, ip string) (*PersonalToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	prefix, ok := personalTokenPrefixOf(secret)
+
+	if !ok {
+		return nil, ErrInvalidPersonalToken
+	}
+
+	tc.mu.Lock()
+	candidates := append([]*memoryPersonalToken(nil), tc.byPrefix[prefix]...)
+	tc.mu.Unlock()
+
+	hashes := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		hashes[i] = candidate.hash
+	}
+
+	// hashes are verified without the lock since argon2id takes time
+	i, err := matchArgon2(hashes, secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if i < 0 {
+		return nil, ErrInvalidPersonalToken
+	}
+	pt := candidates[i]
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t := now()
+
+	if pt.RevokedAt != nil || (pt.ExpiresAt != nil && !pt.ExpiresAt.After(t)) {
+		return nil, ErrInvalidPersonalToken
+	}
+
+	pt.LastUsedAt = &t
+	pt.LastUsedIP = ip
+
+	return copyPersonalToken(pt), nil
+}
+
+// revokeUser revokes every token of the user
+func (tc *memoryPersonalTokenController) revokeUser(userID int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t := now()
+	for _, pt := range tc.tokens {
+		if pt.UserID == userID && pt.RevokedAt == nil {
+			pt.RevokedAt = &t
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// QueryError means a filter or sort expression is malformed
+type QueryError struct {
+	// Pos is the byte offset of the failing token
+	Pos     int
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Pos)
+}
+
+type fieldKind int
+
+const (
+	intField fieldKind = iota
+	stringField
+	timeField
+)
+
+// userField is a column of users table which can be used in filters and sorts
+type userField struct {
+	column string
+	kind   fieldKind
+	value  func(u *User) interface{}
+}
+
+// userFields is the whitelist of filterable and sortable fields
+var userFields = map[string]*userField{
+	"id":         {column: "id", kind: intField, value: func(u *User) interface{} { return u.ID }},
+	"name":       {column: "name", kind: stringField, value: func(u *User) interface{} { return u.Name }},
+	"email":      {column: "email", kind: stringField, value: func(u *User) interface{} { return u.Email }},
+	"created_at": {column: "created_at", kind: timeField, value: func(u *User) interface{} { return u.CreatedAt }},
+	"updated_at": {column: "updated_at", kind: timeField, value: func(u *User) interface{} { return u.UpdatedAt }},
+}
+
+// compareValues compares two values of the same field kind
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int:
+		b := b.(int)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+	}
+
+	return 0
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	pos  int
+	text string
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += size
+	}
+
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+
+	switch ch := l.src[l.pos]; {
+	case ch == '(':
+		l.pos++
+		return token{kind: tokenLParen, pos: start, text: "("}, nil
+	case ch == ')':
+		l.pos++
+		return token{kind: tokenRParen, pos: start, text: ")"}, nil
+	case ch == '"':
+		return l.string()
+	case ch == '-' || ('0' <= ch && ch <= '9'):
+		l.pos++
+		for l.pos < len(l.src) && '0' <= l.src[l.pos] && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+
+		return token{kind: tokenNumber, pos: start, text: l.src[start:l.pos]}, nil
+	case ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z'):
+		for l.pos < len(l.src) {
+			ch := l.src[l.pos]
+			if ch != '_' && !('a' <= ch && ch <= 'z') && !('A' <= ch && ch <= 'Z') && !('0' <= ch && ch <= '9') {
+				break
+			}
+			l.pos++
+		}
+
+		return token{kind: tokenIdent, pos: start, text: l.src[start:l.pos]}, nil
+	}
+
+	return token{}, &QueryError{Pos: start, Message: "unexpected character"}
+}
+
+func (l *lexer) string() (token, error) {
+	start := l.pos
+	l.pos++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+
+		switch ch {
+		case '"':
+			l.pos++
+
+			return token{kind: tokenString, pos: start, text: b.String()}, nil
+		case '\\':
+			if l.pos+1 >= len(l.src) {
+				return token{}, &QueryError{Pos: l.pos, Message: "unterminated escape"}
+			}
+			l.pos++
+			ch = l.src[l.pos]
+		}
+
+		b.WriteByte(ch)
+		l.pos++
+	}
+
+	return token{}, &QueryError{Pos: start, Message: "unterminated string"}
+}
+
+// Operators available in filter expressions
+var filterOperators = map[string]bool{
+	"eq": true, "ne": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+	"sw": true, "ew": true, "co": true,
+}
+
+// Filter is a parsed filter expression for ListUsers
+type Filter struct {
+	root filterNode
+}
+
+// filterNode is a node of filter expressions
+type filterNode interface {
+	// sql writes a parameterized condition and appends its arguments
+	sql(b *strings.Builder, args *[]interface{})
+	match(u *User) bool
+}
+
+type logicalNode struct {
+	and         bool
+	left, right filterNode
+}
+
+func (n *logicalNode) sql(b *strings.Builder, args *[]interface{}) {
+	op := " OR "
+	if n.and {
+		op = " AND "
+	}
+
+	b.WriteString("(")
+	n.left.sql(b, args)
+	b.WriteString(op)
+	n.right.sql(b, args)
+	b.WriteString(")")
+}
+
+func (n *logicalNode) match(u *User) bool {
+	if n.and {
+		return n.left.match(u) && n.right.match(u)
+	}
+
+	return n.left.match(u) || n.right.match(u)
+}
+
+type notNode struct {
+	node filterNode
+}
+
+func (n *notNode) sql(b *strings.Builder, args *[]interface{}) {
+	b.WriteString("NOT ")
+	n.node.sql(b, args)
+}
+
+func (n *notNode) match(u *User) bool {
+	return !n.node.match(u)
+}
+
+type compareNode struct {
+	field *userField
+	op    string
+	value interface{}
+}
+
+var sqlOperators = map[string]string{
+	"eq": "=", "ne": "<>",
+	"gt": ">", "ge": ">=", "lt": "<", "le": "<=",
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (n *compareNode) sql(b *strings.Builder, args *[]interface{}) {
+	value := n.value
+
+	switch n.op {
+	case "sw":
+		value = likeEscaper.Replace(value.(string)) + "%"
+	case "ew":
+		value = "%" + likeEscaper.Replace(value.(string))
+	case "co":
+		value = "%" + likeEscaper.Replace(value.(string)) + "%"
+	}
+
+	*args = append(*args, value)
+	placeholder := "$" + strconv.Itoa(len(*args))
+
+	b.WriteString("(")
+	b.WriteString(n.field.column)
+	if op, ok := sqlOperators[n.op]; ok {
+		b.WriteString(" " + op + " " + placeholder)
+	} else {
+		b.WriteString(" LIKE " + placeholder + ` ESCAPE '\'`)
+	}
+	b.WriteString(")")
+}
+
+func (n *compareNode) match(u *User) bool {
+	v := n.field.value(u)
+
+	switch n.op {
+	case "eq":
+		return compareValues(v, n.value) == 0
+	case "ne":
+		return compareValues(v, n.value) != 0
+	case "gt":
+		return compareValues(v, n.value) > 0
+	case "ge":
+		return compareValues(v, n.value) >= 0
+	case "lt":
+		return compareValues(v, n.value) < 0
+	case "le":
+		return compareValues(v, n.value) <= 0
+	case "sw":
+		return strings.HasPrefix(v.(string), n.value.(string))
+	case "ew":
+		return strings.HasSuffix(v.(string), n.value.(string))
+	case "co":
+		return strings.Contains(v.(string), n.value.(string))
+	}
+
+	return false
+}
+
+// ParseFilter parses a filter expression such as
+//
+//	email ew "@example.com" and (created_at gt "2019-05-01" or not name eq "taro")
+//
+// Comparison operators are eq, ne, gt, ge, lt, le, sw (starts with), ew (ends with) and co (contains).
+// Time values are written as RFC 3339 strings or dates.
+func ParseFilter(s string) (*Filter, error) {
+	p := &filterParser{
+		lexer: lexer{src: s},
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.or()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokenEOF {
+		return nil, &QueryError{Pos: p.tok.pos, Message: "unexpected token " + strconv.Quote(p.tok.text)}
+	}
+
+	return &Filter{root: root}, nil
+}
+
+type filterParser struct {
+	lexer
+	tok token
+}
+
+func (p *filterParser) advance() error {
+	tok, err := p.next()
+
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+
+	return nil
+}
+
+func (p *filterParser) keyword(kw string) bool {
+	return p.tok.kind == tokenIdent && strings.EqualFold(p.tok.text, kw)
+}
+
+func (p *filterParser) or() (filterNode, error) {
+	left, err := p.and()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		right, err := p.and()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = &logicalNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	left, err := p.unary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		right, err := p.unary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = &logicalNode{and: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) unary() (filterNode, error) {
+	switch {
+	case p.keyword("not"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		node, err := p.unary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{node: node}, nil
+	case p.tok.kind == tokenLParen:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		node, err := p.or()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != tokenRParen {
+			return nil, &QueryError{Pos: p.tok.pos, Message: "expected )"}
+		}
+
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		return node, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (filterNode, error) {
+	if p.tok.kind != tokenIdent {
+		return nil, &QueryError{Pos: p.tok.pos, Message: "expected field name"}
+	}
+
+	field, ok := userFields[p.tok.text]
+	if !ok {
+		return nil, &QueryError{Pos: p.tok.pos, Message: "unknown field " + strconv.Quote(p.tok.text)}
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	op := strings.ToLower(p.tok.text)
+	if p.tok.kind != tokenIdent || !filterOperators[op] {
+		return nil, &QueryError{Pos: p.tok.pos, Message: "expected operator"}
+	}
+
+	if (op == "sw" || op == "ew" || op == "co") && field.kind != stringField {
+		return nil, &QueryError{Pos: p.tok.pos, Message: "operator " + op + " is only for string fields"}
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	value, err := parseValue(field, p.tok)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	return &compareNode{field: field, op: op, value: value}, nil
+}
+
+func parseValue(field *userField, tok token) (interface{}, error) {
+	switch field.kind {
+	case intField:
+		if tok.kind == tokenNumber {
+			if v, err := strconv.Atoi(tok.text); err == nil {
+				return v, nil
+			}
+		}
+
+		return nil, &QueryError{Pos: tok.pos, Message: "expected integer"}
+	case timeField:
+		if tok.kind == tokenString {
+			if v, err := parseTime(tok.text); err == nil {
+				return v, nil
+			}
+		}
+
+		return nil, &QueryError{Pos: tok.pos, Message: "expected RFC 3339 time string"}
+	}
+
+	if tok.kind != tokenString {
+		return nil, &QueryError{Pos: tok.pos, Message: "expected string"}
+	}
+
+	return tok.text, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", s)
+}
+
+// SortField is a key of ordering for ListUsers
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSort parses a comma separated list of fields such as "-created_at,name".
+// A leading "-" means descending order.
+func ParseSort(s string) ([]SortField, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	var (
+		fields []SortField
+		seen   = map[string]bool{}
+		pos    = 0
+	)
+	for _, item := range strings.Split(s, ",") {
+		f := SortField{Field: strings.TrimSpace(item)}
+		itemPos := pos + strings.Index(item, f.Field)
+		pos += len(item) + 1
+
+		switch {
+		case strings.HasPrefix(f.Field, "-"):
+			f.Desc = true
+			f.Field = f.Field[1:]
+		case strings.HasPrefix(f.Field, "+"):
+			f.Field = f.Field[1:]
+		}
+
+		if _, ok := userFields[f.Field]; !ok {
+			return nil, &QueryError{Pos: itemPos, Message: "unknown sort field " + strconv.Quote(f.Field)}
+		}
+
+		if seen[f.Field] {
+			return nil, &QueryError{Pos: itemPos, Message: "duplicated sort field " + strconv.Quote(f.Field)}
+		}
+		seen[f.Field] = true
+
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,82 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+func TestParseFilter(t *testing.T) {
+	valid := []string{
+		`email ew "@partner.co.jp"`,
+		`email sw "x" and created_at gt "2019-05-01T00:00:00+09:00"`,
+		`not (name eq "ta\"ro" or id ge 10) AND updated_at le "2019-05-20"`,
+	}
+
+	for _, s := range valid {
+		if _, err := model.ParseFilter(s); err != nil {
+			t.Error("filter should be valid", s, err)
+		}
+	}
+
+	invalid := []struct {
+		filter string
+		pos    int
+	}{
+		{filter: `password eq "x"`, pos: 0},
+		{filter: `name is "x"`, pos: 5},
+		{filter: `name eq taro`, pos: 8},
+		{filter: `id sw "1"`, pos: 3},
+		{filter: `created_at gt "yesterday"`, pos: 14},
+		{filter: `(name eq "x"`, pos: 12},
+		{filter: `name eq "x" name eq "y"`, pos: 12},
+		{filter: `name eq "x`, pos: 8},
+		{filter: `name eq "x" & id eq 1`, pos: 12},
+		{filter: ``, pos: 0},
+	}
+
+	for _, tc := range invalid {
+		_, err := model.ParseFilter(tc.filter)
+
+		qerr, ok := err.(*model.QueryError)
+		if !ok {
+			t.Errorf("filter %q should be rejected, but got %v", tc.filter, err)
+
+			continue
+		}
+
+		if qerr.Pos != tc.pos {
+			t.Errorf("position for %q should be %d, but got %d (%v)", tc.filter, tc.pos, qerr.Pos, qerr)
+		}
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	fields, err := model.ParseSort("-created_at, name,+id")
+
+	if err != nil {
+		t.Fatal("parse sort error", err)
+	}
+
+	expected := []model.SortField{
+		{Field: "created_at", Desc: true},
+		{Field: "name"},
+		{Field: "id"},
+	}
+
+	if len(fields) != len(expected) {
+		t.Fatal("sort fields are incorrect", fields)
+	}
+
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Error("sort field is incorrect", fields[i], expected[i])
+		}
+	}
+
+	for _, s := range []string{"password", "name,-name", "name,"} {
+		if _, err := model.ParseSort(s); err == nil {
+			t.Error("sort should be rejected", s)
+		}
+	}
+}
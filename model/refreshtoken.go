@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// refreshTokenPrefix starts every refresh token
+const refreshTokenPrefix = "urt_"
+
+// RefreshToken is a single-use token exchanged for access tokens.
+// Tokens rotated from the same login form a family, which is revoked together.
+type RefreshToken struct {
+	ID        int       `json:"id"`
+	Family    string    `json:"family"`
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RefreshTokenController defines an interface for refresh_tokens table
+type RefreshTokenController interface {
+	// NewRefreshToken issues a token of a new family lasting for ttl, and returns it with the secret
+	NewRefreshToken(ctx context.Context, userID int, ttl time.Duration) (*RefreshToken, string, error)
+
+	// RotateRefreshToken uses up the token and issues the next one of the family lasting for ttl.
+	// If the token has been used already, the whole family is revoked and it fails with ErrRefreshTokenReused.
+	// It fails with ErrInvalidRefreshToken if the token is unknown, revoked or expired.
+	RotateRefreshToken(ctx context.Context, token string, ttl time.Duration) (*RefreshToken, string, error)
+
+	// RevokeRefreshToken revokes the family of the token. Unknown tokens are ignored.
+	RevokeRefreshToken(ctx context.Context, token string) error
+}
+
+// NewRefreshTokenController creates a controller for refresh_tokens table
+func NewRefreshTokenController(db DB) RefreshTokenController {
+	return &refreshTokenController{db: db}
+}
+
+type refreshTokenController struct {
+	db DB
+}
+
+const refreshTokenColumns = "id, family, user_id, created_at, expires_at"
+
+func scanRefreshToken(s scanner, rt *RefreshToken) error {
+	return s.Scan(&rt.ID, &rt.Family, &rt.UserID, &rt.CreatedAt, &rt.ExpiresAt)
+}
+
+// insertRefreshToken issues a token of the family
+func insertRefreshToken(ctx context.Context, db DB, family string, userID int, ttl time.Duration) (*RefreshToken, string, error) {
+	token, err := newSecret(refreshTokenPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	rt := &RefreshToken{}
+	err = scanRefreshToken(
+		db.QueryRowContext(
+			ctx,
+			"INSERT INTO refresh_tokens(family, user_id, token_hash, expires_at) VALUES ($1, $2, $3, now() + $4 * interval '1 microsecond') RETURNING "+refreshTokenColumns,
+			family, userID, hashSecret(token), int64(ttl/time.Microsecond),
+		),
+		rt,
+	)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return rt, token, nil
+}
+
+func (rc *refreshTokenController) NewRefreshToken(ctx context.Context, userID int, ttl time.Duration) (*RefreshToken, string, error) {
+	family, err := newSecret("")
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	// expired tokens of the user are removed here since they can not be used anymore
+	if _, err := rc.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE user_id=$1 AND expires_at <= now()", userID); err != nil {
+		return nil, "", err
+	}
+
+	return insertRefreshToken(ctx, rc.db, family, userID, ttl)
+}
+
+func (rc *refreshTokenController) RotateRefreshToken(ctx context.Context, token string, ttl time.Duration) (*RefreshToken, string, error) {
+	var (
+		next   *RefreshToken
+		secret string
+		reused bool
+	)
+	err := withTx(ctx, rc.db, func(db DB) error {
+		var (
+			family string
+			userID int
+		)
+		err := db.
+			QueryRowContext(
+				ctx,
+				`UPDATE refresh_tokens SET used_at=now()
+				WHERE token_hash=$1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > now()
+				RETURNING family, user_id`,
+				hashSecret(token),
+			).
+			Scan(&family, &userID)
+
+		if err == sql.ErrNoRows {
+			// the revocation is committed although the rotation fails
+			res, err := db.ExecContext(
+				ctx,
+				"UPDATE refresh_tokens SET revoked_at=COALESCE(revoked_at, now()) WHERE family IN (SELECT family FROM refresh_tokens WHERE token_hash=$1 AND used_at IS NOT NULL)",
+				hashSecret(token),
+			)
+
+			if err != nil {
+				return err
+			}
+
+			n, err := res.RowsAffected()
+			reused = n != 0
+
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		next, secret, err = insertRefreshToken(ctx, db, family, userID, ttl)
+
+		return err
+	})
+
+	switch {
+	case err != nil:
+		return nil, "", err
+	case reused:
+		return nil, "", ErrRefreshTokenReused
+	case next == nil:
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	return next, secret, nil
+}
+
+func (rc *refreshTokenController) RevokeRefreshToken(ctx context.Context, token string) error {
+	_, err := rc.db.ExecContext(
+		ctx,
+		"UPDATE refresh_tokens SET revoked_at=COALESCE(revoked_at, now()) WHERE family IN (SELECT family FROM refresh_tokens WHERE token_hash=$1)",
+		hashSecret(token),
+	)
+
+	return err
+}
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewMemoryRefreshTokenController creates a controller keeping refresh tokens in memory.
+// It is safe for concurrent use and behaves like the controller for refresh_tokens table.
+func NewMemoryRefreshTokenController() RefreshTokenController {
+	return &memoryRefreshTokenController{
+		byHash: map[string]*memoryRefreshToken{},
+	}
+}
+
+type memoryRefreshToken struct {
+	RefreshToken
+	usedAt    *time.Time
+	revokedAt *time.Time
+}
+
+// memoryRefreshTokenController looks tokens up by the hash as the unique index of refresh_tokens
+type memoryRefreshTokenController struct {
+	mu     sync.Mutex
+	byHash map[string]*memoryRefreshToken
+	lastID int
+}
+
+// insert issues a token of the family while the lock is held
+func (rc *memoryRefreshTokenController) insert(family string, userID int, ttl time.Duration) (*RefreshToken, string, error) {
+	token, err := newSecret(refreshTokenPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	rc.lastID++
+	t := now()
+	rt := &memoryRefreshToken{
+		RefreshToken: RefreshToken{
+			ID:        rc.lastID,
+			Family:    family,
+			UserID:    userID,
+			CreatedAt: t,
+			ExpiresAt: t.Add(ttl).Truncate(time.Microsecond),
+		},
+	}
+	rc.byHash[string(hashSecret(token))] = rt
+
+	ret := rt.RefreshToken
+
+	return &ret, token, nil
+}
+
+// revokeFamily revokes every token of the family while the lock is held
+func (rc *memoryRefreshTokenController) revokeFamily(family string) {
+	t := now()
+	for _, rt := range rc.byHash {
+		if rt.Family == family && rt.revokedAt == nil {
+			rt.revokedAt = &t
+		}
+	}
+}
+
+func (rc *memoryRefreshTokenController) NewRefreshToken(ctx context.Context, userID int, ttl time.Duration) (*RefreshToken, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	family, err := newSecret("")
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	t := now()
+	for hash, rt := range rc.byHash {
+		if rt.UserID == userID && !rt.ExpiresAt.After(t) {
+			delete(rc.byHash, hash)
+		}
+	}
+
+	return rc.insert(family, userID, ttl)
+}
+
+func (rc *memoryRefreshTokenController) RotateRefreshToken(ctx context.Context, token string, ttl time.Duration) (*RefreshToken, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rt, ok := rc.byHash[string(hashSecret(token))]
+
+	if !ok {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	if rt.usedAt != nil {
+		rc.revokeFamily(rt.Family)
+
+		return nil, "", ErrRefreshTokenReused
+	}
+
+	t := now()
+	if rt.revokedAt != nil || !rt.ExpiresAt.After(t) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	rt.usedAt = &t
+
+	return rc.insert(rt.Family, rt.UserID, ttl)
+}
+
+func (rc *memoryRefreshTokenController) RevokeRefreshToken(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rt, ok := rc.byHash[string(hashSecret(token))]; ok {
+		rc.revokeFamily(rt.Family)
+	}
+
+	return nil
+}
+
+// revokeUser revokes every token of the user
+func (rc *memoryRefreshTokenController) revokeUser(userID int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	t := now()
+	for _, rt := range rc.byHash {
+		if rt.UserID == userID && rt.revokedAt == nil {
+			rt.revokedAt = &t
+		}
+	}
+}
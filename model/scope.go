@@ -0,0 +1,56 @@
+package model
+
+import "strconv"
+
+// Scopes of credentials
+const (
+	ScopeRead   = "users:read"
+	ScopeWrite  = "users:write"
+	ScopeDelete = "users:delete"
+
+	// ScopeAdmin grants every other scope
+	ScopeAdmin = "users:admin"
+)
+
+// Scopes are all scopes in the canonical order
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeDelete, ScopeAdmin}
+
+// HasScope reports whether scopes grant scope
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateScopes removes duplicates from scopes and sorts them in the canonical order.
+// At least one scope is required.
+func validateScopes(scopes []string) ([]string, *FieldError) {
+	requested := map[string]bool{}
+	for _, s := range scopes {
+		requested[s] = true
+	}
+
+	validated := make([]string, 0, len(requested))
+	for _, s := range Scopes {
+		if requested[s] {
+			validated = append(validated, s)
+			delete(requested, s)
+		}
+	}
+
+	for _, s := range scopes {
+		if requested[s] {
+			return nil, &FieldError{Field: "scopes", Reason: "unknown scope " + strconv.Quote(s)}
+		}
+	}
+
+	if len(validated) == 0 {
+		return nil, &FieldError{Field: "scopes", Reason: "required"}
+	}
+
+	return validated, nil
+}
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// secretBytes is the entropy of generated secrets
+const secretBytes = 32
+
+// newSecret generates a random secret starting with prefix, which tells the kind of the secret
+func newSecret(prefix string) (string, error) {
+	b := make([]byte, secretBytes)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret returns the digest stored instead of a generated secret such as a session token.
+// Such secrets are looked up by the digest, so a fast hash is used.
+// Long-lived credentials such as API keys and personal tokens are hashed by hashArgon2 instead.
+func hashSecret(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+
+	return h[:]
+}
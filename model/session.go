@@ -0,0 +1,99 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// sessionPrefix starts every session token
+const sessionPrefix = "uss_"
+
+// Session is a server-side session of a signed-in user. Only the hash of the token is stored.
+type Session struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SessionController defines an interface for sessions table
+type SessionController interface {
+	// NewSession starts a session of the user lasting for ttl, and returns it with the token
+	NewSession(ctx context.Context, userID int, ttl time.Duration) (*Session, string, error)
+
+	// AuthenticateSession returns the session of the token.
+	// It fails with ErrInvalidSession if the session is unknown or expired.
+	AuthenticateSession(ctx context.Context, token string) (*Session, error)
+
+	// DeleteSession ends the session of the token. Unknown tokens are ignored.
+	DeleteSession(ctx context.Context, token string) error
+}
+
+// NewSessionController creates a controller for sessions table
+func NewSessionController(db DB) SessionController {
+	return &sessionController{db: db}
+}
+
+type sessionController struct {
+	db DB
+}
+
+const sessionColumns = "id, user_id, created_at, expires_at"
+
+func scanSession(s scanner, sess *Session) error {
+	return s.Scan(&sess.ID, &sess.UserID, &sess.CreatedAt, &sess.ExpiresAt)
+}
+
+func (sc *sessionController) NewSession(ctx context.Context, userID int, ttl time.Duration) (*Session, string, error) {
+	token, err := newSecret(sessionPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	// expired sessions of the user are removed here since nothing else reads them
+	if _, err := sc.db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id=$1 AND expires_at <= now()", userID); err != nil {
+		return nil, "", err
+	}
+
+	sess := &Session{}
+	err = scanSession(
+		sc.db.QueryRowContext(
+			ctx,
+			"INSERT INTO sessions(user_id, token_hash, expires_at) VALUES ($1, $2, now() + $3 * interval '1 microsecond') RETURNING "+sessionColumns,
+			userID, hashSecret(token), int64(ttl/time.Microsecond),
+		),
+		sess,
+	)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return sess, token, nil
+}
+
+func (sc *sessionController) AuthenticateSession(ctx context.Context, token string) (*Session, error) {
+	sess := &Session{}
+	err := scanSession(
+		sc.db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE token_hash=$1 AND expires_at > now()", hashSecret(token)),
+		sess,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidSession
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func (sc *sessionController) DeleteSession(ctx context.Context, token string) error {
+	_, err := sc.db.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash=$1", hashSecret(token))
+
+	return err
+}
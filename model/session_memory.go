@@ -0,0 +1,100 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewMemorySessionController creates a controller keeping sessions in memory.
+// It is safe for concurrent use and behaves like the controller for sessions table.
+func NewMemorySessionController() SessionController {
+	return &memorySessionController{
+		byHash: map[string]*Session{},
+	}
+}
+
+// memorySessionController looks sessions up by the hash as the unique index of sessions
+type memorySessionController struct {
+	mu     sync.Mutex
+	byHash map[string]*Session
+	lastID int
+}
+
+func (sc *memorySessionController) NewSession(ctx context.Context, userID int, ttl time.Duration) (*Session, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	token, err := newSecret(sessionPrefix)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	t := now()
+	for hash, sess := range sc.byHash {
+		if sess.UserID == userID && !sess.ExpiresAt.After(t) {
+			delete(sc.byHash, hash)
+		}
+	}
+
+	sc.lastID++
+	sess := &Session{
+		ID:        sc.lastID,
+		UserID:    userID,
+		CreatedAt: t,
+		ExpiresAt: t.Add(ttl).Truncate(time.Microsecond),
+	}
+	sc.byHash[string(hashSecret(token))] = sess
+
+	ret := *sess
+
+	return &ret, token, nil
+}
+
+func (sc *memorySessionController) AuthenticateSession(ctx context.Context, token string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sess, ok := sc.byHash[string(hashSecret(token))]
+
+	if !ok || !sess.ExpiresAt.After(now()) {
+		return nil, ErrInvalidSession
+	}
+
+	ret := *sess
+
+	return &ret, nil
+}
+
+func (sc *memorySessionController) DeleteSession(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	delete(sc.byHash, string(hashSecret(token)))
+	sc.mu.Unlock()
+
+	return nil
+}
+
+// revokeUser deletes every session of the user
+func (sc *memorySessionController) revokeUser(userID int) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for hash, sess := range sc.byHash {
+		if sess.UserID == userID {
+			delete(sc.byHash, hash)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"context"
+	"time"
+)
+
+// SigningKey is a key signing access tokens. Retired keys only verify tokens signed before.
+type SigningKey struct {
+	// ID is the kid of tokens signed with the key
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+
+	// PrivateKey is the key encoded in PKCS #8 DER
+	PrivateKey []byte `json:"-"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// SigningKeyController defines an interface for signing_keys table
+type SigningKeyController interface {
+	// AddSigningKey adds the key to sign from now on and retires the others atomically
+	AddSigningKey(ctx context.Context, k *SigningKey) error
+
+	// ListSigningKeys returns every key in order of creation from the newest
+	ListSigningKeys(ctx context.Context) ([]*SigningKey, error)
+
+	// PurgeSigningKeys removes keys retired before the time and returns the number of them
+	PurgeSigningKeys(ctx context.Context, before time.Time) (int, error)
+}
+
+// NewSigningKeyController creates a controller for signing_keys table
+func NewSigningKeyController(db DB) SigningKeyController {
+	return &signingKeyController{db: db}
+}
+
+type signingKeyController struct {
+	db DB
+}
+
+const signingKeyColumns = "id, algorithm, private_key, created_at, retired_at"
+
+func (kc *signingKeyController) AddSigningKey(ctx context.Context, k *SigningKey) error {
+	return kc.db.
+		QueryRowContext(
+			ctx,
+			`WITH retired AS (UPDATE signing_keys SET retired_at=now() WHERE retired_at IS NULL)
+			INSERT INTO signing_keys(id, algorithm, private_key) VALUES ($1, $2, $3) RETURNING created_at`,
+			k.ID, k.Algorithm, k.PrivateKey,
+		).
+		Scan(&k.CreatedAt)
+}
+
+func (kc *signingKeyController) ListSigningKeys(ctx context.Context) ([]*SigningKey, error) {
+	rows, err := kc.db.QueryContext(ctx, "SELECT "+signingKeyColumns+" FROM signing_keys ORDER BY created_at DESC, id")
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*SigningKey{}
+	for rows.Next() {
+		k := &SigningKey{}
+		if err := rows.Scan(&k.ID, &k.Algorithm, &k.PrivateKey, &k.CreatedAt, &k.RetiredAt); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (kc *signingKeyController) PurgeSigningKeys(ctx context.Context, before time.Time) (int, error) {
+	res, err := kc.db.ExecContext(ctx, "DELETE FROM signing_keys WHERE retired_at < $1", before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewMemorySigningKeyController creates a controller keeping signing keys in memory.
+// It is safe for concurrent use and behaves like the controller for signing_keys table.
+func NewMemorySigningKeyController() SigningKeyController {
+	return &memorySigningKeyController{}
+}
+
+// memorySigningKeyController keeps keys in order of creation from the newest
+type memorySigningKeyController struct {
+	mu   sync.Mutex
+	keys []*SigningKey
+}
+
+func (kc *memorySigningKeyController) AddSigningKey(ctx context.Context, k *SigningKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	t := now()
+	for _, existing := range kc.keys {
+		if existing.RetiredAt == nil {
+			retired := t
+			existing.RetiredAt = &retired
+		}
+	}
+
+	k.CreatedAt = t
+	stored := *k
+	kc.keys = append([]*SigningKey{&stored}, kc.keys...)
+
+	return nil
+}
+
+func (kc *memorySigningKeyController) ListSigningKeys(ctx context.Context) ([]*SigningKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	keys := make([]*SigningKey, len(kc.keys))
+	for i, k := range kc.keys {
+		copied := *k
+		keys[i] = &copied
+	}
+
+	return keys, nil
+}
+
+func (kc *memorySigningKeyController) PurgeSigningKeys(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	kept := kc.keys[:0]
+	for _, k := range kc.keys {
+		if k.RetiredAt == nil || !k.RetiredAt.Before(before) {
+			kept = append(kept, k)
+		}
+	}
+	n := len(kc.keys) - len(kept)
+	kc.keys = kept
+
+	return n, nil
+}
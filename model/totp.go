@@ -0,0 +1,162 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parameters of TOTP in RFC 6238, which are the defaults of authenticator apps
+const (
+	totpSecretBytes = 20
+	totpDigits      = 6
+	totpPeriod      = 30
+
+	// totpSkew is the number of steps accepted before and after the current one for clock drift
+	totpSkew = 1
+)
+
+const (
+	// recoveryCodeCount is the number of recovery codes issued at once
+	recoveryCodeCount = 10
+
+	// recoveryCodeBytes is the entropy of recovery codes
+	recoveryCodeBytes = 10
+)
+
+// totpEncoding encodes secrets as authenticator apps expect
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// recoveryCodeEncoding encodes recovery codes in letters hard to confuse
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// TOTPURI returns the otpauth:// URI of the secret registered to authenticator apps
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+
+	return u.String()
+}
+
+// TOTPCode returns the code of the secret encoded in base32 at the time
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+
+	if err != nil {
+		return "", err
+	}
+
+	return totpCode(key, totpStep(t)), nil
+}
+
+// newTOTPSecret generates a secret of TOTP
+func newTOTPSecret() ([]byte, error) {
+	key := make([]byte, totpSecretBytes)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode computes HOTP of RFC 4226 at the step
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	s := strconv.Itoa(int(code % 1000000))
+
+	return strings.Repeat("0", totpDigits-len(s)) + s
+}
+
+// matchTOTP returns the step of the code around now which is later than last, or 0 if there is none.
+// Steps up to last have been used, so codes can not be replayed.
+func matchTOTP(key []byte, code string, now time.Time, last int64) int64 {
+	current := totpStep(now)
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > last && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+
+	return 0
+}
+
+// isTOTPCode reports whether code looks like a code of TOTP rather than a recovery code
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRecoveryCodes generates recovery codes in groups of four letters such as "abcd-efgh-ijkl-mnop"
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		s := recoveryCodeEncoding.EncodeToString(b)
+
+		groups := make([]string, 0, len(s)/4)
+		for j := 0; j < len(s); j += 4 {
+			groups = append(groups, s[j:j+4])
+		}
+		codes[i] = strings.Join(groups, "-")
+	}
+
+	return codes, nil
+}
+
+// normalizeMFACode strips separators and spaces users may type
+func normalizeMFACode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
@@ -0,0 +1,33 @@
+package model_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of HOTP in RFC 4226
+	key := []byte("12345678901234567890")
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for step, code := range expected {
+		if actual := model.TOTPCodeAt(key, int64(step)); actual != code {
+			t.Errorf("code at %d is incorrect (expected: %s, actual: %s)", step, code, actual)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(model.TOTPURI("users", "taro@example.com", "JBSWY3DPEHPK3PXP"))
+
+	if err != nil {
+		t.Fatal("parse error", err)
+	}
+
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/users:taro@example.com" || q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "users" {
+		t.Error("uri is incorrect", u)
+	}
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// maxTxRetries is the number of retries on serialization failures
+	maxTxRetries = 8
+
+	txRetryBackoff = 10 * time.Millisecond
+)
+
+// txBeginner is implemented by sql.DB
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// WithTx calls fn with a controller bound to a serializable transaction.
+// The transaction is committed if fn returns nil, and is rolled back otherwise.
+// fn is called again when the transaction fails to be serialized, so it must not have side effects out of the transaction.
+// If the controller is already bound to a transaction, fn joins it.
+func (uc *userController) WithTx(ctx context.Context, fn func(uc UserController) error) error {
+	beginner, ok := uc.db.(txBeginner)
+
+	if !ok {
+		return fn(uc)
+	}
+
+	backoff := txRetryBackoff
+	for retry := 0; ; retry++ {
+		err := uc.runTx(ctx, beginner, fn)
+
+		if !isSerializationFailure(err) || retry >= maxTxRetries {
+			return err
+		}
+
+		// jitter prevents conflicting transactions from retrying at the same time
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		backoff *= 2
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (uc *userController) runTx(ctx context.Context, beginner txBeginner, fn func(uc UserController) error) error {
+	tx, err := beginner.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+
+	if err != nil {
+		return err
+	}
+	// no-op after commit
+	defer tx.Rollback()
+
+	if err := fn(&userController{db: tx, emailPolicy: uc.emailPolicy}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isSerializationFailure reports whether err is serialization_failure or deadlock_detected
+func isSerializationFailure(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+
+	return ok && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
+
+// withTx runs fn in a transaction of db, which is committed if fn returns nil.
+// fn is run with db itself if db can not begin transactions.
+func withTx(ctx context.Context, db DB, fn func(db DB) error) error {
+	beginner, ok := db.(txBeginner)
+
+	if !ok {
+		return fn(db)
+	}
+
+	tx, err := beginner.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+	// no-op after commit
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
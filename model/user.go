@@ -1,10 +1,17 @@
 package model
 
 import (
+	"context"
 	"database/sql"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+const userColumns = "id, name, email, created_at, updated_at, deleted_at, email_verified_at"
+
 // User is a struct for users table
 type User struct {
 	ID        int       `json:"id"`
@@ -12,76 +19,323 @@ type User struct {
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// DeletedAt is set while the user is soft-deleted
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// EmailVerifiedAt is set once the user proves the ownership of the email, and cleared when the email changes
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+}
+
+// UserPatch is a partial update of a user. Nil fields are kept as they are.
+type UserPatch struct {
+	Name  *string
+	Email *string
+
+	// UpdatedAt makes the patch fail with ErrPreconditionFailed
+	// unless the user is not updated since then. Zero means no condition.
+	UpdatedAt time.Time
 }
 
 // UserController defines an interface for users table
 type UserController interface {
-	NewUser(name, email string) (*User, error)
-	ListUsers() ([]*User, error)
-	GetUser(id int) (*User, error)
-	UpdateUser(u *User) (*User, error)
-	DeleteUser(id int) error
-	Migrate() error
+	NewUser(ctx context.Context, name, email string) (*User, error)
+	ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error)
+
+	// EachUser calls fn for each user listed by opts without buffering them, and stops at the first error of fn.
+	// Users are not paged unlike ListUsers, and opts.Limit limits the number of users only if it is positive.
+	// fn must not use the controller bound to a transaction since the connection is busy reading rows.
+	EachUser(ctx context.Context, opts ListOptions, fn func(u *User) error) error
+
+	GetUser(ctx context.Context, id int) (*User, error)
+
+	// GetUserByEmail returns the user whose email is the same as email under the email policy
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+
+	// VerifyEmail records that the user has proven the ownership of the current email
+	VerifyEmail(ctx context.Context, id int) (*User, error)
+
+	// UpdateUser replaces name and email of the user.
+	// If u.UpdatedAt is not zero, it fails with ErrPreconditionFailed unless the user is not updated since then.
+	UpdateUser(ctx context.Context, u *User) (*User, error)
+
+	// PatchUser updates only the supplied fields of the user
+	PatchUser(ctx context.Context, id int, p UserPatch) (*User, error)
+	DeleteUser(ctx context.Context, id int) error
+
+	// RestoreUser undoes DeleteUser
+	RestoreUser(ctx context.Context, id int) (*User, error)
+
+	// NewUsers creates users in a statement. Users which are invalid or conflict fail individually.
+	NewUsers(ctx context.Context, users []*User) ([]BatchResult, error)
+
+	// UpdateUsers updates users in a statement as UpdateUser. Users appearing twice fail with ErrDuplicatedInBatch.
+	UpdateUsers(ctx context.Context, users []*User) ([]BatchResult, error)
+
+	// DeleteUsers soft-deletes users in a statement
+	DeleteUsers(ctx context.Context, ids []int) ([]BatchResult, error)
+
+	// PurgeUsers permanently removes users deleted before the time and returns the number of them
+	PurgeUsers(ctx context.Context, before time.Time) (int, error)
+
+	// WithTx runs fn atomically with a controller bound to the transaction
+	WithTx(ctx context.Context, fn func(uc UserController) error) error
 }
 
 // NewUserController creates a controller for users table
-func NewUserController(db DB) UserController {
+func NewUserController(db DB, opts ...Option) UserController {
 	uc := &userController{}
 
 	uc.db = db
+	uc.emailPolicy = newOptions(opts).emailPolicy
 
 	return uc
 }
 
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser scans userColumns into u, followed by extra columns selected after them
+func scanUser(s scanner, u *User, extra ...interface{}) error {
+	return s.Scan(append([]interface{}{&u.ID, &u.Name, &u.Email, &u.CreatedAt, &u.UpdatedAt, &u.DeletedAt, &u.EmailVerifiedAt}, extra...)...)
+}
+
 type userController struct {
-	db DB
+	db          DB
+	emailPolicy EmailPolicy
+}
+
+// emailConflict returns *ConflictError with the id of the user having key other than id
+func (uc *userController) emailConflict(ctx context.Context, id int, key string) error {
+	var existing int
+	err := uc.db.
+		QueryRowContext(ctx, "SELECT id FROM users WHERE email_key=$1 AND id<>$2 AND deleted_at IS NULL", key, id).
+		Scan(&existing)
+
+	switch err {
+	case nil:
+		return newEmailConflictError(existing)
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+}
+
+// unmodifiedSince returns a parameter comparing updated_at. It is NULL for the zero time.
+func unmodifiedSince(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+// writeFailed tells why the conditional write of the user did not affect any rows
+func (uc *userController) writeFailed(ctx context.Context, id int) error {
+	var exists bool
+	err := uc.db.
+		QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id=$1 AND deleted_at IS NULL)", id).
+		Scan(&exists)
+
+	switch {
+	case err != nil:
+		return err
+	case exists:
+		return ErrPreconditionFailed
+	default:
+		return ErrNoUser
+	}
+}
+
+// isUniqueViolation reports whether err is caused by users_email_key_idx
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == "users_email_key_idx"
 }
 
 var _ UserController = &userController{}
 
-func (uc *userController) NewUser(name, email string) (*User, error) {
+func (uc *userController) NewUser(ctx context.Context, name, email string) (*User, error) {
+	name, email, err := ValidateUser(name, email)
+
+	if err != nil {
+		return nil, err
+	}
+
 	u := &User{
 		Name:  name,
 		Email: email,
 	}
 
-	err := uc.db.
-		QueryRow("INSERT INTO users(name, email) VALUES ($1, $2) RETURNING id, created_at, updated_at", name, email).
+	// ON CONFLICT keeps the transaction alive to look up the existing user
+	key := uc.emailPolicy.Key(email)
+	err = uc.db.
+		QueryRowContext(
+			ctx,
+			"INSERT INTO users(name, email, email_key) VALUES ($1, $2, $3) ON CONFLICT (email_key) WHERE deleted_at IS NULL DO NOTHING RETURNING id, created_at, updated_at",
+			name, email, key,
+		).
 		Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt)
 
 	if err != nil {
+		if err == sql.ErrNoRows {
+			if err := uc.emailConflict(ctx, 0, key); err != nil {
+				return nil, err
+			}
+
+			// the existing user has been deleted in the meantime
+			return nil, newEmailConflictError(0)
+		}
+
 		return nil, err
 	}
 
 	return u, nil
 }
 
-func (uc *userController) ListUsers() ([]*User, error) {
-	rows, err := uc.db.Query("SELECT * FROM users")
+// ListUsers returns users ordered by opts.Sort.
+// Pages are delimited by keyset, so they stay stable while rows are inserted or deleted.
+func (uc *userController) ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	limit := opts.limit()
+	keys, err := opts.orderKeys()
+
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, err := listQuery(&opts, keys, limit+1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := uc.db.QueryContext(ctx, query, args...)
 
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	users := make([]*User, 0, 16)
+	users := make([]*User, 0, limit+1)
 	for rows.Next() {
 		u := &User{}
-		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		if err := scanUser(rows, u); err != nil {
 			return nil, err
 		}
 
 		users = append(users, u)
 	}
 
-	return users, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &UserPage{
+		Users: users,
+	}
+
+	if len(users) > limit {
+		page.Users = users[:limit]
+		page.NextCursor = newCursor(keys, page.Users[limit-1])
+	}
+
+	return page, nil
+}
+
+// EachUser reads rows of a query without LIMIT one by one,
+// so the memory in use does not grow with the number of users.
+func (uc *userController) EachUser(ctx context.Context, opts ListOptions, fn func(u *User) error) error {
+	keys, err := opts.orderKeys()
+
+	if err != nil {
+		return err
+	}
+
+	query, args, err := listQuery(&opts, keys, opts.Limit)
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := uc.db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u := &User{}
+		if err := scanUser(rows, u); err != nil {
+			return err
+		}
+
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
 }
-func (uc *userController) GetUser(id int) (*User, error) {
+
+func (uc *userController) GetUser(ctx context.Context, id int) (*User, error) {
 	u := &User{}
 
-	err := uc.db.
-		QueryRow("SELECT * FROM users WHERE id = $1", id).
-		Scan(&u.ID, &u.Name, &u.Email, &u.CreatedAt, &u.UpdatedAt)
+	err := scanUser(
+		uc.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id),
+		u,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoUser
+		}
+
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (uc *userController) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	u := &User{}
+
+	err := scanUser(
+		uc.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email_key=$1 AND deleted_at IS NULL", uc.emailPolicy.Key(sanitize(email))),
+		u,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNoUser
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// VerifyEmail keeps the first time of verification if the email has been verified already
+func (uc *userController) VerifyEmail(ctx context.Context, id int) (*User, error) {
+	u := &User{}
+
+	err := scanUser(
+		uc.db.QueryRowContext(
+			ctx,
+			"UPDATE users SET email_verified_at=now() WHERE id=$1 AND deleted_at IS NULL AND email_verified_at IS NULL RETURNING "+userColumns,
+			id,
+		),
+		u,
+	)
+
+	// verified already, or the user does not exist
+	if err == sql.ErrNoRows {
+		return uc.GetUser(ctx, id)
+	}
 
 	if err != nil {
 		return nil, err
@@ -90,17 +344,41 @@ func (uc *userController) GetUser(id int) (*User, error) {
 	return u, nil
 }
 
-func (uc *userController) UpdateUser(u *User) (*User, error) {
+func (uc *userController) UpdateUser(ctx context.Context, u *User) (*User, error) {
+	name, email, err := ValidateUser(u.Name, u.Email)
+
+	if err != nil {
+		return nil, err
+	}
+
 	// copied user to return
 	ret := *u
+	ret.Name = name
+	ret.Email = email
 
-	err := uc.db.
-		QueryRow("UPDATE users SET name=$1, email=$2 WHERE id=$3 RETURNING created_at, updated_at", u.Name, u.Email, u.ID).
-		Scan(&ret.CreatedAt, &ret.UpdatedAt)
+	key := uc.emailPolicy.Key(email)
+	if err := uc.emailConflict(ctx, u.ID, key); err != nil {
+		return nil, err
+	}
+
+	// updated_at is compared in the statement not to overwrite concurrent updates
+	err = uc.db.
+		QueryRowContext(
+			ctx,
+			`UPDATE users SET name=$1, email=$2, email_key=$3
+			WHERE id=$4 AND deleted_at IS NULL AND ($5::TIMESTAMP WITH TIME ZONE IS NULL OR updated_at=$5)
+			RETURNING created_at, updated_at, email_verified_at`,
+			name, email, key, u.ID, unmodifiedSince(u.UpdatedAt),
+		).
+		Scan(&ret.CreatedAt, &ret.UpdatedAt, &ret.EmailVerifiedAt)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, ErrNoUser
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, uc.writeFailed(ctx, u.ID)
+		case isUniqueViolation(err):
+			// another user has taken the email after the check
+			return nil, newEmailConflictError(0)
 		}
 
 		return nil, err
@@ -109,35 +387,142 @@ func (uc *userController) UpdateUser(u *User) (*User, error) {
 	return &ret, nil
 }
 
-func (uc *userController) DeleteUser(id int) error {
-	_, err := uc.db.Exec("DELETE FROM users WHERE id=$1", id)
-
-	return err
-}
-
-func (uc *userController) Migrate() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(256),
-		email VARCHAR(256) NOT NULL,
-		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
-	);
-	DROP TRIGGER IF EXISTS update_tri ON users;
-	DROP FUNCTION IF EXISTS set_update_time;
-	CREATE FUNCTION set_update_time() RETURNS OPAQUE AS '
-		BEGIN
-	    	new.updated_at := ''now'';
-	    	return new;
-  		END;
-	' LANGUAGE 'plpgsql';
-	CREATE TRIGGER update_tri BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE set_update_time();
-	`
-
-	if _, err := uc.db.Exec(query); err != nil {
+func (uc *userController) PatchUser(ctx context.Context, id int, p UserPatch) (*User, error) {
+	p, err := ValidatePatch(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sets []string
+		args []interface{}
+	)
+
+	if p.Name != nil {
+		args = append(args, *p.Name)
+		sets = append(sets, "name=$"+strconv.Itoa(len(args)))
+	}
+
+	if p.Email != nil {
+		key := uc.emailPolicy.Key(*p.Email)
+		if err := uc.emailConflict(ctx, id, key); err != nil {
+			return nil, err
+		}
+
+		args = append(args, *p.Email, key)
+		sets = append(sets, "email=$"+strconv.Itoa(len(args)-1), "email_key=$"+strconv.Itoa(len(args)))
+	}
+
+	// an empty patch does not touch updated_at
+	if len(sets) == 0 {
+		u, err := uc.GetUser(ctx, id)
+
+		if err == nil && !p.UpdatedAt.IsZero() && !u.UpdatedAt.Equal(p.UpdatedAt) {
+			return nil, ErrPreconditionFailed
+		}
+
+		return u, err
+	}
+
+	args = append(args, id, unmodifiedSince(p.UpdatedAt))
+	query := "UPDATE users SET " + strings.Join(sets, ", ") +
+		" WHERE id=$" + strconv.Itoa(len(args)-1) + " AND deleted_at IS NULL" +
+		" AND ($" + strconv.Itoa(len(args)) + "::TIMESTAMP WITH TIME ZONE IS NULL OR updated_at=$" + strconv.Itoa(len(args)) + ")" +
+		" RETURNING " + userColumns
+
+	u := &User{}
+	err = scanUser(uc.db.QueryRowContext(ctx, query, args...), u)
+
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, uc.writeFailed(ctx, id)
+		case isUniqueViolation(err):
+			return nil, newEmailConflictError(0)
+		}
+
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// DeleteUser soft-deletes the user. It is removed by PurgeUsers later.
+func (uc *userController) DeleteUser(ctx context.Context, id int) error {
+	res, err := uc.db.ExecContext(ctx, "UPDATE users SET deleted_at=now() WHERE id=$1 AND deleted_at IS NULL", id)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+
+	if err != nil {
 		return err
 	}
 
+	if n == 0 {
+		return ErrNoUser
+	}
+
 	return nil
 }
+
+func (uc *userController) RestoreUser(ctx context.Context, id int) (*User, error) {
+	var (
+		key     string
+		deleted bool
+	)
+	err := uc.db.
+		QueryRowContext(ctx, "SELECT email_key, deleted_at IS NOT NULL FROM users WHERE id=$1", id).
+		Scan(&key, &deleted)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoUser
+		}
+
+		return nil, err
+	}
+
+	if !deleted {
+		return nil, ErrNotDeleted
+	}
+
+	if err := uc.emailConflict(ctx, id, key); err != nil {
+		return nil, err
+	}
+
+	u := &User{}
+	err = scanUser(
+		uc.db.QueryRowContext(ctx, "UPDATE users SET deleted_at=NULL WHERE id=$1 AND deleted_at IS NOT NULL RETURNING "+userColumns, id),
+		u,
+	)
+
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			// restored or purged in the meantime
+			return nil, ErrNoUser
+		case isUniqueViolation(err):
+			return nil, newEmailConflictError(0)
+		}
+
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (uc *userController) PurgeUsers(ctx context.Context, before time.Time) (int, error) {
+	res, err := uc.db.ExecContext(ctx, "DELETE FROM users WHERE deleted_at < $1", before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
@@ -1,34 +1,32 @@
 package model_test
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/cs3238-tsuzu/coding_challenge_03/migrations"
 	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/model/modeltest"
 	_ "github.com/lib/pq"
 )
 
-const migration = `
-DROP TRIGGER IF EXISTS update_tri ON users;
-DROP FUNCTION IF EXISTS set_update_time;
+const reset = `
+DROP TABLE IF EXISTS personal_tokens;
+DROP TABLE IF EXISTS one_time_tokens;
+DROP TABLE IF EXISTS mfa_challenges;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS totp_credentials;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS signing_keys;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS password_credentials;
 DROP TABLE IF EXISTS users;
-CREATE TABLE users (
-	id SERIAL PRIMARY KEY,
-	name VARCHAR(256) NOT NULL,
-	email VARCHAR(256) NOT NULL,
-	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
-	updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
-);
-CREATE FUNCTION set_update_time() RETURNS OPAQUE AS '
-	BEGIN
-		new.updated_at := ''now'';
-		return new;
-	  END;
-' LANGUAGE 'plpgsql';
-CREATE TRIGGER update_tri BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE set_update_time();
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS schema_migrations;
 `
 
 func initDB(t *testing.T) (*sql.DB, model.UserController) {
@@ -41,7 +39,11 @@ func initDB(t *testing.T) (*sql.DB, model.UserController) {
 		log.Fatal(err)
 	}
 
-	if _, err := db.Exec(migration); err != nil {
+	if _, err := db.Exec(reset); err != nil {
+		t.Fatal("reset error", err)
+	}
+
+	if _, err := migrations.NewMigrator(db).Up(context.Background(), 0); err != nil {
 		t.Fatal("migration error", err)
 	}
 
@@ -81,7 +83,7 @@ func TestNewUser(t *testing.T) {
 		Email: "hoge@example.com",
 	}
 
-	ret, err := uc.NewUser(param.Name, param.Email)
+	ret, err := uc.NewUser(context.Background(), param.Name, param.Email)
 
 	if err != nil {
 		t.Fatal("new user error ", err)
@@ -115,138 +117,107 @@ func TestNewUser(t *testing.T) {
 	compareUser(t, &user, ret)
 }
 
-func TestListUsers(t *testing.T) {
-	before := time.Now()
-	_, uc := initDB(t)
-
-	params := []*model.User{
-		{
-			ID:    -1,
-			Name:  "name",
-			Email: "hoge@example.com",
-		},
-		{
-			ID:    -1,
-			Name:  "name2",
-			Email: "hoge2@example.com",
-		},
-	}
-
-	for _, p := range params {
-		if _, err := uc.NewUser(p.Name, p.Email); err != nil {
-			t.Fatal("new user error ", err)
-		}
-	}
-
-	after := time.Now()
-
-	users, err := uc.ListUsers()
-
-	if err != nil {
-		t.Fatal("list user error ", err)
-	}
-
-	for i, u := range users {
-		compareUser(t, u, params[i])
+func TestUserControllerSuite(t *testing.T) {
+	modeltest.RunUserControllerSuite(t, func(t *testing.T) model.UserController {
+		_, uc := initDB(t)
 
-		checkTime(t, before, after, u.CreatedAt)
-		checkTime(t, before, after, u.UpdatedAt)
-	}
+		return uc
+	})
 }
 
-func TestGetUser(t *testing.T) {
-	before := time.Now()
-	_, uc := initDB(t)
-
-	param := &model.User{
-		ID:    -1,
-		Name:  "name",
-		Email: "hoge@example.com",
-	}
-	user, err := uc.NewUser(param.Name, param.Email)
-
-	if err != nil {
-		t.Fatal("new user error ", err)
-	}
-
-	after := time.Now()
-
-	ret, err := uc.GetUser(user.ID)
+func TestAPIKeyControllerSuite(t *testing.T) {
+	modeltest.RunAPIKeyControllerSuite(t, func(t *testing.T) model.APIKeyController {
+		db, _ := initDB(t)
 
-	if err != nil {
-		t.Fatal("list user error ", err)
-	}
+		return model.NewAPIKeyController(db)
+	})
+}
 
-	compareUser(t, ret, user)
+func TestCredentialControllerSuite(t *testing.T) {
+	modeltest.RunCredentialControllerSuite(t, func(t *testing.T) (model.UserController, model.CredentialController) {
+		db, uc := initDB(t)
 
-	checkTime(t, before, after, ret.CreatedAt)
-	checkTime(t, before, after, ret.UpdatedAt)
+		return uc, model.NewCredentialController(db)
+	})
 }
 
-func TestUpdateUser(t *testing.T) {
-	beforeCreated := time.Now()
-	_, uc := initDB(t)
-
-	param := &model.User{
-		ID:    -1,
-		Name:  "name",
-		Email: "hoge@example.com",
-	}
-	user, err := uc.NewUser(param.Name, param.Email)
+func TestSessionControllerSuite(t *testing.T) {
+	modeltest.RunSessionControllerSuite(t, func(t *testing.T) (model.SessionController, int) {
+		db, uc := initDB(t)
 
-	if err != nil {
-		t.Fatal("new user error ", err)
-	}
+		u, err := uc.NewUser(context.Background(), "taro", "taro@example.com")
 
-	afterCreated := time.Now()
+		if err != nil {
+			t.Fatal("new user error", err)
+		}
 
-	time.Sleep(3 * time.Second)
+		return model.NewSessionController(db), u.ID
+	})
+}
 
-	beforeUpdated := time.Now()
+func TestSigningKeyControllerSuite(t *testing.T) {
+	modeltest.RunSigningKeyControllerSuite(t, func(t *testing.T) model.SigningKeyController {
+		db, _ := initDB(t)
 
-	user.Name = "name2"
-	user.Email = "hoge2@example.com"
+		return model.NewSigningKeyController(db)
+	})
+}
 
-	ret, err := uc.UpdateUser(user)
+func TestRefreshTokenControllerSuite(t *testing.T) {
+	modeltest.RunRefreshTokenControllerSuite(t, func(t *testing.T) (model.RefreshTokenController, int) {
+		db, uc := initDB(t)
 
-	if err != nil {
-		t.Fatal("update error ", err)
-	}
-	afterUpdated := time.Now()
+		u, err := uc.NewUser(context.Background(), "taro", "taro@example.com")
 
-	compareUser(t, ret, user)
+		if err != nil {
+			t.Fatal("new user error", err)
+		}
 
-	checkTime(t, beforeCreated, afterCreated, ret.CreatedAt)
-	checkTime(t, beforeUpdated, afterUpdated, ret.UpdatedAt)
+		return model.NewRefreshTokenController(db), u.ID
+	})
+}
 
-	ret, err = uc.GetUser(user.ID)
+func TestMFAControllerSuite(t *testing.T) {
+	modeltest.RunMFAControllerSuite(t, func(t *testing.T) (model.MFAController, int) {
+		db, uc := initDB(t)
 
-	if err != nil {
-		t.Fatal("get user error ", err)
-	}
+		u, err := uc.NewUser(context.Background(), "taro", "taro@example.com")
 
-	compareUser(t, ret, user)
+		if err != nil {
+			t.Fatal("new user error", err)
+		}
 
-	checkTime(t, beforeCreated, afterCreated, ret.CreatedAt)
-	checkTime(t, beforeUpdated, afterUpdated, ret.UpdatedAt)
+		return model.NewMFAController(db), u.ID
+	})
 }
 
-func TestMigrate(t *testing.T) {
-	dsn := os.Getenv("POSTGRES_DSN")
+func TestOneTimeTokenControllerSuite(t *testing.T) {
+	modeltest.RunOneTimeTokenControllerSuite(t, func(t *testing.T) (model.UserController, model.OneTimeTokenController) {
+		db, uc := initDB(t)
 
-	db, err := sql.Open("postgres", dsn)
-	if err != nil {
-		log.Fatal(err)
-	}
+		return uc, model.NewOneTimeTokenController(db)
+	})
+}
 
-	uc := model.NewUserController(db)
+func TestPersonalTokenControllerSuite(t *testing.T) {
+	modeltest.RunPersonalTokenControllerSuite(t, func(t *testing.T) (model.UserController, model.PersonalTokenController) {
+		db, uc := initDB(t)
 
-	if err := uc.Migrate(); err != nil {
-		t.Fatal("migration error", err)
-	}
+		return uc, model.NewPersonalTokenController(db)
+	})
+}
 
-	// check idempotency
-	if err := uc.Migrate(); err != nil {
-		t.Fatal("migration for checking idempotency error", err)
-	}
+func TestPasswordResetSuite(t *testing.T) {
+	modeltest.RunPasswordResetSuite(t, func(t *testing.T) *modeltest.PasswordResetControllers {
+		db, uc := initDB(t)
+
+		return &modeltest.PasswordResetControllers{
+			Users:          uc,
+			Credentials:    model.NewCredentialController(db),
+			OneTimeTokens:  model.NewOneTimeTokenController(db),
+			Sessions:       model.NewSessionController(db),
+			RefreshTokens:  model.NewRefreshTokenController(db),
+			PersonalTokens: model.NewPersonalTokenController(db),
+		}
+	})
 }
@@ -0,0 +1,194 @@
+package model
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxNameLength is the maximum number of characters in User.Name
+	MaxNameLength = 256
+
+	// MaxEmailLength is the maximum number of characters in User.Email
+	MaxEmailLength = 256
+)
+
+// FieldError is an invalid field and the reason
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidateUser strips control characters and surrounding spaces from name and email, and validates them.
+// It returns the sanitized values, or *ValidationError listing every invalid field.
+func ValidateUser(name, email string) (string, string, error) {
+	var fields []FieldError
+
+	name, ferr := validateName(name)
+	if ferr != nil {
+		fields = append(fields, *ferr)
+	}
+
+	email, ferr = validateEmail(email)
+	if ferr != nil {
+		fields = append(fields, *ferr)
+	}
+
+	if len(fields) != 0 {
+		return "", "", &ValidationError{Message: "user is invalid", Fields: fields}
+	}
+
+	return name, email, nil
+}
+
+// ValidatePatch sanitizes and validates the supplied fields of p as ValidateUser does
+func ValidatePatch(p UserPatch) (UserPatch, error) {
+	var fields []FieldError
+
+	if p.Name != nil {
+		name, ferr := validateName(*p.Name)
+		if ferr != nil {
+			fields = append(fields, *ferr)
+		}
+		p.Name = &name
+	}
+
+	if p.Email != nil {
+		email, ferr := validateEmail(*p.Email)
+		if ferr != nil {
+			fields = append(fields, *ferr)
+		}
+		p.Email = &email
+	}
+
+	if len(fields) != 0 {
+		return UserPatch{}, &ValidationError{Message: "user is invalid", Fields: fields}
+	}
+
+	return p, nil
+}
+
+func validateName(name string) (string, *FieldError) {
+	name = sanitize(name)
+	switch {
+	case len(name) == 0:
+		return "", &FieldError{Field: "name", Reason: "required"}
+	case utf8.RuneCountInString(name) > MaxNameLength:
+		return "", &FieldError{Field: "name", Reason: "must be at most 256 characters"}
+	}
+
+	return name, nil
+}
+
+func validateEmail(email string) (string, *FieldError) {
+	email = sanitize(email)
+	switch {
+	case len(email) == 0:
+		return "", &FieldError{Field: "email", Reason: "required"}
+	case utf8.RuneCountInString(email) > MaxEmailLength:
+		return "", &FieldError{Field: "email", Reason: "must be at most 256 characters"}
+	case !isEmail(email):
+		return "", &FieldError{Field: "email", Reason: "must be an RFC 5322 address"}
+	}
+
+	return email, nil
+}
+
+func sanitize(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+
+		return r
+	}, s)
+
+	return strings.TrimSpace(s)
+}
+
+// isEmail reports whether s is an addr-spec of RFC 5322 without comments and obsolete syntax.
+// Non-ASCII characters are allowed as RFC 6532.
+func isEmail(s string) bool {
+	var rest string
+
+	if strings.HasPrefix(s, `"`) {
+		var ok bool
+		rest, ok = skipQuotedString(s)
+
+		if !ok {
+			return false
+		}
+	} else {
+		at := strings.IndexByte(s, '@')
+
+		if at < 0 || !isDotAtom(s[:at]) {
+			return false
+		}
+		rest = s[at:]
+	}
+
+	if !strings.HasPrefix(rest, "@") {
+		return false
+	}
+	domain := rest[1:]
+
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		for _, r := range domain[1 : len(domain)-1] {
+			if r < 33 || r > 126 || r == '[' || r == ']' || r == '\\' {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return isDotAtom(domain)
+}
+
+func isAtext(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') ||
+		strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r) || r > unicode.MaxASCII
+}
+
+func isDotAtom(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+
+	for _, atom := range strings.Split(s, ".") {
+		if len(atom) == 0 {
+			return false
+		}
+
+		for _, r := range atom {
+			if !isAtext(r) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// skipQuotedString returns the rest of s after the leading quoted-string
+func skipQuotedString(s string) (string, bool) {
+	escaped := false
+	for i, r := range s[1:] {
+		switch {
+		case escaped:
+			if r < ' ' && r != '\t' {
+				return "", false
+			}
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			return s[i+2:], true
+		case r < ' ' && r != '\t':
+			return "", false
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,54 @@
+package model_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+func TestValidateUserEmail(t *testing.T) {
+	valid := []string{
+		"hoge@example.com",
+		"first.last+tag@sub.example.co.jp",
+		"!#$%&'*+-/=?^_`{|}~@example.com",
+		`"john doe"@example.com`,
+		`"a@b\"c"@example.com`,
+		"user@[192.168.0.1]",
+		"ユーザー@例え.jp",
+		"user@localhost",
+	}
+
+	for _, email := range valid {
+		if _, _, err := model.ValidateUser("name", email); err != nil {
+			t.Error("email should be valid", email, err)
+		}
+	}
+
+	invalid := []string{
+		"hoge",
+		"@example.com",
+		"hoge@",
+		"hoge@@example.com",
+		".hoge@example.com",
+		"hoge.@example.com",
+		"ho..ge@example.com",
+		"hoge@example..com",
+		"ho ge@example.com",
+		"hoge(comment)@example.com",
+		`"unterminated@example.com`,
+		`"quoted"x@example.com`,
+		"hoge@[1.2.3.4",
+		"hoge@exa[mple].com",
+		strings.Repeat("a", 250) + "@example.com",
+	}
+
+	for _, email := range invalid {
+		_, _, err := model.ValidateUser("name", email)
+
+		verr, ok := err.(*model.ValidationError)
+		if !ok || len(verr.Fields) != 1 || verr.Fields[0].Field != "email" {
+			t.Error("email should be invalid", email, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package token
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+)
+
+// Algorithms of signing keys
+const (
+	// RS256 is RSASSA-PKCS1-v1_5 with SHA-256 and 2048-bit keys
+	RS256 = "RS256"
+
+	// EdDSA is Ed25519, which is available if built with Go 1.13 or later
+	EdDSA = "EdDSA"
+)
+
+// rsaKeyBits is the size of generated RSA keys
+const rsaKeyBits = 2048
+
+// algorithm signs and verifies tokens with keys of the kind
+type algorithm struct {
+	generate func() (crypto.Signer, error)
+	sign     func(key crypto.Signer, data []byte) ([]byte, error)
+
+	// verify reports whether sig is valid, and false if pub is not a key of the algorithm
+	verify func(pub crypto.PublicKey, data, sig []byte) bool
+
+	// jwk sets members of the public key to k
+	jwk func(pub crypto.PublicKey, k *JWK)
+}
+
+// algorithms are the supported algorithms by the names in JWS
+var algorithms = map[string]*algorithm{
+	RS256: {
+		generate: func() (crypto.Signer, error) {
+			return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		},
+		sign: func(key crypto.Signer, data []byte) ([]byte, error) {
+			digest := sha256.Sum256(data)
+
+			return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		},
+		verify: func(pub crypto.PublicKey, data, sig []byte) bool {
+			key, ok := pub.(*rsa.PublicKey)
+
+			if !ok {
+				return false
+			}
+
+			digest := sha256.Sum256(data)
+
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+		},
+		jwk: func(pub crypto.PublicKey, k *JWK) {
+			key := pub.(*rsa.PublicKey)
+
+			k.KeyType = "RSA"
+			k.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+			k.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+		},
+	},
+}
+
+// Supported reports whether keys of the algorithm can be used
+func Supported(alg string) bool {
+	_, ok := algorithms[alg]
+
+	return ok
+}
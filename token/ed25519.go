@@ -0,0 +1,35 @@
+//go:build go1.13
+// +build go1.13
+
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+)
+
+func init() {
+	algorithms[EdDSA] = &algorithm{
+		generate: func() (crypto.Signer, error) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+
+			return key, err
+		},
+		sign: func(key crypto.Signer, data []byte) ([]byte, error) {
+			// Ed25519 signs messages without prehashing
+			return key.Sign(rand.Reader, data, crypto.Hash(0))
+		},
+		verify: func(pub crypto.PublicKey, data, sig []byte) bool {
+			key, ok := pub.(ed25519.PublicKey)
+
+			return ok && ed25519.Verify(key, data, sig)
+		},
+		jwk: func(pub crypto.PublicKey, k *JWK) {
+			k.KeyType = "OKP"
+			k.Curve = "Ed25519"
+			k.X = base64.RawURLEncoding.EncodeToString(pub.(ed25519.PublicKey))
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package token
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidToken means the access token is malformed, expired or not signed by the service
+var ErrInvalidToken = errors.New("access token is invalid")
+
+// Claims are the claims of access tokens
+type Claims struct {
+	// Subject is the id of the user
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// header is the JOSE header of tokens
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// encodeSegment encodes v as a segment of JWS compact serialization
+func encodeSegment(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeSegment decodes a segment of JWS compact serialization to v
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// split returns the header, the claims and the signature of the token, and the signing input
+func split(token string) (*header, *Claims, []byte, string, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, nil, nil, "", ErrInvalidToken
+	}
+
+	h := &header{}
+	if err := decodeSegment(parts[0], h); err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, nil, nil, "", ErrInvalidToken
+	}
+
+	return h, claims, sig, parts[0] + "." + parts[1], nil
+}
@@ -0,0 +1,300 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+const (
+	// keyReloadInterval is the interval of reloading keys to pick up ones rotated by other instances
+	keyReloadInterval = time.Minute
+
+	// minKeyReloadInterval limits reloading triggered by tokens with unknown key ids
+	minKeyReloadInterval = 5 * time.Second
+
+	// keyIDBytes is the entropy of generated key ids
+	keyIDBytes = 12
+)
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// N and E are members of RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Curve and X are members of Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKSet is a set of public keys published at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// signingKey is a parsed model.SigningKey
+type signingKey struct {
+	id      string
+	alg     string
+	signer  crypto.Signer
+	retired bool
+}
+
+// KeySet signs and verifies access tokens with keys stored by a SigningKeyController.
+// Keys are cached and reloaded periodically, so keys rotated by other instances are used in a minute.
+type KeySet struct {
+	controller model.SigningKeyController
+	algorithm  string
+
+	mu       sync.RWMutex
+	keys     []*signingKey
+	loadedAt time.Time
+}
+
+// NewKeySet creates a KeySet generating keys of the algorithm
+func NewKeySet(kc model.SigningKeyController, alg string) (*KeySet, error) {
+	if !Supported(alg) {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+
+	return &KeySet{controller: kc, algorithm: alg}, nil
+}
+
+// Rotate generates a key signing tokens from now on. Retired keys still verify tokens until they are purged.
+func (ks *KeySet) Rotate(ctx context.Context) (*model.SigningKey, error) {
+	signer, err := algorithms[ks.algorithm].generate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, keyIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	k := &model.SigningKey{
+		ID:         base64.RawURLEncoding.EncodeToString(id),
+		Algorithm:  ks.algorithm,
+		PrivateKey: der,
+	}
+
+	if err := ks.controller.AddSigningKey(ctx, k); err != nil {
+		return nil, err
+	}
+
+	if _, err := ks.reload(ctx); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// load returns the cached keys, which are reloaded if they are stale
+func (ks *KeySet) load(ctx context.Context) ([]*signingKey, error) {
+	ks.mu.RLock()
+	keys, loadedAt := ks.keys, ks.loadedAt
+	ks.mu.RUnlock()
+
+	if !loadedAt.IsZero() && time.Since(loadedAt) < keyReloadInterval {
+		return keys, nil
+	}
+
+	return ks.reload(ctx)
+}
+
+// reload reads keys from the controller
+func (ks *KeySet) reload(ctx context.Context) ([]*signingKey, error) {
+	stored, err := ks.controller.ListSigningKeys(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*signingKey, 0, len(stored))
+	for _, k := range stored {
+		if !Supported(k.Algorithm) {
+			return nil, fmt.Errorf("signing key %s has unsupported algorithm: %s", k.ID, k.Algorithm)
+		}
+
+		parsed, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s is malformed: %v", k.ID, err)
+		}
+
+		signer, ok := parsed.(crypto.Signer)
+
+		if !ok {
+			return nil, fmt.Errorf("signing key %s is not a signing key", k.ID)
+		}
+
+		keys = append(keys, &signingKey{id: k.ID, alg: k.Algorithm, signer: signer, retired: k.RetiredAt != nil})
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.loadedAt = time.Now()
+	ks.mu.Unlock()
+
+	return keys, nil
+}
+
+// Sign returns a token of the claims signed with the active key. The first key is generated if there is none.
+func (ks *KeySet) Sign(ctx context.Context, claims *Claims) (string, error) {
+	keys, err := ks.load(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	active := activeKey(keys)
+
+	if active == nil {
+		if _, err := ks.Rotate(ctx); err != nil {
+			return "", err
+		}
+
+		ks.mu.RLock()
+		active = activeKey(ks.keys)
+		ks.mu.RUnlock()
+
+		if active == nil {
+			return "", errors.New("no signing key is active")
+		}
+	}
+
+	h, err := encodeSegment(&header{Algorithm: active.alg, Type: "JWT", KeyID: active.id})
+
+	if err != nil {
+		return "", err
+	}
+
+	c, err := encodeSegment(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	input := h + "." + c
+	sig, err := algorithms[active.alg].sign(active.signer, []byte(input))
+
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// activeKey returns the key signing tokens, or nil if every key is retired
+func activeKey(keys []*signingKey) *signingKey {
+	for _, k := range keys {
+		if !k.retired {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// Verify returns the claims of the token if it is signed with one of the keys and has not expired.
+// It fails with ErrInvalidToken otherwise.
+func (ks *KeySet) Verify(ctx context.Context, token string) (*Claims, error) {
+	h, claims, sig, input, err := split(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := ks.find(ctx, h.KeyID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the algorithm is fixed by the key, so that tokens can not choose a weaker one such as "none"
+	if k == nil || h.Algorithm != k.alg || !algorithms[k.alg].verify(k.signer.Public(), []byte(input), sig) {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// find returns the key of the id, or nil if there is none even after reloading
+func (ks *KeySet) find(ctx context.Context, id string) (*signingKey, error) {
+	keys, err := ks.load(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if k.id == id {
+			return k, nil
+		}
+	}
+
+	ks.mu.RLock()
+	recent := time.Since(ks.loadedAt) < minKeyReloadInterval
+	ks.mu.RUnlock()
+
+	if recent {
+		return nil, nil
+	}
+
+	// the key may have been rotated by another instance
+	keys, err = ks.reload(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if k.id == id {
+			return k, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// JWKS returns the public keys of every key including retired ones
+func (ks *KeySet) JWKS(ctx context.Context) (*JWKSet, error) {
+	keys, err := ks.load(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	set := &JWKSet{Keys: make([]JWK, len(keys))}
+	for i, k := range keys {
+		set.Keys[i] = JWK{KeyID: k.id, Use: "sig", Algorithm: k.alg}
+		algorithms[k.alg].jwk(k.signer.Public(), &set.Keys[i])
+	}
+
+	return set, nil
+}
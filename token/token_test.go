@@ -0,0 +1,158 @@
+package token_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/token"
+)
+
+func newClaims(ttl time.Duration) *token.Claims {
+	now := time.Now()
+
+	return &token.Claims{
+		Subject:   "1",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        "jti",
+	}
+}
+
+func TestKeySetSignVerify(t *testing.T) {
+	for _, alg := range []string{token.RS256, token.EdDSA} {
+		if !token.Supported(alg) {
+			t.Log(alg, "is not supported by this version of Go")
+
+			continue
+		}
+
+		ks, err := token.NewKeySet(model.NewMemorySigningKeyController(), alg)
+
+		if err != nil {
+			t.Fatal("new key set error", err)
+		}
+
+		ctx := context.Background()
+
+		// the first key is generated on demand
+		signed, err := ks.Sign(ctx, newClaims(time.Minute))
+
+		if err != nil {
+			t.Fatal("sign error", alg, err)
+		}
+
+		claims, err := ks.Verify(ctx, signed)
+
+		if err != nil {
+			t.Fatal("verify error", alg, err)
+		}
+
+		if claims.Subject != "1" || claims.ID != "jti" {
+			t.Error("claims should be kept", alg, claims)
+		}
+
+		parts := strings.Split(signed, ".")
+		tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2","exp":9999999999}`)) + "." + parts[2]
+		none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "."
+
+		expired, err := ks.Sign(ctx, newClaims(-time.Second))
+
+		if err != nil {
+			t.Fatal("sign error", alg, err)
+		}
+
+		for _, invalid := range []string{tampered, none, expired, "", "a.b", signed + "x"} {
+			if _, err := ks.Verify(ctx, invalid); err != token.ErrInvalidToken {
+				t.Error("invalid tokens should be rejected", alg, invalid, err)
+			}
+		}
+	}
+}
+
+func TestKeySetRotate(t *testing.T) {
+	kc := model.NewMemorySigningKeyController()
+	ks, err := token.NewKeySet(kc, token.RS256)
+
+	if err != nil {
+		t.Fatal("new key set error", err)
+	}
+
+	ctx := context.Background()
+
+	first, err := ks.Rotate(ctx)
+
+	if err != nil {
+		t.Fatal("rotate error", err)
+	}
+
+	old, err := ks.Sign(ctx, newClaims(time.Minute))
+
+	if err != nil {
+		t.Fatal("sign error", err)
+	}
+
+	second, err := ks.Rotate(ctx)
+
+	if err != nil {
+		t.Fatal("rotate error", err)
+	}
+
+	signed, err := ks.Sign(ctx, newClaims(time.Minute))
+
+	if err != nil {
+		t.Fatal("sign error", err)
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(signed, ".")[0])
+
+	if err != nil || !strings.Contains(string(header), `"kid":"`+second.ID+`"`) {
+		t.Error("tokens should be signed with the new key", string(header))
+	}
+
+	if _, err := ks.Verify(ctx, old); err != nil {
+		t.Error("tokens of retired keys should be verified", err)
+	}
+
+	jwks, err := ks.JWKS(ctx)
+
+	if err != nil {
+		t.Fatal("jwks error", err)
+	}
+
+	if len(jwks.Keys) != 2 || jwks.Keys[0].KeyID != second.ID || jwks.Keys[1].KeyID != first.ID {
+		t.Fatal("every key should be published", jwks)
+	}
+
+	if k := jwks.Keys[0]; k.KeyType != "RSA" || k.Algorithm != token.RS256 || k.Use != "sig" || len(k.N) == 0 || k.E != "AQAB" {
+		t.Error("public key is incorrect", k)
+	}
+
+	if _, err := kc.PurgeSigningKeys(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal("purge error", err)
+	}
+
+	// another instance has not reloaded purged keys yet
+	other, err := token.NewKeySet(kc, token.RS256)
+
+	if err != nil {
+		t.Fatal("new key set error", err)
+	}
+
+	if _, err := other.Verify(ctx, old); err != token.ErrInvalidToken {
+		t.Error("tokens of purged keys should be rejected", err)
+	}
+
+	if _, err := other.Verify(ctx, signed); err != nil {
+		t.Error("keys rotated by another instance should be loaded", err)
+	}
+}
+
+func TestNewKeySetUnsupported(t *testing.T) {
+	if _, err := token.NewKeySet(model.NewMemorySigningKeyController(), "HS256"); err == nil {
+		t.Error("unsupported algorithms should be rejected")
+	}
+}
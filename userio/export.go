@@ -0,0 +1,133 @@
+package userio
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// FlushInterval is the number of users written between flushes
+const FlushInterval = 500
+
+// csvColumns are the columns of exported CSV
+var csvColumns = []string{"id", "name", "email", "created_at", "updated_at", "deleted_at"}
+
+// encoder writes users in a format
+type encoder interface {
+	encode(u *model.User) error
+
+	// flush writes buffered users to the underlying writer
+	flush() error
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) (*csvEncoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w)}
+
+	// the header is buffered until the first flush
+	if err := e.w.Write(csvColumns); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *csvEncoder) encode(u *model.User) error {
+	var deletedAt string
+	if u.DeletedAt != nil {
+		deletedAt = u.DeletedAt.Format(time.RFC3339Nano)
+	}
+
+	return e.w.Write([]string{
+		strconv.Itoa(u.ID),
+		u.Name,
+		u.Email,
+		u.CreatedAt.Format(time.RFC3339Nano),
+		u.UpdatedAt.Format(time.RFC3339Nano),
+		deletedAt,
+	})
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+
+	return e.w.Error()
+}
+
+type ndjsonEncoder struct {
+	w *json.Encoder
+}
+
+func (e *ndjsonEncoder) encode(u *model.User) error {
+	// Encode terminates each value with a newline
+	return e.w.Encode(u)
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+// Export writes users listed by opts to w in f.
+// Users are streamed with EachUser, so they are never buffered at once.
+// opts.Limit limits the number of users only if it is positive, and opts.Cursor resumes an export from the position.
+// If w is an http.Flusher, it is flushed every FlushInterval users.
+//
+// Nothing is written to w until the query succeeds,
+// so errors such as model.ErrInvalidCursor can still be responded as they are.
+func Export(ctx context.Context, uc model.UserController, w io.Writer, f Format, opts model.ListOptions) error {
+	var enc encoder
+	switch f {
+	case CSV:
+		e, err := newCSVEncoder(w)
+
+		if err != nil {
+			return err
+		}
+		enc = e
+	case NDJSON:
+		enc = &ndjsonEncoder{w: json.NewEncoder(w)}
+	default:
+		return fmt.Errorf("unknown format: %q", string(f))
+	}
+
+	flush := func() error {
+		if err := enc.flush(); err != nil {
+			return err
+		}
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		return nil
+	}
+
+	n := 0
+	err := uc.EachUser(ctx, opts, func(u *model.User) error {
+		if err := enc.encode(u); err != nil {
+			return err
+		}
+
+		if n++; n%FlushInterval == 0 {
+			return flush()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
@@ -0,0 +1,55 @@
+// Package userio exports and imports users in CSV and NDJSON
+package userio
+
+import (
+	"fmt"
+	"mime"
+)
+
+// Format is a file format of users
+type Format string
+
+const (
+	// CSV has a header row followed by a row per user
+	CSV Format = "csv"
+
+	// NDJSON has a JSON object per line
+	NDJSON Format = "ndjson"
+)
+
+// ParseFormat parses "csv" or "ndjson"
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case CSV, NDJSON:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown format: %q", s)
+}
+
+// FormatOf returns the format of a media type such as "text/csv; charset=utf-8"
+func FormatOf(contentType string) (Format, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return "", false
+	}
+
+	switch mediaType {
+	case "text/csv":
+		return CSV, true
+	case "application/x-ndjson", "application/ndjson":
+		return NDJSON, true
+	}
+
+	return "", false
+}
+
+// ContentType returns the media type of f
+func (f Format) ContentType() string {
+	if f == CSV {
+		return "text/csv; charset=utf-8"
+	}
+
+	return "application/x-ndjson"
+}
@@ -0,0 +1,458 @@
+package userio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+)
+
+// importFields are the fields of users read from rows
+var importFields = []string{"name", "email"}
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run is rolled back")
+
+// Mapping maps names of CSV columns or NDJSON members to fields of users, "name" or "email".
+// Fields without a mapping are read from the column or member of the same name.
+type Mapping map[string]string
+
+// ParseMapping parses comma-separated "column:field" pairs such as "Full Name:name,Mail:email".
+// Columns may contain ':' since the field follows the last one.
+func ParseMapping(s string) (Mapping, error) {
+	m := Mapping{}
+
+	if len(s) == 0 {
+		return m, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndexByte(pair, ':')
+
+		if i <= 0 {
+			return nil, fmt.Errorf("mapping must be column:field: %q", pair)
+		}
+
+		m[pair[:i]] = pair[i+1:]
+	}
+
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m Mapping) validate() error {
+	mapped := map[string]bool{}
+
+	for _, field := range m {
+		if field != "name" && field != "email" {
+			return fmt.Errorf("unknown field in mapping: %q", field)
+		}
+
+		if mapped[field] {
+			return fmt.Errorf("field is mapped more than once: %q", field)
+		}
+		mapped[field] = true
+	}
+
+	return nil
+}
+
+// names returns the column or member name of each field
+func (m Mapping) names() map[string]string {
+	names := map[string]string{}
+
+	for column, field := range m {
+		names[field] = column
+	}
+
+	for _, field := range importFields {
+		if _, ok := names[field]; !ok {
+			names[field] = field
+		}
+	}
+
+	return names
+}
+
+// ImportOptions specifies how Import reads rows
+type ImportOptions struct {
+	Mapping Mapping
+
+	// DryRun reports the result without creating users
+	DryRun bool
+}
+
+// RowFailure is a row which was not imported
+type RowFailure struct {
+	// Row is the line number in NDJSON,
+	// or the number of the record counting the header as 1 in CSV
+	Row int
+
+	// Err is *model.ValidationError or *model.ConflictError
+	Err error
+}
+
+// Report is the result of Import
+type Report struct {
+	// Rows is the number of rows read
+	Rows int
+
+	// Imported is the number of users created, or which would be created in a dry run
+	Imported int
+
+	// Failures are in the order of rows
+	Failures []RowFailure
+}
+
+// decoder reads users from rows
+type decoder interface {
+	// next returns the next user and its row number, or io.EOF after the last row.
+	// *model.ValidationError means only the row is invalid.
+	next() (int, *model.User, error)
+}
+
+type csvDecoder struct {
+	r   *csv.Reader
+	row int
+
+	// columns are indexes of the columns of fields
+	columns map[string]int
+}
+
+func newCSVDecoder(r io.Reader, m Mapping) (*csvDecoder, error) {
+	cr := csv.NewReader(r)
+
+	// missing columns are reported per row
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+
+	if err == io.EOF {
+		return nil, &model.ValidationError{Message: "header row is missing"}
+	}
+
+	if perr, ok := err.(*csv.ParseError); ok {
+		return nil, &model.ValidationError{Message: "malformed header row: " + perr.Err.Error()}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// spreadsheets may prepend a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	d := &csvDecoder{r: cr, row: 1, columns: map[string]int{}}
+
+	names := m.names()
+
+	var fields []model.FieldError
+	for _, field := range importFields {
+		name := names[field]
+
+		for i, column := range header {
+			if column == name {
+				d.columns[field] = i
+
+				break
+			}
+		}
+
+		if _, ok := d.columns[field]; !ok {
+			fields = append(fields, model.FieldError{Field: field, Reason: "column " + strconv.Quote(name) + " is missing"})
+		}
+	}
+
+	if len(fields) != 0 {
+		return nil, &model.ValidationError{Message: "header row is invalid", Fields: fields}
+	}
+
+	return d, nil
+}
+
+func (d *csvDecoder) next() (int, *model.User, error) {
+	record, err := d.r.Read()
+
+	if err == io.EOF {
+		return 0, nil, err
+	}
+	d.row++
+
+	if perr, ok := err.(*csv.ParseError); ok {
+		return d.row, nil, &model.ValidationError{Message: "malformed row: " + perr.Err.Error()}
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var u model.User
+	if i := d.columns["name"]; i < len(record) {
+		u.Name = record[i]
+	}
+	if i := d.columns["email"]; i < len(record) {
+		u.Email = record[i]
+	}
+
+	return d.row, &u, nil
+}
+
+type ndjsonDecoder struct {
+	r     *bufio.Reader
+	row   int
+	names map[string]string
+}
+
+func (d *ndjsonDecoder) next() (int, *model.User, error) {
+	for {
+		line, err := d.r.ReadBytes('\n')
+
+		if err == io.EOF && len(line) != 0 {
+			// the last line may not be terminated
+			err = nil
+		}
+
+		if err != nil {
+			return 0, nil, err
+		}
+		d.row++
+
+		line = bytes.TrimSpace(line)
+
+		if len(line) == 0 {
+			continue
+		}
+
+		var obj map[string]interface{}
+		if err := json.Unmarshal(line, &obj); err != nil || obj == nil {
+			return d.row, nil, &model.ValidationError{Message: "malformed row: row must be a JSON object"}
+		}
+
+		var (
+			u      model.User
+			fields []model.FieldError
+		)
+		for _, field := range importFields {
+			v, ok := obj[d.names[field]]
+
+			if !ok {
+				continue
+			}
+
+			s, ok := v.(string)
+
+			if !ok {
+				fields = append(fields, model.FieldError{Field: field, Reason: "must be a string"})
+
+				continue
+			}
+
+			if field == "name" {
+				u.Name = s
+			} else {
+				u.Email = s
+			}
+		}
+
+		if len(fields) != 0 {
+			return d.row, nil, &model.ValidationError{Message: "user is invalid", Fields: fields}
+		}
+
+		return d.row, &u, nil
+	}
+}
+
+// decodedRow is a row read by a decoder
+type decodedRow struct {
+	row  int
+	user *model.User
+	err  error
+}
+
+// replayDecoder returns rows read in advance
+type replayDecoder struct {
+	rows []decodedRow
+}
+
+func (d *replayDecoder) next() (int, *model.User, error) {
+	if len(d.rows) == 0 {
+		return 0, nil, io.EOF
+	}
+
+	r := d.rows[0]
+	d.rows = d.rows[1:]
+
+	// the transaction may be retried, so it gets a copy of the user
+	var u *model.User
+	if r.user != nil {
+		copied := *r.user
+		u = &copied
+	}
+
+	return r.row, u, r.err
+}
+
+// readAll reads every row of dec, so that a transaction is not held open while the input arrives
+func readAll(dec decoder) ([]decodedRow, error) {
+	var rows []decodedRow
+	for {
+		row, u, err := dec.next()
+
+		if err == io.EOF {
+			return rows, nil
+		}
+
+		if _, ok := err.(*model.ValidationError); err != nil && !ok {
+			return nil, err
+		}
+
+		rows = append(rows, decodedRow{row: row, user: u, err: err})
+	}
+}
+
+func newDecoder(r io.Reader, f Format, m Mapping) (decoder, error) {
+	switch f {
+	case CSV:
+		return newCSVDecoder(r, m)
+	case NDJSON:
+		return &ndjsonDecoder{r: bufio.NewReader(r), names: m.names()}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format: %q", string(f))
+}
+
+// Import creates users from rows of r in f.
+// Rows are created in batches of model.MaxBatchSize, and invalid or conflicting rows are reported instead of aborting the import.
+// Errors are returned only if the import can not continue, such as on a malformed CSV header or a failure of the store.
+//
+// A dry run creates users in a transaction which is rolled back,
+// so conflicts with existing users and between rows are reported as well.
+// It reads every row before the transaction begins, so that a slow client does not hold the transaction open.
+func Import(ctx context.Context, uc model.UserController, r io.Reader, f Format, opts ImportOptions) (*Report, error) {
+	if err := opts.Mapping.validate(); err != nil {
+		return nil, err
+	}
+
+	dec, err := newDecoder(r, f, opts.Mapping)
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+
+	if !opts.DryRun {
+		if err := importRows(ctx, uc, dec, report); err != nil {
+			return nil, err
+		}
+
+		return report, nil
+	}
+
+	rows, err := readAll(dec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = uc.WithTx(ctx, func(uc model.UserController) error {
+		// the transaction may be retried on concurrent updates
+		*report = Report{}
+
+		if err := importRows(ctx, uc, &replayDecoder{rows: rows}, report); err != nil {
+			return err
+		}
+
+		return errDryRun
+	})
+
+	if err != errDryRun {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func importRows(ctx context.Context, uc model.UserController, dec decoder, report *Report) error {
+	var (
+		rows  []int
+		users []*model.User
+	)
+	flush := func() error {
+		if len(users) == 0 {
+			return nil
+		}
+
+		results, err := uc.NewUsers(ctx, users)
+
+		if err != nil {
+			return err
+		}
+
+		for i, r := range results {
+			if r.Err != nil {
+				report.Failures = append(report.Failures, RowFailure{Row: rows[i], Err: r.Err})
+
+				continue
+			}
+
+			report.Imported++
+		}
+
+		rows, users = nil, nil
+
+		return nil
+	}
+
+	for {
+		row, u, err := dec.next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if verr, ok := err.(*model.ValidationError); ok {
+			report.Rows++
+			report.Failures = append(report.Failures, RowFailure{Row: row, Err: verr})
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+		report.Rows++
+
+		rows = append(rows, row)
+		users = append(users, u)
+
+		if len(users) == model.MaxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// rows failed while decoding precede the batches they were read in
+	sort.SliceStable(report.Failures, func(i, j int) bool {
+		return report.Failures[i].Row < report.Failures[j].Row
+	})
+
+	return nil
+}
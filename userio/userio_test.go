@@ -0,0 +1,202 @@
+package userio_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cs3238-tsuzu/coding_challenge_03/model"
+	"github.com/cs3238-tsuzu/coding_challenge_03/userio"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+
+	for _, format := range []userio.Format{userio.CSV, userio.NDJSON} {
+		src := model.NewMemoryUserController()
+
+		// more than a flush interval
+		for i := 0; i < userio.FlushInterval+10; i++ {
+			if _, err := src.NewUser(ctx, "user"+strconv.Itoa(i), "user"+strconv.Itoa(i)+"@example.com"); err != nil {
+				t.Fatal("new user error", err)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := userio.Export(ctx, src, &buf, format, model.ListOptions{}); err != nil {
+			t.Fatal("export error", format, err)
+		}
+
+		dst := model.NewMemoryUserController()
+		report, err := userio.Import(ctx, dst, &buf, format, userio.ImportOptions{})
+
+		if err != nil {
+			t.Fatal("import error", format, err)
+		}
+
+		if report.Rows != userio.FlushInterval+10 || report.Imported != report.Rows || len(report.Failures) != 0 {
+			t.Fatal("exported users should be imported", format, report)
+		}
+
+		page, err := dst.ListUsers(ctx, model.ListOptions{PageRequest: model.PageRequest{Limit: 1}})
+
+		if err != nil {
+			t.Fatal("list users error", err)
+		}
+
+		if len(page.Users) != 1 || page.Users[0].Name != "user0" || page.Users[0].Email != "user0@example.com" {
+			t.Fatal("users should be imported in order", format, page.Users)
+		}
+	}
+}
+
+func TestImportFailures(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		format userio.Format
+
+		// invalidRow is the row with an invalid name
+		invalidRow int
+		input      string
+	}{
+		{userio.CSV, 3, "Mail,Full Name\r\nhoge@example.com,hoge\r\nfoo@example.com\r\nHOGE@example.com,hoge2\r\nfuga@example.com,fuga\r\n"},
+		{userio.NDJSON, 2, `{"Mail":"hoge@example.com","Full Name":"hoge"}
+{"Mail":"foo@example.com","Full Name":1}
+{"Mail":"HOGE@example.com","Full Name":"hoge2"}
+
+{"Mail":"fuga@example.com","Full Name":"fuga"}`},
+	}
+
+	for _, tc := range tests {
+		for _, dryRun := range []bool{true, false} {
+			uc := model.NewMemoryUserController()
+			existing, err := uc.NewUser(ctx, "fuga", "fuga@example.com")
+
+			if err != nil {
+				t.Fatal("new user error", err)
+			}
+
+			mapping, err := userio.ParseMapping("Full Name:name,Mail:email")
+
+			if err != nil {
+				t.Fatal("parse mapping error", err)
+			}
+
+			report, err := userio.Import(ctx, uc, strings.NewReader(tc.input), tc.format, userio.ImportOptions{Mapping: mapping, DryRun: dryRun})
+
+			if err != nil {
+				t.Fatal("import error", tc.format, err)
+			}
+
+			if report.Rows != 4 || report.Imported != 1 || len(report.Failures) != 3 {
+				t.Fatal("only the first row should be imported", tc.format, report)
+			}
+
+			if _, ok := report.Failures[0].Err.(*model.ValidationError); !ok || report.Failures[0].Row != tc.invalidRow {
+				t.Fatal("the invalid row should be reported", tc.format, report.Failures[0])
+			}
+
+			if cerr, ok := report.Failures[1].Err.(*model.ConflictError); !ok || cerr.ExistingID == existing.ID {
+				t.Fatal("rows duplicated in the input should be reported", tc.format, report.Failures[1])
+			}
+
+			if cerr, ok := report.Failures[2].Err.(*model.ConflictError); !ok || cerr.ExistingID != existing.ID {
+				t.Fatal("rows conflicting with users should be reported", tc.format, report.Failures[2])
+			}
+
+			page, err := uc.ListUsers(ctx, model.ListOptions{})
+
+			if err != nil {
+				t.Fatal("list users error", err)
+			}
+
+			expected := 2
+			if dryRun {
+				expected = 1
+			}
+
+			if len(page.Users) != expected {
+				t.Fatal("users should be created unless dry run", tc.format, dryRun, len(page.Users))
+			}
+		}
+	}
+}
+
+// eofReader records whether its reader reached io.EOF
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	if err == io.EOF {
+		r.eof = true
+	}
+
+	return n, err
+}
+
+// retryingController runs transactions of a dry run twice as if the first one were serialized after concurrent updates
+type retryingController struct {
+	model.UserController
+	input *eofReader
+}
+
+func (uc *retryingController) WithTx(ctx context.Context, fn func(uc model.UserController) error) error {
+	if !uc.input.eof {
+		return errors.New("the transaction should begin after the input is read")
+	}
+
+	if err := uc.UserController.WithTx(ctx, fn); err == nil {
+		return errors.New("dry runs should be rolled back")
+	}
+
+	return uc.UserController.WithTx(ctx, fn)
+}
+
+func TestImportDryRunReadsInputFirst(t *testing.T) {
+	input := &eofReader{r: strings.NewReader("name,email\nhoge,hoge@example.com\nfoo,\nfuga,fuga@example.com\n")}
+	uc := &retryingController{UserController: model.NewMemoryUserController(), input: input}
+
+	report, err := userio.Import(context.Background(), uc, input, userio.CSV, userio.ImportOptions{DryRun: true})
+
+	if err != nil {
+		t.Fatal("import error", err)
+	}
+
+	if report.Rows != 3 || report.Imported != 2 || len(report.Failures) != 1 || report.Failures[0].Row != 3 {
+		t.Fatal("retried dry runs should report the rows once", report)
+	}
+}
+
+func TestImportInvalidHeader(t *testing.T) {
+	uc := model.NewMemoryUserController()
+	_, err := userio.Import(context.Background(), uc, strings.NewReader("name,mail\nhoge,hoge@example.com\n"), userio.CSV, userio.ImportOptions{})
+
+	verr, ok := err.(*model.ValidationError)
+
+	if !ok || len(verr.Fields) != 1 || verr.Fields[0].Field != "email" {
+		t.Fatal("missing columns should be rejected", err)
+	}
+}
+
+func TestParseMapping(t *testing.T) {
+	m, err := userio.ParseMapping("a:b:name,Mail:email")
+
+	if err != nil || m["a:b"] != "name" || m["Mail"] != "email" {
+		t.Fatal("mapping should be parsed", m, err)
+	}
+
+	for _, s := range []string{"name", ":name", "a:id", "a:name,b:name"} {
+		if _, err := userio.ParseMapping(s); err == nil {
+			t.Fatal("invalid mapping should be rejected", s)
+		}
+	}
+}